@@ -2,17 +2,24 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/spf13/viper"
 
 	"github.com/charlieegan3/toolbelt/pkg/database"
 	"github.com/charlieegan3/toolbelt/pkg/tool"
 
+	"github.com/charlieegan3/music/internal/pkg/spotify"
 	musicTool "github.com/charlieegan3/music/pkg/tool"
+	"github.com/charlieegan3/music/pkg/tool/store"
 )
 
 func main() {
@@ -43,16 +50,20 @@ func main() {
 		}
 	}()
 
-	// load the database configuration
-	params := viper.GetStringMapString("database.params")
+	// load the database configuration, this is not needed when the music
+	// tool is configured to use sqlite
+	var db *sql.DB
 	connectionString := viper.GetString("database.connectionString")
-	db, err := database.Init(connectionString, params, params["dbname"], false)
-	if err != nil {
-		log.Fatalf("failed to init DB: %s", err)
+	if connectionString != "" {
+		params := viper.GetStringMapString("database.params")
+		db, err = database.Init(connectionString, params, params["dbname"], false)
+		if err != nil {
+			log.Fatalf("failed to init DB: %s", err)
+		}
+		// we have 5 connections, it's important to be able to manually connect to the db too
+		db.SetMaxOpenConns(4)
+		defer db.Close()
 	}
-	// we have 5 connections, it's important to be able to manually connect to the db too
-	db.SetMaxOpenConns(4)
-	defer db.Close()
 
 	// init the toolbelt, connecting the database, config and external runner
 	tb := tool.NewBelt()
@@ -66,36 +77,142 @@ func main() {
 	}
 
 	if len(os.Args) > 1 {
-		jobs, err := mt.Jobs()
-		if err != nil {
-			log.Fatalf("failed to get jobs: %v", err)
-		}
 		switch os.Args[1] {
 		case "lastfm":
-			err := jobs[0].Run(ctx)
+			err := mt.LastFMSync().Run(ctx)
 			if err != nil {
 				log.Fatalf("failed to run job: %v", err)
 			}
 		case "covers_sync":
-			err := jobs[2].Run(ctx)
+			err := mt.CoversSync().Run(ctx)
 			if err != nil {
 				log.Fatalf("failed to run job: %v", err)
 			}
 		case "covers_store":
-			err := jobs[3].Run(ctx)
+			err := mt.CoversStore().Run(ctx)
 			if err != nil {
 				log.Fatalf("failed to run job: %v", err)
 			}
 		case "build_index":
-			err := jobs[4].Run(ctx)
+			// --full indexes the names of all plays rather than new plays
+			job := mt.BuildIndex()
+			if len(os.Args) > 2 && os.Args[2] == "--full" {
+				job.Full = true
+			}
+			err := job.Run(ctx)
 			if err != nil {
 				log.Fatalf("failed to run job: %v", err)
 			}
 		case "backup":
-			err := jobs[5].Run(ctx)
+			err := mt.Backup().Run(ctx)
+			if err != nil {
+				log.Fatalf("failed to run job: %v", err)
+			}
+		case "lastfm_backfill":
+			job := mt.LastFMBackfill()
+			// --restart discards the saved checkpoint and loads the history again
+			if len(os.Args) > 2 && os.Args[2] == "--restart" {
+				job.Restart = true
+			}
+			err := job.Run(ctx)
+			if err != nil {
+				log.Fatalf("failed to run job: %v", err)
+			}
+		case "dedupe":
+			// --full checks all plays rather than the recent lookback period
+			job := mt.Dedupe()
+			if len(os.Args) > 2 && os.Args[2] == "--full" {
+				job.Full = true
+			}
+			err := job.Run(ctx)
 			if err != nil {
 				log.Fatalf("failed to run job: %v", err)
 			}
+		case "forward":
+			// --dead-letters sends rejected plays again rather than new plays
+			job := mt.Forward()
+			if len(os.Args) > 2 && os.Args[2] == "--dead-letters" {
+				job.DeadLetters = true
+			}
+			err := job.Run(ctx)
+			if err != nil {
+				log.Fatalf("failed to run job: %v", err)
+			}
+		case "artist_credits":
+			err := mt.ArtistCredits().Run(ctx)
+			if err != nil {
+				log.Fatalf("failed to run job: %v", err)
+			}
+		case "normalize_titles":
+			err := mt.NormalizeTitles().Run(ctx)
+			if err != nil {
+				log.Fatalf("failed to run job: %v", err)
+			}
+		case "artist_aliases":
+			err := listArtistAliases(ctx, mt.Aliases())
+			if err != nil {
+				log.Fatalf("failed to list artist aliases: %v", err)
+			}
+		case "merge_artists":
+			err := mergeArtists(ctx, mt.Aliases(), os.Args[2:])
+			if err != nil {
+				log.Fatalf("failed to merge artists: %v", err)
+			}
+		case "unmerge_artists":
+			err := unmergeArtists(ctx, mt.Aliases(), os.Args[2:])
+			if err != nil {
+				log.Fatalf("failed to unmerge artists: %v", err)
+			}
+		case "exclusions":
+			err := listExclusions(ctx, mt.Exclusions())
+			if err != nil {
+				log.Fatalf("failed to list exclusions: %v", err)
+			}
+		case "add_exclusion":
+			err := addExclusion(ctx, mt.Exclusions(), os.Args[2:])
+			if err != nil {
+				log.Fatalf("failed to add exclusion: %v", err)
+			}
+		case "remove_exclusion":
+			err := removeExclusion(ctx, mt.Exclusions(), os.Args[2:])
+			if err != nil {
+				log.Fatalf("failed to remove exclusion: %v", err)
+			}
+		case "edit_play":
+			err := editPlay(ctx, mt.Editor(), os.Args[2:])
+			if err != nil {
+				log.Fatalf("failed to edit play: %v", err)
+			}
+		case "delete_play":
+			err := deletePlay(ctx, mt.Editor(), os.Args[2:])
+			if err != nil {
+				log.Fatalf("failed to delete play: %v", err)
+			}
+		case "private_play":
+			err := privatePlay(ctx, mt.Editor(), os.Args[2:])
+			if err != nil {
+				log.Fatalf("failed to update play: %v", err)
+			}
+		case "rewrite_plays":
+			err := rewritePlays(ctx, mt.Editor(), os.Args[2:])
+			if err != nil {
+				log.Fatalf("failed to rewrite plays: %v", err)
+			}
+		case "audit_log":
+			err := listAuditLog(ctx, mt.Editor().Audit, os.Args[2:])
+			if err != nil {
+				log.Fatalf("failed to list audit log: %v", err)
+			}
+		case "restore":
+			err := restore(ctx, &mt, os.Args[2:])
+			if err != nil {
+				log.Fatalf("failed to restore: %v", err)
+			}
+		case "spotify_import":
+			err := importSpotifyHistory(ctx, mt.PlayStore(), os.Args[2:])
+			if err != nil {
+				log.Fatalf("failed to import spotify history: %v", err)
+			}
 		}
 
 		os.Exit(0)
@@ -106,3 +223,392 @@ func main() {
 
 	tb.RunServer(ctx, "0.0.0.0", "3000")
 }
+
+// restore loads a backup into the play store, e.g.
+// restore --dry-run gs://bucket/plays-backup-latest.json
+func restore(ctx context.Context, mt *musicTool.Music, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "check the backup and report what would be restored")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected a single backup path or gs:// uri")
+	}
+
+	result, err := mt.Restore(ctx, flags.Arg(0), *dryRun)
+	if err != nil {
+		return err
+	}
+
+	verb := "restored"
+	if *dryRun {
+		verb = "would restore"
+	}
+	log.Printf(
+		"read %d rows, %s %d plays, skipped %d duplicate rows and %d plays already saved",
+		result.Rows, verb, result.Inserted, result.Duplicates, result.Existing,
+	)
+	if result.Inserted > 0 {
+		log.Printf("new plays are from %s to %s", result.First.Format(time.RFC3339), result.Last.Format(time.RFC3339))
+		for source, count := range result.Sources {
+			log.Printf("  %q: %d", source, count)
+		}
+	}
+
+	return nil
+}
+
+// importSpotifyHistory loads plays from Spotify data export files, args are
+// json files or export directories, e.g.
+// spotify_import -min-played 30s my_spotify_data/
+func importSpotifyHistory(ctx context.Context, playStore store.PlayStore, args []string) error {
+	flags := flag.NewFlagSet("spotify_import", flag.ExitOnError)
+	minPlayed := flags.Duration("min-played", spotify.DefaultMinPlayed, "skip plays shorter than this")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+	for _, arg := range flags.Args() {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+
+		files, err := spotify.HistoryFiles(arg)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, files...)
+	}
+
+	if len(paths) == 0 {
+		return fmt.Errorf("no history files given")
+	}
+
+	result, err := spotify.ImportHistory(ctx, playStore, paths, *minPlayed)
+	if err != nil {
+		return err
+	}
+
+	log.Printf(
+		"read %d entries from %d files, inserted %d, skipped %d short or non track, %d duplicates",
+		result.Read, len(paths), result.Inserted, result.Skipped, result.Duplicates,
+	)
+
+	return nil
+}
+
+// listArtistAliases prints each alias and the artist it's merged into
+func listArtistAliases(ctx context.Context, aliases *store.Aliases) error {
+	list, err := aliases.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range list {
+		fmt.Printf("%q -> %q\n", a.Alias, a.Artist)
+	}
+
+	return nil
+}
+
+// mergeArtists counts the plays of other names as the first artist, e.g.
+// merge_artists "Beyoncé" "Beyonce" "BEYONCE"
+func mergeArtists(ctx context.Context, aliases *store.Aliases, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("expected an artist and at least one name to merge into it")
+	}
+
+	merged, err := aliases.Merge(ctx, args[0], args[1:])
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%q now has %d aliases", args[0], len(merged))
+	for _, a := range merged {
+		log.Printf("  %q", a.Alias)
+	}
+
+	return nil
+}
+
+// unmergeArtists counts the plays of each name as a separate artist again,
+// e.g. unmerge_artists "Beyonce"
+func unmergeArtists(ctx context.Context, aliases *store.Aliases, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected at least one name to unmerge")
+	}
+
+	removed, err := aliases.Remove(ctx, args)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("removed %d aliases", removed)
+
+	return nil
+}
+
+// listExclusions prints the play exclusion rules
+func listExclusions(ctx context.Context, exclusions *store.Exclusions) error {
+	list, err := exclusions.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range list {
+		fmt.Printf(
+			"%d artist=%q album=%q track=%q source=%q shorter_than=%s longer_than=%s hide_recent=%t\n",
+			e.ID, e.Artist, e.Album, e.Track, e.Source,
+			time.Duration(e.ShorterThan)*time.Millisecond,
+			time.Duration(e.LongerThan)*time.Millisecond,
+			e.HideRecent,
+		)
+	}
+
+	return nil
+}
+
+// addExclusion saves a rule for plays which are left out of counts, e.g.
+// add_exclusion -artist "%white noise%" -hide-recent
+func addExclusion(ctx context.Context, exclusions *store.Exclusions, args []string) error {
+	flags := flag.NewFlagSet("add_exclusion", flag.ExitOnError)
+	var e store.Exclusion
+	flags.StringVar(&e.Artist, "artist", "", "artist pattern, % matches any text")
+	flags.StringVar(&e.Album, "album", "", "album pattern")
+	flags.StringVar(&e.Track, "track", "", "track pattern")
+	flags.StringVar(&e.Source, "source", "", "source of the plays")
+	shorterThan := flags.Duration("shorter-than", 0, "match plays shorter than this")
+	longerThan := flags.Duration("longer-than", 0, "match plays longer than this")
+	flags.BoolVar(&e.HideRecent, "hide-recent", false, "also hide matching plays from recent plays")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	e.ShorterThan = shorterThan.Milliseconds()
+	e.LongerThan = longerThan.Milliseconds()
+
+	e, err = exclusions.Add(ctx, e)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("added exclusion %d", e.ID)
+
+	return nil
+}
+
+// removeExclusion deletes a rule by its id, e.g. remove_exclusion 3
+func removeExclusion(ctx context.Context, exclusions *store.Exclusions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected an exclusion id")
+	}
+
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid exclusion id: %v", err)
+	}
+
+	removed, err := exclusions.Remove(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return fmt.Errorf("no exclusion with id %d", id)
+	}
+
+	log.Printf("removed exclusion %d", id)
+
+	return nil
+}
+
+// editUser is the name saved in the audit log for changes made with commands
+func editUser(flags *flag.FlagSet) *string {
+	return flags.String("user", os.Getenv("USER"), "name recorded in the audit log")
+}
+
+// playKey parses the source and RFC3339 timestamp of a play from args
+func playKey(args []string) (store.PlayKey, error) {
+	if len(args) != 2 {
+		return store.PlayKey{}, fmt.Errorf("expected a play source and timestamp")
+	}
+
+	timestamp, err := time.Parse(time.RFC3339, args[1])
+	if err != nil {
+		return store.PlayKey{}, fmt.Errorf("invalid timestamp: %v", err)
+	}
+
+	return store.PlayKey{Source: args[0], Timestamp: timestamp}, nil
+}
+
+// editPlay changes the names of a single play, e.g.
+// edit_play -track "Halo" lastfm 2023-01-02T15:04:05Z
+func editPlay(ctx context.Context, editor *store.PlayEditor, args []string) error {
+	flags := flag.NewFlagSet("edit_play", flag.ExitOnError)
+	user := editUser(flags)
+	var names store.PlayNames
+	flags.StringVar(&names.Artist, "artist", "", "new artist")
+	flags.StringVar(&names.Album, "album", "", "new album")
+	flags.StringVar(&names.Track, "track", "", "new track")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	key, err := playKey(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	entry, err := editor.Edit(ctx, *user, key, names)
+	if err != nil {
+		return err
+	}
+
+	logAuditChanges(entry)
+
+	return nil
+}
+
+// privatePlay hides a single play from visitors who aren't signed in, or
+// shows it again with -public, e.g.
+// private_play lastfm 2023-01-02T15:04:05Z
+func privatePlay(ctx context.Context, editor *store.PlayEditor, args []string) error {
+	flags := flag.NewFlagSet("private_play", flag.ExitOnError)
+	user := editUser(flags)
+	public := flags.Bool("public", false, "show the play to everyone again")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	key, err := playKey(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	entry, err := editor.SetPrivate(ctx, *user, key, !*public)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range entry.Changes {
+		log.Printf("  %q / %q / %q is %s", c.Before.Artist, c.Before.Album, c.Before.Track, entry.Action)
+	}
+
+	return nil
+}
+
+// deletePlay removes a single play, e.g.
+// delete_play lastfm 2023-01-02T15:04:05Z
+func deletePlay(ctx context.Context, editor *store.PlayEditor, args []string) error {
+	flags := flag.NewFlagSet("delete_play", flag.ExitOnError)
+	user := editUser(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	key, err := playKey(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	entry, err := editor.Delete(ctx, *user, key)
+	if err != nil {
+		return err
+	}
+
+	logAuditChanges(entry)
+
+	return nil
+}
+
+// rewritePlays replaces a pattern in the field of all matching plays, e.g.
+// rewrite_plays -field artist -dry-run '^Beyonce$' 'Beyoncé'
+func rewritePlays(ctx context.Context, editor *store.PlayEditor, args []string) error {
+	flags := flag.NewFlagSet("rewrite_plays", flag.ExitOnError)
+	user := editUser(flags)
+	field := flags.String("field", store.FieldTrack, "artist, album or track")
+	artist := flags.String("artist", "", "only rewrite plays with this artist string")
+	dryRun := flags.Bool("dry-run", false, "list the changes without making them")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 2 {
+		return fmt.Errorf("expected a pattern and replacement")
+	}
+
+	rewrite, err := store.NewRewrite(*field, flags.Arg(0), flags.Arg(1), *artist)
+	if err != nil {
+		return err
+	}
+
+	entry, err := editor.Rewrite(ctx, *user, rewrite, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	verb := "rewrote"
+	if *dryRun {
+		verb = "would rewrite"
+	}
+	log.Printf("%s %d tracks", verb, len(entry.Changes))
+	logAuditChanges(entry)
+
+	return nil
+}
+
+// listAuditLog prints the most recent changes made to plays
+func listAuditLog(ctx context.Context, audit *store.AuditLog, args []string) error {
+	flags := flag.NewFlagSet("audit_log", flag.ExitOnError)
+	limit := flags.Int("limit", 20, "number of entries to list")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	entries, err := audit.List(ctx, *limit)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		fmt.Printf("%d %s %s %s %s\n", entry.ID, entry.CreatedAt.Format(time.RFC3339), entry.User, entry.Action, entry.Details)
+		for _, c := range entry.Changes {
+			fmt.Printf("  %s\n", auditChange(c))
+		}
+	}
+
+	return nil
+}
+
+func logAuditChanges(entry store.AuditEntry) {
+	for _, c := range entry.Changes {
+		log.Printf("  %s", auditChange(c))
+	}
+}
+
+func auditChange(c store.AuditChange) string {
+	after := "deleted"
+	if c.After != nil {
+		after = fmt.Sprintf("%q / %q / %q", c.After.Artist, c.After.Album, c.After.Track)
+	}
+
+	return fmt.Sprintf(
+		"%q / %q / %q -> %s (%d plays)",
+		c.Before.Artist, c.Before.Album, c.Before.Track, after, c.Plays,
+	)
+}
@@ -0,0 +1,314 @@
+package spotify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+// DefaultMinPlayed is the play time under which streams are not counted,
+// it matches the threshold Spotify uses for counting a stream
+const DefaultMinPlayed = 30 * time.Second
+
+// historyFilePatterns match the files in a Spotify data export which contain
+// listening history. Extended history is named endsong_N.json in older
+// exports and Streaming_History_Audio_*.json in newer ones, the account data
+// export contains StreamingHistoryN.json.
+var historyFilePatterns = []string{
+	"endsong_*.json",
+	"Streaming_History_Audio_*.json",
+	"StreamingHistory*.json",
+}
+
+const historyInsertBatchSize = 500
+
+// historyItem is an entry from either export format, extended history uses
+// snake case fields while account data uses camel case
+type historyItem struct {
+	TS              string  `json:"ts"`
+	MsPlayed        int64   `json:"ms_played"`
+	TrackName       *string `json:"master_metadata_track_name"`
+	ArtistName      *string `json:"master_metadata_album_artist_name"`
+	AlbumName       *string `json:"master_metadata_album_album_name"`
+	SpotifyTrackURI *string `json:"spotify_track_uri"`
+
+	EndTime           string `json:"endTime"`
+	AccountArtistName string `json:"artistName"`
+	AccountTrackName  string `json:"trackName"`
+	AccountMsPlayed   int64  `json:"msPlayed"`
+}
+
+// HistoryImportResult summarises an import of streaming history files
+type HistoryImportResult struct {
+	// Read is the number of entries in the files
+	Read int
+	// Skipped is the number of entries which were too short or not tracks
+	Skipped int
+	// Duplicates is the number of entries already in the store or repeated
+	// across files
+	Duplicates int
+	// Inserted is the number of new plays saved
+	Inserted int
+}
+
+// HistoryFiles returns the streaming history files in an export directory
+func HistoryFiles(dir string) ([]string, error) {
+	var paths []string
+	for _, pattern := range historyFilePatterns {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list files: %v", err)
+		}
+		paths = append(paths, matches...)
+	}
+
+	return paths, nil
+}
+
+// historyMinuteTolerance is how far from an account data entry's time a saved
+// play of the same track can be and still match it. The entries only have the
+// minute the stream ended, while Sync saves it to the second.
+const historyMinuteTolerance = time.Minute
+
+// historyTrack is the artist and track used to match account data entries to
+// saved plays
+type historyTrack struct {
+	Artist string
+	Track  string
+}
+
+// ImportHistory reads Spotify streaming history files and saves the plays
+// which are at least minPlayed long and not already in the store. As with
+// Sync, the end time of the stream is used as the play timestamp.
+//
+// Extended history entries match saved plays by their timestamp. Account data
+// entries only have the minute, so they match a saved play of the same artist
+// and track within historyMinuteTolerance instead, and entries ending in the
+// same minute are saved a second apart as a source has one play per second.
+func ImportHistory(
+	ctx context.Context,
+	playStore store.PlayStore,
+	paths []string,
+	minPlayed time.Duration,
+) (HistoryImportResult, error) {
+	var result HistoryImportResult
+	var plays, minutePlays []store.Play
+
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return result, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+
+		var items []historyItem
+		err = json.Unmarshal(b, &items)
+		if err != nil {
+			return result, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+
+		for _, item := range items {
+			result.Read++
+
+			play, ok, err := item.play(minPlayed)
+			if err != nil {
+				return result, fmt.Errorf("failed to read entry in %s: %v", path, err)
+			}
+			if !ok {
+				result.Skipped++
+				continue
+			}
+
+			if item.TS == "" {
+				minutePlays = append(minutePlays, play)
+			} else {
+				plays = append(plays, play)
+			}
+		}
+	}
+
+	if len(plays)+len(minutePlays) == 0 {
+		return result, nil
+	}
+
+	// stable so that when files overlap the entry from the first file is kept
+	sort.SliceStable(plays, func(i, j int) bool {
+		return plays[i].Timestamp.Before(plays[j].Timestamp)
+	})
+	sort.SliceStable(minutePlays, func(i, j int) bool {
+		return minutePlays[i].Timestamp.Before(minutePlays[j].Timestamp)
+	})
+
+	var from, to time.Time
+	for _, sorted := range [][]store.Play{plays, minutePlays} {
+		if len(sorted) == 0 {
+			continue
+		}
+		if from.IsZero() || sorted[0].Timestamp.Before(from) {
+			from = sorted[0].Timestamp
+		}
+		if sorted[len(sorted)-1].Timestamp.After(to) {
+			to = sorted[len(sorted)-1].Timestamp
+		}
+	}
+
+	existing, err := playStore.SourcePlays(
+		ctx,
+		"spotify",
+		from.Add(-historyMinuteTolerance),
+		to.Add(historyMinuteTolerance),
+	)
+	if err != nil {
+		return result, fmt.Errorf("failed to get existing plays: %v", err)
+	}
+	seen := make(map[int64]bool)
+	saved := make(map[historyTrack][]time.Time)
+	for _, p := range existing {
+		seen[p.Timestamp.Unix()] = true
+		key := historyTrack{Artist: p.Artist, Track: p.Track}
+		saved[key] = append(saved[key], p.Timestamp)
+	}
+
+	var newPlays []store.Play
+	for _, p := range plays {
+		if seen[p.Timestamp.Unix()] {
+			result.Duplicates++
+			continue
+		}
+		seen[p.Timestamp.Unix()] = true
+		key := historyTrack{Artist: p.Artist, Track: p.Track}
+		saved[key] = append(saved[key], p.Timestamp)
+		newPlays = append(newPlays, p)
+	}
+
+	for _, p := range minutePlays {
+		// each saved play only matches one entry
+		key := historyTrack{Artist: p.Artist, Track: p.Track}
+		if i := closestTime(saved[key], p.Timestamp, historyMinuteTolerance); i >= 0 {
+			saved[key] = append(saved[key][:i], saved[key][i+1:]...)
+			result.Duplicates++
+			continue
+		}
+
+		timestamp := p.Timestamp
+		for seen[timestamp.Unix()] && timestamp.Sub(p.Timestamp) < time.Minute-time.Second {
+			timestamp = timestamp.Add(time.Second)
+		}
+		if seen[timestamp.Unix()] {
+			result.Duplicates++
+			continue
+		}
+		seen[timestamp.Unix()] = true
+		p.Timestamp = timestamp
+		newPlays = append(newPlays, p)
+	}
+
+	sort.SliceStable(newPlays, func(i, j int) bool {
+		return newPlays[i].Timestamp.Before(newPlays[j].Timestamp)
+	})
+
+	// insert oldest first in batches so that a failure leaves a usable table
+	for i := 0; i < len(newPlays); i += historyInsertBatchSize {
+		end := i + historyInsertBatchSize
+		if end > len(newPlays) {
+			end = len(newPlays)
+		}
+
+		err = playStore.InsertPlays(ctx, newPlays[i:end])
+		if err != nil {
+			return result, fmt.Errorf("failed to insert plays: %v", err)
+		}
+		result.Inserted += end - i
+	}
+
+	return result, nil
+}
+
+// closestTime returns the index of the time closest to t which is at most
+// tolerance away, or -1 when there isn't one
+func closestTime(times []time.Time, t time.Time, tolerance time.Duration) int {
+	closest := -1
+	var closestDiff time.Duration
+	for i, c := range times {
+		diff := c.Sub(t)
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff <= tolerance && (closest < 0 || diff < closestDiff) {
+			closest = i
+			closestDiff = diff
+		}
+	}
+
+	return closest
+}
+
+// play converts a history entry to a play, ok is false when the entry should
+// be skipped because it's too short or is not a track
+func (i historyItem) play(minPlayed time.Duration) (p store.Play, ok bool, err error) {
+	// extended streaming history
+	if i.TS != "" {
+		// podcast episodes and other non track content have no track name
+		if i.TrackName == nil || i.ArtistName == nil {
+			return p, false, nil
+		}
+		if time.Duration(i.MsPlayed)*time.Millisecond < minPlayed {
+			return p, false, nil
+		}
+
+		ts, err := time.Parse(time.RFC3339, i.TS)
+		if err != nil {
+			return p, false, fmt.Errorf("failed to parse timestamp: %v", err)
+		}
+
+		p = store.Play{
+			Track:  *i.TrackName,
+			Artist: *i.ArtistName,
+			// the history only has the primary artist
+			Artists:   []string{*i.ArtistName},
+			Timestamp: ts.UTC(),
+			CreatedAt: time.Now(),
+			Source:    "spotify",
+		}
+		if i.AlbumName != nil {
+			p.Album = *i.AlbumName
+		}
+		if i.SpotifyTrackURI != nil {
+			p.SpotifyID = strings.TrimPrefix(*i.SpotifyTrackURI, "spotify:track:")
+		}
+
+		return p, true, nil
+	}
+
+	// account data streaming history
+	if i.EndTime != "" {
+		if i.AccountTrackName == "" {
+			return p, false, nil
+		}
+		if time.Duration(i.AccountMsPlayed)*time.Millisecond < minPlayed {
+			return p, false, nil
+		}
+
+		ts, err := time.Parse("2006-01-02 15:04", i.EndTime)
+		if err != nil {
+			return p, false, fmt.Errorf("failed to parse timestamp: %v", err)
+		}
+
+		return store.Play{
+			Track:     i.AccountTrackName,
+			Artist:    i.AccountArtistName,
+			Artists:   []string{i.AccountArtistName},
+			Timestamp: ts.UTC(),
+			CreatedAt: time.Now(),
+			Source:    "spotify",
+		}, true, nil
+	}
+
+	return p, false, fmt.Errorf("entry has no timestamp")
+}
@@ -0,0 +1,158 @@
+package spotify_test
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/charlieegan3/music/internal/pkg/spotify"
+	"github.com/charlieegan3/music/pkg/tool"
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+func newStore(t *testing.T) *store.SQL {
+	t.Helper()
+
+	db, err := tool.OpenSQLite(filepath.Join(t.TempDir(), "music.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return store.NewSQLite(db)
+}
+
+func historyFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	paths, err := spotify.HistoryFiles(filepath.Join("testdata", dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return paths
+}
+
+// savedPlays returns the time of each saved spotify play by track
+func savedPlays(t *testing.T, s *store.SQL) map[string][]string {
+	t.Helper()
+
+	plays, err := s.SourcePlays(
+		context.Background(),
+		"spotify",
+		time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2023, 1, 3, 0, 0, 0, 0, time.UTC),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(map[string][]string)
+	for _, p := range plays {
+		result[p.Track] = append(result[p.Track], p.Timestamp.Format("15:04:05"))
+	}
+
+	return result
+}
+
+func TestImportExtendedHistory(t *testing.T) {
+	ctx := context.Background()
+	s := newStore(t)
+	paths := historyFiles(t, "extended")
+
+	result, err := spotify.ImportHistory(ctx, s, paths, spotify.DefaultMinPlayed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the short play and the podcast are skipped, the files overlap
+	expected := spotify.HistoryImportResult{Read: 5, Skipped: 2, Duplicates: 1, Inserted: 2}
+	if result != expected {
+		t.Fatalf("expected %+v, got %+v", expected, result)
+	}
+	expectedPlays := map[string][]string{
+		"Halo":          {"15:04:05"},
+		"Single Ladies": {"15:08:30"},
+	}
+	if plays := savedPlays(t, s); !reflect.DeepEqual(plays, expectedPlays) {
+		t.Fatalf("expected plays %v, got %v", expectedPlays, plays)
+	}
+
+	// importing again saves nothing
+	result, err = spotify.ImportHistory(ctx, s, paths, spotify.DefaultMinPlayed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = spotify.HistoryImportResult{Read: 5, Skipped: 2, Duplicates: 3}
+	if result != expected {
+		t.Fatalf("expected %+v on the second import, got %+v", expected, result)
+	}
+}
+
+func TestImportHistoryMinPlayed(t *testing.T) {
+	s := newStore(t)
+
+	result, err := spotify.ImportHistory(context.Background(), s, historyFiles(t, "extended"), 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the podcast is skipped
+	expected := spotify.HistoryImportResult{Read: 5, Skipped: 1, Duplicates: 1, Inserted: 3}
+	if result != expected {
+		t.Fatalf("expected %+v, got %+v", expected, result)
+	}
+	if plays := savedPlays(t, s); len(plays["Skipped Song"]) != 1 {
+		t.Fatalf("expected the short play to be saved, got %v", plays)
+	}
+}
+
+func TestImportAccountHistory(t *testing.T) {
+	ctx := context.Background()
+	s := newStore(t)
+	paths := historyFiles(t, "account")
+
+	// the play saved by the spotify job has the time to the second
+	err := s.InsertPlays(ctx, []store.Play{{
+		Artist:    "Beyoncé",
+		Album:     "I Am... Sasha Fierce",
+		Track:     "Halo",
+		Source:    "spotify",
+		Timestamp: time.Date(2023, 1, 2, 15, 4, 37, 0, time.UTC),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := spotify.ImportHistory(ctx, s, paths, spotify.DefaultMinPlayed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the entry in the same minute as the saved play matches it, entries
+	// ending in the same minute are both kept
+	expected := spotify.HistoryImportResult{Read: 5, Skipped: 2, Duplicates: 1, Inserted: 2}
+	if result != expected {
+		t.Fatalf("expected %+v, got %+v", expected, result)
+	}
+	expectedPlays := map[string][]string{
+		"Halo":      {"15:04:37"},
+		"Intro":     {"15:10:00"},
+		"Interlude": {"15:10:01"},
+	}
+	if plays := savedPlays(t, s); !reflect.DeepEqual(plays, expectedPlays) {
+		t.Fatalf("expected plays %v, got %v", expectedPlays, plays)
+	}
+
+	// importing again matches the plays saved a second apart
+	result, err = spotify.ImportHistory(ctx, s, paths, spotify.DefaultMinPlayed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = spotify.HistoryImportResult{Read: 5, Skipped: 2, Duplicates: 3}
+	if result != expected {
+		t.Fatalf("expected %+v on the second import, got %+v", expected, result)
+	}
+}
@@ -3,55 +3,35 @@ package spotify
 import (
 	"context"
 	"fmt"
-	"google.golang.org/api/option"
 	"strings"
 	"time"
 
-	"cloud.google.com/go/bigquery"
-	bq "github.com/charlieegan3/music/internal/pkg/bigquery"
 	"github.com/zmb3/spotify"
-	"google.golang.org/api/iterator"
+
+	"github.com/charlieegan3/music/pkg/tool/nowplaying"
+	"github.com/charlieegan3/music/pkg/tool/store"
 )
 
-// Sync gets a list of recently played tracks and uploads to bigquery
+// Sync gets a list of recently played tracks and saves them to the play store.
+// The plays which were saved are returned, also when there is an error.
 func Sync(
+	ctx context.Context,
 	accessToken,
 	refreshToken,
 	clientID,
-	clientSecret,
-	googleCredentialsJSON,
-	projectID,
-	datasetName,
-	tableName string,
-	jsonSchema []byte,
-) error {
-	// Creates a bq client.
-	ctx := context.Background()
-
-	bigqueryClient, err := bigquery.NewClient(
-		ctx,
-		projectID,
-		option.WithCredentialsJSON([]byte(googleCredentialsJSON)),
-	)
-	if err != nil {
-		return fmt.Errorf("Failed to create client: %v", err)
-	}
-	schema, err := bigquery.SchemaFromJSON(jsonSchema)
-	if err != nil {
-		return fmt.Errorf("Failed to parse schema: %v", err)
-	}
-	u := bigqueryClient.Dataset(datasetName).Table(tableName).Uploader()
-
+	clientSecret string,
+	playStore store.PlayStore,
+) ([]store.Play, error) {
 	// Creates a spotify client
 	spotifyClient := buildClient(accessToken, refreshToken, clientID, clientSecret)
 	recentlyPlayed, err := spotifyClient.PlayerRecentlyPlayedOpt(&spotify.RecentlyPlayedOptions{Limit: 50})
 	if err != nil {
-		return fmt.Errorf("Failed to get recent plays: %v", err)
+		return nil, fmt.Errorf("Failed to get recent plays: %v", err)
 	}
 
-	timestamps, err := nMostRecentTimestamps(ctx, bigqueryClient, projectID, datasetName, tableName, "spotify", 100)
+	timestamps, err := playStore.MostRecentTimestamps(ctx, "spotify", 100)
 	if err != nil {
-		return fmt.Errorf("Failed to get most recent timestamps: %v", err)
+		return nil, fmt.Errorf("Failed to get most recent timestamps: %v", err)
 	}
 
 	// reverse to import in order in case of failure
@@ -59,11 +39,12 @@ func Sync(
 		recentlyPlayed[i], recentlyPlayed[j] = recentlyPlayed[j], recentlyPlayed[i]
 	}
 	failures := 0
+	var inserted []store.Play
 	for _, item := range recentlyPlayed {
 		// look for songs that arrive in recently played too late out of order
 		found := false
 		for _, v := range timestamps {
-			if v.Truncate(time.Second) == item.PlayedAt.Truncate(time.Second) {
+			if v.Truncate(time.Second).Equal(item.PlayedAt.Truncate(time.Second)) {
 				found = true
 				break
 			}
@@ -86,69 +67,118 @@ func Sync(
 				image = fullTrack.Album.Images[0].URL
 			}
 
-			err = bq.SavePlay(ctx,
-				schema,
-				*u,
-				item.Track.Name,
-				strings.Join(artists, ", "),
-				fullTrack.Album.Name,
-				fmt.Sprintf("%d", item.PlayedAt.Unix()),
-				int64(item.Track.Duration),
-				fmt.Sprintf("%s", item.Track.ID),
-				image,
-				"spotify",
-				"", // youtube_id
-				"", // youtube_category_id
-				"", // soundcloud_id
-				"", // soundcloud_permalink
-				"", // shazam_id
-				"", // shazam_permalink
-			)
-
+			p := store.Play{
+				Track:      item.Track.Name,
+				Artist:     strings.Join(artists, ", "),
+				Artists:    artists,
+				Album:      fullTrack.Album.Name,
+				Timestamp:  item.PlayedAt.Truncate(time.Second).UTC(),
+				Duration:   int64(item.Track.Duration),
+				SpotifyID:  fmt.Sprintf("%s", item.Track.ID),
+				AlbumCover: image,
+				CreatedAt:  time.Now(),
+				Source:     "spotify",
+			}
+			err = playStore.InsertPlays(ctx, []store.Play{p})
 			if err != nil {
-				return fmt.Errorf("Failed to upload item: %v", err)
+				return inserted, fmt.Errorf("Failed to upload item: %v", err)
 			}
+			inserted = append(inserted, p)
 
 			fmt.Printf("%v %s\n", item.PlayedAt, item.Track.Name)
 		}
 	}
 
 	if failures > 0 {
-		return fmt.Errorf("Some tracks failed (%d failures)", failures)
+		return inserted, fmt.Errorf("Some tracks failed (%d failures)", failures)
 	}
 
-	return nil
+	return inserted, nil
 }
 
-func nMostRecentTimestamps(ctx context.Context, client *bigquery.Client, projectID string, datasetName string, tableName string, source string, count int) ([]time.Time, error) {
-	var t []time.Time
-	queryString := fmt.Sprintf(
-		"SELECT timestamp FROM `%s.%s.%s` WHERE source = \"%s\" ORDER BY timestamp DESC LIMIT %d",
-		projectID,
-		datasetName,
-		tableName,
-		source,
-		count,
-	)
-	q := client.Query(queryString)
-	it, err := q.Read(ctx)
+// CurrentlyPlaying returns the track playing on the user's account, nil is
+// returned when nothing is playing. The refresh token needs the
+// user-read-currently-playing scope.
+func CurrentlyPlaying(
+	accessToken,
+	refreshToken,
+	clientID,
+	clientSecret string,
+) (*nowplaying.Track, error) {
+	spotifyClient := buildClient(accessToken, refreshToken, clientID, clientSecret)
+	current, err := spotifyClient.PlayerCurrentlyPlaying()
 	if err != nil {
-		return t, fmt.Errorf("Failed query for recent timestamps: %v", err)
+		return nil, fmt.Errorf("failed to get currently playing: %v", err)
+	}
+
+	// an empty response is returned when nothing is playing
+	if current == nil || !current.Playing || current.Item == nil {
+		return nil, nil
+	}
+
+	var artists []string
+	for _, a := range current.Item.Artists {
+		artists = append(artists, a.Name)
 	}
-	var l struct {
-		Timestamp time.Time
+	var image string
+	if len(current.Item.Album.Images) > 0 {
+		image = current.Item.Album.Images[0].URL
 	}
-	for {
-		err := it.Next(&l)
-		if err == iterator.Done {
-			break
+
+	return &nowplaying.Track{
+		Source:     "spotify",
+		Track:      current.Item.Name,
+		Artist:     strings.Join(artists, ", "),
+		Album:      current.Item.Album.Name,
+		Duration:   int64(current.Item.Duration),
+		SpotifyID:  string(current.Item.ID),
+		AlbumCover: image,
+		StartedAt:  time.Now().Add(-time.Duration(current.Progress) * time.Millisecond).UTC(),
+	}, nil
+}
+
+// trackArtistsBatchSize is the most tracks which can be requested at once
+const trackArtistsBatchSize = 50
+
+// TrackArtists returns the names of the artists of each track id, ids which
+// are not found are left out
+func TrackArtists(
+	accessToken,
+	refreshToken,
+	clientID,
+	clientSecret string,
+	ids []string,
+) (map[string][]string, error) {
+	spotifyClient := buildClient(accessToken, refreshToken, clientID, clientSecret)
+
+	result := make(map[string][]string)
+	for len(ids) > 0 {
+		n := trackArtistsBatchSize
+		if len(ids) < n {
+			n = len(ids)
 		}
+
+		var batch []spotify.ID
+		for _, id := range ids[:n] {
+			batch = append(batch, spotify.ID(id))
+		}
+		ids = ids[n:]
+
+		tracks, err := spotifyClient.GetTracks(batch...)
 		if err != nil {
-			fmt.Println(err)
-			return t, fmt.Errorf("Failed reading results for time: %v", err)
+			return nil, fmt.Errorf("failed to get tracks: %v", err)
+		}
+
+		for _, t := range tracks {
+			// unknown ids are returned as null
+			if t == nil {
+				continue
+			}
+			for _, a := range t.Artists {
+				result[string(t.ID)] = append(result[string(t.ID)], a.Name)
+			}
 		}
-		t = append(t, l.Timestamp)
 	}
 
-	return t, nil
+	return result, nil
 }
@@ -0,0 +1,390 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// Destination is somewhere that backups can be written to
+type Destination interface {
+	// Create returns a writer for a new backup with the given name, the
+	// backup is only complete once the writer has been closed without error
+	Create(ctx context.Context, name string) (io.WriteCloser, error)
+	// Open returns a reader for an existing backup
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	// List returns the names of backups starting with prefix
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Delete removes a backup
+	Delete(ctx context.Context, name string) error
+}
+
+// aborter is implemented by the writers returned by destinations so that a
+// failed backup can be discarded rather than completed
+type aborter interface {
+	abort(err error)
+}
+
+// Write calls fn with a writer which streams to a backup for each of names at
+// the destination. If fn fails none of the backups are completed.
+func Write(ctx context.Context, dest Destination, names []string, fn func(w io.Writer) error) error {
+	var writers []io.WriteCloser
+	abortAll := func(writers []io.WriteCloser, err error) {
+		for _, w := range writers {
+			if a, ok := w.(aborter); ok {
+				a.abort(err)
+			}
+		}
+	}
+
+	for _, name := range names {
+		w, err := dest.Create(ctx, name)
+		if err != nil {
+			abortAll(writers, err)
+			return fmt.Errorf("failed to create backup %s: %v", name, err)
+		}
+		writers = append(writers, w)
+	}
+
+	var ws []io.Writer
+	for _, w := range writers {
+		ws = append(ws, w)
+	}
+
+	err := fn(io.MultiWriter(ws...))
+	if err != nil {
+		abortAll(writers, err)
+		return err
+	}
+
+	for i, w := range writers {
+		err = w.Close()
+		if err != nil {
+			// writers which have been closed can't be aborted
+			abortAll(writers[i+1:], err)
+			return fmt.Errorf("failed to complete backup %s: %v", names[i], err)
+		}
+	}
+
+	return nil
+}
+
+// Local writes backups to files in a directory
+type Local struct {
+	Dir string
+}
+
+func (l *Local) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	err := os.MkdirAll(l.Dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create backup dir: %v", err)
+	}
+
+	// the backup is written to a temp file so that a failed backup doesn't
+	// replace an existing file
+	f, err := os.CreateTemp(l.Dir, "."+name+".*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create backup file: %v", err)
+	}
+
+	return &localWriter{File: f, path: filepath.Join(l.Dir, name)}, nil
+}
+
+type localWriter struct {
+	*os.File
+	path string
+}
+
+func (w *localWriter) Close() error {
+	err := w.File.Close()
+	if err != nil {
+		os.Remove(w.File.Name())
+		return fmt.Errorf("failed to close backup file: %v", err)
+	}
+
+	err = os.Rename(w.File.Name(), w.path)
+	if err != nil {
+		return fmt.Errorf("failed to move backup file: %v", err)
+	}
+
+	return nil
+}
+
+func (w *localWriter) abort(err error) {
+	w.File.Close()
+	os.Remove(w.File.Name())
+}
+
+func (l *Local) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(l.Dir, name))
+}
+
+func (l *Local) List(ctx context.Context, prefix string) ([]string, error) {
+	entries, err := os.ReadDir(l.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backup dir: %v", err)
+	}
+
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+		names = append(names, e.Name())
+	}
+
+	return names, nil
+}
+
+func (l *Local) Delete(ctx context.Context, name string) error {
+	return os.Remove(filepath.Join(l.Dir, name))
+}
+
+// GCS writes backups to objects in a Google Cloud Storage bucket
+type GCS struct {
+	BucketName            string
+	GoogleCredentialsJSON string
+}
+
+func (g *GCS) storageClient(ctx context.Context) (*storage.Client, error) {
+	storageClient, err := storage.NewClient(ctx, option.WithCredentialsJSON([]byte(g.GoogleCredentialsJSON)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage client: %v", err)
+	}
+
+	return storageClient, nil
+}
+
+func (g *GCS) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	storageClient, err := g.storageClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// cancelling the context used to create the writer discards the object
+	ctx, cancel := context.WithCancel(ctx)
+	w := storageClient.Bucket(g.BucketName).Object(name).NewWriter(ctx)
+	w.ContentType = "application/json"
+
+	return &gcsWriter{Writer: w, client: storageClient, cancel: cancel}, nil
+}
+
+// gcsWriter closes the storage client once the object has been written
+type gcsWriter struct {
+	*storage.Writer
+	client *storage.Client
+	cancel context.CancelFunc
+}
+
+func (w *gcsWriter) Close() error {
+	defer w.cancel()
+
+	err := w.Writer.Close()
+	if closeErr := w.client.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (w *gcsWriter) abort(err error) {
+	w.cancel()
+	w.Writer.Close()
+	w.client.Close()
+}
+
+func (g *GCS) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	storageClient, err := g.storageClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := storageClient.Bucket(g.BucketName).Object(name).NewReader(ctx)
+	if err != nil {
+		storageClient.Close()
+		return nil, fmt.Errorf("failed to open gs://%s/%s: %v", g.BucketName, name, err)
+	}
+
+	return &gcsReader{Reader: r, client: storageClient}, nil
+}
+
+// gcsReader closes the storage client along with the object reader
+type gcsReader struct {
+	*storage.Reader
+	client *storage.Client
+}
+
+func (r *gcsReader) Close() error {
+	err := r.Reader.Close()
+	if closeErr := r.client.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (g *GCS) List(ctx context.Context, prefix string) ([]string, error) {
+	storageClient, err := g.storageClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer storageClient.Close()
+
+	var names []string
+	it := storageClient.Bucket(g.BucketName).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %v", err)
+		}
+		names = append(names, attrs.Name)
+	}
+
+	return names, nil
+}
+
+func (g *GCS) Delete(ctx context.Context, name string) error {
+	storageClient, err := g.storageClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer storageClient.Close()
+
+	err = storageClient.Bucket(g.BucketName).Object(name).Delete(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to delete gs://%s/%s: %v", g.BucketName, name, err)
+	}
+
+	return nil
+}
+
+// S3 writes backups to objects in a bucket on any S3 compatible service
+type S3 struct {
+	// Endpoint is the host and optional port of the service, e.g.
+	// s3.amazonaws.com or localhost:9000
+	Endpoint        string
+	Region          string
+	BucketName      string
+	AccessKeyID     string
+	SecretAccessKey string
+	// Insecure uses http rather than https
+	Insecure bool
+}
+
+func (s *S3) client() (*minio.Client, error) {
+	client, err := minio.New(s.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(s.AccessKeyID, s.SecretAccessKey, ""),
+		Secure: !s.Insecure,
+		Region: s.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 client: %v", err)
+	}
+
+	return client, nil
+}
+
+func (s *S3) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	client, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+
+	// the object is uploaded in parts as it's written to the pipe
+	pr, pw := io.Pipe()
+	w := &s3Writer{PipeWriter: pw, done: make(chan error, 1)}
+	go func() {
+		_, err := client.PutObject(ctx, s.BucketName, name, pr, -1, minio.PutObjectOptions{
+			ContentType: "application/json",
+		})
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+
+	return w, nil
+}
+
+// s3Writer waits for the upload to complete when closed
+type s3Writer struct {
+	*io.PipeWriter
+	done chan error
+}
+
+func (w *s3Writer) Close() error {
+	err := w.PipeWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	err = <-w.done
+	if err != nil {
+		return fmt.Errorf("failed to upload backup: %v", err)
+	}
+
+	return nil
+}
+
+// abort fails the upload, minio doesn't complete a multipart upload when the
+// reader returns an error
+func (w *s3Writer) abort(err error) {
+	w.PipeWriter.CloseWithError(err)
+	<-w.done
+}
+
+func (s *S3) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	client, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := client.GetObject(ctx, s.BucketName, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", name, err)
+	}
+
+	return object, nil
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]string, error) {
+	client, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for object := range client.ListObjects(ctx, s.BucketName, minio.ListObjectsOptions{Prefix: prefix}) {
+		if object.Err != nil {
+			return nil, fmt.Errorf("failed to list objects: %v", object.Err)
+		}
+		names = append(names, object.Key)
+	}
+
+	return names, nil
+}
+
+func (s *S3) Delete(ctx context.Context, name string) error {
+	client, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	err = client.RemoveObject(ctx, s.BucketName, name, minio.RemoveObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %v", name, err)
+	}
+
+	return nil
+}
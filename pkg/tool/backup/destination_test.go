@@ -0,0 +1,268 @@
+package backup_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/charlieegan3/music/pkg/tool/backup"
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+func TestLocal(t *testing.T) {
+	testDestination(t, &backup.Local{Dir: filepath.Join(t.TempDir(), "backups")})
+}
+
+func TestS3(t *testing.T) {
+	s3 := newFakeS3("backups")
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	testDestination(t, &backup.S3{
+		Endpoint:        strings.TrimPrefix(server.URL, "http://"),
+		Region:          "us-east-1",
+		BucketName:      "backups",
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+		Insecure:        true,
+	})
+
+	if len(s3.uploads) != 0 {
+		t.Fatalf("expected failed uploads to be aborted, %d are open", len(s3.uploads))
+	}
+}
+
+// testDestination writes, lists and deletes backups at an empty destination
+func testDestination(t *testing.T, dest backup.Destination) {
+	ctx := context.Background()
+
+	play := store.Play{
+		Artist:    "Artist",
+		Album:     "Album",
+		Track:     "Track",
+		Source:    "lastfm",
+		Timestamp: time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC),
+	}
+
+	err := backup.Write(ctx, dest, []string{"plays-a.json", "plays-b.json"}, func(w io.Writer) error {
+		return backup.NewEncoder(w).Encode(play)
+	})
+	if err != nil {
+		t.Fatalf("failed to write backups: %v", err)
+	}
+
+	content := readBackup(t, dest, "plays-a.json")
+	if !strings.Contains(content, `"track":"Track"`) {
+		t.Fatalf("expected backup to contain the play, got %q", content)
+	}
+
+	// a failed backup leaves nothing behind, including for an existing name
+	encodeErr := errors.New("failed to encode play")
+	err = backup.Write(ctx, dest, []string{"plays-a.json", "plays-c.json"}, func(w io.Writer) error {
+		_, err := w.Write([]byte("{\"track\":"))
+		if err != nil {
+			return err
+		}
+		return encodeErr
+	})
+	if !errors.Is(err, encodeErr) {
+		t.Fatalf("expected the encoder error, got %v", err)
+	}
+
+	assertNames(t, dest, "", []string{"plays-a.json", "plays-b.json"})
+	if readBackup(t, dest, "plays-a.json") != content {
+		t.Fatal("expected the failed backup not to replace plays-a.json")
+	}
+
+	assertNames(t, dest, "plays-b", []string{"plays-b.json"})
+	assertNames(t, dest, "other", nil)
+
+	err = dest.Delete(ctx, "plays-a.json")
+	if err != nil {
+		t.Fatalf("failed to delete backup: %v", err)
+	}
+	assertNames(t, dest, "", []string{"plays-b.json"})
+}
+
+func readBackup(t *testing.T, dest backup.Destination, name string) string {
+	t.Helper()
+
+	r, err := dest.Open(context.Background(), name)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", name, err)
+	}
+	defer r.Close()
+
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", name, err)
+	}
+
+	return string(content)
+}
+
+func assertNames(t *testing.T, dest backup.Destination, prefix string, expected []string) {
+	t.Helper()
+
+	names, err := dest.List(context.Background(), prefix)
+	if err != nil {
+		t.Fatalf("failed to list backups: %v", err)
+	}
+	sort.Strings(names)
+
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected backups %v with prefix %q, got %v", expected, prefix, names)
+	}
+}
+
+// fakeS3 is a single bucket supporting the requests made by the minio client
+// to upload objects in parts, list, read and delete them
+type fakeS3 struct {
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	nextID  int
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{
+		bucket:  bucket,
+		objects: make(map[string][]byte),
+		uploads: make(map[string]map[int][]byte),
+	}
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path != s.bucket && !strings.HasPrefix(path, s.bucket+"/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(path, s.bucket), "/")
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		type object struct {
+			Key          string
+			LastModified string
+			Size         int
+		}
+		result := struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Name     string
+			Prefix   string
+			KeyCount int
+			Contents []object
+		}{Name: s.bucket, Prefix: query.Get("prefix")}
+		for k, v := range s.objects {
+			if strings.HasPrefix(k, result.Prefix) {
+				result.Contents = append(result.Contents, object{
+					Key:          k,
+					LastModified: time.Now().UTC().Format(time.RFC3339),
+					Size:         len(v),
+				})
+			}
+		}
+		result.KeyCount = len(result.Contents)
+		writeXML(w, result)
+
+	case query.Has("uploads") && r.Method == http.MethodPost:
+		s.nextID++
+		id := strconv.Itoa(s.nextID)
+		s.uploads[id] = make(map[int][]byte)
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: s.bucket, Key: key, UploadId: id})
+
+	case uploadID != "" && r.Method == http.MethodPut:
+		parts, ok := s.uploads[uploadID]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		parts[number] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, uploadID, number))
+
+	case uploadID != "" && r.Method == http.MethodPost:
+		parts, ok := s.uploads[uploadID]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var numbers []int
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var object bytes.Buffer
+		for _, n := range numbers {
+			object.Write(parts[n])
+		}
+		s.objects[key] = object.Bytes()
+		delete(s.uploads, uploadID)
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: s.bucket, Key: key, ETag: `"complete"`})
+
+	case uploadID != "" && r.Method == http.MethodDelete:
+		delete(s.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(object)))
+		w.Header().Set("ETag", `"object"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(object)
+		}
+
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
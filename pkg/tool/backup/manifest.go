@@ -0,0 +1,206 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+// Manifest lists the timestamped backups at a destination, newest first
+type Manifest struct {
+	UpdatedAt time.Time `json:"updated_at"`
+	// Latest is the timestamped backup which was copied to LatestName
+	Latest  string          `json:"latest"`
+	Backups []ManifestEntry `json:"backups"`
+}
+
+// ManifestEntry describes a single backup. Rows, SHA256 and Size are unset
+// for backups taken before the manifest was introduced.
+type ManifestEntry struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Rows      int       `json:"rows,omitempty"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Size      int64     `json:"size,omitempty"`
+
+	// Verification is set when the backup was checked against the store
+	Verification *Verification `json:"verification,omitempty"`
+}
+
+// summaryWriter counts and hashes the bytes written to a backup
+type summaryWriter struct {
+	hash hash.Hash
+	size int64
+}
+
+func newSummaryWriter() *summaryWriter {
+	return &summaryWriter{hash: sha256.New()}
+}
+
+func (w *summaryWriter) sha256() string {
+	return hex.EncodeToString(w.hash.Sum(nil))
+}
+
+func (w *summaryWriter) Write(p []byte) (int, error) {
+	w.size += int64(len(p))
+	return w.hash.Write(p)
+}
+
+// Summarize reads a backup to count its rows and compute its checksum
+func Summarize(ctx context.Context, dest Destination, name string) (ManifestEntry, error) {
+	entry := ManifestEntry{Name: name}
+	if t, ok := ParseName(name); ok {
+		entry.CreatedAt = t
+	}
+
+	r, err := dest.Open(ctx, name)
+	if err != nil {
+		return entry, err
+	}
+	defer r.Close()
+
+	summary := newSummaryWriter()
+	scanner := bufio.NewScanner(io.TeeReader(r, summary))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			entry.Rows++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return entry, fmt.Errorf("failed to read %s: %v", name, err)
+	}
+
+	entry.SHA256 = summary.sha256()
+	entry.Size = summary.size
+
+	return entry, nil
+}
+
+// ReadManifest returns the manifest at the destination, or an empty manifest
+// if there isn't one yet
+func ReadManifest(ctx context.Context, dest Destination) (Manifest, error) {
+	var manifest Manifest
+
+	names, err := dest.List(ctx, ManifestName)
+	if err != nil {
+		return manifest, err
+	}
+	found := false
+	for _, name := range names {
+		if name == ManifestName {
+			found = true
+		}
+	}
+	if !found {
+		return manifest, nil
+	}
+
+	r, err := dest.Open(ctx, ManifestName)
+	if err != nil {
+		return manifest, err
+	}
+	defer r.Close()
+
+	err = json.NewDecoder(r).Decode(&manifest)
+	if err != nil {
+		return manifest, fmt.Errorf("failed to parse manifest: %v", err)
+	}
+
+	return manifest, nil
+}
+
+// Rotate adds a new backup to the manifest, removes backups which are not kept
+// by the retention policy and saves the manifest. The names of removed
+// backups are returned.
+func Rotate(ctx context.Context, dest Destination, retention Retention, latest ManifestEntry) ([]string, error) {
+	names, err := dest.List(ctx, namePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %v", err)
+	}
+
+	expired := retention.Expired(names)
+	isExpired := make(map[string]bool)
+	for _, name := range expired {
+		err = dest.Delete(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete %s: %v", name, err)
+		}
+		isExpired[name] = true
+	}
+
+	manifest, err := ReadManifest(ctx, dest)
+	if err != nil {
+		return expired, err
+	}
+	entries := make(map[string]ManifestEntry)
+	for _, e := range manifest.Backups {
+		entries[e.Name] = e
+	}
+	entries[latest.Name] = latest
+
+	// the new backup may or may not be listed depending on the destination
+	seen := make(map[string]bool)
+	manifest.Backups = nil
+	for _, name := range append(names, latest.Name) {
+		t, ok := ParseName(name)
+		if !ok || isExpired[name] || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		entry, ok := entries[name]
+		if !ok {
+			entry = ManifestEntry{Name: name, CreatedAt: t}
+		}
+		manifest.Backups = append(manifest.Backups, entry)
+	}
+	sort.Slice(manifest.Backups, func(i, j int) bool {
+		return manifest.Backups[i].Name > manifest.Backups[j].Name
+	})
+	manifest.Latest = latest.Name
+	manifest.UpdatedAt = time.Now().UTC()
+
+	err = Write(ctx, dest, []string{ManifestName}, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(manifest)
+	})
+	if err != nil {
+		return expired, fmt.Errorf("failed to write manifest: %v", err)
+	}
+
+	return expired, nil
+}
+
+// Backup streams every play in the store to a timestamped backup and the
+// latest backup at the destination, and returns the manifest entry for it
+func Backup(ctx context.Context, dest Destination, playStore store.PlayStore, t time.Time) (ManifestEntry, error) {
+	entry := ManifestEntry{Name: Name(t), CreatedAt: t.UTC().Truncate(time.Minute)}
+
+	summary := newSummaryWriter()
+	err := Write(ctx, dest, []string{entry.Name, LatestName}, func(w io.Writer) error {
+		encoder := NewEncoder(io.MultiWriter(w, summary))
+		return playStore.EachPlay(ctx, func(p store.Play) error {
+			entry.Rows++
+			return encoder.Encode(p)
+		})
+	})
+	if err != nil {
+		return entry, err
+	}
+
+	entry.SHA256 = summary.sha256()
+	entry.Size = summary.size
+
+	return entry, nil
+}
@@ -0,0 +1,270 @@
+package backup
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+
+	"github.com/charlieegan3/music/pkg/tool/bq"
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+// timestampFormats are the formats accepted for TIMESTAMP fields, BigQuery
+// extracts use the first and may include fractional seconds
+var timestampFormats = []string{
+	"2006-01-02 15:04:05 UTC",
+	time.RFC3339Nano,
+}
+
+// Decoder reads plays from a newline delimited json backup, in the format
+// written by BigQuery extract jobs, checking each row against the bq schema
+type Decoder struct {
+	scanner *bufio.Scanner
+	schema  bigquery.Schema
+	fields  map[string]bool
+	line    int
+}
+
+// NewDecoder returns a decoder reading rows from r
+func NewDecoder(r io.Reader) (*Decoder, error) {
+	schema, err := bigquery.SchemaFromJSON(bq.JSONSchema)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse schema: %v", err)
+	}
+
+	scanner := bufio.NewScanner(r)
+	// album cover urls can make for long lines
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	fields := make(map[string]bool)
+	for _, f := range schema {
+		fields[f.Name] = true
+	}
+
+	return &Decoder{scanner: scanner, schema: schema, fields: fields}, nil
+}
+
+// Next returns the next play, io.EOF is returned after the last row
+func (d *Decoder) Next() (store.Play, error) {
+	for d.scanner.Scan() {
+		d.line++
+		if len(d.scanner.Bytes()) == 0 {
+			continue
+		}
+
+		play, err := d.decode(d.scanner.Bytes())
+		if err != nil {
+			return play, fmt.Errorf("line %d: %v", d.line, err)
+		}
+
+		return play, nil
+	}
+
+	if err := d.scanner.Err(); err != nil {
+		return store.Play{}, fmt.Errorf("failed to read backup: %v", err)
+	}
+
+	return store.Play{}, io.EOF
+}
+
+func (d *Decoder) decode(line []byte) (store.Play, error) {
+	var row map[string]interface{}
+	err := json.Unmarshal(line, &row)
+	if err != nil {
+		return store.Play{}, fmt.Errorf("invalid json: %v", err)
+	}
+
+	for name := range row {
+		if !d.fields[name] {
+			return store.Play{}, fmt.Errorf("unknown field %q", name)
+		}
+	}
+
+	values := make(map[string]interface{})
+	for _, f := range d.schema {
+		raw, ok := row[f.Name]
+		if !ok || raw == nil {
+			if f.Required {
+				return store.Play{}, fmt.Errorf("missing required field %q", f.Name)
+			}
+			continue
+		}
+
+		if f.Repeated {
+			items, ok := raw.([]interface{})
+			if !ok {
+				return store.Play{}, fmt.Errorf("invalid value for %q: %T is not an array", f.Name, raw)
+			}
+			var repeated []interface{}
+			for _, item := range items {
+				value, err := parseValue(f.Type, item)
+				if err != nil {
+					return store.Play{}, fmt.Errorf("invalid value for %q: %v", f.Name, err)
+				}
+				repeated = append(repeated, value)
+			}
+			values[f.Name] = repeated
+			continue
+		}
+
+		value, err := parseValue(f.Type, raw)
+		if err != nil {
+			return store.Play{}, fmt.Errorf("invalid value for %q: %v", f.Name, err)
+		}
+		values[f.Name] = value
+	}
+
+	str := func(name string) string {
+		v, _ := values[name].(string)
+		return v
+	}
+	timestamp, _ := values["timestamp"].(time.Time)
+	createdAt, _ := values["created_at"].(time.Time)
+	duration, _ := values["duration"].(int64)
+	var artists []string
+	if repeated, ok := values["artists"].([]interface{}); ok {
+		for _, v := range repeated {
+			artists = append(artists, v.(string))
+		}
+	}
+
+	return store.Play{
+		Track:               str("track"),
+		Artist:              str("artist"),
+		Album:               str("album"),
+		Timestamp:           timestamp,
+		Duration:            duration,
+		SpotifyID:           str("spotify_id"),
+		AlbumCover:          str("album_cover"),
+		CreatedAt:           createdAt,
+		Source:              str("source"),
+		YoutubeID:           str("youtube_id"),
+		YoutubeCategoryID:   str("youtube_category_id"),
+		SoundcloudID:        str("soundcloud_id"),
+		SoundcloudPermalink: str("soundcloud_permalink"),
+		ShazamID:            str("shazam_id"),
+		ShazamPermalink:     str("shazam_permalink"),
+		TrackMBID:           str("track_mbid"),
+		ArtistMBID:          str("artist_mbid"),
+		AlbumMBID:           str("album_mbid"),
+		Artists:             artists,
+	}, nil
+}
+
+// parseValue checks a json value against a field type, BigQuery writes
+// integers as strings so both are accepted
+func parseValue(fieldType bigquery.FieldType, raw interface{}) (interface{}, error) {
+	switch fieldType {
+	case bigquery.StringFieldType:
+		v, ok := raw.(string)
+		if !ok {
+			return nil, fmt.Errorf("%T is not a string", raw)
+		}
+		return v, nil
+	case bigquery.IntegerFieldType:
+		switch v := raw.(type) {
+		case string:
+			return strconv.ParseInt(v, 10, 64)
+		case float64:
+			return int64(v), nil
+		}
+		return nil, fmt.Errorf("%T is not an integer", raw)
+	case bigquery.TimestampFieldType:
+		v, ok := raw.(string)
+		if !ok {
+			return nil, fmt.Errorf("%T is not a timestamp", raw)
+		}
+		for _, format := range timestampFormats {
+			t, err := time.Parse(format, v)
+			if err == nil {
+				return t.UTC(), nil
+			}
+		}
+		return nil, fmt.Errorf("%q is not a timestamp", v)
+	}
+
+	return nil, fmt.Errorf("unsupported field type %s", fieldType)
+}
+
+// bigQueryTimestampFormat matches the timestamps in BigQuery json extracts
+const bigQueryTimestampFormat = "2006-01-02 15:04:05.999999 UTC"
+
+// ndjsonRow is a play in the format of a BigQuery json extract, integers are
+// strings and null values are left out
+type ndjsonRow struct {
+	Track     string `json:"track"`
+	Artist    string `json:"artist"`
+	Album     string `json:"album"`
+	Timestamp string `json:"timestamp"`
+	Duration  string `json:"duration,omitempty"`
+
+	SpotifyID  string `json:"spotify_id"`
+	AlbumCover string `json:"album_cover"`
+	CreatedAt  string `json:"created_at,omitempty"`
+	Source     string `json:"source"`
+
+	YoutubeID           string `json:"youtube_id"`
+	YoutubeCategoryID   string `json:"youtube_category_id"`
+	SoundcloudID        string `json:"soundcloud_id"`
+	SoundcloudPermalink string `json:"soundcloud_permalink"`
+	ShazamID            string `json:"shazam_id"`
+	ShazamPermalink     string `json:"shazam_permalink"`
+
+	// mbids are left out when unset to match backups taken before they were
+	// added
+	TrackMBID  string `json:"track_mbid,omitempty"`
+	ArtistMBID string `json:"artist_mbid,omitempty"`
+	AlbumMBID  string `json:"album_mbid,omitempty"`
+
+	Artists []string `json:"artists,omitempty"`
+}
+
+// Encoder writes plays as newline delimited json which can be read by a
+// Decoder or loaded into BigQuery
+type Encoder struct {
+	encoder *json.Encoder
+}
+
+// NewEncoder returns an encoder writing rows to w
+func NewEncoder(w io.Writer) *Encoder {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	return &Encoder{encoder: encoder}
+}
+
+// Encode writes a play as a single line
+func (e *Encoder) Encode(p store.Play) error {
+	row := ndjsonRow{
+		Track:               p.Track,
+		Artist:              p.Artist,
+		Album:               p.Album,
+		Timestamp:           p.Timestamp.UTC().Format(bigQueryTimestampFormat),
+		SpotifyID:           p.SpotifyID,
+		AlbumCover:          p.AlbumCover,
+		Source:              p.Source,
+		YoutubeID:           p.YoutubeID,
+		YoutubeCategoryID:   p.YoutubeCategoryID,
+		SoundcloudID:        p.SoundcloudID,
+		SoundcloudPermalink: p.SoundcloudPermalink,
+		ShazamID:            p.ShazamID,
+		ShazamPermalink:     p.ShazamPermalink,
+		TrackMBID:           p.TrackMBID,
+		ArtistMBID:          p.ArtistMBID,
+		AlbumMBID:           p.AlbumMBID,
+		Artists:             p.Artists,
+	}
+	if p.Duration != 0 {
+		row.Duration = strconv.FormatInt(p.Duration, 10)
+	}
+	if !p.CreatedAt.IsZero() {
+		row.CreatedAt = p.CreatedAt.UTC().Format(bigQueryTimestampFormat)
+	}
+
+	return e.encoder.Encode(row)
+}
@@ -0,0 +1,165 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+const restoreInsertBatchSize = 500
+
+// RestoreResult summarises the rows in a backup and what was, or in a dry run
+// would be, loaded
+type RestoreResult struct {
+	// Rows is the number of rows in the backup
+	Rows int
+	// Duplicates is the number of rows with the insert id of an earlier row
+	Duplicates int
+	// Existing is the number of rows already in the store
+	Existing int
+	// Inserted is the number of new plays saved, or to be saved in a dry run
+	Inserted int
+
+	// Sources is the number of new plays from each source
+	Sources map[string]int
+	// First and Last are the times of the oldest and newest new plays
+	First time.Time
+	Last  time.Time
+}
+
+// Open returns a reader for a backup at a gs://bucket/object uri or a local
+// file path
+func Open(ctx context.Context, uri, googleCredentialsJSON string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(uri, "gs://") {
+		return os.Open(uri)
+	}
+
+	bucket, object, ok := strings.Cut(strings.TrimPrefix(uri, "gs://"), "/")
+	if !ok || object == "" {
+		return nil, fmt.Errorf("invalid gcs uri: %s", uri)
+	}
+
+	return (&GCS{
+		BucketName:            bucket,
+		GoogleCredentialsJSON: googleCredentialsJSON,
+	}).Open(ctx, object)
+}
+
+// Restore loads the plays in a backup into the play store. The whole backup is
+// validated before any plays are saved. Rows are skipped when they have the
+// source and timestamp of an earlier row, or are already in the store, so
+// restoring into a table which has some of the plays is safe. Restored plays
+// keep their created_at, so build_index doesn't see them as new, their names
+// are added to index when it's set.
+func Restore(ctx context.Context, playStore store.PlayStore, index *store.NameIndex, r io.Reader, dryRun bool) (RestoreResult, error) {
+	result := RestoreResult{Sources: make(map[string]int)}
+
+	decoder, err := NewDecoder(r)
+	if err != nil {
+		return result, err
+	}
+
+	seen := make(map[store.PlayKey]bool)
+	var plays []store.Play
+	for {
+		play, err := decoder.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+		result.Rows++
+
+		key := restoreKey(play.Source, play.Timestamp)
+		if seen[key] {
+			result.Duplicates++
+			continue
+		}
+		seen[key] = true
+
+		plays = append(plays, play)
+	}
+
+	// find the plays already saved for each source in the backup's range
+	ranges := make(map[string][2]time.Time)
+	for _, p := range plays {
+		rng, ok := ranges[p.Source]
+		if !ok {
+			rng = [2]time.Time{p.Timestamp, p.Timestamp}
+		}
+		if p.Timestamp.Before(rng[0]) {
+			rng[0] = p.Timestamp
+		}
+		if p.Timestamp.After(rng[1]) {
+			rng[1] = p.Timestamp
+		}
+		ranges[p.Source] = rng
+	}
+	existing := make(map[store.PlayKey]bool)
+	for source, rng := range ranges {
+		timestamps, err := playStore.SourceTimestamps(ctx, source, rng[0], rng[1])
+		if err != nil {
+			return result, fmt.Errorf("failed to get existing timestamps: %v", err)
+		}
+		for _, t := range timestamps {
+			existing[restoreKey(source, t)] = true
+		}
+	}
+
+	var newPlays []store.Play
+	for _, p := range plays {
+		if existing[restoreKey(p.Source, p.Timestamp)] {
+			result.Existing++
+			continue
+		}
+		newPlays = append(newPlays, p)
+
+		result.Sources[p.Source]++
+		if result.First.IsZero() || p.Timestamp.Before(result.First) {
+			result.First = p.Timestamp
+		}
+		if p.Timestamp.After(result.Last) {
+			result.Last = p.Timestamp
+		}
+	}
+
+	if dryRun {
+		result.Inserted = len(newPlays)
+		return result, nil
+	}
+
+	for i := 0; i < len(newPlays); i += restoreInsertBatchSize {
+		end := i + restoreInsertBatchSize
+		if end > len(newPlays) {
+			end = len(newPlays)
+		}
+
+		err = playStore.InsertPlays(ctx, newPlays[i:end])
+		if err != nil {
+			return result, fmt.Errorf("failed to insert plays: %v", err)
+		}
+		result.Inserted += end - i
+
+		if index != nil {
+			_, err = index.AddPlays(ctx, newPlays[i:end])
+			if err != nil {
+				return result, fmt.Errorf("failed to index plays: %v", err)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// restoreKey identifies a play in a backup or the store. Timestamps are
+// compared to the second in UTC, like the insert ids of plays, so that they
+// match whatever precision and location the store returns.
+func restoreKey(source string, timestamp time.Time) store.PlayKey {
+	return store.PlayKey{Source: source, Timestamp: timestamp.UTC().Truncate(time.Second)}
+}
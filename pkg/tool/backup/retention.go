@@ -0,0 +1,114 @@
+package backup
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	namePrefix     = "plays-backup-"
+	nameTimeFormat = "2006-01-02-1504"
+
+	// LatestName is the backup which is replaced on each run
+	LatestName = namePrefix + "latest.json"
+	// ManifestName is the file listing the timestamped backups
+	ManifestName = namePrefix + "manifest.json"
+)
+
+// Name returns the name of a backup taken at t
+func Name(t time.Time) string {
+	return namePrefix + t.UTC().Format(nameTimeFormat) + ".json"
+}
+
+// ParseName returns the time of a timestamped backup, ok is false for other
+// names such as the latest backup or the manifest
+func ParseName(name string) (t time.Time, ok bool) {
+	if !strings.HasPrefix(name, namePrefix) || !strings.HasSuffix(name, ".json") {
+		return t, false
+	}
+
+	t, err := time.Parse(nameTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, namePrefix), ".json"))
+	if err != nil {
+		return t, false
+	}
+
+	return t, true
+}
+
+// Retention is how many timestamped backups to keep. A backup is kept when it
+// is the newest backup in one of the most recent Daily days, Weekly weeks or
+// Monthly months. When all are zero every backup is kept.
+type Retention struct {
+	Daily   int
+	Weekly  int
+	Monthly int
+}
+
+// Enabled is true when old backups should be removed
+func (r Retention) Enabled() bool {
+	return r.Daily > 0 || r.Weekly > 0 || r.Monthly > 0
+}
+
+// Expired returns the timestamped backups in names which are not kept
+func (r Retention) Expired(names []string) []string {
+	if !r.Enabled() {
+		return nil
+	}
+
+	type backup struct {
+		name string
+		t    time.Time
+	}
+	var backups []backup
+	for _, name := range names {
+		t, ok := ParseName(name)
+		if !ok {
+			continue
+		}
+		backups = append(backups, backup{name: name, t: t})
+	}
+
+	// newest first, so the first backup seen in a period is the one kept
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].t.After(backups[j].t)
+	})
+
+	periods := []struct {
+		count int
+		key   func(t time.Time) string
+	}{
+		{r.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{r.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{r.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+
+	keep := make(map[string]bool)
+	for _, period := range periods {
+		seen := make(map[string]bool)
+		for _, b := range backups {
+			if len(seen) >= period.count {
+				break
+			}
+			key := period.key(b.t)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			keep[b.name] = true
+		}
+	}
+
+	var expired []string
+	for _, b := range backups {
+		if !keep[b.name] {
+			expired = append(expired, b.name)
+		}
+	}
+
+	return expired
+}
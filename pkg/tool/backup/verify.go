@@ -0,0 +1,152 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+// Verification is the result of comparing a backup with the play store
+type Verification struct {
+	CheckedAt time.Time `json:"checked_at"`
+	OK        bool      `json:"ok"`
+	// Months is the number of months compared
+	Months     int             `json:"months"`
+	Mismatches []MonthMismatch `json:"mismatches,omitempty"`
+}
+
+// MonthMismatch is a month where the backup and play store differ
+type MonthMismatch struct {
+	Month      string `json:"month"`
+	BackupRows int    `json:"backup_rows"`
+	StoreRows  int    `json:"store_rows"`
+	BackupHash string `json:"backup_hash"`
+	StoreHash  string `json:"store_hash"`
+}
+
+// monthDigests collects a digest of each play in each month so that the
+// contents of a month can be compared regardless of row order
+type monthDigests struct {
+	cutoff time.Time
+	months map[string][][sha256.Size]byte
+	buf    bytes.Buffer
+}
+
+func newMonthDigests(cutoff time.Time) *monthDigests {
+	return &monthDigests{cutoff: cutoff, months: make(map[string][][sha256.Size]byte)}
+}
+
+func (m *monthDigests) add(p store.Play) error {
+	if !p.CreatedAt.IsZero() && p.CreatedAt.After(m.cutoff) {
+		return nil
+	}
+
+	// plays are hashed in their backup encoding, which is the same for a
+	// play read from the store and the same play read from a backup
+	m.buf.Reset()
+	err := NewEncoder(&m.buf).Encode(p)
+	if err != nil {
+		return err
+	}
+
+	month := p.Timestamp.UTC().Format("2006-01")
+	m.months[month] = append(m.months[month], sha256.Sum256(m.buf.Bytes()))
+
+	return nil
+}
+
+func (m *monthDigests) hash(month string) string {
+	digests := m.months[month]
+	if len(digests) == 0 {
+		return ""
+	}
+
+	sort.Slice(digests, func(i, j int) bool {
+		return bytes.Compare(digests[i][:], digests[j][:]) < 0
+	})
+
+	h := sha256.New()
+	for _, d := range digests {
+		h.Write(d[:])
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Verify compares the row count and content hash of each month in a backup
+// with the plays in the store. Plays created after cutoff are ignored in
+// both, so that plays saved since the backup was taken are not mismatches.
+func Verify(ctx context.Context, dest Destination, name string, playStore store.PlayStore, cutoff time.Time) (Verification, error) {
+	verification := Verification{CheckedAt: time.Now().UTC()}
+
+	r, err := dest.Open(ctx, name)
+	if err != nil {
+		return verification, err
+	}
+	defer r.Close()
+
+	decoder, err := NewDecoder(r)
+	if err != nil {
+		return verification, err
+	}
+
+	backupMonths := newMonthDigests(cutoff)
+	for {
+		p, err := decoder.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return verification, fmt.Errorf("failed to read backup: %v", err)
+		}
+
+		err = backupMonths.add(p)
+		if err != nil {
+			return verification, err
+		}
+	}
+
+	storeMonths := newMonthDigests(cutoff)
+	err = playStore.EachPlay(ctx, storeMonths.add)
+	if err != nil {
+		return verification, fmt.Errorf("failed to read plays: %v", err)
+	}
+
+	months := make(map[string]bool)
+	for month := range backupMonths.months {
+		months[month] = true
+	}
+	for month := range storeMonths.months {
+		months[month] = true
+	}
+	var sorted []string
+	for month := range months {
+		sorted = append(sorted, month)
+	}
+	sort.Strings(sorted)
+
+	for _, month := range sorted {
+		mismatch := MonthMismatch{
+			Month:      month,
+			BackupRows: len(backupMonths.months[month]),
+			StoreRows:  len(storeMonths.months[month]),
+			BackupHash: backupMonths.hash(month),
+			StoreHash:  storeMonths.hash(month),
+		}
+		if mismatch.BackupRows != mismatch.StoreRows || mismatch.BackupHash != mismatch.StoreHash {
+			verification.Mismatches = append(verification.Mismatches, mismatch)
+		}
+	}
+
+	verification.Months = len(sorted)
+	verification.OK = len(verification.Mismatches) == 0
+
+	return verification, nil
+}
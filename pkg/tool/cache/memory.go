@@ -65,3 +65,14 @@ func (s Storage) Set(key string, content []byte, duration time.Duration) {
 
 	fmt.Printf("Total cache size: %dmb\n", totalBytes/1024/1024)
 }
+
+// Clear removes all cached content, it's used when changes to plays affect
+// pages which are already cached
+func (s Storage) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range s.items {
+		delete(s.items, key)
+	}
+}
@@ -25,7 +25,11 @@ func Middleware(duration string, storage *Storage, handler func(w http.ResponseW
 			w.WriteHeader(c.Code)
 			content := c.Body.Bytes()
 
-			if d, err := time.ParseDuration(duration); err == nil {
+			// errors, redirects and not found pages aren't cached as only the
+			// body is kept
+			if c.Code != http.StatusOK {
+				fmt.Printf("Page not cached. status: %d\n", c.Code)
+			} else if d, err := time.ParseDuration(duration); err == nil {
 				fmt.Printf("New page cached: %s for %s\n", r.RequestURI, duration)
 				storage.Set(r.RequestURI, content, d)
 			} else {
@@ -0,0 +1,98 @@
+package events
+
+import (
+	"sync"
+
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+// backlogSize is the number of recent events kept for subscribers which
+// reconnect and ask for the events they missed
+const backlogSize = 100
+
+// subscriberBuffer is the number of events a subscriber can fall behind by
+// before events are dropped for it
+const subscriberBuffer = 50
+
+// Event is a play which has been saved to the play store
+type Event struct {
+	// ID increases with each event published since the process started
+	ID   uint64
+	Play store.Play
+}
+
+// Bus passes newly saved plays to subscribers in the same process. A nil Bus
+// can be used and drops all events.
+type Bus struct {
+	mu          sync.Mutex
+	lastID      uint64
+	backlog     []Event
+	subscribers map[chan Event]struct{}
+}
+
+// New returns an empty bus
+func New() *Bus {
+	return &Bus{subscribers: make(map[chan Event]struct{})}
+}
+
+// Publish sends an event for each play to the current subscribers. Publishing
+// never blocks, a subscriber which isn't keeping up misses events.
+func (b *Bus) Publish(plays ...store.Play) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, p := range plays {
+		b.lastID++
+		e := Event{ID: b.lastID, Play: p}
+
+		b.backlog = append(b.backlog, e)
+		if len(b.backlog) > backlogSize {
+			b.backlog = b.backlog[len(b.backlog)-backlogSize:]
+		}
+
+		for ch := range b.subscribers {
+			select {
+			case ch <- e:
+			default:
+			}
+		}
+	}
+}
+
+// Subscribe returns the kept events after lastID, a channel of new events
+// and a function to call when the subscriber is done. A lastID of 0 returns
+// no backlog.
+func (b *Bus) Subscribe(lastID uint64) ([]Event, <-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+	if b == nil {
+		return nil, ch, func() {}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var backlog []Event
+	// an id from before a restart is ignored as the ids have started again
+	if lastID > 0 && lastID <= b.lastID {
+		for _, e := range b.backlog {
+			if e.ID > lastID {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+
+	b.subscribers[ch] = struct{}{}
+
+	var once sync.Once
+	return backlog, ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			delete(b.subscribers, ch)
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+// Sender sends plays to a service outside the play store
+type Sender interface {
+	Send(ctx context.Context, plays []store.Play) error
+}
+
+// Target is a configured destination for plays, Name identifies the cursor
+// and dead letters of the target so it must not change
+type Target struct {
+	Name   string
+	Sender Sender
+	// Sources limits the plays sent to those from these sources, all plays
+	// are sent when empty
+	Sources []string
+}
+
+// Forwards is true when a play should be sent to the target
+func (t Target) Forwards(p store.Play) bool {
+	if len(t.Sources) == 0 {
+		return true
+	}
+	for _, s := range t.Sources {
+		if s == p.Source {
+			return true
+		}
+	}
+	return false
+}
+
+// StatusError is returned when a target responds with an unexpected status
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d: %s", e.StatusCode, e.Body)
+}
+
+// Permanent is true when an error will not be fixed by sending the same plays
+// again, such as a client error other than rate limiting. Network errors and
+// server errors are temporary.
+func Permanent(err error) bool {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+
+	return statusErr.StatusCode >= 400 &&
+		statusErr.StatusCode < 500 &&
+		statusErr.StatusCode != http.StatusTooManyRequests
+}
+
+// do sends a request and returns a StatusError for non 2xx responses
+func do(client *http.Client, req *http.Request) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &StatusError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+// DefaultListenBrainzEndpoint is the public ListenBrainz api
+const DefaultListenBrainzEndpoint = "https://api.listenbrainz.org"
+
+// ListenBrainz submits plays as listens to the ListenBrainz api, or any
+// server implementing POST /1/submit-listens
+type ListenBrainz struct {
+	// Endpoint defaults to DefaultListenBrainzEndpoint
+	Endpoint string
+	Token    string
+
+	Client *http.Client
+}
+
+type listenBrainzListen struct {
+	ListenedAt    int64                     `json:"listened_at"`
+	TrackMetadata listenBrainzTrackMetadata `json:"track_metadata"`
+}
+
+type listenBrainzTrackMetadata struct {
+	ArtistName     string                 `json:"artist_name"`
+	TrackName      string                 `json:"track_name"`
+	ReleaseName    string                 `json:"release_name,omitempty"`
+	AdditionalInfo map[string]interface{} `json:"additional_info"`
+}
+
+func (l *ListenBrainz) Send(ctx context.Context, plays []store.Play) error {
+	if len(plays) == 0 {
+		return nil
+	}
+
+	listenType := "import"
+	if len(plays) == 1 {
+		listenType = "single"
+	}
+
+	var payload []listenBrainzListen
+	for _, p := range plays {
+		info := map[string]interface{}{
+			"submission_client": "music",
+			"music_service":     p.Source,
+		}
+		if p.Duration != 0 {
+			info["duration_ms"] = p.Duration
+		}
+		if p.SpotifyID != "" {
+			info["spotify_id"] = "https://open.spotify.com/track/" + p.SpotifyID
+		}
+		if p.TrackMBID != "" {
+			info["recording_mbid"] = p.TrackMBID
+		}
+		if p.AlbumMBID != "" {
+			info["release_mbid"] = p.AlbumMBID
+		}
+		if p.ArtistMBID != "" {
+			info["artist_mbids"] = []string{p.ArtistMBID}
+		}
+
+		payload = append(payload, listenBrainzListen{
+			ListenedAt: p.Timestamp.Unix(),
+			TrackMetadata: listenBrainzTrackMetadata{
+				ArtistName:     p.Artist,
+				TrackName:      p.Track,
+				ReleaseName:    p.Album,
+				AdditionalInfo: info,
+			},
+		})
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"listen_type": listenType,
+		"payload":     payload,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode listens: %v", err)
+	}
+
+	endpoint := l.Endpoint
+	if endpoint == "" {
+		endpoint = DefaultListenBrainzEndpoint
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		strings.TrimSuffix(endpoint, "/")+"/1/submit-listens",
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Token "+l.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	return do(l.Client, req)
+}
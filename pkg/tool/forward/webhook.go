@@ -0,0 +1,89 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+// SignatureHeader holds the hex hmac-sha256 of the request body when a
+// webhook has a secret
+const SignatureHeader = "X-Music-Signature"
+
+// Webhook posts plays as json to a url
+type Webhook struct {
+	URL string
+	// Secret is used to sign the request body, requests are unsigned when empty
+	Secret string
+
+	Client *http.Client
+}
+
+type webhookPlay struct {
+	Track     string    `json:"track"`
+	Artist    string    `json:"artist"`
+	Album     string    `json:"album"`
+	Timestamp time.Time `json:"timestamp"`
+	// Duration is in ms
+	Duration  int64     `json:"duration,omitempty"`
+	Source    string    `json:"source"`
+	CreatedAt time.Time `json:"created_at"`
+
+	SpotifyID  string `json:"spotify_id,omitempty"`
+	TrackMBID  string `json:"track_mbid,omitempty"`
+	ArtistMBID string `json:"artist_mbid,omitempty"`
+	AlbumMBID  string `json:"album_mbid,omitempty"`
+
+	Artists []string `json:"artists"`
+}
+
+func (wh *Webhook) Send(ctx context.Context, plays []store.Play) error {
+	if len(plays) == 0 {
+		return nil
+	}
+
+	var rows []webhookPlay
+	for _, p := range plays {
+		rows = append(rows, webhookPlay{
+			Track:      p.Track,
+			Artist:     p.Artist,
+			Album:      p.Album,
+			Timestamp:  p.Timestamp.UTC(),
+			Duration:   p.Duration,
+			Source:     p.Source,
+			CreatedAt:  p.CreatedAt.UTC(),
+			SpotifyID:  p.SpotifyID,
+			TrackMBID:  p.TrackMBID,
+			ArtistMBID: p.ArtistMBID,
+			AlbumMBID:  p.AlbumMBID,
+			Artists:    p.CreditedArtists(),
+		})
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"plays": rows})
+	if err != nil {
+		return fmt.Errorf("failed to encode plays: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if wh.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(wh.Secret))
+		mac.Write(body)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	return do(wh.Client, req)
+}
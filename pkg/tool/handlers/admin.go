@@ -0,0 +1,495 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charlieegan3/music/pkg/tool/cache"
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+// AdminUser can change how plays are shown using a token, the name is logged
+// with each change
+type AdminUser struct {
+	Name  string
+	Token string
+}
+
+// adminMaxBody limits the size of admin requests
+const adminMaxBody = 1024 * 1024
+
+// BuildArtistAliasesHandler lists the artist aliases as json
+func BuildArtistAliasesHandler(aliases *store.Aliases, users []AdminUser) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminUser(r, users) == nil {
+			writeAdminUnauthorized(w)
+			return
+		}
+
+		list, err := aliases.List(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if list == nil {
+			list = []store.ArtistAlias{}
+		}
+
+		writeAdminJSON(w, struct {
+			Aliases []store.ArtistAlias `json:"aliases"`
+		}{Aliases: list})
+	}
+}
+
+type artistMergeRequest struct {
+	// Artist is the canonical name the other names are counted as
+	Artist string   `json:"artist"`
+	Names  []string `json:"names"`
+}
+
+// BuildArtistMergeHandler merges artist names into a canonical artist, the
+// page cache is cleared so that counts are updated straight away
+func BuildArtistMergeHandler(aliases *store.Aliases, pageCache *cache.Storage, users []AdminUser) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := adminUser(r, users)
+		if user == nil {
+			writeAdminUnauthorized(w)
+			return
+		}
+
+		var req artistMergeRequest
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, adminMaxBody)).Decode(&req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("failed to parse request: %v", err)))
+			return
+		}
+		if strings.TrimSpace(req.Artist) == "" || len(req.Names) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("artist and names are required"))
+			return
+		}
+
+		merged, err := aliases.Merge(r.Context(), req.Artist, req.Names)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		pageCache.Clear()
+
+		log.Printf("%s merged %q into %q", user.Name, req.Names, req.Artist)
+
+		writeAdminJSON(w, struct {
+			Artist  string              `json:"artist"`
+			Aliases []store.ArtistAlias `json:"aliases"`
+		}{Artist: req.Artist, Aliases: merged})
+	}
+}
+
+type artistUnmergeRequest struct {
+	Names []string `json:"names"`
+}
+
+// BuildArtistUnmergeHandler removes aliases so that the names are counted as
+// separate artists again
+func BuildArtistUnmergeHandler(aliases *store.Aliases, pageCache *cache.Storage, users []AdminUser) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := adminUser(r, users)
+		if user == nil {
+			writeAdminUnauthorized(w)
+			return
+		}
+
+		var req artistUnmergeRequest
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, adminMaxBody)).Decode(&req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("failed to parse request: %v", err)))
+			return
+		}
+
+		removed, err := aliases.Remove(r.Context(), req.Names)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		pageCache.Clear()
+
+		log.Printf("%s removed %d aliases of %q", user.Name, removed, req.Names)
+
+		writeAdminJSON(w, struct {
+			Removed int64 `json:"removed"`
+		}{Removed: removed})
+	}
+}
+
+// BuildExclusionsHandler lists the play exclusion rules as json
+func BuildExclusionsHandler(exclusions *store.Exclusions, users []AdminUser) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminUser(r, users) == nil {
+			writeAdminUnauthorized(w)
+			return
+		}
+
+		list, err := exclusions.List(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		writeAdminJSON(w, struct {
+			Exclusions []store.Exclusion `json:"exclusions"`
+		}{Exclusions: list})
+	}
+}
+
+// BuildExclusionAddHandler saves a play exclusion rule, the page cache is
+// cleared so that counts are updated straight away
+func BuildExclusionAddHandler(exclusions *store.Exclusions, pageCache *cache.Storage, users []AdminUser) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := adminUser(r, users)
+		if user == nil {
+			writeAdminUnauthorized(w)
+			return
+		}
+
+		var req store.Exclusion
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, adminMaxBody)).Decode(&req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("failed to parse request: %v", err)))
+			return
+		}
+		if req.Empty() {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("one of artist, album, track, source, shorter_than_ms or longer_than_ms is required"))
+			return
+		}
+
+		exclusion, err := exclusions.Add(r.Context(), req)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		pageCache.Clear()
+
+		log.Printf("%s added play exclusion %d", user.Name, exclusion.ID)
+
+		writeAdminJSON(w, exclusion)
+	}
+}
+
+type exclusionRemoveRequest struct {
+	ID int64 `json:"id"`
+}
+
+// BuildExclusionRemoveHandler deletes a play exclusion rule
+func BuildExclusionRemoveHandler(exclusions *store.Exclusions, pageCache *cache.Storage, users []AdminUser) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := adminUser(r, users)
+		if user == nil {
+			writeAdminUnauthorized(w)
+			return
+		}
+
+		var req exclusionRemoveRequest
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, adminMaxBody)).Decode(&req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("failed to parse request: %v", err)))
+			return
+		}
+
+		removed, err := exclusions.Remove(r.Context(), req.ID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if !removed {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmt.Sprintf("no play exclusion with id %d", req.ID)))
+			return
+		}
+		pageCache.Clear()
+
+		log.Printf("%s removed play exclusion %d", user.Name, req.ID)
+
+		writeAdminJSON(w, struct {
+			ID      int64 `json:"id"`
+			Removed bool  `json:"removed"`
+		}{ID: req.ID, Removed: true})
+	}
+}
+
+// adminAuditLimit is the number of audit entries listed by default
+const adminAuditLimit = 50
+
+// BuildAuditLogHandler lists the most recent changes made to plays as json,
+// the limit param sets the number listed
+func BuildAuditLogHandler(audit *store.AuditLog, users []AdminUser) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminUser(r, users) == nil {
+			writeAdminUnauthorized(w)
+			return
+		}
+
+		limit := adminAuditLimit
+		if v := r.URL.Query().Get("limit"); v != "" {
+			var err error
+			limit, err = strconv.Atoi(v)
+			if err != nil || limit < 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("limit must be a positive number"))
+				return
+			}
+		}
+
+		entries, err := audit.List(r.Context(), limit)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		writeAdminJSON(w, struct {
+			Entries []store.AuditEntry `json:"entries"`
+		}{Entries: entries})
+	}
+}
+
+// playRequest identifies a play, plays are unique by source and timestamp
+type playRequest struct {
+	Source    string    `json:"source"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func (p playRequest) key() store.PlayKey {
+	return store.PlayKey{Source: p.Source, Timestamp: p.Timestamp}
+}
+
+type playEditRequest struct {
+	playRequest
+	store.PlayNames
+}
+
+// BuildPlayEditHandler sets the artist, album or track of a play, fields
+// missing from the request are unchanged
+func BuildPlayEditHandler(editor *store.PlayEditor, pageCache *cache.Storage, users []AdminUser) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := adminUser(r, users)
+		if user == nil {
+			writeAdminUnauthorized(w)
+			return
+		}
+
+		var req playEditRequest
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, adminMaxBody)).Decode(&req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("failed to parse request: %v", err)))
+			return
+		}
+		if req.Source == "" || req.Timestamp.IsZero() || req.PlayNames == (store.PlayNames{}) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("source, timestamp and one of artist, album or track are required"))
+			return
+		}
+
+		entry, err := editor.Edit(r.Context(), user.Name, req.key(), req.PlayNames)
+		if err != nil {
+			writeAdminPlayError(w, err)
+			return
+		}
+		pageCache.Clear()
+
+		log.Printf("%s edited the %s play at %s", user.Name, req.Source, req.Timestamp.Format(time.RFC3339))
+
+		writeAdminJSON(w, entry)
+	}
+}
+
+// BuildPlayDeleteHandler removes a play
+func BuildPlayDeleteHandler(editor *store.PlayEditor, pageCache *cache.Storage, users []AdminUser) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := adminUser(r, users)
+		if user == nil {
+			writeAdminUnauthorized(w)
+			return
+		}
+
+		var req playRequest
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, adminMaxBody)).Decode(&req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("failed to parse request: %v", err)))
+			return
+		}
+		if req.Source == "" || req.Timestamp.IsZero() {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("source and timestamp are required"))
+			return
+		}
+
+		entry, err := editor.Delete(r.Context(), user.Name, req.key())
+		if err != nil {
+			writeAdminPlayError(w, err)
+			return
+		}
+		pageCache.Clear()
+
+		log.Printf("%s deleted the %s play at %s", user.Name, req.Source, req.Timestamp.Format(time.RFC3339))
+
+		writeAdminJSON(w, entry)
+	}
+}
+
+type playPrivateRequest struct {
+	playRequest
+	Private bool `json:"private"`
+}
+
+// BuildPlayPrivateHandler hides a play from visitors who aren't signed in, or
+// shows it again when private is false
+func BuildPlayPrivateHandler(editor *store.PlayEditor, pageCache *cache.Storage, users []AdminUser) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := adminUser(r, users)
+		if user == nil {
+			writeAdminUnauthorized(w)
+			return
+		}
+
+		var req playPrivateRequest
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, adminMaxBody)).Decode(&req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("failed to parse request: %v", err)))
+			return
+		}
+		if req.Source == "" || req.Timestamp.IsZero() {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("source and timestamp are required"))
+			return
+		}
+
+		entry, err := editor.SetPrivate(r.Context(), user.Name, req.key(), req.Private)
+		if err != nil {
+			writeAdminPlayError(w, err)
+			return
+		}
+		pageCache.Clear()
+
+		log.Printf("%s made the %s play at %s %s", user.Name, req.Source, req.Timestamp.Format(time.RFC3339), entry.Action)
+
+		writeAdminJSON(w, entry)
+	}
+}
+
+type playRewriteRequest struct {
+	// Field is artist, album or track
+	Field   string `json:"field"`
+	Pattern string `json:"pattern"`
+	Replace string `json:"replace"`
+	// Artist limits the rewrite to plays with the artist string
+	Artist string `json:"artist"`
+	DryRun bool   `json:"dry_run"`
+}
+
+// BuildPlayRewriteHandler replaces a regular expression in the artist, album
+// or track of all matching plays. With dry_run the changes are listed but not
+// made.
+func BuildPlayRewriteHandler(editor *store.PlayEditor, pageCache *cache.Storage, users []AdminUser) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := adminUser(r, users)
+		if user == nil {
+			writeAdminUnauthorized(w)
+			return
+		}
+
+		var req playRewriteRequest
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, adminMaxBody)).Decode(&req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("failed to parse request: %v", err)))
+			return
+		}
+
+		rewrite, err := store.NewRewrite(req.Field, req.Pattern, req.Replace, req.Artist)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		entry, err := editor.Rewrite(r.Context(), user.Name, rewrite, req.DryRun)
+		if err != nil {
+			writeAdminPlayError(w, err)
+			return
+		}
+		if req.DryRun {
+			writeAdminJSON(w, struct {
+				DryRun  bool                `json:"dry_run"`
+				Details string              `json:"details"`
+				Changes []store.AuditChange `json:"changes"`
+			}{DryRun: true, Details: entry.Details, Changes: entry.Changes})
+			return
+		}
+		pageCache.Clear()
+
+		log.Printf("%s rewrote %d tracks, %s", user.Name, len(entry.Changes), entry.Details)
+
+		writeAdminJSON(w, entry)
+	}
+}
+
+func writeAdminPlayError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, store.ErrPlayNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, store.ErrPlayTooRecent):
+		w.WriteHeader(http.StatusConflict)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.Write([]byte(err.Error()))
+}
+
+// adminUser returns the user for the bearer token in the Authorization header
+func adminUser(r *http.Request, users []AdminUser) *AdminUser {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	token = strings.TrimSpace(token)
+	if !strings.EqualFold(scheme, "bearer") || token == "" {
+		return nil
+	}
+
+	return findAdminUser(token, users)
+}
+
+func writeAdminUnauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte("a valid admin token is required"))
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
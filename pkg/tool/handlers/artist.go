@@ -5,173 +5,120 @@ import (
 	"fmt"
 	"math"
 	"net/http"
+	"sort"
 	"strings"
 
-	"cloud.google.com/go/bigquery"
-	"github.com/doug-martin/goqu/v9"
 	"github.com/foolin/goview"
-	"github.com/gorilla/mux"
-	"google.golang.org/api/iterator"
-	"google.golang.org/api/option"
 
+	"github.com/charlieegan3/music/pkg/tool/store"
 	"github.com/charlieegan3/music/pkg/tool/utils"
 )
 
-func BuildArtistHandler(db *sql.DB, projectID, datasetName, tablename, googleJSON string) func(http.ResponseWriter, *http.Request) {
+func BuildArtistHandler(db *sql.DB, playStore store.PlayStore) func(http.ResponseWriter, *http.Request) {
 
-	goquDB := goqu.New("postgres", db)
+	aliases := store.NewAliases(db)
+	index := store.NewNameIndex(db)
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		artistSlug, ok := mux.Vars(r)["artistSlug"]
+		resolved, ok := resolveSlugs(w, r, index, "artistSlug")
 		if !ok {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("invalid URL"))
 			return
 		}
+		artist := resolved[0]
+		artistName := artist.Name
 
-		parts := strings.Split(artistSlug, "-")
-		if len(parts) < 2 {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("invalid URL"))
-			return
-		}
-
-		artistID := parts[0]
-
-		var artistName string
-		_, err := goquDB.Select("name").
-			From("music.name_index").
-			Where(goqu.C("id").Eq(artistID)).ScanVal(&artistName)
+		// a name merged into another artist shows the other artist's page
+		canonical, found, err := aliases.Canonical(r.Context(), artistName)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
 			return
 		}
+		if found {
+			artistName = canonical
+			indexed, _, err := index.Find(r.Context(), artistName)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			artist.ArtistMBID = indexed.ArtistMBID
+		}
 
-		bigqueryClient, err := bigquery.NewClient(
-			r.Context(),
-			projectID,
-			option.WithCredentialsJSON([]byte(googleJSON)),
-		)
+		// plays of aliases are counted by the store as the canonical artist
+		merged, err := aliases.Merged(r.Context(), artistName)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
 			return
 		}
 
-		queryString := fmt.Sprintf(`
-select artist, album, track, count(track) as count from %s
-where STARTS_WITH(artist, @artistName) or contains_substr(artist, @artistNameWithComma)
-group by artist, album, track
-order by count desc
-`,
-			fmt.Sprintf(
-				"`%s.%s.%s`",
-				projectID,
-				datasetName,
-				tablename,
-			),
-		)
-		q := bigqueryClient.Query(queryString)
-		q.Parameters = []bigquery.QueryParameter{
-			{
-				Name:  "artistName",
-				Value: artistName,
-			},
-			{
-				Name:  "artistNameWithComma",
-				Value: fmt.Sprintf(", %s", artistName),
-			},
+		// names saved with the same MusicBrainz id are the same artist, such
+		// as a name with different spelling or accents
+		names := []string{artistName}
+		if artist.ArtistMBID != "" {
+			otherNames, err := index.ArtistsWithMBID(r.Context(), artist.ArtistMBID)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			for _, name := range otherNames {
+				if name != artistName && !contains(merged, name) {
+					names = append(names, name)
+				}
+			}
 		}
 
-		it, err := q.Read(r.Context())
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-			return
-		}
 		var rows []artistTrackRow
 		var total int64
-		for {
-			var r artistTrackRow
-			err := it.Next(&r)
-			if err == iterator.Done {
-				break
-			}
+		seen := make(map[string]bool)
+		for _, name := range names {
+			counts, err := playStore.ArtistTracks(r.Context(), name)
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				w.Write([]byte(err.Error()))
 				return
 			}
 
-			r.Artwork = fmt.Sprintf(
-				"/artworks/%s/%s.jpg",
-				utils.CRC32Hash(r.Artist),
-				utils.CRC32Hash(r.Album),
-			)
-
-			for _, a := range strings.Split(r.Artist, ", ") {
-				if a != artistName {
-					r.Artists = append(r.Artists, a)
+			for _, c := range counts {
+				// a track can match more than one name, such as a collaboration
+				key := strings.Join([]string{c.Artist, c.Album, c.Track}, "\x00")
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+
+				row := artistTrackRow{
+					Name:   name,
+					Album:  c.Album,
+					Artist: c.Artist,
+					Track:  c.Track,
+					Count:  c.Count,
 				}
-			}
 
-			total += r.Count
+				row.Artwork = fmt.Sprintf(
+					"/artworks/%s/%s.jpg",
+					utils.CRC32Hash(row.Artist),
+					utils.CRC32Hash(row.Album),
+				)
 
-			rows = append(rows, r)
-		}
+				for _, a := range c.CreditedArtists() {
+					if !contains(names, a) {
+						row.Artists = append(row.Artists, a)
+					}
+				}
 
-		queryString = fmt.Sprintf(`
-WITH
-  artists AS (
-  SELECT
-    artist,
-    COUNT(track) AS count
-  FROM
-    %s
-  GROUP BY
-    artist
-  ORDER BY
-    count DESC ),
-  ranks AS (
-  SELECT
-    ROW_NUMBER() OVER (ORDER BY count DESC) AS rank,
-    artist,
-    count
-  FROM
-    artists
-  ORDER BY
-    count DESC)
-SELECT
-  artist,
-  rank
-FROM
-  ranks
-WHERE
-  STARTS_WITH(artist, @artistName) 
-  OR CONTAINS_SUBSTR(artist, @artistNameWithComma)
-`,
-			fmt.Sprintf(
-				"`%s.%s.%s`",
-				projectID,
-				datasetName,
-				tablename,
-			),
-		)
+				total += row.Count
 
-		q = bigqueryClient.Query(queryString)
-		q.Parameters = []bigquery.QueryParameter{
-			{
-				Name:  "artistName",
-				Value: artistName,
-			},
-			{
-				Name:  "artistNameWithComma",
-				Value: fmt.Sprintf(", %s", artistName),
-			},
+				rows = append(rows, row)
+			}
 		}
+		sort.SliceStable(rows, func(i, j int) bool {
+			return rows[i].Count > rows[j].Count
+		})
 
-		it, err = q.Read(r.Context())
+		artistRanks, err := playStore.ArtistRanks(r.Context(), artistName)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
@@ -182,21 +129,7 @@ WHERE
 		var best int64
 		best = math.MaxInt64
 		isPrimaryArtist := true
-		for {
-			var row struct {
-				Rank   int64
-				Artist string
-			}
-			err = it.Next(&row)
-			if err == iterator.Done {
-				break
-			}
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(err.Error()))
-				return
-			}
-
+		for _, row := range artistRanks {
 			ranks = append(ranks, row.Rank)
 
 			if row.Artist != artistName {
@@ -222,6 +155,8 @@ WHERE
 			"artist",
 			goview.M{
 				"ArtistName": artistName,
+				"MBID":       artist.ArtistMBID,
+				"OtherNames": append(merged, names[1:]...),
 				"Tracks":     rows,
 				"Total":      total,
 				"Rank":       rankString,
@@ -235,6 +170,8 @@ WHERE
 }
 
 type artistTrackRow struct {
+	// Name is the artist name the track was found by
+	Name    string
 	Album   string
 	Artist  string
 	Artists []string
@@ -242,3 +179,12 @@ type artistTrackRow struct {
 	Artwork string
 	Count   int64
 }
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
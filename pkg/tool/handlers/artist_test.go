@@ -0,0 +1,69 @@
+package handlers_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/charlieegan3/music/pkg/tool"
+	"github.com/charlieegan3/music/pkg/tool/handlers"
+	"github.com/charlieegan3/music/pkg/tool/jobs"
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+func TestArtistIncludesAliasesAndMBIDNames(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := tool.OpenSQLite(filepath.Join(t.TempDir(), "music.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	timestamp := time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)
+	playStore := store.NewSQLite(db)
+	err = playStore.InsertPlays(ctx, []store.Play{
+		{Artist: "Beyoncé", Album: "I Am... Sasha Fierce", Track: "Halo", Source: "lastfm", Timestamp: timestamp, ArtistMBID: "859d0860"},
+		{Artist: "Beyonce", Album: "Dangerously in Love", Track: "Crazy in Love", Source: "lastfm", Timestamp: timestamp.Add(time.Hour), ArtistMBID: "859d0860"},
+		{Artist: "Sasha Fierce", Album: "I Am... Sasha Fierce", Track: "Single Ladies", Source: "lastfm", Timestamp: timestamp.Add(2 * time.Hour)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.NewAliases(db).Merge(ctx, "Beyoncé", []string{"Sasha Fierce"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = (&jobs.BuildIndex{DB: db, Store: playStore}).Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alias, found, err := store.NewNameIndex(db).Find(ctx, "Sasha Fierce")
+	if err != nil || !found {
+		t.Fatalf("expected the alias to be indexed: %v", err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/artists/{artistSlug}", handlers.BuildArtistHandler(db, playStore))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/artists/"+alias.Slug(), nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	body := w.Body.String()
+	// the alias shows the canonical artist, with the plays of the name saved
+	// with the same MusicBrainz id
+	for _, expected := range []string{"<title>Music - Beyoncé</title>", "Halo", "Single Ladies", "Crazy in Love", "musicbrainz.org/artist/859d0860"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected the page to contain %q", expected)
+		}
+	}
+}
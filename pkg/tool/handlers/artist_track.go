@@ -4,146 +4,44 @@ import (
 	"database/sql"
 	"fmt"
 	"net/http"
-	"strings"
 	"time"
 
-	"cloud.google.com/go/bigquery"
-	"github.com/doug-martin/goqu/v9"
 	"github.com/dustin/go-humanize"
 	"github.com/foolin/goview"
-	"github.com/gorilla/mux"
-	"google.golang.org/api/iterator"
-	"google.golang.org/api/option"
 
+	"github.com/charlieegan3/music/pkg/tool/store"
 	"github.com/charlieegan3/music/pkg/tool/utils"
 )
 
-func BuildArtistTrackHandler(db *sql.DB, projectID, datasetName, tablename, googleJSON string) func(http.ResponseWriter, *http.Request) {
+func BuildArtistTrackHandler(db *sql.DB, playStore store.PlayStore) func(http.ResponseWriter, *http.Request) {
 
-	goquDB := goqu.New("postgres", db)
+	index := store.NewNameIndex(db)
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		var err error
 
-		artistSlug, ok := mux.Vars(r)["artistSlug"]
+		names, ok := resolveSlugs(w, r, index, "artistSlug", "trackSlug")
 		if !ok {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("invalid URL"))
-			return
-		}
-
-		artistParts := strings.Split(artistSlug, "-")
-		if len(artistParts) < 2 {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("invalid URL"))
-			return
-		}
-
-		trackSlug, ok := mux.Vars(r)["trackSlug"]
-		if !ok {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("invalid URL"))
-			return
-		}
-
-		trackParts := strings.Split(trackSlug, "-")
-		if len(trackParts) < 2 {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("invalid URL"))
-			return
-		}
-
-		artistID := artistParts[0]
-		trackID := trackParts[0]
-
-		var artistName string
-		_, err = goquDB.Select("name").
-			From("music.name_index").
-			Where(goqu.C("id").Eq(artistID)).ScanVal(&artistName)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
 			return
 		}
+		artistName := names[0].Name
+		trackName := names[1].Name
 
-		var trackName string
-		_, err = goquDB.Select("name").
-			From("music.name_index").
-			Where(goqu.C("id").Eq(trackID)).ScanVal(&trackName)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-			return
-		}
-
-		bigqueryClient, err := bigquery.NewClient(
-			r.Context(),
-			projectID,
-			option.WithCredentialsJSON([]byte(googleJSON)),
-		)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-			return
-		}
-
-		queryString := fmt.Sprintf(`
-SELECT
-  artist,
-  album,
-  timestamp
-FROM
-  %s
-WHERE
-  (STARTS_WITH(artist, @artistName)
-    OR CONTAINS_SUBSTR(artist, @artistNameWithComma))
-  AND ( track = @trackName )
-ORDER BY
-  timestamp desc
-`,
-			fmt.Sprintf(
-				"`%s.%s.%s`",
-				projectID,
-				datasetName,
-				tablename,
-			),
-		)
-		q := bigqueryClient.Query(queryString)
-		q.Parameters = []bigquery.QueryParameter{
-			{
-				Name:  "artistName",
-				Value: artistName,
-			},
-			{
-				Name:  "artistNameWithComma",
-				Value: fmt.Sprintf(", %s", artistName),
-			},
-			{
-				Name:  "trackName",
-				Value: trackName,
-			},
-		}
-
-		it, err := q.Read(r.Context())
+		plays, err := playStore.ArtistTrackPlays(r.Context(), artistName, trackName)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
 			return
 		}
 		var rows []artistSingleTrackRow
-		for {
-			var r artistSingleTrackRow
-			err := it.Next(&r)
-			if err == iterator.Done {
-				break
-			}
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(err.Error()))
-				return
+		for _, p := range plays {
+			r := artistSingleTrackRow{
+				Artist:    p.Artist,
+				Album:     p.Album,
+				Timestamp: p.Timestamp,
 			}
 
-			for _, a := range strings.Split(r.Artist, ", ") {
+			for _, a := range p.CreditedArtists() {
 				if a != artistName {
 					r.Artists = append(r.Artists, a)
 				}
@@ -0,0 +1,417 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charlieegan3/music/pkg/tool/events"
+	"github.com/charlieegan3/music/pkg/tool/nowplaying"
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+// ScrobbleClient is an application allowed to submit plays, plays are saved
+// with the client name as their source
+type ScrobbleClient struct {
+	Name         string
+	APIKey       string
+	SharedSecret string
+}
+
+// error codes from the last.fm api docs
+const (
+	lfmErrorInvalidMethod     = 3
+	lfmErrorAuthFailed        = 4
+	lfmErrorInvalidParameters = 6
+	lfmErrorInvalidSession    = 9
+	lfmErrorInvalidAPIKey     = 10
+	lfmErrorServiceOffline    = 11
+	lfmErrorInvalidSignature  = 13
+)
+
+// lfmServiceOffline is the message sent with lfmErrorServiceOffline, errors
+// saving plays are logged rather than sent to clients
+const lfmServiceOffline = "Service Offline - This service is temporarily offline. Try again later."
+
+// ignored message codes for individual scrobbles
+const (
+	lfmIgnoredArtist       = "1"
+	lfmIgnoredTrack        = "2"
+	lfmIgnoredTimestampOld = "3"
+	lfmIgnoredTimestampNew = "4"
+)
+
+const lfmMaxScrobbles = 50
+
+// BuildAudioscrobblerHandler serves an Audioscrobbler 2.0 compatible api so
+// that scrobbling clients can be pointed at this server instead of last.fm.
+// auth.getMobileSession, track.scrobble and track.updateNowPlaying are
+// supported, and responses are xml unless format=json is set.
+func BuildAudioscrobblerHandler(
+	playStore store.PlayStore,
+	nowPlaying *nowplaying.Store,
+	bus *events.Bus,
+	username, password string,
+	clients []ScrobbleClient,
+) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			writeLFMError(w, r, http.StatusBadRequest, lfmErrorInvalidParameters, "failed to parse form")
+			return
+		}
+
+		var client *ScrobbleClient
+		for i := range clients {
+			if clients[i].APIKey == r.Form.Get("api_key") {
+				client = &clients[i]
+				break
+			}
+		}
+		if client == nil {
+			writeLFMError(w, r, http.StatusForbidden, lfmErrorInvalidAPIKey, "Invalid API key - You must be granted a valid key by last.fm")
+			return
+		}
+
+		if !validLFMSignature(r, client.SharedSecret) {
+			writeLFMError(w, r, http.StatusForbidden, lfmErrorInvalidSignature, "Invalid method signature supplied")
+			return
+		}
+
+		sessionKey := lfmSessionKey(username, password, client)
+
+		method := strings.ToLower(r.Form.Get("method"))
+		if method == "auth.getmobilesession" {
+			authToken := r.Form.Get("authToken")
+			passwordHash := md5.Sum([]byte(password))
+			expectedToken := md5.Sum([]byte(username + hex.EncodeToString(passwordHash[:])))
+
+			validUser := r.Form.Get("username") == username
+			validPassword := subtle.ConstantTimeCompare([]byte(r.Form.Get("password")), []byte(password)) == 1
+			validToken := authToken != "" && subtle.ConstantTimeCompare([]byte(authToken), []byte(hex.EncodeToString(expectedToken[:]))) == 1
+			if !validUser || !(validPassword || validToken) {
+				writeLFMError(w, r, http.StatusForbidden, lfmErrorAuthFailed, "Authentication Failed - You do not have permissions to access the service")
+				return
+			}
+
+			writeLFM(w, r, lfmSession{Name: username, Key: sessionKey, Subscriber: 0})
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(r.Form.Get("sk")), []byte(sessionKey)) != 1 {
+			writeLFMError(w, r, http.StatusForbidden, lfmErrorInvalidSession, "Invalid session key - Please re-authenticate")
+			return
+		}
+
+		switch method {
+		case "track.updatenowplaying":
+			if r.Form.Get("artist") == "" || r.Form.Get("track") == "" {
+				writeLFMError(w, r, http.StatusBadRequest, lfmErrorInvalidParameters, "Invalid parameters - artist and track are required")
+				return
+			}
+
+			// duration is in seconds in the api, and ms in the store
+			duration, _ := strconv.ParseInt(r.Form.Get("duration"), 10, 64)
+
+			err = nowPlaying.Set(r.Context(), nowplaying.Track{
+				Source:   client.Name,
+				Track:    r.Form.Get("track"),
+				Artist:   r.Form.Get("artist"),
+				Album:    r.Form.Get("album"),
+				Duration: duration * 1000,
+			})
+			if err != nil {
+				log.Printf("failed to set now playing for %s: %v", client.Name, err)
+				writeLFMError(w, r, http.StatusServiceUnavailable, lfmErrorServiceOffline, lfmServiceOffline)
+				return
+			}
+
+			writeLFM(w, r, lfmNowPlaying{
+				Track:          newLFMText(r.Form.Get("track")),
+				Artist:         newLFMText(r.Form.Get("artist")),
+				Album:          newLFMText(r.Form.Get("album")),
+				AlbumArtist:    newLFMText(r.Form.Get("albumArtist")),
+				IgnoredMessage: lfmIgnored{Code: "0"},
+			})
+		case "track.scrobble":
+			scrobbles, plays := parseLFMScrobbles(r, client.Name, time.Now())
+			if len(scrobbles) == 0 {
+				writeLFMError(w, r, http.StatusBadRequest, lfmErrorInvalidParameters, "Invalid parameters - no scrobbles found")
+				return
+			}
+
+			err = playStore.InsertPlays(r.Context(), plays)
+			if err != nil {
+				log.Printf("failed to save scrobbles from %s: %v", client.Name, err)
+				writeLFMError(w, r, http.StatusServiceUnavailable, lfmErrorServiceOffline, lfmServiceOffline)
+				return
+			}
+			bus.Publish(plays...)
+
+			writeLFM(w, r, lfmScrobbles{Scrobbles: scrobbles})
+		default:
+			writeLFMError(w, r, http.StatusBadRequest, lfmErrorInvalidMethod, "Invalid Method - No method with that name in this package")
+		}
+	}
+}
+
+// lfmSessionKey is the session key for a client. It's derived from the
+// password so that sessions don't need to be stored, and changing the
+// password signs out all clients.
+func lfmSessionKey(username, password string, client *ScrobbleClient) string {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write([]byte(client.APIKey + ":" + username))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// validLFMSignature checks api_sig, the md5 of the sorted parameters and
+// values followed by the shared secret
+func validLFMSignature(r *http.Request, secret string) bool {
+	var keys []string
+	for k := range r.Form {
+		if k == "format" || k == "callback" || k == "api_sig" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteString(r.Form.Get(k))
+	}
+	b.WriteString(secret)
+
+	sum := md5.Sum([]byte(b.String()))
+	expected := hex.EncodeToString(sum[:])
+
+	return subtle.ConstantTimeCompare([]byte(strings.ToLower(r.Form.Get("api_sig"))), []byte(expected)) == 1
+}
+
+// parseLFMScrobbles reads the artist[i], track[i], timestamp[i] etc. params
+// of a batch, or the same params without an index for a single scrobble
+func parseLFMScrobbles(r *http.Request, source string, now time.Time) ([]lfmScrobble, []store.Play) {
+	var suffixes []string
+	if r.Form.Has("artist") || r.Form.Has("track") {
+		suffixes = append(suffixes, "")
+	}
+	for i := 0; i < lfmMaxScrobbles; i++ {
+		suffix := fmt.Sprintf("[%d]", i)
+		if r.Form.Has("artist"+suffix) || r.Form.Has("track"+suffix) {
+			suffixes = append(suffixes, suffix)
+		}
+	}
+
+	var scrobbles []lfmScrobble
+	var plays []store.Play
+	for _, suffix := range suffixes {
+		s := lfmScrobble{
+			Track:          newLFMText(r.Form.Get("track" + suffix)),
+			Artist:         newLFMText(r.Form.Get("artist" + suffix)),
+			Album:          newLFMText(r.Form.Get("album" + suffix)),
+			AlbumArtist:    newLFMText(r.Form.Get("albumArtist" + suffix)),
+			Timestamp:      r.Form.Get("timestamp" + suffix),
+			IgnoredMessage: lfmIgnored{Code: "0"},
+		}
+
+		unix, err := strconv.ParseInt(s.Timestamp, 10, 64)
+		timestamp := time.Unix(unix, 0).UTC()
+		switch {
+		case s.Artist.Text == "":
+			s.IgnoredMessage = lfmIgnored{Code: lfmIgnoredArtist, Text: "Artist was ignored"}
+		case s.Track.Text == "":
+			s.IgnoredMessage = lfmIgnored{Code: lfmIgnoredTrack, Text: "Track was ignored"}
+		case err != nil || unix <= 0:
+			s.IgnoredMessage = lfmIgnored{Code: lfmIgnoredTimestampOld, Text: "Timestamp was invalid"}
+		case timestamp.After(now.Add(5 * time.Minute)):
+			s.IgnoredMessage = lfmIgnored{Code: lfmIgnoredTimestampNew, Text: "Timestamp is too new"}
+		}
+		scrobbles = append(scrobbles, s)
+
+		if s.IgnoredMessage.Code != "0" {
+			continue
+		}
+
+		// duration is in seconds in the api, and ms in the store
+		duration, _ := strconv.ParseInt(r.Form.Get("duration"+suffix), 10, 64)
+
+		plays = append(plays, store.Play{
+			Track:     s.Track.Text,
+			Artist:    s.Artist.Text,
+			Artists:   []string{s.Artist.Text},
+			Album:     s.Album.Text,
+			Timestamp: timestamp,
+			Duration:  duration * 1000,
+			CreatedAt: now,
+			Source:    source,
+			TrackMBID: r.Form.Get("mbid" + suffix),
+		})
+	}
+
+	return scrobbles, plays
+}
+
+type lfmText struct {
+	Corrected string `xml:"corrected,attr" json:"corrected"`
+	Text      string `xml:",chardata" json:"#text"`
+}
+
+// newLFMText returns a value as submitted, corrections are never made
+func newLFMText(text string) lfmText {
+	return lfmText{Corrected: "0", Text: text}
+}
+
+type lfmIgnored struct {
+	Code string `xml:"code,attr" json:"code"`
+	Text string `xml:",chardata" json:"#text"`
+}
+
+type lfmSession struct {
+	XMLName    xml.Name `xml:"session" json:"-"`
+	Name       string   `xml:"name" json:"name"`
+	Key        string   `xml:"key" json:"key"`
+	Subscriber int      `xml:"subscriber" json:"subscriber"`
+}
+
+type lfmNowPlaying struct {
+	XMLName        xml.Name   `xml:"nowplaying" json:"-"`
+	Track          lfmText    `xml:"track" json:"track"`
+	Artist         lfmText    `xml:"artist" json:"artist"`
+	Album          lfmText    `xml:"album" json:"album"`
+	AlbumArtist    lfmText    `xml:"albumArtist" json:"albumArtist"`
+	IgnoredMessage lfmIgnored `xml:"ignoredMessage" json:"ignoredMessage"`
+}
+
+type lfmScrobble struct {
+	Track          lfmText    `xml:"track" json:"track"`
+	Artist         lfmText    `xml:"artist" json:"artist"`
+	Album          lfmText    `xml:"album" json:"album"`
+	AlbumArtist    lfmText    `xml:"albumArtist" json:"albumArtist"`
+	Timestamp      string     `xml:"timestamp" json:"timestamp"`
+	IgnoredMessage lfmIgnored `xml:"ignoredMessage" json:"ignoredMessage"`
+}
+
+type lfmScrobbles struct {
+	Scrobbles []lfmScrobble
+}
+
+func (s lfmScrobbles) counts() (accepted, ignored int) {
+	for _, scrobble := range s.Scrobbles {
+		if scrobble.IgnoredMessage.Code == "0" {
+			accepted++
+		} else {
+			ignored++
+		}
+	}
+	return accepted, ignored
+}
+
+func (s lfmScrobbles) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	accepted, ignored := s.counts()
+	return e.Encode(struct {
+		XMLName   xml.Name      `xml:"scrobbles"`
+		Accepted  int           `xml:"accepted,attr"`
+		Ignored   int           `xml:"ignored,attr"`
+		Scrobbles []lfmScrobble `xml:"scrobble"`
+	}{Accepted: accepted, Ignored: ignored, Scrobbles: s.Scrobbles})
+}
+
+// MarshalJSON matches last.fm, which returns a single scrobble as an object
+// rather than a list
+func (s lfmScrobbles) MarshalJSON() ([]byte, error) {
+	accepted, ignored := s.counts()
+
+	var scrobble interface{} = s.Scrobbles
+	if len(s.Scrobbles) == 1 {
+		scrobble = s.Scrobbles[0]
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"scrobble": scrobble,
+		"@attr": map[string]int{
+			"accepted": accepted,
+			"ignored":  ignored,
+		},
+	})
+}
+
+// writeLFM writes a successful response, json responses are wrapped in an
+// object keyed by the element name and xml responses in an lfm element
+func writeLFM(w http.ResponseWriter, r *http.Request, body interface{}) {
+	if r.Form.Get("format") == "json" {
+		var key string
+		switch body.(type) {
+		case lfmSession:
+			key = "session"
+		case lfmNowPlaying:
+			key = "nowplaying"
+		case lfmScrobbles:
+			key = "scrobbles"
+		}
+
+		d, err := json.Marshal(map[string]interface{}{key: body})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(d)
+		return
+	}
+
+	d, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"lfm"`
+		Status  string   `xml:"status,attr"`
+		Body    interface{}
+	}{Status: "ok", Body: body})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	w.Write(d)
+}
+
+func writeLFMError(w http.ResponseWriter, r *http.Request, status, code int, message string) {
+	if r.Form.Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(struct {
+			Error   int    `json:"error"`
+			Message string `json:"message"`
+		}{Error: code, Message: message})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"lfm"`
+		Status  string   `xml:"status,attr"`
+		Error   struct {
+			Code    int    `xml:"code,attr"`
+			Message string `xml:",chardata"`
+		} `xml:"error"`
+	}{Status: "failed", Error: struct {
+		Code    int    `xml:"code,attr"`
+		Message string `xml:",chardata"`
+	}{Code: code, Message: message}})
+}
@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/charlieegan3/music/pkg/tool/events"
+	"github.com/charlieegan3/music/pkg/tool/nowplaying"
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+// ListenBrainzClient is an application allowed to submit listens with a
+// token, listens are saved with the client name as their source
+type ListenBrainzClient struct {
+	Name  string
+	Token string
+}
+
+const (
+	listenTypeSingle     = "single"
+	listenTypeImport     = "import"
+	listenTypePlayingNow = "playing_now"
+
+	// limits from the listenbrainz api docs
+	listenBrainzMaxListens = 1000
+	listenBrainzMaxBody    = 10 * 1024 * 1024
+)
+
+type listenBrainzSubmission struct {
+	ListenType string               `json:"listen_type"`
+	Payload    []listenBrainzListen `json:"payload"`
+}
+
+type listenBrainzListen struct {
+	ListenedAt    *int64 `json:"listened_at"`
+	TrackMetadata struct {
+		ArtistName     string                     `json:"artist_name"`
+		TrackName      string                     `json:"track_name"`
+		ReleaseName    string                     `json:"release_name"`
+		AdditionalInfo listenBrainzAdditionalInfo `json:"additional_info"`
+	} `json:"track_metadata"`
+}
+
+type listenBrainzAdditionalInfo struct {
+	RecordingMBID string   `json:"recording_mbid"`
+	ReleaseMBID   string   `json:"release_mbid"`
+	ArtistMBIDs   []string `json:"artist_mbids"`
+	// ArtistNames lists the credited artists, when set by the client
+	ArtistNames []string `json:"artist_names"`
+	DurationMS  int64    `json:"duration_ms"`
+	// Duration is in seconds, it's used when duration_ms is not set
+	Duration  int64  `json:"duration"`
+	SpotifyID string `json:"spotify_id"`
+}
+
+// BuildListenBrainzSubmitHandler accepts listens in the format of the
+// ListenBrainz POST /1/submit-listens api. single and import listens are
+// saved, playing_now listens are saved as the client's now playing track.
+func BuildListenBrainzSubmitHandler(
+	playStore store.PlayStore,
+	nowPlaying *nowplaying.Store,
+	bus *events.Bus,
+	clients []ListenBrainzClient,
+) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := listenBrainzClient(r, clients)
+		if client == nil {
+			writeListenBrainzError(w, http.StatusUnauthorized, "You need to provide an Authorization header.")
+			return
+		}
+
+		var submission listenBrainzSubmission
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, listenBrainzMaxBody)).Decode(&submission)
+		if err != nil {
+			writeListenBrainzError(w, http.StatusBadRequest, fmt.Sprintf("Cannot parse JSON document: %s", err))
+			return
+		}
+
+		plays, err := listenBrainzPlays(submission, client.Name, time.Now())
+		if err != nil {
+			writeListenBrainzError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if submission.ListenType == listenTypePlayingNow {
+			metadata := submission.Payload[0].TrackMetadata
+			duration := metadata.AdditionalInfo.DurationMS
+			if duration == 0 {
+				duration = metadata.AdditionalInfo.Duration * 1000
+			}
+
+			err = nowPlaying.Set(r.Context(), nowplaying.Track{
+				Source:    client.Name,
+				Track:     metadata.TrackName,
+				Artist:    metadata.ArtistName,
+				Album:     metadata.ReleaseName,
+				Duration:  duration,
+				SpotifyID: spotifyTrackID(metadata.AdditionalInfo.SpotifyID),
+			})
+		} else {
+			err = playStore.InsertPlays(r.Context(), plays)
+			if err == nil {
+				bus.Publish(plays...)
+			}
+		}
+		if err != nil {
+			log.Printf("failed to save %s listens from %s: %v", submission.ListenType, client.Name, err)
+			writeListenBrainzError(w, http.StatusServiceUnavailable, listenBrainzUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"ok"}`))
+	}
+}
+
+// BuildListenBrainzValidateTokenHandler serves GET /1/validate-token, which
+// clients use to check a token when it's configured
+func BuildListenBrainzValidateTokenHandler(clients []ListenBrainzClient) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response := struct {
+			Code     int    `json:"code"`
+			Message  string `json:"message"`
+			Valid    bool   `json:"valid"`
+			UserName string `json:"user_name,omitempty"`
+		}{Code: http.StatusOK, Message: "Token invalid."}
+
+		if client := listenBrainzClient(r, clients); client != nil {
+			response.Message = "Token valid."
+			response.Valid = true
+			response.UserName = client.Name
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// listenBrainzClient returns the client for the token in the Authorization
+// header, or the token param which older clients use for validate-token
+func listenBrainzClient(r *http.Request, clients []ListenBrainzClient) *ListenBrainzClient {
+	token := r.URL.Query().Get("token")
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, value, _ := strings.Cut(header, " ")
+		if !strings.EqualFold(scheme, "token") {
+			return nil
+		}
+		token = strings.TrimSpace(value)
+	}
+	if token == "" {
+		return nil
+	}
+
+	for i := range clients {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(clients[i].Token)) == 1 {
+			return &clients[i]
+		}
+	}
+
+	return nil
+}
+
+// listenBrainzPlays validates a submission and returns the plays to save. As
+// with listenbrainz, if any listen is invalid none are saved.
+func listenBrainzPlays(submission listenBrainzSubmission, source string, now time.Time) ([]store.Play, error) {
+	switch submission.ListenType {
+	case listenTypeSingle, listenTypePlayingNow:
+		if len(submission.Payload) != 1 {
+			return nil, fmt.Errorf("json document must contain exactly one listen for listen_type %s", submission.ListenType)
+		}
+	case listenTypeImport:
+		if len(submission.Payload) == 0 {
+			return nil, fmt.Errorf("json document does not contain any listens")
+		}
+		if len(submission.Payload) > listenBrainzMaxListens {
+			return nil, fmt.Errorf("too many listens, you may not submit more than %d listens at once", listenBrainzMaxListens)
+		}
+	default:
+		return nil, fmt.Errorf("json document has invalid listen_type %q", submission.ListenType)
+	}
+
+	var plays []store.Play
+	for i, l := range submission.Payload {
+		metadata := l.TrackMetadata
+		if metadata.ArtistName == "" || metadata.TrackName == "" {
+			return nil, fmt.Errorf("listen %d: artist_name and track_name are required", i)
+		}
+
+		if submission.ListenType == listenTypePlayingNow {
+			if l.ListenedAt != nil {
+				return nil, fmt.Errorf("listen %d: listened_at must not be set for playing_now", i)
+			}
+			continue
+		}
+
+		if l.ListenedAt == nil || *l.ListenedAt <= 0 {
+			return nil, fmt.Errorf("listen %d: listened_at is required", i)
+		}
+		timestamp := time.Unix(*l.ListenedAt, 0).UTC()
+		if timestamp.After(now.Add(5 * time.Minute)) {
+			return nil, fmt.Errorf("listen %d: listened_at is in the future", i)
+		}
+
+		info := metadata.AdditionalInfo
+		duration := info.DurationMS
+		if duration == 0 {
+			duration = info.Duration * 1000
+		}
+
+		play := store.Play{
+			Track:     metadata.TrackName,
+			Artist:    metadata.ArtistName,
+			Artists:   []string{metadata.ArtistName},
+			Album:     metadata.ReleaseName,
+			Timestamp: timestamp,
+			Duration:  duration,
+			CreatedAt: now,
+			Source:    source,
+
+			SpotifyID: spotifyTrackID(info.SpotifyID),
+			TrackMBID: info.RecordingMBID,
+			AlbumMBID: info.ReleaseMBID,
+		}
+		if len(info.ArtistNames) > 0 {
+			play.Artists = info.ArtistNames
+		}
+		// the first artist is the one credited first in artist_name
+		if len(info.ArtistMBIDs) > 0 {
+			play.ArtistMBID = info.ArtistMBIDs[0]
+		}
+
+		plays = append(plays, play)
+	}
+
+	return plays, nil
+}
+
+// spotifyTrackID returns the id from a track url such as
+// https://open.spotify.com/track/ID, or the value as is if it's not a url
+func spotifyTrackID(value string) string {
+	if i := strings.LastIndex(value, "/track/"); i >= 0 {
+		value = value[i+len("/track/"):]
+	}
+	value, _, _ = strings.Cut(value, "?")
+
+	return strings.TrimPrefix(value, "spotify:track:")
+}
+
+// listenBrainzUnavailable is the error sent when listens can't be saved, the
+// cause is logged rather than sent to clients
+const listenBrainzUnavailable = "Cannot submit listens to queue, please try again later."
+
+func writeListenBrainzError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Code  int    `json:"code"`
+		Error string `json:"error"`
+	}{Code: status, Error: message})
+}
@@ -3,78 +3,19 @@ package handlers
 import (
 	"fmt"
 	"net/http"
-	"strings"
+	"time"
 
-	"cloud.google.com/go/bigquery"
 	"github.com/foolin/goview"
-	"google.golang.org/api/iterator"
-	"google.golang.org/api/option"
 
+	"github.com/charlieegan3/music/pkg/tool/store"
 	"github.com/charlieegan3/music/pkg/tool/utils"
 )
 
-func BuildMonthsHandler(projectID, datasetName, tablename, googleJSON string) func(http.ResponseWriter, *http.Request) {
+func BuildMonthsHandler(playStore store.PlayStore) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var err error
-		bigqueryClient, err := bigquery.NewClient(
-			r.Context(),
-			projectID,
-			option.WithCredentialsJSON([]byte(googleJSON)),
-		)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-			return
-		}
 
-		tableName := fmt.Sprintf("`%s.%s.%s`", projectID, datasetName, tablename)
-		monthFormat := "%Y-%m"
-		monthFormatPretty := "%B %Y"
-		queryString := fmt.Sprintf(`
-  SELECT
-  month,
-  MAX(pretty) AS pretty,
-  ARRAY_AGG(STRUCT(track,
-      artist,
-      album,
-      count)
-  ORDER BY
-    count DESC
-  LIMIT
-    10) AS top
-FROM (
-  SELECT
-    COUNT(track) AS count,
-    track,
-    artist,
-    MAX(album) as album,
-    month,
-    pretty,
-    MAX(album_cover) AS artwork,
-    MAX(spotify_id) AS spotify
-  FROM (
-    SELECT
-      *,
-      FORMAT_DATE('%s', DATE(timestamp)) AS month,
-      FORMAT_DATE('%s', DATE(timestamp)) AS pretty
-    FROM
-      %s)
-  GROUP BY
-    track,
-    artist,
-    month,
-    pretty
-  ORDER BY
-    count DESC )
-GROUP BY
-  month
-ORDER BY
-  month desc
-`, monthFormat, monthFormatPretty, tableName)
-
-		q := bigqueryClient.Query(queryString)
-
-		it, err := q.Read(r.Context())
+		months, err := playStore.MonthsTopTracks(r.Context(), 10)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
@@ -82,31 +23,35 @@ ORDER BY
 		}
 
 		monthsTopTracks := []monthTopTracks{}
-		for {
-			var r monthTopTracks
-			err := it.Next(&r)
-			if err == iterator.Done {
-				break
-			}
+		for _, m := range months {
+			month, err := time.Parse("2006-01", m.Month)
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				w.Write([]byte(err.Error()))
 				return
 			}
 
-			for i := range r.TopTracks {
-				t := &r.TopTracks[i]
-
-				t.Artists = strings.Split(t.Artist, ", ")
+			row := monthTopTracks{
+				Month:  m.Month,
+				Pretty: month.Format("January 2006"),
+			}
 
-				t.Artwork = fmt.Sprintf(
-					"/artworks/%s/%s.jpg",
-					utils.CRC32Hash(t.Artist),
-					utils.CRC32Hash(t.Album),
-				)
+			for _, t := range m.Tracks {
+				row.TopTracks = append(row.TopTracks, monthTopTrack{
+					Track:   t.Track,
+					Artist:  t.Artist,
+					Album:   t.Album,
+					Count:   t.Count,
+					Artists: t.CreditedArtists(),
+					Artwork: fmt.Sprintf(
+						"/artworks/%s/%s.jpg",
+						utils.CRC32Hash(t.Artist),
+						utils.CRC32Hash(t.Album),
+					),
+				})
 			}
 
-			monthsTopTracks = append(monthsTopTracks, r)
+			monthsTopTracks = append(monthsTopTracks, row)
 		}
 
 		err = gv.Render(
@@ -127,14 +72,14 @@ ORDER BY
 type monthTopTracks struct {
 	Month     string
 	Pretty    string
-	TopTracks []monthTopTrack `bigquery:"top"`
+	TopTracks []monthTopTrack
 }
 
 type monthTopTrack struct {
 	Track  string
 	Artist string
 	Album  string
-	Count  int
+	Count  int64
 
 	Artwork string
 	Artists []string
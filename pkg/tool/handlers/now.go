@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/foolin/goview"
+	"github.com/gorilla/mux"
+
+	"github.com/charlieegan3/music/pkg/tool/nowplaying"
+	"github.com/charlieegan3/music/pkg/tool/store"
+	"github.com/charlieegan3/music/pkg/tool/utils"
+)
+
+// BuildNowHandler shows the track each source is currently playing, as html
+// or as json at /now.json. Visitors who aren't signed in only see tracks
+// which are visible with the privacy on the request context.
+func BuildNowHandler(nowPlaying *nowplaying.Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		tracks, err := nowPlaying.Current(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		// tracks are hidden like plays from visitors who aren't signed in
+		privacy := store.PrivacyFrom(r.Context())
+		now := time.Now()
+
+		rows := []nowPlayingRow{}
+		for _, t := range tracks {
+			if !privacy.Visible(t.StartedAt, now) {
+				continue
+			}
+
+			artwork := t.AlbumCover
+			if artwork == "" {
+				artwork = fmt.Sprintf(
+					"/artworks/%s/%s.jpg",
+					utils.CRC32Hash(t.Artist),
+					utils.CRC32Hash(t.Album),
+				)
+			}
+
+			rows = append(rows, nowPlayingRow{
+				Source: t.Source,
+				Track:  t.Track,
+				Artist: t.Artist,
+				// tracks don't have a list of artists, so like plays without
+				// one the whole artist string links to a single artist
+				Artists:   []string{t.Artist},
+				Album:     t.Album,
+				Artwork:   artwork,
+				AgoTime:   humanize.Time(t.StartedAt),
+				StartedAt: t.StartedAt,
+				ExpiresAt: t.ExpiresAt,
+			})
+		}
+
+		// now playing changes too often to be cached
+		w.Header().Set("Cache-Control", "no-store")
+
+		format, _ := mux.Vars(r)["format"]
+		if format == ".json" {
+			d, err := json.MarshalIndent(struct {
+				NowPlaying []nowPlayingRow `json:"NowPlaying"`
+			}{
+				NowPlaying: rows,
+			}, "", "  ")
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(d)
+			return
+		}
+
+		err = gv.Render(
+			w,
+			http.StatusOK,
+			"now",
+			goview.M{"Tracks": rows},
+		)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+		}
+	}
+}
+
+type nowPlayingRow struct {
+	Source    string
+	Track     string
+	Artist    string
+	Artists   []string
+	Album     string
+	Artwork   string
+	AgoTime   string
+	StartedAt time.Time
+	ExpiresAt time.Time
+}
@@ -0,0 +1,56 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/charlieegan3/music/pkg/tool"
+	"github.com/charlieegan3/music/pkg/tool/handlers"
+	"github.com/charlieegan3/music/pkg/tool/nowplaying"
+)
+
+func TestNowKeepsArtistsWithCommas(t *testing.T) {
+	db, err := tool.OpenSQLite(filepath.Join(t.TempDir(), "music.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	nowPlaying := nowplaying.New(db)
+	err = nowPlaying.Set(context.Background(), nowplaying.Track{
+		Source: "lastfm",
+		Track:  "Ohio",
+		Artist: "Crosby, Stills, Nash & Young",
+		Album:  "4 Way Street",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/now{format:(?:\\.json)?}", handlers.BuildNowHandler(nowPlaying))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/now.json", nil))
+
+	var body struct {
+		NowPlaying []struct {
+			Artists []string
+		}
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &body)
+	if err != nil {
+		t.Fatalf("failed to parse %q: %v", w.Body.String(), err)
+	}
+	if len(body.NowPlaying) != 1 {
+		t.Fatalf("expected one track, got %d", len(body.NowPlaying))
+	}
+	if expected := []string{"Crosby, Stills, Nash & Young"}; !reflect.DeepEqual(body.NowPlaying[0].Artists, expected) {
+		t.Fatalf("expected artists %q, got %q", expected, body.NowPlaying[0].Artists)
+	}
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/foolin/goview"
+
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+const (
+	// signInCookie holds the admin token of a user signed in with a browser
+	signInCookie = "music_admin"
+	// signInDuration is how long a browser stays signed in
+	signInDuration = 30 * 24 * time.Hour
+)
+
+// PrivacyMiddleware serves pages to users who are signed in from handler,
+// bypassing the cache, so they see every play. Other visitors get pages from
+// cached, where queries only return plays which are visible with privacy.
+// A nil privacy still hides plays marked as private.
+func PrivacyMiddleware(privacy *store.Privacy, users []AdminUser, cached http.Handler, handler func(http.ResponseWriter, *http.Request)) http.Handler {
+	if privacy == nil {
+		privacy = &store.Privacy{}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if signedInUser(r, users) != nil {
+			w.Header().Set("Cache-Control", "private, no-store")
+			handler(w, r)
+			return
+		}
+
+		cached.ServeHTTP(w, r.WithContext(store.WithPrivacy(r.Context(), privacy)))
+	})
+}
+
+// signedInUser returns the admin user from a bearer token or the sign in
+// cookie. The cookie is only used for viewing pages, the admin api needs a
+// bearer token so that other sites can't make changes.
+func signedInUser(r *http.Request, users []AdminUser) *AdminUser {
+	if user := adminUser(r, users); user != nil {
+		return user
+	}
+
+	cookie, err := r.Cookie(signInCookie)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+
+	return findAdminUser(cookie.Value, users)
+}
+
+// BuildLoginHandler shows the sign in form and, when posted a valid admin
+// token, signs in the browser with a cookie
+func BuildLoginHandler(users []AdminUser) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+
+		status := http.StatusOK
+		data := goview.M{"SignedIn": signedInUser(r, users) != nil}
+
+		if r.Method == http.MethodPost {
+			user := findAdminUser(strings.TrimSpace(r.PostFormValue("token")), users)
+			if user != nil {
+				http.SetCookie(w, signInCookieFor(r, user.Token, signInDuration))
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
+			}
+
+			status = http.StatusUnauthorized
+			data["Error"] = "The token is not valid"
+		}
+
+		err := gv.Render(w, status, "login", data)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+		}
+	}
+}
+
+// BuildLogoutHandler removes the sign in cookie
+func BuildLogoutHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, signInCookieFor(r, "", -1))
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
+
+// signInCookieFor returns the sign in cookie, a negative maxAge removes it
+func signInCookieFor(r *http.Request, token string, maxAge time.Duration) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     signInCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		MaxAge:   int(maxAge.Seconds()),
+	}
+	if maxAge < 0 {
+		cookie.MaxAge = -1
+	}
+
+	return cookie
+}
+
+// findAdminUser returns the user with the token
+func findAdminUser(token string, users []AdminUser) *AdminUser {
+	if token == "" {
+		return nil
+	}
+
+	for i := range users {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(users[i].Token)) == 1 {
+			return &users[i]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package handlers_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charlieegan3/music/pkg/tool"
+	"github.com/charlieegan3/music/pkg/tool/handlers"
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+func TestPrivacyMiddlewareHidesPrivatePlays(t *testing.T) {
+	db, err := tool.OpenSQLite(filepath.Join(t.TempDir(), "music.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	playStore := store.NewSQLite(db)
+
+	timestamp := time.Now().UTC().Add(-2 * time.Hour).Truncate(time.Second)
+	err = playStore.InsertPlays(ctx, []store.Play{
+		{Artist: "Artist", Album: "Album", Track: "Public Track", Source: "lastfm", Timestamp: timestamp},
+		{Artist: "Artist", Album: "Album", Track: "Private Track", Source: "lastfm", Timestamp: timestamp.Add(time.Minute)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.NewSQLitePrivatePlays(db).Set(ctx, store.PlayKey{Source: "lastfm", Timestamp: timestamp.Add(time.Minute)}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := []handlers.AdminUser{{Name: "admin", Token: "token"}}
+	handler := handlers.BuildRecentHandler(playStore)
+
+	testCases := []struct {
+		name    string
+		privacy *store.Privacy
+		token   string
+		hidden  bool
+	}{
+		{name: "visitor without privacy config", privacy: &store.Privacy{}, hidden: true},
+		{name: "visitor with nil privacy", hidden: true},
+		{name: "visitor with a delay", privacy: &store.Privacy{Delay: time.Hour}, hidden: true},
+		{name: "signed in", privacy: &store.Privacy{}, token: "token", hidden: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/recent", nil)
+			if tc.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			w := httptest.NewRecorder()
+
+			handlers.PrivacyMiddleware(tc.privacy, users, http.HandlerFunc(handler), handler).ServeHTTP(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+			body := w.Body.String()
+			if !strings.Contains(body, "Public Track") {
+				t.Error("expected the public play to be shown")
+			}
+			if strings.Contains(body, "Private Track") == tc.hidden {
+				t.Errorf("expected the private play to be hidden: %v", tc.hidden)
+			}
+		})
+	}
+}
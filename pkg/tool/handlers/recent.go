@@ -4,41 +4,21 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strings"
 	"time"
 
-	"cloud.google.com/go/bigquery"
 	"github.com/dustin/go-humanize"
 	"github.com/foolin/goview"
 	"github.com/gorilla/mux"
-	"google.golang.org/api/iterator"
-	"google.golang.org/api/option"
 
+	"github.com/charlieegan3/music/pkg/tool/store"
 	"github.com/charlieegan3/music/pkg/tool/utils"
 )
 
-func BuildRecentHandler(projectID, datasetName, tablename, googleJSON string) func(http.ResponseWriter, *http.Request) {
+func BuildRecentHandler(playStore store.PlayStore) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var err error
-		bigqueryClient, err := bigquery.NewClient(
-			r.Context(),
-			projectID,
-			option.WithCredentialsJSON([]byte(googleJSON)),
-		)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-			return
-		}
-
-		queryString := fmt.Sprintf(`
-select track, artist, album, timestamp from %s
-order by timestamp desc
-limit 50
-`, fmt.Sprintf("`%s.%s.%s`", projectID, datasetName, tablename))
 
-		q := bigqueryClient.Query(queryString)
-		it, err := q.Read(r.Context())
+		plays, err := playStore.RecentPlays(r.Context(), 50)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
@@ -46,29 +26,8 @@ limit 50
 		}
 
 		var rows []recentPlayRow
-		for {
-			var row recentPlayRow
-			err := it.Next(&row)
-			if err == iterator.Done {
-				break
-			}
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(err.Error()))
-				return
-			}
-
-			row.Artists = strings.Split(row.Artist, ", ")
-
-			row.Artwork = fmt.Sprintf(
-				"/artworks/%s/%s.jpg",
-				utils.CRC32Hash(row.Artist),
-				utils.CRC32Hash(row.Album),
-			)
-
-			row.AgoTime = humanize.Time(row.Timestamp)
-
-			rows = append(rows, row)
+		for _, p := range plays {
+			rows = append(rows, newRecentPlayRow(p))
 		}
 
 		format, _ := mux.Vars(r)["format"]
@@ -111,3 +70,19 @@ type recentPlayRow struct {
 	AgoTime   string
 	Timestamp time.Time
 }
+
+func newRecentPlayRow(p store.Play) recentPlayRow {
+	return recentPlayRow{
+		Track:   p.Track,
+		Artist:  p.Artist,
+		Artists: p.CreditedArtists(),
+		Album:   p.Album,
+		Artwork: fmt.Sprintf(
+			"/artworks/%s/%s.jpg",
+			utils.CRC32Hash(p.Artist),
+			utils.CRC32Hash(p.Album),
+		),
+		AgoTime:   humanize.Time(p.Timestamp),
+		Timestamp: p.Timestamp,
+	}
+}
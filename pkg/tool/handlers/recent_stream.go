@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/charlieegan3/music/pkg/tool/events"
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+const (
+	// recentStreamDuration is how long a stream stays open, it must be less
+	// than the server's write timeout. The browser reconnects and gets the
+	// plays it missed using the Last-Event-ID header.
+	recentStreamDuration = 25 * time.Second
+	// recentStreamKeepAlive is how often a comment is sent so that proxies
+	// don't close an idle stream
+	recentStreamKeepAlive = 10 * time.Second
+	// recentStreamRetry is how long the browser waits before reconnecting
+	recentStreamRetry = 2 * time.Second
+)
+
+// BuildRecentStreamHandler streams plays as server-sent events as they are
+// saved, so that the cached recent page can show new plays. Plays matching
+// exclusions which hide recent plays, or hidden by the privacy on the request
+// context, including plays marked as private, are not sent.
+func BuildRecentStreamHandler(bus *events.Bus, exclusions *store.Exclusions, private *store.PrivatePlays) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := responseFlusher(w)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("streaming is not supported"))
+			return
+		}
+
+		// rules are loaded once as streams are short lived
+		var hidden []store.Exclusion
+		if exclusions != nil {
+			list, err := exclusions.List(r.Context())
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			for _, e := range list {
+				if e.HideRecent {
+					hidden = append(hidden, e)
+				}
+			}
+		}
+
+		privacy := store.PrivacyFrom(r.Context())
+		privateKeys := make(map[store.PlayKey]bool)
+		if privacy != nil && private != nil {
+			keys, err := private.List(r.Context())
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			for _, k := range keys {
+				privateKeys[privatePlayKey(k.Source, k.Timestamp)] = true
+			}
+		}
+		hide := func(p store.Play) bool {
+			return excluded(hidden, p) ||
+				!privacy.Visible(p.Timestamp, time.Now()) ||
+				privateKeys[privatePlayKey(p.Source, p.Timestamp)]
+		}
+
+		lastID, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+		backlog, ch, cancel := bus.Subscribe(lastID)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		fmt.Fprintf(w, "retry: %d\n\n", recentStreamRetry.Milliseconds())
+		for _, e := range backlog {
+			if hide(e.Play) {
+				continue
+			}
+			err := writeRecentPlayEvent(w, e)
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		end := time.NewTimer(recentStreamDuration)
+		defer end.Stop()
+		keepAlive := time.NewTicker(recentStreamKeepAlive)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-end.C:
+				return
+			case <-keepAlive.C:
+				_, err := fmt.Fprint(w, ": keep-alive\n\n")
+				if err != nil {
+					return
+				}
+			case e := <-ch:
+				if hide(e.Play) {
+					continue
+				}
+				err := writeRecentPlayEvent(w, e)
+				if err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// privatePlayKey identifies a play in the private plays, timestamps are
+// compared as the same instant whatever their location
+func privatePlayKey(source string, timestamp time.Time) store.PlayKey {
+	return store.PlayKey{Source: source, Timestamp: time.Unix(0, timestamp.UnixNano()).UTC()}
+}
+
+// excluded reports whether any of the rules match a play
+func excluded(exclusions []store.Exclusion, p store.Play) bool {
+	for _, e := range exclusions {
+		if e.Matches(p) {
+			return true
+		}
+	}
+	return false
+}
+
+type recentPlayEvent struct {
+	recentPlayRow
+	// Unix is the play's timestamp, used to skip plays already on the page
+	Unix int64
+	// HTML is the play's row on the recent page
+	HTML string
+}
+
+func writeRecentPlayEvent(w http.ResponseWriter, e events.Event) error {
+	row := newRecentPlayRow(e.Play)
+
+	var html bytes.Buffer
+	err := gv.RenderWriter(&html, "partials/recent_play.html", row)
+	if err != nil {
+		return fmt.Errorf("failed to render play: %v", err)
+	}
+
+	data, err := json.Marshal(recentPlayEvent{
+		recentPlayRow: row,
+		Unix:          row.Timestamp.Unix(),
+		HTML:          html.String(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode play: %v", err)
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: play\ndata: %s\n\n", e.ID, data)
+	return err
+}
+
+// responseFlusher finds a http.Flusher for w. Middleware which wraps the
+// ResponseWriter by embedding it hides the Flush method, so embedded
+// ResponseWriters are also checked.
+func responseFlusher(w http.ResponseWriter) (http.Flusher, bool) {
+	for w != nil {
+		if f, ok := w.(http.Flusher); ok {
+			return f, true
+		}
+
+		v := reflect.Indirect(reflect.ValueOf(w))
+		if v.Kind() != reflect.Struct {
+			return nil, false
+		}
+		field := v.FieldByName("ResponseWriter")
+		if !field.IsValid() || !field.CanInterface() {
+			return nil, false
+		}
+		w, _ = field.Interface().(http.ResponseWriter)
+	}
+
+	return nil, false
+}
@@ -0,0 +1,101 @@
+package handlers_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charlieegan3/music/pkg/tool"
+	"github.com/charlieegan3/music/pkg/tool/events"
+	"github.com/charlieegan3/music/pkg/tool/handlers"
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+func TestRecentStreamHidesPrivatePlays(t *testing.T) {
+	db, err := tool.OpenSQLite(filepath.Join(t.TempDir(), "music.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	private := store.NewSQLitePrivatePlays(db)
+
+	old := time.Now().UTC().Add(-2 * time.Hour).Truncate(time.Second)
+	play := func(track string, timestamp time.Time) store.Play {
+		return store.Play{Track: track, Artist: "Artist", Album: "Album", Source: "lastfm", Timestamp: timestamp}
+	}
+	err = private.Set(ctx, store.PlayKey{Source: "lastfm", Timestamp: old.Add(time.Minute)}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = private.Set(ctx, store.PlayKey{Source: "lastfm", Timestamp: old.Add(3 * time.Minute)}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name    string
+		privacy *store.Privacy
+		want    []string
+		hidden  []string
+	}{
+		{
+			name:    "visitor",
+			privacy: &store.Privacy{Delay: time.Hour},
+			want:    []string{"public backlog", "public live"},
+			hidden:  []string{"private backlog", "private live", "too recent"},
+		},
+		{
+			name:   "signed in",
+			want:   []string{"public backlog", "private backlog", "public live", "private live", "too recent"},
+			hidden: []string{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			bus := events.New()
+			bus.Publish(play("first", old))
+			bus.Publish(
+				play("private backlog", old.Add(time.Minute)),
+				play("public backlog", old.Add(2*time.Minute)),
+			)
+
+			reqCtx, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+			defer cancel()
+			if tc.privacy != nil {
+				reqCtx = store.WithPrivacy(reqCtx, tc.privacy)
+			}
+			r := httptest.NewRequest("GET", "/recent/stream", nil).WithContext(reqCtx)
+			r.Header.Set("Last-Event-ID", "1")
+			w := httptest.NewRecorder()
+
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				bus.Publish(
+					play("private live", old.Add(3*time.Minute)),
+					play("public live", old.Add(4*time.Minute)),
+					play("too recent", time.Now().UTC()),
+				)
+			}()
+
+			handlers.BuildRecentStreamHandler(bus, nil, private)(w, r)
+
+			body := w.Body.String()
+			for _, track := range tc.want {
+				if !strings.Contains(body, track) {
+					t.Errorf("expected %q to be streamed", track)
+				}
+			}
+			for _, track := range tc.hidden {
+				if strings.Contains(body, track) {
+					t.Errorf("expected %q not to be streamed", track)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/foolin/goview"
+	"github.com/gorilla/mux"
+
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+// slugKinds names the entity in each slug route var for the not found page
+var slugKinds = map[string]string{
+	"artistSlug": "artist",
+	"albumSlug":  "album",
+	"trackSlug":  "track",
+}
+
+// resolveSlugs finds the indexed name for the slug in each route var, it's
+// used by every artist, album and track page. Slugs which aren't the name's
+// canonical id-name form, such as links from the crc32 of a name with a
+// fallback id, a changed name part or a bare id, are redirected in one step to
+// the url with canonical slugs. Malformed slugs and unknown ids get the not
+// found page. false is returned when a response has been written.
+func resolveSlugs(w http.ResponseWriter, r *http.Request, index *store.NameIndex, routeVars ...string) ([]store.IndexedName, bool) {
+	names := make([]store.IndexedName, len(routeVars))
+	path := r.URL.Path
+	for i, routeVar := range routeVars {
+		nameSlug := mux.Vars(r)[routeVar]
+
+		name, found, err := index.Resolve(r.Context(), nameSlug)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return nil, false
+		}
+		if !found {
+			writeNotFound(w, slugKinds[routeVar])
+			return nil, false
+		}
+
+		if canonical := name.Slug(); nameSlug != canonical {
+			path = replaceSlug(path, nameSlug, canonical)
+		}
+		names[i] = name
+	}
+
+	if path != r.URL.Path {
+		u := *r.URL
+		u.Path = path
+		u.RawPath = ""
+		http.Redirect(w, r, u.RequestURI(), http.StatusMovedPermanently)
+		return nil, false
+	}
+
+	return names, true
+}
+
+// replaceSlug returns path with the first segment matching a slug replaced,
+// route vars are in order so earlier segments have been replaced already
+func replaceSlug(path, from, to string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		if s == from {
+			segments[i] = to
+			break
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// writeNotFound renders the not found page for a kind of entity, such as an
+// artist
+func writeNotFound(w http.ResponseWriter, kind string) {
+	if kind == "" {
+		kind = "page"
+	}
+
+	err := gv.Render(w, http.StatusNotFound, "not_found", goview.M{"Kind": kind})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+	}
+}
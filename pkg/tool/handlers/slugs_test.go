@@ -0,0 +1,99 @@
+package handlers_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/charlieegan3/music/pkg/tool"
+	"github.com/charlieegan3/music/pkg/tool/handlers"
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+func TestSlugsWithCollidingNames(t *testing.T) {
+	db, err := tool.OpenSQLite(filepath.Join(t.TempDir(), "music.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// plumless and buckeroo have the same crc32, plumless gets a fallback id
+	index := store.NewNameIndex(db)
+	_, err = index.Add(context.Background(), []string{"buckeroo", "plumless"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := store.FormatNameID(store.NameHash("plumless"))
+	plumless, found, err := index.Resolve(context.Background(), hash+"-plumless")
+	if err != nil || !found {
+		t.Fatalf("expected plumless to be indexed: %v", err)
+	}
+	buckeroo, found, err := index.Resolve(context.Background(), hash+"-buckeroo")
+	if err != nil || !found {
+		t.Fatalf("expected buckeroo to be indexed: %v", err)
+	}
+
+	playStore := store.NewSQLite(db)
+	router := mux.NewRouter()
+	router.HandleFunc("/artists/{artistSlug}", handlers.BuildArtistHandler(db, playStore))
+	router.HandleFunc("/artists/{artistSlug}/albums/{albumSlug}", handlers.BuildArtistAlbumHandler(db, playStore))
+
+	testCases := []struct {
+		name     string
+		path     string
+		status   int
+		location string
+	}{
+		{
+			name:   "canonical slug of the name with the crc32",
+			path:   "/artists/" + buckeroo.Slug(),
+			status: http.StatusOK,
+		},
+		{
+			name:   "canonical slug of the name with a fallback id",
+			path:   "/artists/" + plumless.Slug(),
+			status: http.StatusOK,
+		},
+		{
+			name:     "old slug from the crc32 of the name",
+			path:     "/artists/" + hash + "-plumless",
+			status:   http.StatusMovedPermanently,
+			location: "/artists/" + plumless.Slug(),
+		},
+		{
+			name:     "old name part",
+			path:     "/artists/" + hash + "-other-name",
+			status:   http.StatusMovedPermanently,
+			location: "/artists/" + buckeroo.Slug(),
+		},
+		{
+			name:     "old slugs in every segment",
+			path:     "/artists/" + hash + "-plumless/albums/" + hash,
+			status:   http.StatusMovedPermanently,
+			location: "/artists/" + plumless.Slug() + "/albums/" + buckeroo.Slug(),
+		},
+		{
+			name:   "unknown id",
+			path:   "/artists/1-plumless",
+			status: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+
+			if w.Code != tc.status {
+				t.Fatalf("expected status %d, got %d: %s", tc.status, w.Code, w.Body.String())
+			}
+			if location := w.Header().Get("Location"); location != tc.location {
+				t.Fatalf("expected location %q, got %q", tc.location, location)
+			}
+		})
+	}
+}
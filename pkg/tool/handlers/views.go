@@ -20,6 +20,7 @@ func init() {
 		Root:      "views",
 		Extension: ".html",
 		Master:    "layouts/master",
+		Partials:  []string{"partials/recent_play"},
 		Funcs: template.FuncMap{
 			"name_slug": utils.NameSlug,
 			"add": func(a, b int) int {
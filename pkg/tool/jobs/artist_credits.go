@@ -0,0 +1,124 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/charlieegan3/music/internal/pkg/spotify"
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+// ArtistCredits is a job that saves the list of artists for plays saved
+// before artists were listed. Spotify plays joined the names of the artists
+// with ", ", so the track is looked up to tell a list of artists from a name
+// containing a comma. Other sources only gave one artist.
+type ArtistCredits struct {
+	Store store.PlayStore
+
+	ScheduleOverride string
+
+	// the spotify credentials are optional, without them joined strings are
+	// split on ", "
+	SpotifyAccessToken  string
+	SpotifyRefreshToken string
+	SpotifyClientID     string
+	SpotifyClientSecret string
+}
+
+func (a *ArtistCredits) Name() string {
+	return "artist-credits"
+}
+
+func (a *ArtistCredits) Run(ctx context.Context) error {
+	doneCh := make(chan bool)
+	errCh := make(chan error)
+
+	go func() {
+		uncredited, err := a.Store.UncreditedArtists(ctx)
+		if err != nil {
+			errCh <- fmt.Errorf("failed to get uncredited artists: %v", err)
+			return
+		}
+
+		var ids []string
+		for _, u := range uncredited {
+			if u.Joined && u.SpotifyID != "" && strings.Contains(u.Artist, ", ") {
+				ids = append(ids, u.SpotifyID)
+			}
+		}
+
+		trackArtists := make(map[string][]string)
+		if len(ids) > 0 && a.SpotifyRefreshToken != "" {
+			trackArtists, err = spotify.TrackArtists(
+				a.SpotifyAccessToken,
+				a.SpotifyRefreshToken,
+				a.SpotifyClientID,
+				a.SpotifyClientSecret,
+				ids,
+			)
+			if err != nil {
+				errCh <- fmt.Errorf("failed to get spotify track artists: %v", err)
+				return
+			}
+		}
+
+		var credits []store.ArtistCredit
+		for _, u := range uncredited {
+			credits = append(credits, store.ArtistCredit{
+				Artist:  u.Artist,
+				Artists: creditArtists(u, trackArtists[u.SpotifyID]),
+			})
+		}
+
+		err = a.Store.SetArtistCredits(ctx, credits)
+		if err != nil {
+			errCh <- fmt.Errorf("failed to save artist credits: %v", err)
+			return
+		}
+
+		log.Printf("saved credits for %d artist strings\n", len(credits))
+
+		doneCh <- true
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case e := <-errCh:
+		return fmt.Errorf("job failed with error: %s", e)
+	case <-doneCh:
+		return nil
+	}
+}
+
+// creditArtists works out the artists of an uncredited artist string.
+// trackArtists are the artists spotify lists for a track played with the
+// string, the string is either all of them joined or only the first when it
+// came from a data export.
+func creditArtists(u store.UncreditedArtist, trackArtists []string) []string {
+	if !u.Joined || !strings.Contains(u.Artist, ", ") {
+		return []string{u.Artist}
+	}
+
+	for i := len(trackArtists); i > 0; i-- {
+		if strings.Join(trackArtists[:i], ", ") == u.Artist {
+			return trackArtists[:i]
+		}
+	}
+
+	return strings.Split(u.Artist, ", ")
+}
+
+func (a *ArtistCredits) Timeout() time.Duration {
+	return 10 * time.Minute
+}
+
+func (a *ArtistCredits) Schedule() string {
+	if a.ScheduleOverride != "" {
+		return a.ScheduleOverride
+	}
+	return "0 30 6 * * *"
+}
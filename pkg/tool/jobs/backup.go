@@ -1,28 +1,42 @@
 package jobs
 
 import (
-	"cloud.google.com/go/bigquery"
 	"context"
 	"database/sql"
 	_ "embed"
 	"fmt"
-	"google.golang.org/api/option"
+	"log"
 	"time"
+
+	"github.com/charlieegan3/music/pkg/tool/backup"
+	"github.com/charlieegan3/music/pkg/tool/store"
 )
 
-// Backup is a job that copies the data in the bq table to GCS
+// Backup is a job that copies the data in the play store to a backup
+// destination. When no destination is set, a store which supports it extracts
+// the data to the GCS backup bucket. Old backups are removed according to the
+// retention policy and a manifest of the remaining backups is saved.
+//
+// Unless SkipVerify is set, the backup is read back and compared with the
+// store. When they differ the result is saved in the manifest, no backups are
+// removed and the job fails.
 type Backup struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Store store.PlayStore
 
 	ScheduleOverride string
 
-	GoogleCredentialsJSON string
-	ProjectID             string
-	DatasetName           string
-	TableName             string
 	BackupBucketName      string
+	GoogleCredentialsJSON string
+	Destination           backup.Destination
+	Retention             backup.Retention
+	SkipVerify            bool
 }
 
+// bigQueryStreamingDelay is how long it can take for streamed rows to be
+// included in extract jobs
+const bigQueryStreamingDelay = 2 * time.Hour
+
 func (b *Backup) Name() string {
 	return "backup"
 }
@@ -32,59 +46,67 @@ func (b *Backup) Run(ctx context.Context) error {
 	errCh := make(chan error)
 
 	go func() {
-		// create a big query client to query for the music stats
-		client, err := bigquery.NewClient(
-			ctx,
-			b.ProjectID,
-			option.WithCredentialsJSON([]byte(b.GoogleCredentialsJSON)),
-		)
-		if err != nil {
-			errCh <- fmt.Errorf("failed to create client: %v", err)
-			return
+		dest := b.Destination
+		start := time.Now().UTC()
+		cutoff := start
+		var entry backup.ManifestEntry
+		var err error
+		if dest != nil {
+			entry, err = backup.Backup(ctx, dest, b.Store, start)
+			if err != nil {
+				errCh <- fmt.Errorf("failed to write backup: %v", err)
+				return
+			}
+		} else {
+			dest = &backup.GCS{
+				BucketName:            b.BackupBucketName,
+				GoogleCredentialsJSON: b.GoogleCredentialsJSON,
+			}
+			entry, err = b.extract(ctx, dest, start)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			cutoff = start.Add(-bigQueryStreamingDelay)
 		}
 
-		// create handles to the dataset and table
-		dataset := client.Dataset(b.DatasetName)
-		table := dataset.Table(b.TableName)
-
-		// create a handle to a gcs location
-		// year-mm-dd-time
-		name := "/plays-backup-" + time.Now().UTC().Format("2006-01-02-1504") + ".json"
-		gcsRef := &bigquery.GCSReference{
-			URIs:              []string{"gs://" + b.BackupBucketName + name},
-			DestinationFormat: bigquery.JSON,
+		log.Printf("backed up %d plays to %s\n", entry.Rows, entry.Name)
+
+		retention := b.Retention
+		if !b.SkipVerify {
+			verification, err := backup.Verify(ctx, dest, entry.Name, b.Store, cutoff)
+			if err != nil {
+				errCh <- fmt.Errorf("failed to verify backup: %v", err)
+				return
+			}
+			entry.Verification = &verification
+
+			// old backups are kept when the new one can't be trusted
+			if !verification.OK {
+				retention = backup.Retention{}
+			}
 		}
 
-		extractor := table.ExtractorTo(gcsRef)
-
-		job, err := extractor.Run(ctx)
+		deleted, err := backup.Rotate(ctx, dest, retention, entry)
 		if err != nil {
-			errCh <- fmt.Errorf("create backup job failed: %v", err)
+			errCh <- fmt.Errorf("failed to rotate backups: %v", err)
 			return
 		}
-		_, err = job.Wait(ctx)
-		if err != nil {
-			errCh <- fmt.Errorf("job failed: %v", err)
-			return
+		for _, name := range deleted {
+			log.Printf("deleted expired backup %s\n", name)
 		}
 
-		// create a handle to a gcs location latest
-		name = "/plays-backup-latest.json"
-		gcsRef = &bigquery.GCSReference{
-			URIs:              []string{"gs://" + b.BackupBucketName + name},
-			DestinationFormat: bigquery.JSON,
-		}
-
-		extractor = table.ExtractorTo(gcsRef)
-
-		job, err = extractor.Run(ctx)
-		if err != nil {
-			errCh <- fmt.Errorf("Create backup job failed: %v", err)
-			return
-		}
-		_, err = job.Wait(ctx)
-		if err != nil {
-			errCh <- fmt.Errorf("job failed: %v", err)
+		if entry.Verification != nil && !entry.Verification.OK {
+			for _, m := range entry.Verification.Mismatches {
+				log.Printf(
+					"backup mismatch in %s: %d rows in backup, %d in store\n",
+					m.Month, m.BackupRows, m.StoreRows,
+				)
+			}
+			errCh <- fmt.Errorf(
+				"backup %s differs from the store in %d of %d months",
+				entry.Name, len(entry.Verification.Mismatches), entry.Verification.Months,
+			)
 			return
 		}
 
@@ -95,14 +117,42 @@ func (b *Backup) Run(ctx context.Context) error {
 	case <-ctx.Done():
 		return ctx.Err()
 	case e := <-errCh:
-		return fmt.Errorf("job failed with error: %b", e)
+		return fmt.Errorf("job failed with error: %s", e)
 	case <-doneCh:
 		return nil
 	}
 }
 
+// extract uses the store to export the table to GCS, the backup is then read
+// back to count the rows for the manifest
+func (b *Backup) extract(ctx context.Context, dest backup.Destination, start time.Time) (backup.ManifestEntry, error) {
+	extractor, ok := b.Store.(store.Extractor)
+	if !ok {
+		return backup.ManifestEntry{}, fmt.Errorf("play store %T does not support extracting to GCS", b.Store)
+	}
+
+	name := backup.Name(start)
+	err := extractor.Extract(ctx, "gs://"+b.BackupBucketName+"/"+name)
+	if err != nil {
+		return backup.ManifestEntry{}, fmt.Errorf("failed to extract backup: %v", err)
+	}
+
+	err = extractor.Extract(ctx, "gs://"+b.BackupBucketName+"/"+backup.LatestName)
+	if err != nil {
+		return backup.ManifestEntry{}, fmt.Errorf("failed to extract latest backup: %v", err)
+	}
+
+	entry, err := backup.Summarize(ctx, dest, name)
+	if err != nil {
+		return entry, fmt.Errorf("failed to summarize backup: %v", err)
+	}
+
+	return entry, nil
+}
+
 func (b *Backup) Timeout() time.Duration {
-	return 30 * time.Second
+	// streaming and summarizing read the whole table
+	return 10 * time.Minute
 }
 
 func (b *Backup) Schedule() string {
@@ -5,27 +5,48 @@ import (
 	"database/sql"
 	_ "embed"
 	"fmt"
-	"github.com/charlieegan3/music/pkg/tool/utils"
 	"log"
-	"strings"
+	"sort"
 	"time"
 
-	"cloud.google.com/go/bigquery"
 	"github.com/doug-martin/goqu/v9"
-	"google.golang.org/api/iterator"
-	"google.golang.org/api/option"
+
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+const (
+	// buildIndexDefaultBatchSize is the number of new plays read at once
+	buildIndexDefaultBatchSize = 1000
+	// buildIndexCursorMargin is taken from the start of a full build for the
+	// cursor, so that plays saved while it runs, or by a database with a
+	// slightly different clock, are indexed by the next run
+	buildIndexCursorMargin = time.Minute
 )
 
-// BuildIndex will create a mapping of crc32(artist/album/track) -> name in the database
+// BuildIndex will create a mapping of id -> artist/album/track name in the database, the id
+// is the crc32 of the name unless another name has it. Artists also have the MusicBrainz id
+// saved with their plays.
+//
+// Runs only index the names of plays saved since the last run, using a cursor on the plays'
+// created_at, along with artist aliases and normalized titles. The first run, and runs with
+// Full set, index every name. Plays which are edited or restored keep their created_at, so
+// their names are indexed by the editor and restore instead.
 type BuildIndex struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Store store.PlayStore
 
 	ScheduleOverride string
 
-	GoogleCredentialsJSON string
-	ProjectID             string
-	DatasetName           string
-	TableName             string
+	// Full indexes the names of all plays rather than new plays
+	Full bool
+	// BatchSize is the number of new plays read at once
+	BatchSize int
+}
+
+type buildIndexCursor struct {
+	CreatedAtUnixNano int64  `db:"created_at_unix_nano"`
+	Source            string `db:"source"`
+	TimestampUnixNano int64  `db:"timestamp_unix_nano"`
 }
 
 func (a *BuildIndex) Name() string {
@@ -37,141 +58,283 @@ func (a *BuildIndex) Run(ctx context.Context) error {
 	errCh := make(chan error)
 
 	go func() {
-		bigqueryClient, err := bigquery.NewClient(
-			ctx,
-			a.ProjectID,
-			option.WithCredentialsJSON([]byte(a.GoogleCredentialsJSON)),
-		)
+		goquDB := goqu.New("postgres", a.DB)
+
+		var saved buildIndexCursor
+		found, err := goquDB.From("music.name_index_cursor").
+			Select("created_at_unix_nano", "source", "timestamp_unix_nano").
+			ScanStructContext(ctx, &saved)
 		if err != nil {
-			errCh <- fmt.Errorf("failed to create bq client: %v", err)
+			errCh <- fmt.Errorf("failed to load cursor: %v", err)
 			return
 		}
 
-		var rows []goqu.Record
-
-		queryString := fmt.Sprintf(`
-select distinct artist from %s
-order by artist asc
-`, fmt.Sprintf("`%s.%s.%s`", a.ProjectID, a.DatasetName, a.TableName))
-		q := bigqueryClient.Query(queryString)
-		it, err := q.Read(ctx)
+		if a.Full || !found {
+			err = a.indexAll(ctx, goquDB)
+		} else {
+			err = a.indexNew(ctx, goquDB, store.CreatedCursor{
+				CreatedAt: time.Unix(0, saved.CreatedAtUnixNano).UTC(),
+				Source:    saved.Source,
+				Timestamp: time.Unix(0, saved.TimestampUnixNano).UTC(),
+			})
+		}
 		if err != nil {
-			errCh <- fmt.Errorf("failed to read from bq: %v", err)
+			errCh <- err
+			return
 		}
-		for {
-			var r struct {
-				Artist string `bigquery:"artist"`
-			}
-			err := it.Next(&r)
-			if err == iterator.Done {
-				break
-			}
-			if err != nil {
-				errCh <- fmt.Errorf("failed to read row from bq result: %v", err)
-			}
 
-			rows = append(rows, goqu.Record{
-				"name": r.Artist,
-				"id":   utils.CRC32Hash(r.Artist),
-			})
+		doneCh <- true
+	}()
 
-			if strings.Contains(r.Artist, ",") {
-				for _, artist := range strings.Split(r.Artist, ", ") {
-					formattedName := strings.TrimSpace(artist)
-					if formattedName == "" {
-						continue
-					}
-					rows = append(rows, goqu.Record{
-						"name": formattedName,
-						"id":   utils.CRC32Hash(formattedName),
-					})
-				}
-			}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case e := <-errCh:
+		return fmt.Errorf("job failed with error: %s", e)
+	case <-doneCh:
+		return nil
+	}
+}
+
+// indexAll indexes the names of every play, then sets the cursor to when it
+// started
+func (a *BuildIndex) indexAll(ctx context.Context, goquDB *goqu.Database) error {
+	cursor := store.CreatedCursor{CreatedAt: time.Now().UTC().Add(-buildIndexCursorMargin)}
+
+	var names []string
+
+	artists, err := a.Store.Artists(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get artists: %v", err)
+	}
+	// each artist credited in a collaboration also has a page
+	credited, err := a.Store.ArtistNames(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get artist names: %v", err)
+	}
+	aliased, err := a.aliasedArtists(ctx)
+	if err != nil {
+		return err
+	}
+	names = append(names, artists...)
+	names = append(names, credited...)
+	names = append(names, aliased...)
+
+	albums, err := a.Store.Albums(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get albums: %v", err)
+	}
+
+	tracks, err := a.Store.Tracks(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get tracks: %v", err)
+	}
+
+	normalized, err := a.normalizedTitles(ctx)
+	if err != nil {
+		return err
+	}
+
+	names = append(names, albums...)
+	names = append(names, tracks...)
+	names = append(names, normalized...)
+
+	// names are added in a stable order so that which of two names with
+	// the same crc32 keeps it doesn't depend on the store
+	sort.Strings(names)
+	rowCount, err := store.NewNameIndex(a.DB).Add(ctx, names)
+	if err != nil {
+		return err
+	}
+
+	log.Println("New rows:", rowCount)
+
+	// MusicBrainz ids are updated on existing rows as they can be added
+	// after a name is first indexed
+	mbids, err := a.Store.ArtistMBIDs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get artist mbids: %v", err)
+	}
+	var indexed []struct {
+		Name       string `db:"name"`
+		ArtistMBID string `db:"artist_mbid"`
+	}
+	err = goquDB.From("music.name_index").
+		Select("name", "artist_mbid").
+		Where(goqu.C("artist_mbid").Neq("")).
+		ScanStructsContext(ctx, &indexed)
+	if err != nil {
+		return fmt.Errorf("failed to get indexed artist mbids: %v", err)
+	}
+	existing := make(map[string]string)
+	for _, i := range indexed {
+		existing[i.Name] = i.ArtistMBID
+	}
+
+	var updated int
+	for _, m := range mbids {
+		if existing[m.Artist] == m.MBID {
+			continue
 		}
-		queryString = fmt.Sprintf(`
-select distinct album from %s
-order by album asc
-`, fmt.Sprintf("`%s.%s.%s`", a.ProjectID, a.DatasetName, a.TableName))
-		q = bigqueryClient.Query(queryString)
-		it, err = q.Read(ctx)
+		_, err = goquDB.Update("music.name_index").
+			Set(goqu.Record{"artist_mbid": m.MBID}).
+			Where(goqu.C("name").Eq(m.Artist)).
+			Executor().
+			ExecContext(ctx)
 		if err != nil {
-			errCh <- fmt.Errorf("failed to read from bq: %v", err)
+			return fmt.Errorf("failed to save artist mbid: %v", err)
 		}
-		for {
-			var r struct {
-				Album string `bigquery:"album"`
-			}
-			err := it.Next(&r)
-			if err == iterator.Done {
-				break
-			}
-			if err != nil {
-				errCh <- fmt.Errorf("failed to read row from bq result: %v", err)
-			}
+		updated++
+	}
 
-			rows = append(rows, goqu.Record{
-				"name": r.Album,
-				"id":   utils.CRC32Hash(r.Album),
-			})
-		}
+	log.Println("Updated MusicBrainz ids:", updated)
+
+	return saveBuildIndexCursor(ctx, goquDB, cursor)
+}
+
+// indexNew indexes the names of plays saved after the cursor, a batch at a
+// time, saving the cursor after each batch
+func (a *BuildIndex) indexNew(ctx context.Context, goquDB *goqu.Database, cursor store.CreatedCursor) error {
+	batchSize := a.BatchSize
+	if batchSize == 0 {
+		batchSize = buildIndexDefaultBatchSize
+	}
 
-		queryString = fmt.Sprintf(`
-select distinct track from %s
-order by track asc
-`, fmt.Sprintf("`%s.%s.%s`", a.ProjectID, a.DatasetName, a.TableName))
-		q = bigqueryClient.Query(queryString)
-		it, err = q.Read(ctx)
+	index := store.NewNameIndex(a.DB)
+
+	// aliases and normalized titles are checked on every run, as an alias
+	// can be added, or titles normalized with new rules, without new plays
+	names, err := a.aliasedArtists(ctx)
+	if err != nil {
+		return err
+	}
+	normalized, err := a.normalizedTitles(ctx)
+	if err != nil {
+		return err
+	}
+	names = append(names, normalized...)
+
+	sort.Strings(names)
+	rowCount, err := index.Add(ctx, names)
+	if err != nil {
+		return err
+	}
+
+	var playCount, updated int64
+	for {
+		plays, err := a.Store.PlaysCreatedAfter(ctx, cursor, batchSize)
 		if err != nil {
-			errCh <- fmt.Errorf("failed to read from bq: %v", err)
+			return fmt.Errorf("failed to get new plays: %v", err)
+		}
+		if len(plays) == 0 {
+			break
 		}
-		for {
-			var r struct {
-				Track string `bigquery:"track"`
+
+		mbids := make(map[string]string)
+		for _, p := range plays {
+			if p.ArtistMBID != "" && mbids[p.Artist] == "" {
+				mbids[p.Artist] = p.ArtistMBID
 			}
-			err := it.Next(&r)
-			if err == iterator.Done {
-				break
+		}
+
+		added, err := index.AddPlays(ctx, plays)
+		if err != nil {
+			return err
+		}
+		rowCount += added
+
+		// only names without an id are set, a full build saves the id seen
+		// most often with each name
+		for artist, mbid := range mbids {
+			res, err := goquDB.Update("music.name_index").
+				Set(goqu.Record{"artist_mbid": mbid}).
+				Where(goqu.C("name").Eq(artist), goqu.C("artist_mbid").Eq("")).
+				Executor().
+				ExecContext(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to save artist mbid: %v", err)
 			}
+			n, err := res.RowsAffected()
 			if err != nil {
-				errCh <- fmt.Errorf("failed to read row from bq result: %v", err)
+				return fmt.Errorf("failed to get row count: %v", err)
 			}
-
-			rows = append(rows, goqu.Record{
-				"name": r.Track,
-				"id":   utils.CRC32Hash(r.Track),
-			})
+			updated += n
 		}
 
-		goquDB := goqu.New("postgres", a.DB)
-		query := goquDB.Insert("music.name_index").Rows(rows).OnConflict(goqu.DoNothing())
-		res, err := query.Executor().ExecContext(ctx)
+		playCount += int64(len(plays))
+		cursor = plays[len(plays)-1].Cursor()
+		err = saveBuildIndexCursor(ctx, goquDB, cursor)
 		if err != nil {
-			errCh <- fmt.Errorf("failed to insert: %v", err)
-			return
+			return err
 		}
-		rowCount, err := res.RowsAffected()
-		if err != nil {
-			errCh <- fmt.Errorf("failed to get row count: %v", err)
-			return
+
+		if len(plays) < batchSize {
+			break
 		}
+	}
 
-		log.Println("New rows:", rowCount)
+	log.Println("New plays:", playCount)
+	log.Println("New rows:", rowCount)
+	log.Println("Updated MusicBrainz ids:", updated)
 
-		doneCh <- true
-	}()
+	return nil
+}
 
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case e := <-errCh:
-		return fmt.Errorf("job failed with error: %s", e)
-	case <-doneCh:
-		return nil
+// aliasedArtists are the names artists are merged into, they need a page even
+// when they haven't been played
+func (a *BuildIndex) aliasedArtists(ctx context.Context) ([]string, error) {
+	aliases, err := store.NewAliases(a.DB).List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get artist aliases: %v", err)
+	}
+
+	var names []string
+	for _, alias := range aliases {
+		names = append(names, alias.Artist)
 	}
+
+	return names, nil
+}
+
+// normalizedTitles are the titles tracks and albums are counted under, pages
+// link to them rather than the titles of plays
+func (a *BuildIndex) normalizedTitles(ctx context.Context) ([]string, error) {
+	normalized, err := store.NewTitles(a.DB, nil).List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get normalized titles: %v", err)
+	}
+
+	var names []string
+	for _, n := range normalized {
+		names = append(names, n.Title)
+	}
+
+	return names, nil
+}
+
+func saveBuildIndexCursor(ctx context.Context, goquDB *goqu.Database, cursor store.CreatedCursor) error {
+	record := goqu.Record{
+		"id":                   1,
+		"created_at_unix_nano": cursor.CreatedAt.UnixNano(),
+		"source":               cursor.Source,
+		"timestamp_unix_nano":  cursor.Timestamp.UnixNano(),
+		"updated_at":           goqu.L("CURRENT_TIMESTAMP"),
+	}
+
+	_, err := goquDB.Insert("music.name_index_cursor").
+		Rows(record).
+		OnConflict(goqu.DoUpdate("id", record)).
+		Executor().
+		ExecContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save cursor: %v", err)
+	}
+
+	return nil
 }
 
 func (a *BuildIndex) Timeout() time.Duration {
-	return 30 * time.Second
+	return 10 * time.Minute
 }
 
 func (a *BuildIndex) Schedule() string {
@@ -0,0 +1,163 @@
+package jobs_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/charlieegan3/music/pkg/tool"
+	"github.com/charlieegan3/music/pkg/tool/backup"
+	"github.com/charlieegan3/music/pkg/tool/jobs"
+	"github.com/charlieegan3/music/pkg/tool/store"
+	"github.com/charlieegan3/music/pkg/tool/titles"
+)
+
+func indexed(t *testing.T, db *sql.DB, name string) bool {
+	t.Helper()
+
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM music.name_index WHERE name = ?", name).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return count > 0
+}
+
+func TestBuildIndexNormalizedTitles(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := tool.OpenSQLite(filepath.Join(t.TempDir(), "music.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	playStore := store.NewSQLite(db)
+	err = playStore.InsertPlays(ctx, []store.Play{{
+		Artist:    "Artist",
+		Album:     "Album (Deluxe Edition)",
+		Track:     "Song - 2011 Remaster",
+		Source:    "lastfm",
+		Timestamp: time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC),
+		CreatedAt: time.Now().Add(-time.Hour),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := &jobs.BuildIndex{DB: db, Store: playStore}
+
+	// the first run indexes every name
+	err = job.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !indexed(t, db, "Song - 2011 Remaster") {
+		t.Fatal("expected the track to be indexed")
+	}
+
+	// normalizing titles with new rules doesn't add plays, the titles are
+	// indexed by the next run
+	rules, err := titles.Builtin("remaster", "deluxe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = store.NewTitles(db, titles.New(rules)).Rebuild(
+		ctx, []string{"Song - 2011 Remaster"}, []string{"Album (Deluxe Edition)"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = job.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Song", "Album"} {
+		if !indexed(t, db, name) {
+			t.Fatalf("expected the normalized title %q to be indexed", name)
+		}
+	}
+}
+
+func TestBuildIndexEditedAndRestoredPlays(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := tool.OpenSQLite(filepath.Join(t.TempDir(), "music.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	timestamp := time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)
+	playStore := store.NewSQLite(db)
+	err = playStore.InsertPlays(ctx, []store.Play{{
+		Artist:    "Artist",
+		Album:     "Album",
+		Track:     "Song",
+		Source:    "lastfm",
+		Timestamp: timestamp,
+		CreatedAt: time.Now().Add(-time.Hour),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := &jobs.BuildIndex{DB: db, Store: playStore}
+	err = job.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	editor := &store.PlayEditor{
+		Store: playStore,
+		Audit: store.NewAuditLog(db),
+		Index: store.NewNameIndex(db),
+	}
+
+	// edits keep the play's created_at, the editor indexes the new names
+	_, err = editor.Edit(ctx, "admin", store.PlayKey{Source: "lastfm", Timestamp: timestamp}, store.PlayNames{Artist: "Edited Artist"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewrite, err := store.NewRewrite(store.FieldTrack, "^Song$", "Rewritten Song", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = editor.Rewrite(ctx, "admin", rewrite, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// restored plays keep the created_at from the backup
+	var buf bytes.Buffer
+	err = backup.NewEncoder(&buf).Encode(store.Play{
+		Artist:    "Restored Artist",
+		Album:     "Restored Album",
+		Track:     "Restored Song",
+		Source:    "lastfm",
+		Timestamp: timestamp.Add(time.Hour),
+		CreatedAt: timestamp.Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = backup.Restore(ctx, playStore, store.NewNameIndex(db), &buf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = job.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Edited Artist", "Rewritten Song", "Restored Artist", "Restored Album", "Restored Song"} {
+		if !indexed(t, db, name) {
+			t.Errorf("expected %q to be indexed", name)
+		}
+	}
+}
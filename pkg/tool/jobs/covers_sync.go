@@ -8,23 +8,19 @@ import (
 	"log"
 	"time"
 
-	"cloud.google.com/go/bigquery"
 	"github.com/doug-martin/goqu/v9"
-	"google.golang.org/api/iterator"
-	"google.golang.org/api/option"
+
+	"github.com/charlieegan3/music/pkg/tool/store"
+	"github.com/charlieegan3/music/pkg/tool/titles"
 )
 
 // CoversSync is a job that maintains a list of artists and
-// album pairings in the database based on data in bigquery
+// album pairings in the database based on data in the play store
 type CoversSync struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Store store.PlayStore
 
 	ScheduleOverride string
-
-	GoogleCredentialsJSON string
-	ProjectID             string
-	DatasetName           string
-	TableName             string
 }
 
 func (s *CoversSync) Name() string {
@@ -36,53 +32,50 @@ func (s *CoversSync) Run(ctx context.Context) error {
 	errCh := make(chan error)
 
 	go func() {
-		bigqueryClient, err := bigquery.NewClient(
-			ctx,
-			s.ProjectID,
-			option.WithCredentialsJSON([]byte(s.GoogleCredentialsJSON)),
-		)
+		covers, err := s.Store.AlbumCovers(ctx)
 		if err != nil {
-			errCh <- fmt.Errorf("failed to create bq client: %v", err)
+			errCh <- fmt.Errorf("failed to get album covers: %v", err)
 			return
 		}
 
-		queryString := fmt.Sprintf(`
-SELECT
-  artist,
-  album,
-  ARRAY_AGG(album_cover
-  ORDER BY
-    COALESCE(timestamp, created_at) DESC
-  LIMIT
-    1)[
-OFFSET
-  (0)] album_cover,
-FROM %s
-  
-GROUP BY
-  artist,
-  album
-ORDER BY
-  artist,
-  album
-`, fmt.Sprintf("`%s.%s.%s`", s.ProjectID, s.DatasetName, s.TableName))
-		q := bigqueryClient.Query(queryString)
-		it, err := q.Read(ctx)
+		// pages link to covers under the canonical artist name and the
+		// normalized album title
+		aliases, err := store.NewAliases(s.DB).Map(ctx)
+		if err != nil {
+			errCh <- fmt.Errorf("failed to get artist aliases: %v", err)
+			return
+		}
+		normalized, err := store.NewTitles(s.DB, nil).List(ctx)
 		if err != nil {
-			errCh <- fmt.Errorf("failed to read from bq: %v", err)
+			errCh <- fmt.Errorf("failed to get normalized titles: %v", err)
+			return
 		}
+		albums := make(map[string]string)
+		for _, n := range normalized {
+			if n.Field == titles.FieldAlbum {
+				albums[n.Raw] = n.Title
+			}
+		}
+
 		var rows []goqu.Record
-		for {
-			var r artistAlbumRow
-			err := it.Next(&r)
-			if err == iterator.Done {
-				break
+		seen := make(map[[2]string]bool)
+		for _, c := range covers {
+			rows = append(rows, goqu.Record{"artist": c.Artist, "album": c.Album, "url": c.URL})
+			seen[[2]string{c.Artist, c.Album}] = true
+		}
+		for _, c := range covers {
+			artist, album := c.Artist, c.Album
+			if a, ok := aliases[artist]; ok {
+				artist = a
 			}
-			if err != nil {
-				errCh <- fmt.Errorf("failed to read row from bq result: %v", err)
+			if a, ok := albums[album]; ok {
+				album = a
 			}
-
-			rows = append(rows, goqu.Record{"artist": r.Artist, "album": r.Album, "url": r.URL})
+			if seen[[2]string{artist, album}] {
+				continue
+			}
+			rows = append(rows, goqu.Record{"artist": artist, "album": album, "url": c.URL})
+			seen[[2]string{artist, album}] = true
 		}
 
 		goquDB := goqu.New("postgres", s.DB)
@@ -128,9 +121,3 @@ func (s *CoversSync) Schedule() string {
 	}
 	return "0 0 6 * * *"
 }
-
-type artistAlbumRow struct {
-	Artist string
-	Album  string
-	URL    string `bigquery:"album_cover"`
-}
@@ -0,0 +1,188 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+// DedupeDefaultSourcePriority is the order in which sources are preferred
+// when picking the canonical play of a duplicate pair. Spotify plays have ids
+// and durations which last fm scrobbles lack.
+var DedupeDefaultSourcePriority = []string{"spotify", lastFMSourceName}
+
+// Dedupe is a job that finds plays of the same listen recorded by more than
+// one source and marks all but the canonical play as duplicates so that they
+// are not counted twice
+type Dedupe struct {
+	Store store.PlayStore
+
+	ScheduleOverride string
+
+	// Window is the maximum time between two plays of the same track for them
+	// to be the same listen. Last fm records the start of a listen while
+	// spotify records the end, so this should be longer than most tracks.
+	Window time.Duration
+	// Lookback is how far back to check for duplicates
+	Lookback time.Duration
+	// Full checks all plays rather than the Lookback period
+	Full bool
+	// SourcePriority lists sources, most preferred first
+	SourcePriority []string
+}
+
+func (d *Dedupe) Name() string {
+	return "dedupe"
+}
+
+func (d *Dedupe) Run(ctx context.Context) error {
+	doneCh := make(chan bool)
+	errCh := make(chan error)
+
+	go func() {
+		window := d.Window
+		if window == 0 {
+			window = 10 * time.Minute
+		}
+		lookback := d.Lookback
+		if lookback == 0 {
+			lookback = 7 * 24 * time.Hour
+		}
+		priority := d.SourcePriority
+		if len(priority) == 0 {
+			priority = DedupeDefaultSourcePriority
+		}
+
+		to := time.Now().UTC()
+		from := to.Add(-lookback)
+		if d.Full {
+			from = time.Time{}
+		}
+
+		plays, err := d.Store.CanonicalPlays(ctx, from, to)
+		if err != nil {
+			errCh <- fmt.Errorf("failed to get plays: %v", err)
+			return
+		}
+
+		duplicates := findDuplicates(plays, window, priority)
+
+		err = d.Store.MarkDuplicates(ctx, duplicates)
+		if err != nil {
+			errCh <- fmt.Errorf("failed to mark duplicates: %v", err)
+			return
+		}
+
+		log.Printf("marked %d duplicates in %d plays\n", len(duplicates), len(plays))
+
+		doneCh <- true
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case e := <-errCh:
+		return fmt.Errorf("job failed with error: %s", e)
+	case <-doneCh:
+		return nil
+	}
+}
+
+func (d *Dedupe) Timeout() time.Duration {
+	if d.Full {
+		return 30 * time.Minute
+	}
+	return time.Minute
+}
+
+func (d *Dedupe) Schedule() string {
+	if d.ScheduleOverride != "" {
+		return d.ScheduleOverride
+	}
+	return "0 30 6 * * *"
+}
+
+// findDuplicates pairs plays, sorted oldest first, from different sources of
+// the same track within window of each other. Each play is paired at most
+// once so that repeated listens to a track are kept.
+func findDuplicates(plays []store.Play, window time.Duration, priority []string) []store.Duplicate {
+	rank := make(map[string]int)
+	for i, source := range priority {
+		rank[source] = i
+	}
+	sourceRank := func(source string) int {
+		if r, ok := rank[source]; ok {
+			return r
+		}
+		return len(priority)
+	}
+
+	keys := make([]string, len(plays))
+	for i, p := range plays {
+		keys[i] = dedupeKey(p)
+	}
+
+	paired := make([]bool, len(plays))
+	var duplicates []store.Duplicate
+	for i := range plays {
+		if paired[i] {
+			continue
+		}
+
+		for j := i + 1; j < len(plays); j++ {
+			if plays[j].Timestamp.Sub(plays[i].Timestamp) > window {
+				break
+			}
+			if paired[j] || plays[j].Source == plays[i].Source || keys[j] != keys[i] {
+				continue
+			}
+
+			canonical, duplicate := plays[i], plays[j]
+			if sourceRank(duplicate.Source) < sourceRank(canonical.Source) {
+				canonical, duplicate = duplicate, canonical
+			}
+
+			duplicates = append(duplicates, store.Duplicate{
+				Source:             duplicate.Source,
+				Timestamp:          duplicate.Timestamp,
+				CanonicalSource:    canonical.Source,
+				CanonicalTimestamp: canonical.Timestamp,
+			})
+			paired[i], paired[j] = true, true
+			break
+		}
+	}
+
+	return duplicates
+}
+
+// dedupeKey is the normalized primary artist and track name of a play. Only
+// the first artist is used as spotify lists all artists while last fm
+// usually only has the first.
+func dedupeKey(p store.Play) string {
+	artist := strings.ToLower(p.Artist)
+	for _, sep := range []string{", ", " feat. ", " ft. ", " & "} {
+		artist, _, _ = strings.Cut(artist, sep)
+	}
+
+	return normalizeName(artist) + "\x00" + normalizeName(p.Track)
+}
+
+// normalizeName lower cases a name and removes punctuation and extra spaces
+func normalizeName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune(' ')
+		}
+	}
+
+	return strings.Join(strings.Fields(b.String()), " ")
+}
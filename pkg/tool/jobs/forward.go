@@ -0,0 +1,378 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+
+	"github.com/charlieegan3/music/pkg/tool/backup"
+	"github.com/charlieegan3/music/pkg/tool/forward"
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+const (
+	forwardDefaultBatchSize   = 100
+	forwardDefaultMaxAttempts = 3
+)
+
+// Forward is a job that sends new plays to each target. Each target has a
+// cursor of the last play sent, in the order plays were saved, so plays of
+// the past loaded by a backfill or import are also sent. A new target starts
+// from the time it's first run, and plays restored from a backup keep the
+// time they were first saved, so neither are sent. Plays which a target
+// rejects are saved as dead letters rather than blocking the target. Plays
+// are sent at least once, a failed run may send some plays again.
+type Forward struct {
+	DB    *sql.DB
+	Store store.PlayStore
+
+	ScheduleOverride string
+
+	Targets []forward.Target
+
+	// BatchSize is the number of plays sent in one request
+	BatchSize int
+	// MaxAttempts is the number of times a request is tried before giving up
+	MaxAttempts int
+	// RetryInterval is the time before the first retry, it doubles each time
+	RetryInterval time.Duration
+
+	// DeadLetters sends the dead letters of each target again instead of new
+	// plays, those which are accepted are removed
+	DeadLetters bool
+}
+
+type forwardCursor struct {
+	Target            string `db:"target"`
+	CreatedAtUnixNano int64  `db:"created_at_unix_nano"`
+	Source            string `db:"source"`
+	TimestampUnixNano int64  `db:"timestamp_unix_nano"`
+}
+
+type forwardDeadLetter struct {
+	Source            string `db:"source"`
+	TimestampUnixNano int64  `db:"timestamp_unix_nano"`
+	Play              string `db:"play"`
+}
+
+func (f *Forward) Name() string {
+	return "forward"
+}
+
+func (f *Forward) Run(ctx context.Context) error {
+	doneCh := make(chan bool)
+	errCh := make(chan error)
+
+	go func() {
+		goquDB := goqu.New("postgres", f.DB)
+
+		// one failing target doesn't stop plays being sent to the others
+		var failed []string
+		for _, target := range f.Targets {
+			var err error
+			if f.DeadLetters {
+				err = f.retryDeadLetters(ctx, goquDB, target)
+			} else {
+				err = f.forwardNew(ctx, goquDB, target)
+			}
+			if err != nil {
+				log.Printf("failed to forward to %s: %v\n", target.Name, err)
+				failed = append(failed, fmt.Sprintf("%s: %v", target.Name, err))
+			}
+		}
+
+		if len(failed) > 0 {
+			errCh <- fmt.Errorf("failed to forward plays: %s", strings.Join(failed, "; "))
+			return
+		}
+
+		doneCh <- true
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case e := <-errCh:
+		return fmt.Errorf("job failed with error: %s", e)
+	case <-doneCh:
+		return nil
+	}
+}
+
+// forwardNew sends the plays saved since the target's cursor. A new target
+// starts from now rather than sending the whole history.
+func (f *Forward) forwardNew(ctx context.Context, goquDB *goqu.Database, target forward.Target) error {
+	var saved forwardCursor
+	found, err := goquDB.From("music.forward_cursors").
+		Where(goqu.C("target").Eq(target.Name)).
+		ScanStructContext(ctx, &saved)
+	if err != nil {
+		return fmt.Errorf("failed to load cursor: %v", err)
+	}
+
+	cursor := store.CreatedCursor{
+		CreatedAt: time.Unix(0, saved.CreatedAtUnixNano).UTC(),
+		Source:    saved.Source,
+		Timestamp: time.Unix(0, saved.TimestampUnixNano).UTC(),
+	}
+	if !found {
+		cursor = store.CreatedCursor{CreatedAt: time.Now().UTC()}
+		err = saveForwardCursor(ctx, goquDB, target.Name, cursor)
+		if err != nil {
+			return err
+		}
+		log.Printf("forwarding plays saved from now to %s\n", target.Name)
+		return nil
+	}
+
+	batchSize := f.BatchSize
+	if batchSize == 0 {
+		batchSize = forwardDefaultBatchSize
+	}
+
+	var sent, deadLetters int
+	for {
+		plays, err := f.Store.PlaysCreatedAfter(ctx, cursor, batchSize)
+		if err != nil {
+			return fmt.Errorf("failed to get plays: %v", err)
+		}
+		if len(plays) == 0 {
+			break
+		}
+
+		var batch []store.Play
+		for _, p := range plays {
+			if target.Forwards(p) {
+				batch = append(batch, p)
+			}
+		}
+
+		rejected, err := f.sendBatch(ctx, goquDB, target, batch)
+		if err != nil {
+			return err
+		}
+		sent += len(batch) - rejected
+		deadLetters += rejected
+
+		cursor = plays[len(plays)-1].Cursor()
+		err = saveForwardCursor(ctx, goquDB, target.Name, cursor)
+		if err != nil {
+			return err
+		}
+
+		if len(plays) < batchSize {
+			break
+		}
+	}
+
+	log.Printf("forwarded %d plays to %s, %d dead letters\n", sent, target.Name, deadLetters)
+
+	return nil
+}
+
+// sendBatch sends plays to a target. When the batch is rejected each play is
+// sent alone so that only the plays which are rejected become dead letters.
+// The number of dead letters is returned.
+func (f *Forward) sendBatch(ctx context.Context, goquDB *goqu.Database, target forward.Target, plays []store.Play) (int, error) {
+	if len(plays) == 0 {
+		return 0, nil
+	}
+
+	err := f.send(ctx, target, plays)
+	if err == nil {
+		return 0, nil
+	}
+	if !forward.Permanent(err) {
+		return 0, err
+	}
+
+	if len(plays) > 1 {
+		log.Printf("batch rejected by %s, sending plays one at a time: %v\n", target.Name, err)
+	}
+
+	var rejected int
+	for _, p := range plays {
+		if len(plays) > 1 {
+			err = f.send(ctx, target, []store.Play{p})
+			if err == nil {
+				continue
+			}
+			if !forward.Permanent(err) {
+				return rejected, err
+			}
+		}
+
+		err = saveForwardDeadLetter(ctx, goquDB, target.Name, p, err)
+		if err != nil {
+			return rejected, err
+		}
+		rejected++
+	}
+
+	return rejected, nil
+}
+
+// send tries to send plays until they are accepted, permanently rejected or
+// there have been MaxAttempts attempts
+func (f *Forward) send(ctx context.Context, target forward.Target, plays []store.Play) error {
+	maxAttempts := f.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = forwardDefaultMaxAttempts
+	}
+	backoff := f.RetryInterval
+	if backoff == 0 {
+		backoff = 5 * time.Second
+	}
+
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		err = target.Sender.Send(ctx, plays)
+		if err == nil || forward.Permanent(err) {
+			return err
+		}
+		if attempt == maxAttempts {
+			break
+		}
+
+		log.Printf("attempt %d to send to %s failed, waiting %s: %v\n", attempt, target.Name, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	return fmt.Errorf("giving up after %d attempts: %w", maxAttempts, err)
+}
+
+// retryDeadLetters sends each dead letter for a target again
+func (f *Forward) retryDeadLetters(ctx context.Context, goquDB *goqu.Database, target forward.Target) error {
+	var deadLetters []forwardDeadLetter
+	err := goquDB.From("music.forward_dead_letters").
+		Select("source", "timestamp_unix_nano", "play").
+		Where(goqu.C("target").Eq(target.Name)).
+		Order(goqu.C("timestamp_unix_nano").Asc()).
+		ScanStructsContext(ctx, &deadLetters)
+	if err != nil {
+		return fmt.Errorf("failed to load dead letters: %v", err)
+	}
+
+	var accepted int
+	for _, d := range deadLetters {
+		decoder, err := backup.NewDecoder(strings.NewReader(d.Play))
+		if err != nil {
+			return err
+		}
+		p, err := decoder.Next()
+		if err != nil {
+			return fmt.Errorf("failed to decode dead letter: %v", err)
+		}
+
+		where := goqu.Ex{
+			"target":              target.Name,
+			"source":              d.Source,
+			"timestamp_unix_nano": d.TimestampUnixNano,
+		}
+
+		sendErr := f.send(ctx, target, []store.Play{p})
+		if sendErr != nil && !forward.Permanent(sendErr) {
+			return sendErr
+		}
+
+		if sendErr != nil {
+			_, err = goquDB.Update("music.forward_dead_letters").
+				Set(goqu.Record{
+					"error":      sendErr.Error(),
+					"attempts":   goqu.L("attempts + 1"),
+					"updated_at": goqu.L("CURRENT_TIMESTAMP"),
+				}).
+				Where(where).
+				Executor().
+				ExecContext(ctx)
+		} else {
+			accepted++
+			_, err = goquDB.Delete("music.forward_dead_letters").
+				Where(where).
+				Executor().
+				ExecContext(ctx)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update dead letter: %v", err)
+		}
+	}
+
+	log.Printf("%d of %d dead letters accepted by %s\n", accepted, len(deadLetters), target.Name)
+
+	return nil
+}
+
+func saveForwardCursor(ctx context.Context, goquDB *goqu.Database, target string, cursor store.CreatedCursor) error {
+	record := goqu.Record{
+		"target":               target,
+		"created_at_unix_nano": cursor.CreatedAt.UnixNano(),
+		"source":               cursor.Source,
+		"timestamp_unix_nano":  cursor.Timestamp.UnixNano(),
+		"updated_at":           goqu.L("CURRENT_TIMESTAMP"),
+	}
+
+	_, err := goquDB.Insert("music.forward_cursors").
+		Rows(record).
+		OnConflict(goqu.DoUpdate("target", record)).
+		Executor().
+		ExecContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save cursor: %v", err)
+	}
+
+	return nil
+}
+
+func saveForwardDeadLetter(ctx context.Context, goquDB *goqu.Database, target string, p store.Play, sendErr error) error {
+	var buf bytes.Buffer
+	err := backup.NewEncoder(&buf).Encode(p)
+	if err != nil {
+		return fmt.Errorf("failed to encode dead letter: %v", err)
+	}
+
+	log.Printf("%s rejected play of %s by %s at %s: %v\n", target, p.Track, p.Artist, p.Timestamp, sendErr)
+
+	_, err = goquDB.Insert("music.forward_dead_letters").
+		Rows(goqu.Record{
+			"target":              target,
+			"source":              p.Source,
+			"timestamp_unix_nano": p.Timestamp.UnixNano(),
+			"play":                strings.TrimSpace(buf.String()),
+			"error":               sendErr.Error(),
+		}).
+		OnConflict(goqu.DoUpdate("target, source, timestamp_unix_nano", goqu.Record{
+			"error":      sendErr.Error(),
+			"updated_at": goqu.L("CURRENT_TIMESTAMP"),
+		})).
+		Executor().
+		ExecContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save dead letter: %v", err)
+	}
+
+	return nil
+}
+
+func (f *Forward) Timeout() time.Duration {
+	// the cursor is saved after each batch, so a timed out run resumes
+	return 15 * time.Minute
+}
+
+func (f *Forward) Schedule() string {
+	if f.ScheduleOverride != "" {
+		return f.ScheduleOverride
+	}
+	return "0 */5 * * * *"
+}
@@ -0,0 +1,319 @@
+package jobs_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/charlieegan3/music/pkg/tool"
+	"github.com/charlieegan3/music/pkg/tool/forward"
+	"github.com/charlieegan3/music/pkg/tool/jobs"
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+// receiver is a webhook target which records the tracks of the plays it
+// accepts, respond returns the status for each request
+type receiver struct {
+	mu       sync.Mutex
+	requests int
+	accepted []string
+	respond  func(request int, tracks []string) int
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Plays []struct {
+			Track string `json:"track"`
+		} `json:"plays"`
+	}
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var tracks []string
+	for _, p := range body.Plays {
+		tracks = append(tracks, p.Track)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.requests++
+	status := http.StatusOK
+	if r.respond != nil {
+		status = r.respond(r.requests, tracks)
+	}
+	if status == http.StatusOK {
+		r.accepted = append(r.accepted, tracks...)
+	}
+	w.WriteHeader(status)
+}
+
+// rejecting responds with 400 to requests including any of the tracks
+func rejecting(rejected ...string) func(int, []string) int {
+	return func(_ int, tracks []string) int {
+		for _, t := range tracks {
+			for _, r := range rejected {
+				if t == r {
+					return http.StatusBadRequest
+				}
+			}
+		}
+		return http.StatusOK
+	}
+}
+
+// newForward returns a job sending to a receiver, it has been run once so
+// that plays inserted after it are new
+func newForward(t *testing.T, r *receiver) (*jobs.Forward, *sql.DB) {
+	t.Helper()
+
+	db, err := tool.OpenSQLite(filepath.Join(t.TempDir(), "music.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	job := &jobs.Forward{
+		DB:    db,
+		Store: store.NewSQLite(db),
+		Targets: []forward.Target{
+			{Name: "test", Sender: &forward.Webhook{URL: server.URL}},
+		},
+		BatchSize:     2,
+		MaxAttempts:   1,
+		RetryInterval: time.Millisecond,
+	}
+
+	err = job.Run(context.Background())
+	if err != nil {
+		t.Fatalf("failed to start forwarding: %v", err)
+	}
+
+	return job, db
+}
+
+// insertPlays saves a play for each track, saved in order after now
+func insertPlays(t *testing.T, job *jobs.Forward, tracks ...string) {
+	t.Helper()
+
+	now := time.Now().UTC()
+	var plays []store.Play
+	for i, track := range tracks {
+		plays = append(plays, store.Play{
+			Artist:    "Artist",
+			Album:     "Album",
+			Track:     track,
+			Source:    "lastfm",
+			Timestamp: now.Add(time.Duration(i-len(tracks)) * time.Minute),
+			CreatedAt: now.Add(time.Duration(i+1) * time.Millisecond),
+		})
+	}
+
+	err := job.Store.InsertPlays(context.Background(), plays)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// deadLetters returns the number of attempts for each dead letter's track
+func deadLetters(t *testing.T, db *sql.DB) map[string]int {
+	t.Helper()
+
+	rows, err := db.Query("SELECT play, attempts FROM music.forward_dead_letters WHERE target = 'test'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	result := make(map[string]int)
+	for rows.Next() {
+		var play string
+		var attempts int
+		err = rows.Scan(&play, &attempts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p struct {
+			Track string `json:"track"`
+		}
+		err = json.Unmarshal([]byte(play), &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result[p.Track] = attempts
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
+
+func TestForwardResumesAfterFailedBatch(t *testing.T) {
+	r := &receiver{}
+	job, _ := newForward(t, r)
+	if r.requests != 0 {
+		t.Fatalf("expected a new target not to be sent old plays, got %d requests", r.requests)
+	}
+
+	insertPlays(t, job, "1", "2", "3", "4", "5")
+
+	// the second batch fails, the first isn't sent again
+	r.respond = func(_ int, tracks []string) int {
+		if tracks[0] == "3" {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	}
+	err := job.Run(context.Background())
+	if err == nil {
+		t.Fatal("expected the failed batch to fail the run")
+	}
+	if expected := []string{"1", "2"}; !reflect.DeepEqual(r.accepted, expected) {
+		t.Fatalf("expected %v to be accepted, got %v", expected, r.accepted)
+	}
+
+	r.respond = nil
+	err = job.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"1", "2", "3", "4", "5"}; !reflect.DeepEqual(r.accepted, expected) {
+		t.Fatalf("expected %v to be accepted, got %v", expected, r.accepted)
+	}
+
+	// there's nothing new to send
+	requests := r.requests
+	err = job.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.requests != requests {
+		t.Fatalf("expected no requests without new plays, got %d", r.requests-requests)
+	}
+}
+
+func TestForwardRetriesServerErrors(t *testing.T) {
+	r := &receiver{}
+	job, _ := newForward(t, r)
+	job.MaxAttempts = 3
+	job.RetryInterval = 20 * time.Millisecond
+
+	insertPlays(t, job, "1")
+
+	r.respond = func(request int, _ []string) int {
+		if request <= 2 {
+			return http.StatusBadGateway
+		}
+		return http.StatusOK
+	}
+
+	start := time.Now()
+	err := job.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.requests != 3 {
+		t.Fatalf("expected 3 attempts, got %d", r.requests)
+	}
+	// the wait doubles after each attempt
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Fatalf("expected to wait at least 60ms between attempts, waited %s", elapsed)
+	}
+	if expected := []string{"1"}; !reflect.DeepEqual(r.accepted, expected) {
+		t.Fatalf("expected %v to be accepted, got %v", expected, r.accepted)
+	}
+
+	// the last attempt fails the run
+	insertPlays(t, job, "2")
+	r.requests = 0
+	r.respond = func(int, []string) int { return http.StatusInternalServerError }
+
+	err = job.Run(context.Background())
+	if err == nil {
+		t.Fatal("expected the run to fail")
+	}
+	if r.requests != 3 {
+		t.Fatalf("expected 3 attempts, got %d", r.requests)
+	}
+}
+
+func TestForwardRejectedBatch(t *testing.T) {
+	r := &receiver{respond: rejecting("bad")}
+	job, db := newForward(t, r)
+	job.BatchSize = 3
+
+	insertPlays(t, job, "1", "bad", "2")
+
+	err := job.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the batch is rejected, then each play is sent alone
+	if r.requests != 4 {
+		t.Fatalf("expected 4 requests, got %d", r.requests)
+	}
+	if expected := []string{"1", "2"}; !reflect.DeepEqual(r.accepted, expected) {
+		t.Fatalf("expected %v to be accepted, got %v", expected, r.accepted)
+	}
+	if expected := map[string]int{"bad": 1}; !reflect.DeepEqual(deadLetters(t, db), expected) {
+		t.Fatalf("expected dead letters %v, got %v", expected, deadLetters(t, db))
+	}
+}
+
+func TestForwardDeadLetters(t *testing.T) {
+	r := &receiver{respond: rejecting("bad", "worse")}
+	job, db := newForward(t, r)
+
+	insertPlays(t, job, "bad", "worse")
+
+	err := job.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]int{"bad": 1, "worse": 1}; !reflect.DeepEqual(deadLetters(t, db), expected) {
+		t.Fatalf("expected dead letters %v, got %v", expected, deadLetters(t, db))
+	}
+
+	// accepted dead letters are removed and the others are tried again later
+	r.respond = rejecting("worse")
+	job.DeadLetters = true
+	for i := 0; i < 2; i++ {
+		err = job.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if expected := map[string]int{"worse": 3}; !reflect.DeepEqual(deadLetters(t, db), expected) {
+		t.Fatalf("expected dead letters %v, got %v", expected, deadLetters(t, db))
+	}
+	if expected := []string{"bad"}; !reflect.DeepEqual(r.accepted, expected) {
+		t.Fatalf("expected %v to be accepted, got %v", expected, r.accepted)
+	}
+
+	// a server error stops the run without changing the dead letters
+	r.respond = func(int, []string) int { return http.StatusServiceUnavailable }
+	err = job.Run(context.Background())
+	if err == nil {
+		t.Fatal("expected the run to fail")
+	}
+	if expected := map[string]int{"worse": 3}; !reflect.DeepEqual(deadLetters(t, db), expected) {
+		t.Fatalf("expected dead letters %v, got %v", expected, deadLetters(t, db))
+	}
+}
@@ -9,20 +9,21 @@ import (
 	"log"
 	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"time"
 
-	"cloud.google.com/go/bigquery"
-	"google.golang.org/api/option"
-
-	"github.com/charlieegan3/music/pkg/tool/bq"
-	"github.com/charlieegan3/music/pkg/tool/utils"
+	"github.com/charlieegan3/music/pkg/tool/events"
+	"github.com/charlieegan3/music/pkg/tool/nowplaying"
+	"github.com/charlieegan3/music/pkg/tool/store"
 )
 
 const lastFMSourceName = "lastfm"
 
-// LastFMSync is a job that syncs last fm plays to bigquery
+const lastFMDefaultEndpoint = "http://ws.audioscrobbler.com/2.0/"
+
+// LastFMSync is a job that syncs last fm plays to the play store
 type LastFMSync struct {
 	ScheduleOverride string
 	Endpoint         string
@@ -30,10 +31,11 @@ type LastFMSync struct {
 	APIKey   string
 	Username string
 
-	GoogleCredentialsJSON string
-	ProjectID             string
-	DatasetName           string
-	TableName             string
+	Store store.PlayStore
+	// NowPlaying is optional, when set the now playing track is saved
+	NowPlaying *nowplaying.Store
+	// Events is optional, when set inserted plays are published to it
+	Events *events.Bus
 }
 
 func (s *LastFMSync) Name() string {
@@ -45,66 +47,35 @@ func (s *LastFMSync) Run(ctx context.Context) error {
 	errCh := make(chan error)
 
 	go func() {
-
-		bigqueryClient, err := bigquery.NewClient(
-			ctx,
-			s.ProjectID,
-			option.WithCredentialsJSON([]byte(s.GoogleCredentialsJSON)),
-		)
-		if err != nil {
-			errCh <- fmt.Errorf("failed to create bq client: %v", err)
-			return
-		}
-		schema, err := bigquery.SchemaFromJSON([]byte(bq.JSONSchema))
-		if err != nil {
-			errCh <- fmt.Errorf("failed to parse schema: %v", err)
-			return
-		}
-
-		client := &http.Client{}
-
-		req, err := http.NewRequest(
-			"GET",
-			fmt.Sprintf(
-				"http://ws.audioscrobbler.com/2.0/?method=user.getrecenttracks&user=%s&api_key=%s&format=json",
-				s.Username,
-				s.APIKey,
-			),
-			nil,
-		)
-
-		resp, err := client.Do(req)
+		results, err := getRecentTracks(ctx, &http.Client{}, s.Endpoint, url.Values{
+			"user":    []string{s.Username},
+			"api_key": []string{s.APIKey},
+		})
 		if err != nil {
 			errCh <- fmt.Errorf("failed to get last fm plays: %w", err)
 			return
 		}
 
-		respBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			errCh <- fmt.Errorf("failed to read response body: %w", err)
-			return
-		}
-
-		var results lastFMResponse
-		err = json.Unmarshal(respBody, &results)
-		if err != nil {
-			errCh <- fmt.Errorf("failed to unmarshal response body: %w", err)
-			return
+		if s.NowPlaying != nil {
+			err = s.saveNowPlaying(ctx, results)
+			if err != nil {
+				log.Printf("failed to save now playing: %v\n", err)
+			}
 		}
 
-		mostRecentPlays, err := utils.MostRecentTimestamps(ctx, bigqueryClient, s.ProjectID, s.DatasetName, s.TableName, lastFMSourceName, 1)
+		mostRecentPlays, err := s.Store.MostRecentTimestamps(ctx, lastFMSourceName, 1)
 		if err != nil {
 			errCh <- fmt.Errorf("failed to get most recent timestamp: %w", err)
 			return
 		}
 
-		if len(mostRecentPlays) == 0 {
-			errCh <- fmt.Errorf("no most recent timestamp found")
-			return
+		// when there are no plays yet, all plays on the first page are new.
+		// The backfill job can be used to load older history.
+		var mostRecentPlayTime time.Time
+		if len(mostRecentPlays) > 0 {
+			mostRecentPlayTime = mostRecentPlays[0].UTC()
 		}
 
-		mostRecentPlayTime := mostRecentPlays[0].UTC()
-
 		var newCompletedPlays []play
 		for _, p := range results.RecentTracks.Items {
 			if p.Date.Timestamp == "" {
@@ -143,47 +114,22 @@ func (s *LastFMSync) Run(ctx context.Context) error {
 			newCompletedPlays = append(newCompletedPlays, p)
 		}
 
-		var vss []*bigquery.ValuesSaver
+		var plays []store.Play
 		for _, p := range newCompletedPlays {
-			var image string
-			if len(p.Image) > 0 {
-				image = p.Image[len(p.Image)-1].Text
+			sp, err := p.storePlay()
+			if err != nil {
+				errCh <- fmt.Errorf("failed to convert play: %w", err)
+				return
 			}
-			vss = append(vss, &bigquery.ValuesSaver{
-				Schema:   schema,
-				InsertID: fmt.Sprintf("%v", p.Date.Timestamp),
-				Row: []bigquery.Value{
-					p.Name,
-					p.Artist.Name,
-					p.Album.Name,
-					p.Date.Timestamp,
-					bigquery.NullInt64{Int64: 0, Valid: false},
-					"",
-					image,
-					time.Now().Unix(),
-					lastFMSourceName,
-					"",
-					"",
-					"",
-					"",
-					"",
-					"",
-				},
-			})
+			plays = append(plays, sp)
 		}
 
-		// upload the items
-		inserter := bigqueryClient.Dataset(s.DatasetName).Table(s.TableName).Inserter()
-		err = inserter.Put(ctx, vss)
+		err = s.Store.InsertPlays(ctx, plays)
 		if err != nil {
-			if pmErr, ok := err.(bigquery.PutMultiError); ok {
-				for _, rowInsertionError := range pmErr {
-					log.Println(rowInsertionError.Errors)
-				}
-			}
-
 			errCh <- fmt.Errorf("failed to insert plays: %w", err)
+			return
 		}
+		s.Events.Publish(plays...)
 
 		for _, play := range newCompletedPlays {
 			fmt.Fprintf(os.Stdout, "Inserted %s %s %s\n", play.Name, play.Artist.Name, play.Date.Timestamp)
@@ -202,6 +148,26 @@ func (s *LastFMSync) Run(ctx context.Context) error {
 	}
 }
 
+// saveNowPlaying saves the now playing item, which is the item with no date,
+// or clears the now playing track when there isn't one
+func (s *LastFMSync) saveNowPlaying(ctx context.Context, results lastFMResponse) error {
+	for _, p := range results.RecentTracks.Items {
+		if p.Attr.NowPlaying != "true" {
+			continue
+		}
+
+		return s.NowPlaying.Set(ctx, nowplaying.Track{
+			Source:     lastFMSourceName,
+			Track:      p.Name,
+			Artist:     p.Artist.Name,
+			Album:      p.Album.Name,
+			AlbumCover: p.image(),
+		})
+	}
+
+	return s.NowPlaying.Clear(ctx, lastFMSourceName)
+}
+
 func (s *LastFMSync) Timeout() time.Duration {
 	return 30 * time.Second
 }
@@ -234,10 +200,109 @@ type play struct {
 	Name       string `json:"name"`
 	Streamable string `json:"streamable"`
 	URL        string `json:"url"`
+	Attr       struct {
+		NowPlaying string `json:"nowplaying"`
+	} `json:"@attr"`
+}
+
+// image returns the url of the largest image
+func (p play) image() string {
+	if len(p.Image) == 0 {
+		return ""
+	}
+	return p.Image[len(p.Image)-1].Text
+}
+
+// storePlay converts a completed play from the api to a row for the store
+func (p play) storePlay() (store.Play, error) {
+	i, err := strconv.ParseInt(p.Date.Timestamp, 10, 64)
+	if err != nil {
+		return store.Play{}, fmt.Errorf("failed to parse timestamp: %w", err)
+	}
+
+	return store.Play{
+		Track:      p.Name,
+		Artist:     p.Artist.Name,
+		Album:      p.Album.Name,
+		Timestamp:  time.Unix(i, 0).UTC(),
+		AlbumCover: p.image(),
+		CreatedAt:  time.Now(),
+		Source:     lastFMSourceName,
+		TrackMBID:  p.MBID,
+		ArtistMBID: p.Artist.MBID,
+		AlbumMBID:  p.Album.MBID,
+		// last.fm only gives the primary artist
+		Artists: []string{p.Artist.Name},
+	}, nil
 }
 
 type lastFMResponse struct {
 	RecentTracks struct {
 		Items []play `json:"track"`
+		Attr  struct {
+			Page       string `json:"page"`
+			TotalPages string `json:"totalPages"`
+			Total      string `json:"total"`
+		} `json:"@attr"`
 	} `json:"recenttracks"`
+
+	// Error and Message are set when the api returns an error
+	Error   int    `json:"error"`
+	Message string `json:"message"`
+}
+
+// lastFMRateLimitError is returned when the api asks for fewer requests
+type lastFMRateLimitError struct {
+	Message string
+}
+
+func (e *lastFMRateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded: %s", e.Message)
+}
+
+// getRecentTracks calls user.getrecenttracks with params such as user,
+// api_key, page, from and to. An empty endpoint uses the last.fm api.
+func getRecentTracks(ctx context.Context, client *http.Client, endpoint string, params url.Values) (lastFMResponse, error) {
+	var results lastFMResponse
+
+	if endpoint == "" {
+		endpoint = lastFMDefaultEndpoint
+	}
+
+	params.Set("method", "user.getrecenttracks")
+	params.Set("format", "json")
+
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint+"?"+params.Encode(), nil)
+	if err != nil {
+		return results, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return results, fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return results, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	err = json.Unmarshal(respBody, &results)
+	if err != nil {
+		return results, fmt.Errorf("failed to unmarshal response body (status %d): %w", resp.StatusCode, err)
+	}
+
+	// 29 is the last.fm error code for rate limiting
+	if resp.StatusCode == http.StatusTooManyRequests || results.Error == 29 {
+		return results, &lastFMRateLimitError{Message: results.Message}
+	}
+	if results.Error != 0 {
+		return results, fmt.Errorf("api error %d: %s", results.Error, results.Message)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return results, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	return results, nil
 }
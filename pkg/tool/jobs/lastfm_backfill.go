@@ -0,0 +1,279 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+const lastFMBackfillPageSize = 200
+
+const lastFMBackfillMaxAttempts = 5
+
+// LastFMBackfill is a job that loads the full last fm history for a user into
+// the play store. Pages are walked oldest last within a fixed window and
+// progress is saved after each page so that an interrupted run can resume.
+type LastFMBackfill struct {
+	DB    *sql.DB
+	Store store.PlayStore
+
+	ScheduleOverride string
+	Endpoint         string
+
+	APIKey   string
+	Username string
+
+	// From is the earliest play to load, the zero time loads all history
+	From time.Time
+	// RequestInterval is the minimum time between api requests
+	RequestInterval time.Duration
+	// Restart discards any saved checkpoint and starts a new window
+	Restart bool
+}
+
+type lastFMBackfillCheckpoint struct {
+	Username   string `db:"username"`
+	FromUnix   int64  `db:"from_unix"`
+	ToUnix     int64  `db:"to_unix"`
+	Page       int    `db:"page"`
+	TotalPages int    `db:"total_pages"`
+	Completed  bool   `db:"completed"`
+}
+
+func (s *LastFMBackfill) Name() string {
+	return "lastfm-backfill"
+}
+
+func (s *LastFMBackfill) Run(ctx context.Context) error {
+	doneCh := make(chan bool)
+	errCh := make(chan error)
+
+	go func() {
+		goquDB := goqu.New("postgres", s.DB)
+
+		var checkpoint lastFMBackfillCheckpoint
+		found, err := goquDB.From("music.lastfm_backfill").
+			Where(goqu.C("username").Eq(s.Username)).
+			ScanStructContext(ctx, &checkpoint)
+		if err != nil {
+			errCh <- fmt.Errorf("failed to load checkpoint: %v", err)
+			return
+		}
+
+		if !found || s.Restart {
+			var from int64
+			if !s.From.IsZero() {
+				from = s.From.Unix()
+			}
+			checkpoint = lastFMBackfillCheckpoint{
+				Username: s.Username,
+				FromUnix: from,
+				ToUnix:   time.Now().Unix(),
+			}
+			err = saveLastFMBackfillCheckpoint(ctx, goquDB, checkpoint)
+			if err != nil {
+				errCh <- err
+				return
+			}
+		}
+
+		if checkpoint.Completed {
+			log.Printf("backfill for %s already completed\n", s.Username)
+			doneCh <- true
+			return
+		}
+
+		interval := s.RequestInterval
+		if interval == 0 {
+			// last.fm asks for no more than 5 requests per second
+			interval = 250 * time.Millisecond
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		client := &http.Client{}
+
+		for page := checkpoint.Page + 1; ; page++ {
+			select {
+			case <-ctx.Done():
+				errCh <- ctx.Err()
+				return
+			case <-ticker.C:
+			}
+
+			results, err := s.getPage(ctx, client, checkpoint, page)
+			if err != nil {
+				errCh <- fmt.Errorf("failed to get page %d: %v", page, err)
+				return
+			}
+
+			inserted, err := s.savePage(ctx, results)
+			if err != nil {
+				errCh <- fmt.Errorf("failed to save page %d: %v", page, err)
+				return
+			}
+
+			totalPages, _ := strconv.Atoi(results.RecentTracks.Attr.TotalPages)
+
+			checkpoint.Page = page
+			checkpoint.TotalPages = totalPages
+			checkpoint.Completed = page >= totalPages
+			err = saveLastFMBackfillCheckpoint(ctx, goquDB, checkpoint)
+			if err != nil {
+				errCh <- err
+				return
+			}
+
+			log.Printf("backfilled page %d/%d for %s, %d new plays\n", page, totalPages, s.Username, inserted)
+
+			if checkpoint.Completed {
+				break
+			}
+		}
+
+		doneCh <- true
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case e := <-errCh:
+		return fmt.Errorf("job failed with error: %s", e)
+	case <-doneCh:
+		return nil
+	}
+}
+
+// getPage requests a page of the checkpoint window, retrying with backoff
+// when rate limited or when the request fails
+func (s *LastFMBackfill) getPage(
+	ctx context.Context,
+	client *http.Client,
+	checkpoint lastFMBackfillCheckpoint,
+	page int,
+) (lastFMResponse, error) {
+	backoff := 10 * time.Second
+
+	var err error
+	var results lastFMResponse
+	for attempt := 1; attempt <= lastFMBackfillMaxAttempts; attempt++ {
+		results, err = getRecentTracks(ctx, client, s.Endpoint, url.Values{
+			"user":    []string{s.Username},
+			"api_key": []string{s.APIKey},
+			"from":    []string{strconv.FormatInt(checkpoint.FromUnix, 10)},
+			"to":      []string{strconv.FormatInt(checkpoint.ToUnix, 10)},
+			"page":    []string{strconv.Itoa(page)},
+			"limit":   []string{strconv.Itoa(lastFMBackfillPageSize)},
+		})
+		if err == nil {
+			return results, nil
+		}
+
+		var rateLimitErr *lastFMRateLimitError
+		if errors.As(err, &rateLimitErr) {
+			log.Printf("rate limited on page %d, waiting %s\n", page, backoff)
+		} else {
+			log.Printf("attempt %d for page %d failed, waiting %s: %v\n", attempt, page, backoff, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return results, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	return results, fmt.Errorf("giving up after %d attempts: %w", lastFMBackfillMaxAttempts, err)
+}
+
+// savePage inserts the completed plays on a page which are not already in
+// the store and returns the number of new plays
+func (s *LastFMBackfill) savePage(ctx context.Context, results lastFMResponse) (int, error) {
+	var plays []store.Play
+	for _, p := range results.RecentTracks.Items {
+		// the now playing item has no date
+		if p.Date.Timestamp == "" {
+			continue
+		}
+
+		sp, err := p.storePlay()
+		if err != nil {
+			return 0, err
+		}
+		plays = append(plays, sp)
+	}
+
+	if len(plays) == 0 {
+		return 0, nil
+	}
+
+	// plays are newest first
+	existing, err := s.Store.SourceTimestamps(ctx, lastFMSourceName, plays[len(plays)-1].Timestamp, plays[0].Timestamp)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get existing timestamps: %v", err)
+	}
+	seen := make(map[int64]bool)
+	for _, t := range existing {
+		seen[t.Unix()] = true
+	}
+
+	var newPlays []store.Play
+	for _, p := range plays {
+		if seen[p.Timestamp.Unix()] {
+			continue
+		}
+		seen[p.Timestamp.Unix()] = true
+		newPlays = append(newPlays, p)
+	}
+
+	err = s.Store.InsertPlays(ctx, newPlays)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert plays: %v", err)
+	}
+
+	return len(newPlays), nil
+}
+
+func saveLastFMBackfillCheckpoint(ctx context.Context, goquDB *goqu.Database, checkpoint lastFMBackfillCheckpoint) error {
+	record := goqu.Record{
+		"username":    checkpoint.Username,
+		"from_unix":   checkpoint.FromUnix,
+		"to_unix":     checkpoint.ToUnix,
+		"page":        checkpoint.Page,
+		"total_pages": checkpoint.TotalPages,
+		"completed":   checkpoint.Completed,
+		"updated_at":  goqu.L("CURRENT_TIMESTAMP"),
+	}
+
+	_, err := goquDB.Insert("music.lastfm_backfill").
+		Rows(record).
+		OnConflict(goqu.DoUpdate("username", record)).
+		Executor().
+		ExecContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save checkpoint: %v", err)
+	}
+
+	return nil
+}
+
+func (s *LastFMBackfill) Timeout() time.Duration {
+	// progress is saved after each page, so a timed out run resumes next time
+	return 30 * time.Minute
+}
+
+// Schedule has no default, the job is only scheduled when one is configured
+func (s *LastFMBackfill) Schedule() string {
+	return s.ScheduleOverride
+}
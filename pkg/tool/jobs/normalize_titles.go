@@ -0,0 +1,73 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+// NormalizeTitles is a job that normalizes the title of every track and album
+// again, so that changes to the title rules apply to plays already saved. New
+// plays have their titles normalized as they are saved.
+type NormalizeTitles struct {
+	Store  store.PlayStore
+	Titles *store.Titles
+
+	ScheduleOverride string
+}
+
+func (n *NormalizeTitles) Name() string {
+	return "normalize-titles"
+}
+
+func (n *NormalizeTitles) Run(ctx context.Context) error {
+	doneCh := make(chan bool)
+	errCh := make(chan error)
+
+	go func() {
+		tracks, err := n.Store.Tracks(ctx)
+		if err != nil {
+			errCh <- fmt.Errorf("failed to get tracks: %v", err)
+			return
+		}
+
+		albums, err := n.Store.Albums(ctx)
+		if err != nil {
+			errCh <- fmt.Errorf("failed to get albums: %v", err)
+			return
+		}
+
+		saved, removed, err := n.Titles.Rebuild(ctx, tracks, albums)
+		if err != nil {
+			errCh <- fmt.Errorf("failed to save normalized titles: %v", err)
+			return
+		}
+
+		log.Printf("normalized %d titles, removed %d\n", saved, removed)
+
+		doneCh <- true
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case e := <-errCh:
+		return fmt.Errorf("job failed with error: %s", e)
+	case <-doneCh:
+		return nil
+	}
+}
+
+func (n *NormalizeTitles) Timeout() time.Duration {
+	return 10 * time.Minute
+}
+
+func (n *NormalizeTitles) Schedule() string {
+	if n.ScheduleOverride != "" {
+		return n.ScheduleOverride
+	}
+	return "0 45 5 * * *"
+}
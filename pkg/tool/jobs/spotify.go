@@ -3,13 +3,16 @@ package jobs
 import (
 	"context"
 	"fmt"
+	"log"
 	"time"
 
 	"github.com/charlieegan3/music/internal/pkg/spotify"
-	"github.com/charlieegan3/music/pkg/tool/bq"
+	"github.com/charlieegan3/music/pkg/tool/events"
+	"github.com/charlieegan3/music/pkg/tool/nowplaying"
+	"github.com/charlieegan3/music/pkg/tool/store"
 )
 
-// SpotifySync is a job that syncs spotify plays to bigquery
+// SpotifySync is a job that syncs spotify plays to the play store
 type SpotifySync struct {
 	ScheduleOverride string
 
@@ -18,10 +21,11 @@ type SpotifySync struct {
 	SpotifyClientID     string
 	SpotifyClientSecret string
 
-	GoogleCredentialsJSON string
-	ProjectID             string
-	DatasetName           string
-	TableName             string
+	Store store.PlayStore
+	// NowPlaying is optional, when set the currently playing track is saved
+	NowPlaying *nowplaying.Store
+	// Events is optional, when set inserted plays are published to it
+	Events *events.Bus
 }
 
 func (s *SpotifySync) Name() string {
@@ -33,19 +37,26 @@ func (s *SpotifySync) Run(ctx context.Context) error {
 	errCh := make(chan error)
 
 	go func() {
-		err := spotify.Sync(
+		if s.NowPlaying != nil {
+			err := s.saveNowPlaying(ctx)
+			if err != nil {
+				log.Printf("failed to save now playing: %v\n", err)
+			}
+		}
+
+		plays, err := spotify.Sync(
+			ctx,
 			s.SpotifyAccessToken,
 			s.SpotifyRefreshToken,
 			s.SpotifyClientID,
 			s.SpotifyClientSecret,
-			s.GoogleCredentialsJSON,
-			s.ProjectID,
-			s.DatasetName,
-			s.TableName,
-			bq.JSONSchema,
+			s.Store,
 		)
+		// plays saved before a failure are still published
+		s.Events.Publish(plays...)
 		if err != nil {
 			errCh <- fmt.Errorf("failed to sync spotify: %v", err)
+			return
 		}
 
 		doneCh <- true
@@ -61,6 +72,26 @@ func (s *SpotifySync) Run(ctx context.Context) error {
 	}
 }
 
+// saveNowPlaying saves the currently playing track, or clears it when
+// nothing is playing
+func (s *SpotifySync) saveNowPlaying(ctx context.Context) error {
+	track, err := spotify.CurrentlyPlaying(
+		s.SpotifyAccessToken,
+		s.SpotifyRefreshToken,
+		s.SpotifyClientID,
+		s.SpotifyClientSecret,
+	)
+	if err != nil {
+		return err
+	}
+
+	if track == nil {
+		return s.NowPlaying.Clear(ctx, "spotify")
+	}
+
+	return s.NowPlaying.Set(ctx, *track)
+}
+
 func (s *SpotifySync) Timeout() time.Duration {
 	return 30 * time.Second
 }
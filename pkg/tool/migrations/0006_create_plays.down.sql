@@ -0,0 +1,6 @@
+SET search_path TO music, public;
+
+DROP INDEX IF EXISTS plays_artist_idx;
+DROP INDEX IF EXISTS plays_timestamp_idx;
+DROP INDEX IF EXISTS plays_source_timestamp_idx;
+DROP TABLE IF EXISTS plays;
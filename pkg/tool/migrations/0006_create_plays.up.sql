@@ -0,0 +1,28 @@
+SET search_path TO music, public;
+
+CREATE TABLE IF NOT EXISTS plays(
+  id BIGSERIAL NOT NULL PRIMARY KEY,
+
+  track TEXT NOT NULL,
+  artist TEXT NOT NULL,
+  album TEXT NOT NULL,
+  timestamp TIMESTAMPTZ NOT NULL,
+
+  duration BIGINT,
+  spotify_id TEXT NOT NULL DEFAULT '',
+  album_cover TEXT NOT NULL DEFAULT '',
+  source TEXT NOT NULL DEFAULT '',
+
+  youtube_id TEXT NOT NULL DEFAULT '',
+  youtube_category_id TEXT NOT NULL DEFAULT '',
+  soundcloud_id TEXT NOT NULL DEFAULT '',
+  soundcloud_permalink TEXT NOT NULL DEFAULT '',
+  shazam_id TEXT NOT NULL DEFAULT '',
+  shazam_permalink TEXT NOT NULL DEFAULT '',
+
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX plays_source_timestamp_idx ON plays(source, timestamp);
+CREATE INDEX plays_timestamp_idx ON plays(timestamp DESC);
+CREATE INDEX plays_artist_idx ON plays(artist);
@@ -0,0 +1,3 @@
+SET search_path TO music, public;
+
+DROP TABLE IF EXISTS lastfm_backfill;
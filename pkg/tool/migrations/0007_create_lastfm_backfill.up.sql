@@ -0,0 +1,18 @@
+SET search_path TO music, public;
+
+CREATE TABLE IF NOT EXISTS lastfm_backfill(
+  username TEXT NOT NULL PRIMARY KEY,
+
+  -- the window being walked, fixed when the backfill starts so that pages
+  -- don't move as new plays are scrobbled
+  from_unix BIGINT NOT NULL,
+  to_unix BIGINT NOT NULL,
+
+  -- the last page which was saved
+  page INTEGER NOT NULL DEFAULT 0,
+  total_pages INTEGER NOT NULL DEFAULT 0,
+
+  completed BOOLEAN NOT NULL DEFAULT FALSE,
+
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
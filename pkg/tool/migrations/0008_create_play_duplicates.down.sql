@@ -0,0 +1,4 @@
+SET search_path TO music, public;
+
+DROP VIEW IF EXISTS canonical_plays;
+DROP TABLE IF EXISTS play_duplicates;
@@ -0,0 +1,22 @@
+SET search_path TO music, public;
+
+-- plays which are the same listen as another play recorded by a different
+-- source, they are kept for reference but excluded from canonical_plays
+CREATE TABLE IF NOT EXISTS play_duplicates(
+  source TEXT NOT NULL,
+  timestamp TIMESTAMPTZ NOT NULL,
+
+  canonical_source TEXT NOT NULL,
+  canonical_timestamp TIMESTAMPTZ NOT NULL,
+
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+  PRIMARY KEY (source, timestamp)
+);
+
+CREATE OR REPLACE VIEW canonical_plays AS
+SELECT * FROM plays p
+WHERE NOT EXISTS (
+  SELECT 1 FROM play_duplicates d
+  WHERE d.source = p.source AND d.timestamp = p.timestamp
+);
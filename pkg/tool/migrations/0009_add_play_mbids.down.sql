@@ -0,0 +1,14 @@
+SET search_path TO music, public;
+
+DROP VIEW IF EXISTS canonical_plays;
+
+ALTER TABLE plays DROP COLUMN IF EXISTS track_mbid;
+ALTER TABLE plays DROP COLUMN IF EXISTS artist_mbid;
+ALTER TABLE plays DROP COLUMN IF EXISTS album_mbid;
+
+CREATE OR REPLACE VIEW canonical_plays AS
+SELECT * FROM plays p
+WHERE NOT EXISTS (
+  SELECT 1 FROM play_duplicates d
+  WHERE d.source = p.source AND d.timestamp = p.timestamp
+);
@@ -0,0 +1,14 @@
+SET search_path TO music, public;
+
+ALTER TABLE plays ADD COLUMN IF NOT EXISTS track_mbid TEXT NOT NULL DEFAULT '';
+ALTER TABLE plays ADD COLUMN IF NOT EXISTS artist_mbid TEXT NOT NULL DEFAULT '';
+ALTER TABLE plays ADD COLUMN IF NOT EXISTS album_mbid TEXT NOT NULL DEFAULT '';
+
+-- the columns of a view are fixed when it's created, so it's replaced to
+-- include the new columns
+CREATE OR REPLACE VIEW canonical_plays AS
+SELECT * FROM plays p
+WHERE NOT EXISTS (
+  SELECT 1 FROM play_duplicates d
+  WHERE d.source = p.source AND d.timestamp = p.timestamp
+);
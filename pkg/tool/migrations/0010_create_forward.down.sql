@@ -0,0 +1,4 @@
+SET search_path TO music, public;
+
+DROP TABLE IF EXISTS forward_dead_letters;
+DROP TABLE IF EXISTS forward_cursors;
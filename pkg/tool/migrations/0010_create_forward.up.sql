@@ -0,0 +1,29 @@
+SET search_path TO music, public;
+
+-- the last play sent to each forwarding target, in the order plays were saved
+CREATE TABLE IF NOT EXISTS forward_cursors(
+  target TEXT NOT NULL PRIMARY KEY,
+
+  created_at_unix_nano BIGINT NOT NULL,
+  source TEXT NOT NULL DEFAULT '',
+  timestamp_unix_nano BIGINT NOT NULL DEFAULT 0,
+
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- plays which a target rejected, play is the play in the backup format so
+-- that it can be sent again
+CREATE TABLE IF NOT EXISTS forward_dead_letters(
+  target TEXT NOT NULL,
+  source TEXT NOT NULL,
+  timestamp_unix_nano BIGINT NOT NULL,
+
+  play TEXT NOT NULL,
+  error TEXT NOT NULL,
+  attempts INTEGER NOT NULL DEFAULT 1,
+
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+  PRIMARY KEY (target, source, timestamp_unix_nano)
+);
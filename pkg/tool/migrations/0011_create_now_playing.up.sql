@@ -0,0 +1,18 @@
+SET search_path TO music, public;
+
+-- the track each source is playing, rows are ignored after they expire
+CREATE TABLE IF NOT EXISTS now_playing(
+  source TEXT NOT NULL PRIMARY KEY,
+
+  track TEXT NOT NULL,
+  artist TEXT NOT NULL,
+  album TEXT NOT NULL DEFAULT '',
+  duration BIGINT NOT NULL DEFAULT 0,
+  spotify_id TEXT NOT NULL DEFAULT '',
+  album_cover TEXT NOT NULL DEFAULT '',
+
+  started_at_unix BIGINT NOT NULL,
+  expires_at_unix BIGINT NOT NULL,
+
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,5 @@
+SET search_path TO music, public;
+
+DROP INDEX IF EXISTS name_index_artist_mbid_idx;
+
+ALTER TABLE name_index DROP COLUMN IF EXISTS artist_mbid;
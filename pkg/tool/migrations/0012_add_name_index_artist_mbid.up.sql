@@ -0,0 +1,5 @@
+SET search_path TO music, public;
+
+ALTER TABLE name_index ADD COLUMN IF NOT EXISTS artist_mbid TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS name_index_artist_mbid_idx ON name_index(artist_mbid);
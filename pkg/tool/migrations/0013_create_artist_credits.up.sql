@@ -0,0 +1,15 @@
+SET search_path TO music, public;
+
+-- artist_credits lists the artists credited by each artist string in plays,
+-- primary artist first
+CREATE TABLE IF NOT EXISTS artist_credits(
+  artist TEXT NOT NULL,
+  position INTEGER NOT NULL,
+  name TEXT NOT NULL,
+
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (artist, position)
+);
+
+CREATE INDEX IF NOT EXISTS artist_credits_name_idx ON artist_credits(name);
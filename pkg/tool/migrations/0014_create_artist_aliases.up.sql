@@ -0,0 +1,12 @@
+SET search_path TO music, public;
+
+-- artist_aliases maps artist names to the canonical name their plays are
+-- counted under, such as a different spelling of the same artist
+CREATE TABLE IF NOT EXISTS artist_aliases(
+  alias TEXT NOT NULL PRIMARY KEY,
+  artist TEXT NOT NULL,
+
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS artist_aliases_artist_idx ON artist_aliases(artist);
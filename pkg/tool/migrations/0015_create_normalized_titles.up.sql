@@ -0,0 +1,15 @@
+SET search_path TO music, public;
+
+-- normalized_titles maps raw track and album titles to the title they are
+-- counted as, such as a title without a remaster suffix
+CREATE TABLE IF NOT EXISTS normalized_titles(
+  field TEXT NOT NULL,
+  raw TEXT NOT NULL,
+  title TEXT NOT NULL,
+
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (field, raw)
+);
+
+CREATE INDEX IF NOT EXISTS normalized_titles_title_idx ON normalized_titles(field, title);
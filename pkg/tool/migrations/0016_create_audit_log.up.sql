@@ -0,0 +1,13 @@
+SET search_path TO music, public;
+
+-- audit_log records changes made to plays by admin users, changes is a json
+-- list of the names of plays before and after each change
+CREATE TABLE IF NOT EXISTS audit_log(
+  id SERIAL PRIMARY KEY,
+  user_name TEXT NOT NULL,
+  action TEXT NOT NULL,
+  details TEXT NOT NULL DEFAULT '',
+  changes TEXT NOT NULL,
+
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,19 @@
+SET search_path TO music, public;
+
+-- play_exclusions are rules for plays which aren't music, matching plays are
+-- left out of counts, and out of recent plays when hide_recent is set
+CREATE TABLE IF NOT EXISTS play_exclusions(
+  id SERIAL PRIMARY KEY,
+
+  artist TEXT NOT NULL DEFAULT '',
+  album TEXT NOT NULL DEFAULT '',
+  track TEXT NOT NULL DEFAULT '',
+  source TEXT NOT NULL DEFAULT '',
+
+  shorter_than_ms BIGINT NOT NULL DEFAULT 0,
+  longer_than_ms BIGINT NOT NULL DEFAULT 0,
+
+  hide_recent BOOLEAN NOT NULL DEFAULT FALSE,
+
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
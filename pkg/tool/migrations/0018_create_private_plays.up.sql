@@ -0,0 +1,11 @@
+SET search_path TO music, public;
+
+-- private_plays are plays which are only shown to signed in users
+CREATE TABLE IF NOT EXISTS private_plays(
+  source TEXT NOT NULL,
+  timestamp TIMESTAMPTZ NOT NULL,
+
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+  PRIMARY KEY (source, timestamp)
+);
@@ -0,0 +1,9 @@
+SET search_path TO music, public;
+
+-- ids were the crc32 of the name, names with the same crc32 as another now
+-- get a fallback id and keep their crc32 as the hash to find them from links
+ALTER TABLE name_index ADD COLUMN IF NOT EXISTS hash NUMERIC NOT NULL DEFAULT 0;
+
+UPDATE name_index SET hash = id WHERE hash = 0;
+
+CREATE INDEX IF NOT EXISTS name_index_hash_idx ON name_index(hash);
@@ -0,0 +1,13 @@
+SET search_path TO music, public;
+
+-- the last play whose names the build_index job has indexed, in the order
+-- plays were saved, there's only one row
+CREATE TABLE IF NOT EXISTS name_index_cursor(
+  id INTEGER NOT NULL PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+
+  created_at_unix_nano BIGINT NOT NULL,
+  source TEXT NOT NULL DEFAULT '',
+  timestamp_unix_nano BIGINT NOT NULL DEFAULT 0,
+
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
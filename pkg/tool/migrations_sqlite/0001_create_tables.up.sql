@@ -0,0 +1,54 @@
+-- sqlite equivalent of the postgres migrations, the database file is attached
+-- as music so that queries can use the same table names
+CREATE TABLE IF NOT EXISTS music.covers(
+  id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+
+  artist TEXT NOT NULL,
+  album TEXT NOT NULL,
+
+  error_count INTEGER NOT NULL DEFAULT 0,
+
+  completed BOOLEAN NOT NULL DEFAULT FALSE,
+
+  url TEXT NOT NULL DEFAULT '',
+
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS music.artist_album_idx ON covers(artist, album);
+
+CREATE TABLE IF NOT EXISTS music.name_index(
+  id NUMERIC PRIMARY KEY NOT NULL,
+  name TEXT NOT NULL,
+
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  UNIQUE(name)
+);
+
+CREATE TABLE IF NOT EXISTS music.plays(
+  id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+
+  track TEXT NOT NULL,
+  artist TEXT NOT NULL,
+  album TEXT NOT NULL,
+  timestamp TIMESTAMP NOT NULL,
+
+  duration INTEGER,
+  spotify_id TEXT NOT NULL DEFAULT '',
+  album_cover TEXT NOT NULL DEFAULT '',
+  source TEXT NOT NULL DEFAULT '',
+
+  youtube_id TEXT NOT NULL DEFAULT '',
+  youtube_category_id TEXT NOT NULL DEFAULT '',
+  soundcloud_id TEXT NOT NULL DEFAULT '',
+  soundcloud_permalink TEXT NOT NULL DEFAULT '',
+  shazam_id TEXT NOT NULL DEFAULT '',
+  shazam_permalink TEXT NOT NULL DEFAULT '',
+
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS music.plays_source_timestamp_idx ON plays(source, timestamp);
+CREATE INDEX IF NOT EXISTS music.plays_timestamp_idx ON plays(timestamp DESC);
+CREATE INDEX IF NOT EXISTS music.plays_artist_idx ON plays(artist);
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS music.lastfm_backfill(
+  username TEXT NOT NULL PRIMARY KEY,
+
+  from_unix INTEGER NOT NULL,
+  to_unix INTEGER NOT NULL,
+
+  page INTEGER NOT NULL DEFAULT 0,
+  total_pages INTEGER NOT NULL DEFAULT 0,
+
+  completed BOOLEAN NOT NULL DEFAULT FALSE,
+
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS music.play_duplicates(
+  source TEXT NOT NULL,
+  timestamp TIMESTAMP NOT NULL,
+
+  canonical_source TEXT NOT NULL,
+  canonical_timestamp TIMESTAMP NOT NULL,
+
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (source, timestamp)
+);
+
+CREATE VIEW IF NOT EXISTS music.canonical_plays AS
+SELECT * FROM plays p
+WHERE NOT EXISTS (
+  SELECT 1 FROM play_duplicates d
+  WHERE d.source = p.source AND d.timestamp = p.timestamp
+);
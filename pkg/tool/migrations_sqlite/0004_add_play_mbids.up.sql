@@ -0,0 +1,3 @@
+ALTER TABLE music.plays ADD COLUMN track_mbid TEXT NOT NULL DEFAULT '';
+ALTER TABLE music.plays ADD COLUMN artist_mbid TEXT NOT NULL DEFAULT '';
+ALTER TABLE music.plays ADD COLUMN album_mbid TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS music.forward_cursors(
+  target TEXT NOT NULL PRIMARY KEY,
+
+  created_at_unix_nano INTEGER NOT NULL,
+  source TEXT NOT NULL DEFAULT '',
+  timestamp_unix_nano INTEGER NOT NULL DEFAULT 0,
+
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS music.forward_dead_letters(
+  target TEXT NOT NULL,
+  source TEXT NOT NULL,
+  timestamp_unix_nano INTEGER NOT NULL,
+
+  play TEXT NOT NULL,
+  error TEXT NOT NULL,
+  attempts INTEGER NOT NULL DEFAULT 1,
+
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (target, source, timestamp_unix_nano)
+);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS music.now_playing(
+  source TEXT NOT NULL PRIMARY KEY,
+
+  track TEXT NOT NULL,
+  artist TEXT NOT NULL,
+  album TEXT NOT NULL DEFAULT '',
+  duration INTEGER NOT NULL DEFAULT 0,
+  spotify_id TEXT NOT NULL DEFAULT '',
+  album_cover TEXT NOT NULL DEFAULT '',
+
+  started_at_unix INTEGER NOT NULL,
+  expires_at_unix INTEGER NOT NULL,
+
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,3 @@
+ALTER TABLE music.name_index ADD COLUMN artist_mbid TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS music.name_index_artist_mbid_idx ON name_index(artist_mbid);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS music.artist_credits(
+  artist TEXT NOT NULL,
+  position INTEGER NOT NULL,
+  name TEXT NOT NULL,
+
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (artist, position)
+);
+
+CREATE INDEX IF NOT EXISTS music.artist_credits_name_idx ON artist_credits(name);
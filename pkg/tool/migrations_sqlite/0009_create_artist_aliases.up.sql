@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS music.artist_aliases(
+  alias TEXT NOT NULL PRIMARY KEY,
+  artist TEXT NOT NULL,
+
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS music.artist_aliases_artist_idx ON artist_aliases(artist);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS music.normalized_titles(
+  field TEXT NOT NULL,
+  raw TEXT NOT NULL,
+  title TEXT NOT NULL,
+
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (field, raw)
+);
+
+CREATE INDEX IF NOT EXISTS music.normalized_titles_title_idx ON normalized_titles(field, title);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS music.audit_log(
+  id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+  user_name TEXT NOT NULL,
+  action TEXT NOT NULL,
+  details TEXT NOT NULL DEFAULT '',
+  changes TEXT NOT NULL,
+
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
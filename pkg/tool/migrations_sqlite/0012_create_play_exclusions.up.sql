@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS music.play_exclusions(
+  id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+
+  artist TEXT NOT NULL DEFAULT '',
+  album TEXT NOT NULL DEFAULT '',
+  track TEXT NOT NULL DEFAULT '',
+  source TEXT NOT NULL DEFAULT '',
+
+  shorter_than_ms INTEGER NOT NULL DEFAULT 0,
+  longer_than_ms INTEGER NOT NULL DEFAULT 0,
+
+  hide_recent BOOLEAN NOT NULL DEFAULT FALSE,
+
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
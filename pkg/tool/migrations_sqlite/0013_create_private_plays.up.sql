@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS music.private_plays(
+  source TEXT NOT NULL,
+  timestamp TIMESTAMP NOT NULL,
+
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (source, timestamp)
+);
@@ -0,0 +1,5 @@
+ALTER TABLE music.name_index ADD COLUMN hash NUMERIC NOT NULL DEFAULT 0;
+
+UPDATE music.name_index SET hash = id WHERE hash = 0;
+
+CREATE INDEX IF NOT EXISTS music.name_index_hash_idx ON name_index(hash);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS music.name_index_cursor(
+  id INTEGER NOT NULL PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+
+  created_at_unix_nano INTEGER NOT NULL,
+  source TEXT NOT NULL DEFAULT '',
+  timestamp_unix_nano INTEGER NOT NULL DEFAULT 0,
+
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,168 @@
+package nowplaying
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+// DefaultExpiry is how long a track is shown as playing when the source
+// doesn't give its duration
+const DefaultExpiry = 10 * time.Minute
+
+// expiryGrace allows for pauses and clients which report a little late
+const expiryGrace = 30 * time.Second
+
+// Track is what a source is currently playing
+type Track struct {
+	Source string
+	Track  string
+	Artist string
+	Album  string
+	// Duration is the length of the track in ms, 0 when unknown
+	Duration   int64
+	SpotifyID  string
+	AlbumCover string
+
+	StartedAt time.Time
+	ExpiresAt time.Time
+}
+
+// Expiry returns when a track started at startedAt is no longer playing
+func Expiry(startedAt time.Time, duration int64) time.Time {
+	if duration <= 0 {
+		return startedAt.Add(DefaultExpiry)
+	}
+
+	return startedAt.Add(time.Duration(duration)*time.Millisecond + expiryGrace)
+}
+
+// Store saves the track each source is playing in music.now_playing
+type Store struct {
+	goquDB *goqu.Database
+}
+
+// New returns a store using the database with the music schema
+func New(db *sql.DB) *Store {
+	return &Store{goquDB: goqu.New("postgres", db)}
+}
+
+type row struct {
+	Source     string `db:"source"`
+	Track      string `db:"track"`
+	Artist     string `db:"artist"`
+	Album      string `db:"album"`
+	Duration   int64  `db:"duration"`
+	SpotifyID  string `db:"spotify_id"`
+	AlbumCover string `db:"album_cover"`
+
+	StartedAtUnix int64 `db:"started_at_unix"`
+	ExpiresAtUnix int64 `db:"expires_at_unix"`
+}
+
+func (r row) track() Track {
+	return Track{
+		Source:     r.Source,
+		Track:      r.Track,
+		Artist:     r.Artist,
+		Album:      r.Album,
+		Duration:   r.Duration,
+		SpotifyID:  r.SpotifyID,
+		AlbumCover: r.AlbumCover,
+		StartedAt:  time.Unix(r.StartedAtUnix, 0).UTC(),
+		ExpiresAt:  time.Unix(r.ExpiresAtUnix, 0).UTC(),
+	}
+}
+
+// Set replaces the track playing for a source. When the source is still
+// playing the same track the original start time is kept, so that sources
+// which are polled don't restart the track on each poll. A zero StartedAt is
+// now and a zero ExpiresAt is worked out from the duration.
+func (s *Store) Set(ctx context.Context, t Track) error {
+	now := time.Now().UTC()
+	if t.StartedAt.IsZero() {
+		t.StartedAt = now
+
+		var existing row
+		found, err := s.goquDB.From("music.now_playing").
+			Where(goqu.C("source").Eq(t.Source)).
+			ScanStructContext(ctx, &existing)
+		if err != nil {
+			return fmt.Errorf("failed to get now playing: %v", err)
+		}
+		if found && existing.Track == t.Track && existing.Artist == t.Artist &&
+			now.Before(existing.track().ExpiresAt) {
+			t.StartedAt = existing.track().StartedAt
+		}
+	}
+
+	if t.ExpiresAt.IsZero() {
+		t.ExpiresAt = Expiry(t.StartedAt, t.Duration)
+		// a track which has been playing longer than its duration is likely
+		// paused or on repeat, it stays for the default expiry from now
+		if t.ExpiresAt.Before(now) {
+			t.ExpiresAt = now.Add(DefaultExpiry)
+		}
+	}
+
+	record := goqu.Record{
+		"source":          t.Source,
+		"track":           t.Track,
+		"artist":          t.Artist,
+		"album":           t.Album,
+		"duration":        t.Duration,
+		"spotify_id":      t.SpotifyID,
+		"album_cover":     t.AlbumCover,
+		"started_at_unix": t.StartedAt.Unix(),
+		"expires_at_unix": t.ExpiresAt.Unix(),
+		"updated_at":      goqu.L("CURRENT_TIMESTAMP"),
+	}
+
+	_, err := s.goquDB.Insert("music.now_playing").
+		Rows(record).
+		OnConflict(goqu.DoUpdate("source", record)).
+		Executor().
+		ExecContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save now playing: %v", err)
+	}
+
+	return nil
+}
+
+// Clear removes the track playing for a source, it's used when a source
+// reports that nothing is playing
+func (s *Store) Clear(ctx context.Context, source string) error {
+	_, err := s.goquDB.Delete("music.now_playing").
+		Where(goqu.C("source").Eq(source)).
+		Executor().
+		ExecContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to clear now playing: %v", err)
+	}
+
+	return nil
+}
+
+// Current returns the tracks which have not expired, most recently started
+// first
+func (s *Store) Current(ctx context.Context) ([]Track, error) {
+	var rows []row
+	err := s.goquDB.From("music.now_playing").
+		Where(goqu.C("expires_at_unix").Gt(time.Now().Unix())).
+		Order(goqu.C("started_at_unix").Desc()).
+		ScanStructsContext(ctx, &rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get now playing: %v", err)
+	}
+
+	var tracks []Track
+	for _, r := range rows {
+		tracks = append(tracks, r.track())
+	}
+
+	return tracks, nil
+}
@@ -0,0 +1,125 @@
+package tool
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/charlieegan3/music/pkg/tool/store"
+	"github.com/charlieegan3/music/pkg/tool/utils"
+)
+
+//go:embed migrations_sqlite
+var sqliteMigrations embed.FS
+
+var sqliteDriversMu sync.Mutex
+var sqliteDrivers = map[string]bool{}
+
+// OpenSQLite opens a database where the file at path is attached as the music
+// schema on every connection, and the functions used by the sqlite store are
+// registered. The migrations are then run against it.
+func OpenSQLite(path string) (*sql.DB, error) {
+	driverName := fmt.Sprintf("sqlite3_music_%s", utils.CRC32Hash(path))
+
+	sqliteDriversMu.Lock()
+	if !sqliteDrivers[driverName] {
+		sql.Register(driverName, &sqlite3.SQLiteDriver{
+			ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+				_, err := conn.Exec("ATTACH DATABASE ? AS music", []driver.Value{path})
+				if err != nil {
+					return fmt.Errorf("failed to attach %s: %v", path, err)
+				}
+				_, err = conn.Exec("PRAGMA music.journal_mode = WAL", nil)
+				if err != nil {
+					return fmt.Errorf("failed to set journal mode: %v", err)
+				}
+				err = conn.RegisterFunc("music_minute_of_day", store.SQLiteMinuteOfDay, true)
+				if err != nil {
+					return fmt.Errorf("failed to register music_minute_of_day: %v", err)
+				}
+				return nil
+			},
+		})
+		sqliteDrivers[driverName] = true
+	}
+	sqliteDriversMu.Unlock()
+
+	db, err := sql.Open(driverName, ":memory:?_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database: %v", err)
+	}
+
+	err = migrateSQLite(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate sqlite database: %v", err)
+	}
+
+	return db, nil
+}
+
+// migrateSQLite runs each up migration newer than the user_version of the
+// attached database and records the new version when done
+func migrateSQLite(db *sql.DB) error {
+	var version int
+	err := db.QueryRow("PRAGMA music.user_version").Scan(&version)
+	if err != nil {
+		return fmt.Errorf("failed to get schema version: %v", err)
+	}
+
+	entries, err := fs.ReadDir(sqliteMigrations, "migrations_sqlite")
+	if err != nil {
+		return fmt.Errorf("failed to list migrations: %v", err)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".up.sql") {
+			continue
+		}
+
+		migrationVersion, err := strconv.Atoi(strings.SplitN(e.Name(), "_", 2)[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse migration version for %s: %v", e.Name(), err)
+		}
+		if migrationVersion <= version {
+			continue
+		}
+
+		content, err := sqliteMigrations.ReadFile("migrations_sqlite/" + e.Name())
+		if err != nil {
+			return fmt.Errorf("failed to read migration %s: %v", e.Name(), err)
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin migration %s: %v", e.Name(), err)
+		}
+		_, err = tx.Exec(string(content))
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to run migration %s: %v", e.Name(), err)
+		}
+		_, err = tx.Exec(fmt.Sprintf("PRAGMA music.user_version = %d", migrationVersion))
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to set schema version for %s: %v", e.Name(), err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("failed to commit migration %s: %v", e.Name(), err)
+		}
+	}
+
+	return nil
+}
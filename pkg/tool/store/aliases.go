@@ -0,0 +1,213 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+// ArtistAlias is an artist name which is counted as another, canonical, name
+type ArtistAlias struct {
+	Alias  string `db:"alias" json:"alias"`
+	Artist string `db:"artist" json:"artist"`
+}
+
+// Aliases saves artist aliases in music.artist_aliases. The table is always in
+// the tool database, including when plays are in BigQuery.
+type Aliases struct {
+	goquDB *goqu.Database
+	// changes counts the writes made with this value, the BigQuery store
+	// loads the aliases again when it changes
+	changes atomic.Uint64
+}
+
+// NewAliases returns the aliases in the database with the music schema
+func NewAliases(db *sql.DB) *Aliases {
+	return &Aliases{goquDB: goqu.New("postgres", db)}
+}
+
+// List returns every alias, ordered by the canonical name
+func (a *Aliases) List(ctx context.Context) ([]ArtistAlias, error) {
+	var aliases []ArtistAlias
+	err := a.goquDB.From("music.artist_aliases").
+		Select("alias", "artist").
+		Order(goqu.C("artist").Asc(), goqu.C("alias").Asc()).
+		ScanStructsContext(ctx, &aliases)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select artist aliases: %v", err)
+	}
+
+	return aliases, nil
+}
+
+// Map returns the canonical name of each alias
+func (a *Aliases) Map(ctx context.Context) (map[string]string, error) {
+	aliases, err := a.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]string)
+	for _, alias := range aliases {
+		names[alias.Alias] = alias.Artist
+	}
+
+	return names, nil
+}
+
+// Canonical returns the name an artist is merged into, false is returned when
+// the artist isn't an alias
+func (a *Aliases) Canonical(ctx context.Context, name string) (string, bool, error) {
+	var artist string
+	found, err := a.goquDB.From("music.artist_aliases").
+		Select("artist").
+		Where(goqu.C("alias").Eq(name)).
+		ScanValContext(ctx, &artist)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to select artist for alias: %v", err)
+	}
+
+	return artist, found, nil
+}
+
+// Merged returns the names merged into an artist in order
+func (a *Aliases) Merged(ctx context.Context, artist string) ([]string, error) {
+	var names []string
+	err := a.goquDB.From("music.artist_aliases").
+		Select("alias").
+		Where(goqu.C("artist").Eq(artist)).
+		Order(goqu.C("alias").Asc()).
+		ScanValsContext(ctx, &names)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select artist aliases: %v", err)
+	}
+
+	return names, nil
+}
+
+// Merge makes artist the canonical name of each of names. Names which were
+// already merged into one of names are moved to artist, and artist stops
+// being an alias if it was one, so that aliases never form a chain.
+func (a *Aliases) Merge(ctx context.Context, artist string, names []string) ([]ArtistAlias, error) {
+	defer a.changes.Add(1)
+
+	artist = strings.TrimSpace(artist)
+	if artist == "" {
+		return nil, fmt.Errorf("an artist to merge into is required")
+	}
+
+	var aliases []string
+	var rows []goqu.Record
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || name == artist || contains(aliases, name) {
+			continue
+		}
+		aliases = append(aliases, name)
+		rows = append(rows, goqu.Record{"alias": name, "artist": artist})
+	}
+	if len(aliases) == 0 {
+		return nil, fmt.Errorf("no names to merge into %q", artist)
+	}
+
+	err := a.goquDB.WithTx(func(tx *goqu.TxDatabase) error {
+		_, err := tx.Delete("music.artist_aliases").
+			Where(goqu.C("alias").Eq(artist)).
+			Executor().
+			ExecContext(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to delete alias for %q: %v", artist, err)
+		}
+
+		_, err = tx.Update("music.artist_aliases").
+			Set(goqu.Record{"artist": artist}).
+			Where(goqu.C("artist").In(aliases)).
+			Executor().
+			ExecContext(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to move merged aliases: %v", err)
+		}
+
+		_, err = tx.Insert("music.artist_aliases").
+			Rows(rows).
+			OnConflict(goqu.DoUpdate("alias", goqu.Record{"artist": artist})).
+			Executor().
+			ExecContext(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to insert artist aliases: %v", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var merged []ArtistAlias
+	err = a.goquDB.From("music.artist_aliases").
+		Select("alias", "artist").
+		Where(goqu.C("artist").Eq(artist)).
+		Order(goqu.C("alias").Asc()).
+		ScanStructsContext(ctx, &merged)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select artist aliases: %v", err)
+	}
+
+	return merged, nil
+}
+
+// Remove stops names being counted as another artist, the number of aliases
+// removed is returned
+func (a *Aliases) Remove(ctx context.Context, names []string) (int64, error) {
+	if len(names) == 0 {
+		return 0, nil
+	}
+	defer a.changes.Add(1)
+
+	res, err := a.goquDB.Delete("music.artist_aliases").
+		Where(goqu.C("alias").In(names)).
+		Executor().
+		ExecContext(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete artist aliases: %v", err)
+	}
+
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get removed count: %v", err)
+	}
+
+	return removed, nil
+}
+
+// resolveArtists returns the canonical name of each of names
+func resolveArtists(aliases map[string]string, names []string) []string {
+	if len(names) == 0 {
+		return names
+	}
+
+	resolved := make([]string, 0, len(names))
+	for _, name := range names {
+		if artist, ok := aliases[name]; ok {
+			name = artist
+		}
+		if !contains(resolved, name) {
+			resolved = append(resolved, name)
+		}
+	}
+
+	return resolved
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
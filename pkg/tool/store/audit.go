@@ -0,0 +1,119 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+const (
+	AuditActionEdit    = "edit"
+	AuditActionDelete  = "delete"
+	AuditActionRewrite = "rewrite"
+	AuditActionPrivate = "private"
+	AuditActionPublic  = "public"
+)
+
+// AuditChange is a change made to the plays of a track, or a single play when
+// Source and Timestamp are set. After is nil when the play was deleted.
+type AuditChange struct {
+	Source    string     `json:"source,omitempty"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+
+	Before PlayNames  `json:"before"`
+	After  *PlayNames `json:"after,omitempty"`
+	Plays  int64      `json:"plays"`
+}
+
+// AuditEntry records who changed plays and what they changed
+type AuditEntry struct {
+	ID      int64         `json:"id"`
+	User    string        `json:"user"`
+	Action  string        `json:"action"`
+	Details string        `json:"details,omitempty"`
+	Changes []AuditChange `json:"changes"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AuditLog saves entries in music.audit_log, like aliases it's always in the
+// tool database
+type AuditLog struct {
+	goquDB *goqu.Database
+}
+
+// NewAuditLog returns the audit log in the database with the music schema
+func NewAuditLog(db *sql.DB) *AuditLog {
+	return &AuditLog{goquDB: goqu.New("postgres", db)}
+}
+
+type auditRow struct {
+	ID        int64     `db:"id" goqu:"skipinsert"`
+	User      string    `db:"user_name"`
+	Action    string    `db:"action"`
+	Details   string    `db:"details"`
+	Changes   string    `db:"changes"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// Record saves an entry, the ID and CreatedAt of the entry are set
+func (a *AuditLog) Record(ctx context.Context, entry *AuditEntry) error {
+	changes, err := json.Marshal(entry.Changes)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit changes: %v", err)
+	}
+
+	entry.CreatedAt = time.Now().UTC().Truncate(time.Second)
+
+	_, err = a.goquDB.Insert("music.audit_log").
+		Rows(auditRow{
+			User:      entry.User,
+			Action:    entry.Action,
+			Details:   entry.Details,
+			Changes:   string(changes),
+			CreatedAt: entry.CreatedAt,
+		}).
+		Returning("id").
+		Executor().
+		ScanValContext(ctx, &entry.ID)
+	if err != nil {
+		return fmt.Errorf("failed to insert audit entry: %v", err)
+	}
+
+	return nil
+}
+
+// List returns up to limit entries, newest first
+func (a *AuditLog) List(ctx context.Context, limit int) ([]AuditEntry, error) {
+	var rows []auditRow
+	err := a.goquDB.From("music.audit_log").
+		Select(&auditRow{}).
+		Order(goqu.C("id").Desc()).
+		Limit(uint(limit)).
+		ScanStructsContext(ctx, &rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select audit entries: %v", err)
+	}
+
+	entries := []AuditEntry{}
+	for _, r := range rows {
+		entry := AuditEntry{
+			ID:        r.ID,
+			User:      r.User,
+			Action:    r.Action,
+			Details:   r.Details,
+			CreatedAt: r.CreatedAt.UTC(),
+		}
+		err = json.Unmarshal([]byte(r.Changes), &entry.Changes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode changes of audit entry %d: %v", r.ID, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,1605 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+
+	"github.com/charlieegan3/music/pkg/tool/bq"
+)
+
+// BigQuery is a PlayStore backed by a single BigQuery table, duplicate plays
+// are listed in a second table with the _duplicates suffix
+type BigQuery struct {
+	ProjectID             string
+	DatasetName           string
+	TableName             string
+	GoogleCredentialsJSON string
+
+	// Aliases are resolved by queries which count plays by artist, none are
+	// resolved when it's nil
+	Aliases *Aliases
+	// Titles are the normalized titles resolved by queries which count plays
+	// by track or album, and saved for inserted plays, when set
+	Titles *Titles
+	// Exclusions are the rules for plays left out of counts, and recent plays
+	// for some rules, none are applied when it's nil
+	Exclusions *Exclusions
+	// Private are the plays hidden by a privacy set on the query context
+	Private *PrivatePlays
+
+	mu     sync.Mutex
+	client *bigquery.Client
+
+	listsMu sync.Mutex
+	lists   *bigQueryLists
+}
+
+// NewBigQuery returns a store for the table at project.dataset.table
+func NewBigQuery(projectID, datasetName, tableName, googleCredentialsJSON string) *BigQuery {
+	return &BigQuery{
+		ProjectID:             projectID,
+		DatasetName:           datasetName,
+		TableName:             tableName,
+		GoogleCredentialsJSON: googleCredentialsJSON,
+	}
+}
+
+// bigqueryClient lazily creates the client shared by all queries. The request
+// context is not used as the client's token source outlives any one request.
+func (s *BigQuery) bigqueryClient() (*bigquery.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	client, err := bigquery.NewClient(
+		context.Background(),
+		s.ProjectID,
+		option.WithCredentialsJSON([]byte(s.GoogleCredentialsJSON)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bq client: %v", err)
+	}
+
+	s.client = client
+
+	return client, nil
+}
+
+// Migrate creates the duplicates table and adds new columns to the plays
+// table. Queries don't change the tables, so it's run once before the store
+// is used.
+func (s *BigQuery) Migrate(ctx context.Context) error {
+	client, err := s.bigqueryClient()
+	if err != nil {
+		return err
+	}
+
+	err = s.createDuplicatesTable(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	return s.addMissingColumns(ctx, client)
+}
+
+// bigQueryDuplicateRow is a row in the duplicates table, see Duplicate
+type bigQueryDuplicateRow struct {
+	Source             string    `bigquery:"source"`
+	Timestamp          time.Time `bigquery:"timestamp"`
+	CanonicalSource    string    `bigquery:"canonical_source"`
+	CanonicalTimestamp time.Time `bigquery:"canonical_timestamp"`
+	CreatedAt          time.Time `bigquery:"created_at"`
+}
+
+// createDuplicatesTable creates the table listing duplicate plays next to the
+// plays table if it doesn't exist yet
+func (s *BigQuery) createDuplicatesTable(ctx context.Context, client *bigquery.Client) error {
+	schema, err := bigquery.InferSchema(bigQueryDuplicateRow{})
+	if err != nil {
+		return fmt.Errorf("failed to infer duplicates schema: %v", err)
+	}
+
+	err = client.Dataset(s.DatasetName).Table(s.duplicatesTableName()).Create(
+		ctx,
+		&bigquery.TableMetadata{Schema: schema},
+	)
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create duplicates table: %v", err)
+	}
+
+	return nil
+}
+
+// addMissingColumns adds columns in bq/schema.json which are not yet in the
+// plays table, new columns are nullable so existing rows are unchanged
+func (s *BigQuery) addMissingColumns(ctx context.Context, client *bigquery.Client) error {
+	schema, err := bigquery.SchemaFromJSON(bq.JSONSchema)
+	if err != nil {
+		return fmt.Errorf("failed to parse schema: %v", err)
+	}
+
+	table := client.Dataset(s.DatasetName).Table(s.TableName)
+	metadata, err := table.Metadata(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get plays table metadata: %v", err)
+	}
+
+	existing := make(map[string]bool)
+	for _, f := range metadata.Schema {
+		existing[f.Name] = true
+	}
+
+	updated := metadata.Schema
+	for _, f := range schema {
+		if !existing[f.Name] {
+			updated = append(updated, f)
+		}
+	}
+	if len(updated) == len(metadata.Schema) {
+		return nil
+	}
+
+	_, err = table.Update(ctx, bigquery.TableMetadataToUpdate{Schema: updated}, metadata.ETag)
+	if err != nil {
+		return fmt.Errorf("failed to add columns to plays table: %v", err)
+	}
+
+	return nil
+}
+
+func (s *BigQuery) tableRef() string {
+	return fmt.Sprintf("`%s.%s.%s`", s.ProjectID, s.DatasetName, s.TableName)
+}
+
+func (s *BigQuery) duplicatesTableName() string {
+	return s.TableName + "_duplicates"
+}
+
+func (s *BigQuery) duplicatesRef() string {
+	return fmt.Sprintf("`%s.%s.%s`", s.ProjectID, s.DatasetName, s.duplicatesTableName())
+}
+
+// canonicalRef is used in place of tableRef in queries which should not count
+// plays marked as duplicates. Rows in the duplicates table may be repeated as
+// streaming inserts are only deduplicated on a best effort basis.
+func (s *BigQuery) canonicalRef() string {
+	return fmt.Sprintf(`(
+  SELECT p.* FROM %s p
+  LEFT JOIN (SELECT DISTINCT source, timestamp FROM %s) d
+  ON d.source = p.source AND d.timestamp = p.timestamp
+  WHERE d.source IS NULL
+)`, s.tableRef(), s.duplicatesRef())
+}
+
+// bigQueryListsTTL is how long the lists passed to queries are kept. Changes
+// made with the store's Aliases, Titles, Exclusions and Private are seen
+// straight away, changes made by other processes, such as commands, once the
+// lists are loaded again.
+const bigQueryListsTTL = time.Minute
+
+// bigQueryLists are the aliases, normalized titles, exclusion rules and
+// private plays in the tool database, which are passed to queries as params
+type bigQueryLists struct {
+	aliases    []bigQueryAlias
+	titles     []bigQueryTitle
+	exclusions []bigQueryExclusion
+	private    []bigQueryPlayKey
+
+	// changes is the listChanges when the lists were loaded
+	changes  uint64
+	loadedAt time.Time
+}
+
+// bigQueryAlias is an ArtistAlias passed in the @aliases param
+type bigQueryAlias struct {
+	Alias  string `bigquery:"alias"`
+	Artist string `bigquery:"artist"`
+}
+
+// bigQueryTitle is a NormalizedTitle passed in the @titles param
+type bigQueryTitle struct {
+	Field string `bigquery:"field"`
+	Raw   string `bigquery:"raw"`
+	Title string `bigquery:"title"`
+}
+
+// bigQueryExclusion is an Exclusion passed in the @exclusions param
+type bigQueryExclusion struct {
+	Artist        string `bigquery:"artist"`
+	Album         string `bigquery:"album"`
+	Track         string `bigquery:"track"`
+	Source        string `bigquery:"source"`
+	ShorterThanMS int64  `bigquery:"shorter_than_ms"`
+	LongerThanMS  int64  `bigquery:"longer_than_ms"`
+	HideRecent    bool   `bigquery:"hide_recent"`
+}
+
+// bigQueryPlayKey is a PlayKey passed in the @private param
+type bigQueryPlayKey struct {
+	Source    string    `bigquery:"source"`
+	Timestamp time.Time `bigquery:"timestamp"`
+}
+
+// listChanges is the number of writes made with the store's lists
+func (s *BigQuery) listChanges() uint64 {
+	var n uint64
+	if s.Aliases != nil {
+		n += s.Aliases.changes.Load()
+	}
+	if s.Titles != nil {
+		n += s.Titles.changes.Load()
+	}
+	if s.Exclusions != nil {
+		n += s.Exclusions.changes.Load()
+	}
+	if s.Private != nil {
+		n += s.Private.changes.Load()
+	}
+	return n
+}
+
+// loadLists returns the lists passed to queries, they are loaded from the
+// tool database when they have changed or are older than bigQueryListsTTL
+func (s *BigQuery) loadLists(ctx context.Context) (*bigQueryLists, error) {
+	// counted before loading, so that a change made while the lists are
+	// loaded is loaded by the next query
+	changes := s.listChanges()
+
+	s.listsMu.Lock()
+	defer s.listsMu.Unlock()
+
+	if s.lists != nil && s.lists.changes == changes && time.Since(s.lists.loadedAt) < bigQueryListsTTL {
+		return s.lists, nil
+	}
+
+	lists := &bigQueryLists{changes: changes, loadedAt: time.Now()}
+
+	if s.Aliases != nil {
+		aliases, err := s.Aliases.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range aliases {
+			lists.aliases = append(lists.aliases, bigQueryAlias{Alias: a.Alias, Artist: a.Artist})
+		}
+	}
+
+	if s.Titles != nil {
+		titles, err := s.Titles.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range titles {
+			lists.titles = append(lists.titles, bigQueryTitle{Field: t.Field, Raw: t.Raw, Title: t.Title})
+		}
+	}
+
+	if s.Exclusions != nil {
+		exclusions, err := s.Exclusions.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range exclusions {
+			lists.exclusions = append(lists.exclusions, bigQueryExclusion{
+				Artist:        e.Artist,
+				Album:         e.Album,
+				Track:         e.Track,
+				Source:        e.Source,
+				ShorterThanMS: e.ShorterThan,
+				LongerThanMS:  e.LongerThan,
+				HideRecent:    e.HideRecent,
+			})
+		}
+	}
+
+	if s.Private != nil {
+		private, err := s.Private.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range private {
+			lists.private = append(lists.private, bigQueryPlayKey{Source: k.Source, Timestamp: k.Timestamp})
+		}
+	}
+
+	s.lists = lists
+
+	return lists, nil
+}
+
+// bigQueryResolved is the resolved table for a query and the params it needs
+type bigQueryResolved struct {
+	// ref is canonicalRef without excluded plays, and plays hidden by the
+	// privacy on the context, with canonical_artist and canonical_artists
+	// columns set to the names each artist string and credited artist are
+	// counted under, and canonical_track and canonical_album columns set to
+	// the normalized titles
+	ref    string
+	params []bigquery.QueryParameter
+	// titles is set when there are normalized titles
+	titles bool
+}
+
+// titleMatch matches plays counted under the normalized title of the raw
+// title in param, field is track or album
+func (r bigQueryResolved) titleMatch(field, param string) string {
+	if !r.titles {
+		return fmt.Sprintf("canonical_%s = %s", field, param)
+	}
+
+	return fmt.Sprintf(`canonical_%[1]s = COALESCE(
+    (SELECT t.title FROM UNNEST(@titles) AS t WHERE t.field = '%[1]s' AND t.raw = %[2]s), %[2]s)`, field, param)
+}
+
+// resolve returns the resolved table with params added to its params. Only
+// the aliases, titles, exclusions and private plays which can change the
+// result are passed to the query, when there are none the joins are left out.
+func (s *BigQuery) resolve(ctx context.Context, params ...bigquery.QueryParameter) (bigQueryResolved, error) {
+	lists, err := s.loadLists(ctx)
+	if err != nil {
+		return bigQueryResolved{}, err
+	}
+
+	artists := `p.artist AS canonical_artist,
+    p.artists AS canonical_artists`
+	var joins string
+	if len(lists.aliases) > 0 {
+		artists = `COALESCE(a.artist, p.artist) AS canonical_artist,
+    ARRAY(
+      SELECT COALESCE(n.artist, name)
+      FROM UNNEST(p.artists) AS name WITH OFFSET AS position
+      LEFT JOIN UNNEST(@aliases) AS n ON n.alias = name
+      ORDER BY position) AS canonical_artists`
+		joins += "\n  LEFT JOIN UNNEST(@aliases) AS a ON a.alias = p.artist"
+		params = append(params, bigquery.QueryParameter{Name: "aliases", Value: lists.aliases})
+	}
+
+	titles := `p.track AS canonical_track,
+    p.album AS canonical_album`
+	if len(lists.titles) > 0 {
+		titles = `COALESCE(nt.title, p.track) AS canonical_track,
+    COALESCE(na.title, p.album) AS canonical_album`
+		joins += `
+  LEFT JOIN UNNEST(@titles) AS nt ON nt.field = 'track' AND nt.raw = p.track
+  LEFT JOIN UNNEST(@titles) AS na ON na.field = 'album' AND na.raw = p.album`
+		params = append(params, bigquery.QueryParameter{Name: "titles", Value: lists.titles})
+	}
+
+	excluded, exclusionParams := s.excluded(lists.exclusions)
+	privacy, privacyParams := s.privacy(ctx, lists)
+	params = append(params, exclusionParams...)
+	params = append(params, privacyParams...)
+
+	return bigQueryResolved{
+		ref: fmt.Sprintf(`(
+  SELECT
+    p.*,
+    %s,
+    %s
+  FROM %s p%s
+  WHERE TRUE%s%s
+)`, artists, titles, s.canonicalRef(), joins, excluded, privacy),
+		params: params,
+		titles: len(lists.titles) > 0,
+	}, nil
+}
+
+// excluded returns a condition on plays aliased as p, starting with AND,
+// which leaves out plays matching any of rules, and the param it needs
+func (s *BigQuery) excluded(rules []bigQueryExclusion) (string, []bigquery.QueryParameter) {
+	if len(rules) == 0 {
+		return "", nil
+	}
+
+	return fmt.Sprintf(`
+    AND NOT EXISTS (
+      SELECT 1 FROM UNNEST(@exclusions) AS e
+      WHERE %s )`, exclusionMatch),
+		[]bigquery.QueryParameter{{Name: "exclusions", Value: rules}}
+}
+
+// privacy returns conditions on plays aliased as p, starting with AND, which
+// hide plays when the context has a privacy set, and the params they need
+func (s *BigQuery) privacy(ctx context.Context, lists *bigQueryLists) (string, []bigquery.QueryParameter) {
+	var params []bigquery.QueryParameter
+	private := "FALSE"
+	if PrivacyFrom(ctx) != nil && len(lists.private) > 0 {
+		private = `EXISTS (
+      SELECT 1 FROM UNNEST(@private) AS pp
+      WHERE pp.source = p.source AND pp.timestamp = p.timestamp )`
+		params = append(params, bigquery.QueryParameter{Name: "private", Value: lists.private})
+	}
+
+	conditions := PrivacyFrom(ctx).conditions(time.Now(), privacySQL{
+		timeLiteral: func(t time.Time) string {
+			return fmt.Sprintf("TIMESTAMP '%s'", t.UTC().Format(time.RFC3339Nano))
+		},
+		minuteOfDay: func(tz string) string {
+			return fmt.Sprintf(
+				"(EXTRACT(HOUR FROM p.timestamp AT TIME ZONE '%[1]s') * 60 + EXTRACT(MINUTE FROM p.timestamp AT TIME ZONE '%[1]s'))",
+				tz,
+			)
+		},
+		private: private,
+	})
+	if conditions == "" {
+		return "", nil
+	}
+
+	return "\n    AND " + conditions, params
+}
+
+// read runs the query and calls fn with the iterator for each row
+func (s *BigQuery) read(
+	ctx context.Context,
+	queryString string,
+	params []bigquery.QueryParameter,
+	fn func(it *bigquery.RowIterator) error,
+) error {
+	client, err := s.bigqueryClient()
+	if err != nil {
+		return err
+	}
+
+	q := client.Query(queryString)
+	q.Parameters = params
+
+	it, err := q.Read(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read from bq: %v", err)
+	}
+
+	for {
+		err := fn(it)
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read row from bq result: %v", err)
+		}
+	}
+}
+
+// bigQueryArtistMatch matches artist strings which credit @artistName, or one
+// of its aliases, in the resolved table. Plays without a list of artists only match
+// the whole string.
+const bigQueryArtistMatch = "(canonical_artist = @artistName OR @artistName IN UNNEST(canonical_artists))"
+
+func artistParams(artist string) []bigquery.QueryParameter {
+	return []bigquery.QueryParameter{
+		{
+			Name:  "artistName",
+			Value: artist,
+		},
+	}
+}
+
+type bigQueryPlayRow struct {
+	Track     string
+	Artist    string
+	Album     string
+	Timestamp time.Time
+	Artists   []string
+}
+
+func (s *BigQuery) readPlays(ctx context.Context, queryString string, params []bigquery.QueryParameter) ([]Play, error) {
+	var plays []Play
+	err := s.read(ctx, queryString, params, func(it *bigquery.RowIterator) error {
+		var r bigQueryPlayRow
+		if err := it.Next(&r); err != nil {
+			return err
+		}
+		plays = append(plays, Play{
+			Track:     r.Track,
+			Artist:    r.Artist,
+			Album:     r.Album,
+			Timestamp: r.Timestamp,
+			Artists:   r.Artists,
+		})
+		return nil
+	})
+
+	return plays, err
+}
+
+func (s *BigQuery) readTrackCounts(ctx context.Context, queryString string, params []bigquery.QueryParameter) ([]TrackCount, error) {
+	var counts []TrackCount
+	err := s.read(ctx, queryString, params, func(it *bigquery.RowIterator) error {
+		var r TrackCount
+		if err := it.Next(&r); err != nil {
+			return err
+		}
+		counts = append(counts, r)
+		return nil
+	})
+
+	return counts, err
+}
+
+func (s *BigQuery) readStrings(ctx context.Context, queryString string, params []bigquery.QueryParameter) ([]string, error) {
+	var values []string
+	err := s.read(ctx, queryString, params, func(it *bigquery.RowIterator) error {
+		var r []bigquery.Value
+		if err := it.Next(&r); err != nil {
+			return err
+		}
+		if len(r) == 0 {
+			return fmt.Errorf("empty row")
+		}
+		value, ok := r[0].(string)
+		if !ok {
+			return fmt.Errorf("%T was not %T", r[0], value)
+		}
+		values = append(values, value)
+		return nil
+	})
+
+	return values, err
+}
+
+func (s *BigQuery) InsertPlays(ctx context.Context, plays []Play) error {
+	if len(plays) == 0 {
+		return nil
+	}
+
+	client, err := s.bigqueryClient()
+	if err != nil {
+		return err
+	}
+
+	schema, err := bigquery.SchemaFromJSON(bq.JSONSchema)
+	if err != nil {
+		return fmt.Errorf("failed to parse schema: %v", err)
+	}
+
+	var vss []*bigquery.ValuesSaver
+	for _, p := range plays {
+		createdAt := p.CreatedAt
+		if createdAt.IsZero() {
+			createdAt = time.Now()
+		}
+		vss = append(vss, &bigquery.ValuesSaver{
+			Schema:   schema,
+			InsertID: InsertID(p),
+			Row: []bigquery.Value{
+				p.Track,
+				p.Artist,
+				p.Album,
+				p.Timestamp.Unix(),
+				bigquery.NullInt64{Int64: p.Duration, Valid: p.Duration != 0},
+				p.SpotifyID,
+				p.AlbumCover,
+				createdAt.Unix(),
+				p.Source,
+				p.YoutubeID,
+				p.YoutubeCategoryID,
+				p.SoundcloudID,
+				p.SoundcloudPermalink,
+				p.ShazamID,
+				p.ShazamPermalink,
+				p.TrackMBID,
+				p.ArtistMBID,
+				p.AlbumMBID,
+				artistValues(p.Artists),
+			},
+		})
+	}
+
+	inserter := client.Dataset(s.DatasetName).Table(s.TableName).Inserter()
+	err = inserter.Put(ctx, vss)
+	if err != nil {
+		if pmErr, ok := err.(bigquery.PutMultiError); ok {
+			for _, rowInsertionError := range pmErr {
+				log.Println(rowInsertionError.Errors)
+			}
+		}
+
+		return fmt.Errorf("failed to insert plays: %w", err)
+	}
+
+	return s.Titles.Save(ctx, plays)
+}
+
+// artistValues converts a list of artists to a value for a repeated column
+func artistValues(artists []string) []bigquery.Value {
+	values := []bigquery.Value{}
+	for _, a := range artists {
+		values = append(values, a)
+	}
+	return values
+}
+
+func (s *BigQuery) MostRecentTimestamps(ctx context.Context, source string, count int) ([]time.Time, error) {
+	queryString := fmt.Sprintf(
+		"SELECT timestamp FROM %s WHERE source = @source ORDER BY timestamp DESC LIMIT %d",
+		s.tableRef(),
+		count,
+	)
+
+	var t []time.Time
+	err := s.read(
+		ctx,
+		queryString,
+		[]bigquery.QueryParameter{{Name: "source", Value: source}},
+		func(it *bigquery.RowIterator) error {
+			var l struct {
+				Timestamp time.Time
+			}
+			if err := it.Next(&l); err != nil {
+				return err
+			}
+			t = append(t, l.Timestamp)
+			return nil
+		},
+	)
+	if err != nil {
+		return t, fmt.Errorf("failed query for recent timestamps: %v", err)
+	}
+
+	return t, nil
+}
+
+func (s *BigQuery) SourceTimestamps(ctx context.Context, source string, from, to time.Time) ([]time.Time, error) {
+	queryString := fmt.Sprintf(
+		"SELECT timestamp FROM %s WHERE source = @source AND timestamp >= @from AND timestamp <= @to ORDER BY timestamp DESC",
+		s.tableRef(),
+	)
+
+	var t []time.Time
+	err := s.read(
+		ctx,
+		queryString,
+		[]bigquery.QueryParameter{
+			{Name: "source", Value: source},
+			{Name: "from", Value: from},
+			{Name: "to", Value: to},
+		},
+		func(it *bigquery.RowIterator) error {
+			var l struct {
+				Timestamp time.Time
+			}
+			if err := it.Next(&l); err != nil {
+				return err
+			}
+			t = append(t, l.Timestamp)
+			return nil
+		},
+	)
+	if err != nil {
+		return t, fmt.Errorf("failed query for source timestamps: %v", err)
+	}
+
+	return t, nil
+}
+
+func (s *BigQuery) SourcePlays(ctx context.Context, source string, from, to time.Time) ([]Play, error) {
+	queryString := fmt.Sprintf(`
+SELECT track, artist, album, timestamp, artists FROM %s
+WHERE source = @source AND timestamp >= @from AND timestamp <= @to
+ORDER BY timestamp ASC
+`, s.tableRef())
+
+	plays, err := s.readPlays(ctx, queryString, []bigquery.QueryParameter{
+		{Name: "source", Value: source},
+		{Name: "from", Value: from},
+		{Name: "to", Value: to},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed query for source plays: %v", err)
+	}
+
+	return plays, nil
+}
+
+// bigQueryFullPlayRow has all the columns in bq/schema.json
+type bigQueryFullPlayRow struct {
+	Track     string             `bigquery:"track"`
+	Artist    string             `bigquery:"artist"`
+	Album     string             `bigquery:"album"`
+	Timestamp time.Time          `bigquery:"timestamp"`
+	Duration  bigquery.NullInt64 `bigquery:"duration"`
+
+	SpotifyID  bigquery.NullString    `bigquery:"spotify_id"`
+	AlbumCover bigquery.NullString    `bigquery:"album_cover"`
+	CreatedAt  bigquery.NullTimestamp `bigquery:"created_at"`
+	Source     bigquery.NullString    `bigquery:"source"`
+
+	YoutubeID           bigquery.NullString `bigquery:"youtube_id"`
+	YoutubeCategoryID   bigquery.NullString `bigquery:"youtube_category_id"`
+	SoundcloudID        bigquery.NullString `bigquery:"soundcloud_id"`
+	SoundcloudPermalink bigquery.NullString `bigquery:"soundcloud_permalink"`
+	ShazamID            bigquery.NullString `bigquery:"shazam_id"`
+	ShazamPermalink     bigquery.NullString `bigquery:"shazam_permalink"`
+
+	TrackMBID  bigquery.NullString `bigquery:"track_mbid"`
+	ArtistMBID bigquery.NullString `bigquery:"artist_mbid"`
+	AlbumMBID  bigquery.NullString `bigquery:"album_mbid"`
+
+	Artists []string `bigquery:"artists"`
+}
+
+func (r bigQueryFullPlayRow) play() Play {
+	return Play{
+		Track:               r.Track,
+		Artist:              r.Artist,
+		Album:               r.Album,
+		Timestamp:           r.Timestamp,
+		Duration:            r.Duration.Int64,
+		SpotifyID:           r.SpotifyID.StringVal,
+		AlbumCover:          r.AlbumCover.StringVal,
+		CreatedAt:           r.CreatedAt.Timestamp,
+		Source:              r.Source.StringVal,
+		YoutubeID:           r.YoutubeID.StringVal,
+		YoutubeCategoryID:   r.YoutubeCategoryID.StringVal,
+		SoundcloudID:        r.SoundcloudID.StringVal,
+		SoundcloudPermalink: r.SoundcloudPermalink.StringVal,
+		ShazamID:            r.ShazamID.StringVal,
+		ShazamPermalink:     r.ShazamPermalink.StringVal,
+		TrackMBID:           r.TrackMBID.StringVal,
+		ArtistMBID:          r.ArtistMBID.StringVal,
+		AlbumMBID:           r.AlbumMBID.StringVal,
+		Artists:             r.Artists,
+	}
+}
+
+func (s *BigQuery) EachPlay(ctx context.Context, fn func(Play) error) error {
+	queryString := fmt.Sprintf("SELECT * FROM %s ORDER BY timestamp ASC", s.tableRef())
+
+	return s.read(ctx, queryString, nil, func(it *bigquery.RowIterator) error {
+		var r bigQueryFullPlayRow
+		if err := it.Next(&r); err != nil {
+			return err
+		}
+
+		return fn(r.play())
+	})
+}
+
+func (s *BigQuery) CanonicalPlays(ctx context.Context, from, to time.Time) ([]Play, error) {
+	queryString := fmt.Sprintf(`
+SELECT track, artist, album, timestamp, duration, source, artists FROM %s
+WHERE timestamp >= @from AND timestamp <= @to
+ORDER BY timestamp ASC
+`, s.canonicalRef())
+
+	var plays []Play
+	err := s.read(
+		ctx,
+		queryString,
+		[]bigquery.QueryParameter{
+			{Name: "from", Value: from},
+			{Name: "to", Value: to},
+		},
+		func(it *bigquery.RowIterator) error {
+			var r struct {
+				Track     string
+				Artist    string
+				Album     string
+				Timestamp time.Time
+				Duration  bigquery.NullInt64
+				Source    bigquery.NullString
+				Artists   []string
+			}
+			if err := it.Next(&r); err != nil {
+				return err
+			}
+			plays = append(plays, Play{
+				Track:     r.Track,
+				Artist:    r.Artist,
+				Album:     r.Album,
+				Timestamp: r.Timestamp,
+				Duration:  r.Duration.Int64,
+				Source:    r.Source.StringVal,
+				Artists:   r.Artists,
+			})
+			return nil
+		},
+	)
+	if err != nil {
+		return plays, fmt.Errorf("failed query for canonical plays: %v", err)
+	}
+
+	return plays, nil
+}
+
+func (s *BigQuery) PlaysCreatedAfter(ctx context.Context, cursor CreatedCursor, limit int) ([]Play, error) {
+	queryString := fmt.Sprintf(`
+SELECT * FROM %s
+WHERE created_at > @created_at
+  OR (created_at = @created_at AND (source > @source OR (source = @source AND timestamp > @timestamp)))
+ORDER BY created_at ASC, source ASC, timestamp ASC
+LIMIT %d
+`, s.canonicalRef(), limit)
+
+	var plays []Play
+	err := s.read(
+		ctx,
+		queryString,
+		[]bigquery.QueryParameter{
+			{Name: "created_at", Value: cursor.CreatedAt},
+			{Name: "source", Value: cursor.Source},
+			{Name: "timestamp", Value: cursor.Timestamp},
+		},
+		func(it *bigquery.RowIterator) error {
+			var r bigQueryFullPlayRow
+			if err := it.Next(&r); err != nil {
+				return err
+			}
+			plays = append(plays, r.play())
+			return nil
+		},
+	)
+	if err != nil {
+		return plays, fmt.Errorf("failed query for plays created after cursor: %v", err)
+	}
+
+	return plays, nil
+}
+
+func (s *BigQuery) MarkDuplicates(ctx context.Context, duplicates []Duplicate) error {
+	if len(duplicates) == 0 {
+		return nil
+	}
+
+	client, err := s.bigqueryClient()
+	if err != nil {
+		return err
+	}
+
+	var savers []*bigquery.StructSaver
+	for _, d := range duplicates {
+		savers = append(savers, &bigquery.StructSaver{
+			InsertID: fmt.Sprintf("%s-%d", d.Source, d.Timestamp.Unix()),
+			Struct: bigQueryDuplicateRow{
+				Source:             d.Source,
+				Timestamp:          d.Timestamp,
+				CanonicalSource:    d.CanonicalSource,
+				CanonicalTimestamp: d.CanonicalTimestamp,
+				CreatedAt:          time.Now(),
+			},
+		})
+	}
+
+	inserter := client.Dataset(s.DatasetName).Table(s.duplicatesTableName()).Inserter()
+	err = inserter.Put(ctx, savers)
+	if err != nil {
+		return fmt.Errorf("failed to insert duplicates: %w", err)
+	}
+
+	return nil
+}
+
+// RecentPlays leaves out plays matching exclusions which hide recent plays
+func (s *BigQuery) RecentPlays(ctx context.Context, limit int) ([]Play, error) {
+	lists, err := s.loadLists(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []bigQueryExclusion
+	for _, e := range lists.exclusions {
+		if e.HideRecent {
+			rules = append(rules, e)
+		}
+	}
+	excluded, params := s.excluded(rules)
+	privacy, privacyParams := s.privacy(ctx, lists)
+	params = append(params, privacyParams...)
+
+	queryString := fmt.Sprintf(`
+select track, artist, album, timestamp, artists from %s p
+where true%s%s
+order by timestamp desc
+limit %d
+`, s.canonicalRef(), excluded, privacy, limit)
+
+	return s.readPlays(ctx, queryString, params)
+}
+
+func (s *BigQuery) TopTracks(ctx context.Context, since time.Time, limit int) ([]TrackCount, error) {
+	var where string
+	var params []bigquery.QueryParameter
+	if !since.IsZero() {
+		where = "WHERE timestamp > @since"
+		params = append(params, bigquery.QueryParameter{Name: "since", Value: since})
+	}
+
+	resolved, err := s.resolve(ctx, params...)
+	if err != nil {
+		return nil, err
+	}
+
+	queryString := fmt.Sprintf(`
+SELECT
+  canonical_artist AS artist,
+  MAX(canonical_album) as album,
+  canonical_track AS track,
+  COUNT(track) AS count,
+  ANY_VALUE(canonical_artists) AS artists
+FROM
+  %s
+%s
+GROUP BY
+  canonical_artist,
+  canonical_track
+ORDER BY
+  count DESC
+LIMIT
+  %d
+`, resolved.ref, where, limit)
+
+	return s.readTrackCounts(ctx, queryString, resolved.params)
+}
+
+func (s *BigQuery) MonthsTopTracks(ctx context.Context, limit int) ([]MonthTopTracks, error) {
+	resolved, err := s.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	queryString := fmt.Sprintf(`
+SELECT
+  month,
+  ARRAY_AGG(STRUCT(track,
+      artist,
+      album,
+      count,
+      artists)
+  ORDER BY
+    count DESC
+  LIMIT
+    %d) AS top
+FROM (
+  SELECT
+    COUNT(track) AS count,
+    canonical_track AS track,
+    canonical_artist AS artist,
+    MAX(canonical_album) as album,
+    ANY_VALUE(canonical_artists) AS artists,
+    month
+  FROM (
+    SELECT
+      *,
+      FORMAT_DATE('%%Y-%%m', DATE(timestamp)) AS month
+    FROM
+      %s)
+  GROUP BY
+    canonical_track,
+    canonical_artist,
+    month
+  ORDER BY
+    count DESC )
+GROUP BY
+  month
+ORDER BY
+  month desc
+`, limit, resolved.ref)
+
+	var months []MonthTopTracks
+	err = s.read(ctx, queryString, resolved.params, func(it *bigquery.RowIterator) error {
+		var r struct {
+			Month string
+			Top   []TrackCount
+		}
+		if err := it.Next(&r); err != nil {
+			return err
+		}
+		months = append(months, MonthTopTracks{Month: r.Month, Tracks: r.Top})
+		return nil
+	})
+
+	return months, err
+}
+
+func (s *BigQuery) SearchArtists(ctx context.Context, query string) ([]string, error) {
+	lists, err := s.loadLists(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	excluded, params := s.excluded(lists.exclusions)
+	privacy, privacyParams := s.privacy(ctx, lists)
+	params = append(params, privacyParams...)
+	params = append(params, bigquery.QueryParameter{
+		Name:  "query",
+		Value: query,
+	})
+
+	queryString := fmt.Sprintf(`
+SELECT
+  DISTINCT artist
+FROM
+  %s p
+WHERE
+  CONTAINS_SUBSTR(LOWER(artist), LOWER(@query))%s%s
+ORDER BY
+  LENGTH(artist) asc
+`, s.tableRef(), excluded, privacy)
+
+	return s.readStrings(ctx, queryString, params)
+}
+
+func (s *BigQuery) ArtistTracks(ctx context.Context, artist string) ([]TrackCount, error) {
+	resolved, err := s.resolve(ctx, artistParams(artist)...)
+	if err != nil {
+		return nil, err
+	}
+
+	queryString := fmt.Sprintf(`
+select
+  canonical_artist as artist,
+  canonical_album as album,
+  canonical_track as track,
+  count(track) as count,
+  any_value(canonical_artists) as artists
+from %s
+where %s
+group by canonical_artist, canonical_album, canonical_track
+order by count desc
+`, resolved.ref, bigQueryArtistMatch)
+
+	return s.readTrackCounts(ctx, queryString, resolved.params)
+}
+
+func (s *BigQuery) ArtistRanks(ctx context.Context, artist string) ([]ArtistRank, error) {
+	resolved, err := s.resolve(ctx, artistParams(artist)...)
+	if err != nil {
+		return nil, err
+	}
+
+	queryString := fmt.Sprintf(`
+WITH
+  artists AS (
+  SELECT
+    canonical_artist,
+    COUNT(track) AS count,
+    ANY_VALUE(canonical_artists) AS canonical_artists
+  FROM
+    %s
+  GROUP BY
+    canonical_artist
+  ORDER BY
+    count DESC ),
+  ranks AS (
+  SELECT
+    ROW_NUMBER() OVER (ORDER BY count DESC) AS rank,
+    canonical_artist,
+    canonical_artists,
+    count
+  FROM
+    artists
+  ORDER BY
+    count DESC)
+SELECT
+  canonical_artist AS artist,
+  rank
+FROM
+  ranks
+WHERE
+  %s
+`, resolved.ref, bigQueryArtistMatch)
+
+	var ranks []ArtistRank
+	err = s.read(ctx, queryString, resolved.params, func(it *bigquery.RowIterator) error {
+		var r ArtistRank
+		if err := it.Next(&r); err != nil {
+			return err
+		}
+		ranks = append(ranks, r)
+		return nil
+	})
+
+	return ranks, err
+}
+
+func (s *BigQuery) ArtistAlbumTracks(ctx context.Context, artist, album string) ([]TrackCount, error) {
+	resolved, err := s.resolve(
+		ctx,
+		append(artistParams(artist), bigquery.QueryParameter{Name: "albumName", Value: album})...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	queryString := fmt.Sprintf(`
+SELECT
+  canonical_artist AS artist,
+  canonical_album AS album,
+  canonical_track AS track,
+  COUNT(track) AS count,
+  ANY_VALUE(canonical_artists) AS artists
+FROM
+  %s
+WHERE
+  %s
+  AND ( %s )
+GROUP BY
+  canonical_artist,
+  canonical_album,
+  canonical_track
+ORDER BY
+  count DESC
+`, resolved.ref, bigQueryArtistMatch, resolved.titleMatch("album", "@albumName"))
+
+	return s.readTrackCounts(ctx, queryString, resolved.params)
+}
+
+func (s *BigQuery) ArtistTrackPlays(ctx context.Context, artist, track string) ([]Play, error) {
+	resolved, err := s.resolve(
+		ctx,
+		append(artistParams(artist), bigquery.QueryParameter{Name: "trackName", Value: track})...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	queryString := fmt.Sprintf(`
+SELECT
+  track,
+  artist,
+  album,
+  timestamp,
+  artists
+FROM
+  %s
+WHERE
+  %s
+  AND ( %s )
+ORDER BY
+  timestamp desc
+`, resolved.ref, bigQueryArtistMatch, resolved.titleMatch("track", "@trackName"))
+
+	return s.readPlays(ctx, queryString, resolved.params)
+}
+
+func (s *BigQuery) ArtistAlbumTrackPlays(ctx context.Context, artist, album, track string) ([]Play, error) {
+	resolved, err := s.resolve(
+		ctx,
+		append(
+			artistParams(artist),
+			bigquery.QueryParameter{Name: "albumName", Value: album},
+			bigquery.QueryParameter{Name: "trackName", Value: track},
+		)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	queryString := fmt.Sprintf(`
+SELECT
+  track,
+  artist,
+  album,
+  timestamp,
+  artists
+FROM
+  %s
+WHERE
+  %s
+  AND ( %s )
+  AND ( %s )
+ORDER BY
+  timestamp desc
+`,
+		resolved.ref,
+		bigQueryArtistMatch,
+		resolved.titleMatch("album", "@albumName"),
+		resolved.titleMatch("track", "@trackName"),
+	)
+
+	return s.readPlays(ctx, queryString, resolved.params)
+}
+
+func (s *BigQuery) AlbumCovers(ctx context.Context) ([]AlbumCover, error) {
+	queryString := fmt.Sprintf(`
+SELECT
+  artist,
+  album,
+  ARRAY_AGG(album_cover
+  ORDER BY
+    COALESCE(timestamp, created_at) DESC
+  LIMIT
+    1)[
+OFFSET
+  (0)] album_cover,
+FROM %s
+GROUP BY
+  artist,
+  album
+ORDER BY
+  artist,
+  album
+`, s.tableRef())
+
+	var covers []AlbumCover
+	err := s.read(ctx, queryString, nil, func(it *bigquery.RowIterator) error {
+		var r struct {
+			Artist string
+			Album  string
+			URL    bigquery.NullString `bigquery:"album_cover"`
+		}
+		if err := it.Next(&r); err != nil {
+			return err
+		}
+		covers = append(covers, AlbumCover{Artist: r.Artist, Album: r.Album, URL: r.URL.StringVal})
+		return nil
+	})
+
+	return covers, err
+}
+
+func (s *BigQuery) Artists(ctx context.Context) ([]string, error) {
+	return s.readStrings(ctx, fmt.Sprintf("select distinct artist from %s order by artist asc", s.tableRef()), nil)
+}
+
+func (s *BigQuery) ArtistNames(ctx context.Context) ([]string, error) {
+	return s.readStrings(ctx, fmt.Sprintf("select distinct name from %s, unnest(artists) as name order by name asc", s.tableRef()), nil)
+}
+
+func (s *BigQuery) UncreditedArtists(ctx context.Context) ([]UncreditedArtist, error) {
+	queryString := fmt.Sprintf(`
+SELECT
+  artist,
+  COALESCE(MAX(IF(source = "spotify", spotify_id, NULL)), "") AS spotify_id,
+  LOGICAL_OR(source = "spotify") AS joined
+FROM
+  %s
+WHERE
+  ARRAY_LENGTH(artists) = 0
+GROUP BY
+  artist
+ORDER BY
+  artist
+`, s.tableRef())
+
+	var artists []UncreditedArtist
+	err := s.read(ctx, queryString, nil, func(it *bigquery.RowIterator) error {
+		var r struct {
+			Artist    string
+			SpotifyID string `bigquery:"spotify_id"`
+			Joined    bigquery.NullBool
+		}
+		if err := it.Next(&r); err != nil {
+			return err
+		}
+		artists = append(artists, UncreditedArtist{
+			Artist:    r.Artist,
+			SpotifyID: r.SpotifyID,
+			Joined:    r.Joined.Bool,
+		})
+		return nil
+	})
+
+	return artists, err
+}
+
+// bigQueryArtistCredit is a query parameter value, see ArtistCredit
+type bigQueryArtistCredit struct {
+	Artist  string   `bigquery:"artist"`
+	Artists []string `bigquery:"artists"`
+}
+
+// SetArtistCredits updates plays with DML, plays still in the streaming
+// buffer can't be updated and the update fails until they are flushed
+func (s *BigQuery) SetArtistCredits(ctx context.Context, credits []ArtistCredit) error {
+	if len(credits) == 0 {
+		return nil
+	}
+
+	client, err := s.bigqueryClient()
+	if err != nil {
+		return err
+	}
+
+	var values []bigQueryArtistCredit
+	for _, c := range credits {
+		if len(c.Artists) == 0 {
+			continue
+		}
+		values = append(values, bigQueryArtistCredit{Artist: c.Artist, Artists: c.Artists})
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	q := client.Query(fmt.Sprintf(`
+UPDATE %s p
+SET artists = c.artists
+FROM UNNEST(@credits) c
+WHERE p.artist = c.artist AND ARRAY_LENGTH(p.artists) = 0
+`, s.tableRef()))
+	q.Parameters = []bigquery.QueryParameter{{Name: "credits", Value: values}}
+
+	job, err := q.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to update artist credits: %v", err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to wait for artist credits update: %v", err)
+	}
+	if status.Err() != nil {
+		return fmt.Errorf("artist credits update failed: %v", status.Err())
+	}
+
+	return nil
+}
+
+func (s *BigQuery) ArtistMBIDs(ctx context.Context) ([]ArtistMBID, error) {
+	queryString := fmt.Sprintf(`
+SELECT
+  artist,
+  ARRAY_AGG(artist_mbid
+  ORDER BY
+    count DESC, artist_mbid ASC
+  LIMIT
+    1)[
+OFFSET
+  (0)] artist_mbid,
+FROM (
+  SELECT
+    artist,
+    artist_mbid,
+    COUNT(*) AS count
+  FROM %s
+  WHERE
+    artist_mbid IS NOT NULL
+    AND artist_mbid != ""
+  GROUP BY
+    artist,
+    artist_mbid )
+GROUP BY
+  artist
+ORDER BY
+  artist
+`, s.tableRef())
+
+	var mbids []ArtistMBID
+	err := s.read(ctx, queryString, nil, func(it *bigquery.RowIterator) error {
+		var r struct {
+			Artist string
+			MBID   string `bigquery:"artist_mbid"`
+		}
+		if err := it.Next(&r); err != nil {
+			return err
+		}
+		mbids = append(mbids, ArtistMBID{Artist: r.Artist, MBID: r.MBID})
+		return nil
+	})
+
+	return mbids, err
+}
+
+func (s *BigQuery) Albums(ctx context.Context) ([]string, error) {
+	return s.readStrings(ctx, fmt.Sprintf("select distinct album from %s order by album asc", s.tableRef()), nil)
+}
+
+func (s *BigQuery) Tracks(ctx context.Context) ([]string, error) {
+	return s.readStrings(ctx, fmt.Sprintf("select distinct track from %s order by track asc", s.tableRef()), nil)
+}
+
+// Extract uses a bq extract job to write the table to GCS
+func (s *BigQuery) Extract(ctx context.Context, uri string) error {
+	client, err := s.bigqueryClient()
+	if err != nil {
+		return err
+	}
+
+	gcsRef := &bigquery.GCSReference{
+		URIs:              []string{uri},
+		DestinationFormat: bigquery.JSON,
+	}
+
+	extractor := client.Dataset(s.DatasetName).Table(s.TableName).ExtractorTo(gcsRef)
+
+	job, err := extractor.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("create backup job failed: %v", err)
+	}
+	_, err = job.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("job failed: %v", err)
+	}
+
+	return nil
+}
+
+// runDML runs a DML statement and returns the number of rows it changed.
+// Plays still in the streaming buffer can't be changed and ErrPlayTooRecent
+// is returned until they are flushed.
+func (s *BigQuery) runDML(ctx context.Context, queryString string, params []bigquery.QueryParameter) (int64, error) {
+	client, err := s.bigqueryClient()
+	if err != nil {
+		return 0, err
+	}
+
+	q := client.Query(queryString)
+	q.Parameters = params
+
+	job, err := q.Run(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to run dml: %v", err)
+	}
+	status, err := job.Wait(ctx)
+	if err == nil {
+		err = status.Err()
+	}
+	if streamingBufferError(err) {
+		return 0, ErrPlayTooRecent
+	}
+	if err != nil {
+		return 0, fmt.Errorf("dml failed: %v", err)
+	}
+
+	stats, ok := status.Statistics.Details.(*bigquery.QueryStatistics)
+	if !ok {
+		return 0, nil
+	}
+
+	return stats.NumDMLAffectedRows, nil
+}
+
+// streamingBufferError is true when a DML statement failed as it would change
+// rows in the streaming buffer
+func streamingBufferError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "streaming buffer")
+}
+
+func keyParams(key PlayKey) []bigquery.QueryParameter {
+	return []bigquery.QueryParameter{
+		{Name: "source", Value: key.Source},
+		{Name: "timestamp", Value: key.Timestamp},
+	}
+}
+
+func (s *BigQuery) FindPlay(ctx context.Context, key PlayKey) (Play, error) {
+	queryString := fmt.Sprintf(
+		"SELECT * FROM %s WHERE source = @source AND timestamp = @timestamp LIMIT 1",
+		s.tableRef(),
+	)
+
+	var plays []Play
+	err := s.read(ctx, queryString, keyParams(key), func(it *bigquery.RowIterator) error {
+		var r bigQueryFullPlayRow
+		if err := it.Next(&r); err != nil {
+			return err
+		}
+		plays = append(plays, r.play())
+		return nil
+	})
+	if err != nil {
+		return Play{}, fmt.Errorf("failed query for play: %v", err)
+	}
+	if len(plays) == 0 {
+		return Play{}, ErrPlayNotFound
+	}
+
+	return plays[0], nil
+}
+
+// EditPlay clears the list of artists when the artist changes, it's set
+// again by the artist credits job
+func (s *BigQuery) EditPlay(ctx context.Context, key PlayKey, names PlayNames) error {
+	queryString := fmt.Sprintf(`
+UPDATE %s
+SET
+  artists = IF(artist = @artist, artists, ARRAY<STRING>[]),
+  artist = @artist,
+  album = @album,
+  track = @track
+WHERE source = @source AND timestamp = @timestamp
+`, s.tableRef())
+
+	updated, err := s.runDML(ctx, queryString, append(
+		keyParams(key),
+		bigquery.QueryParameter{Name: "artist", Value: names.Artist},
+		bigquery.QueryParameter{Name: "album", Value: names.Album},
+		bigquery.QueryParameter{Name: "track", Value: names.Track},
+	))
+	if err != nil {
+		return fmt.Errorf("failed to update play: %w", err)
+	}
+	if updated == 0 {
+		return ErrPlayNotFound
+	}
+
+	return s.Titles.Save(ctx, []Play{{Track: names.Track, Album: names.Album}})
+}
+
+// DeletePlay leaves rows in the duplicates table, they no longer match a
+// play
+func (s *BigQuery) DeletePlay(ctx context.Context, key PlayKey) error {
+	queryString := fmt.Sprintf(
+		"DELETE FROM %s WHERE source = @source AND timestamp = @timestamp",
+		s.tableRef(),
+	)
+
+	deleted, err := s.runDML(ctx, queryString, keyParams(key))
+	if err != nil {
+		return fmt.Errorf("failed to delete play: %w", err)
+	}
+	if deleted == 0 {
+		return ErrPlayNotFound
+	}
+
+	return nil
+}
+
+func (s *BigQuery) RawTrackCounts(ctx context.Context) ([]TrackCount, error) {
+	queryString := fmt.Sprintf(`
+SELECT artist, album, track, COUNT(*) AS count, ANY_VALUE(artists) AS artists
+FROM %s
+GROUP BY artist, album, track
+ORDER BY artist ASC, album ASC, track ASC
+`, s.tableRef())
+
+	return s.readTrackCounts(ctx, queryString, nil)
+}
+
+// bigQueryTrackRewrite is a query parameter value, see TrackRewrite
+type bigQueryTrackRewrite struct {
+	FromArtist string `bigquery:"from_artist"`
+	FromAlbum  string `bigquery:"from_album"`
+	FromTrack  string `bigquery:"from_track"`
+	ToArtist   string `bigquery:"to_artist"`
+	ToAlbum    string `bigquery:"to_album"`
+	ToTrack    string `bigquery:"to_track"`
+}
+
+// RewriteTracks updates all plays in one statement, plays with a new artist
+// have their list of artists cleared as in EditPlay
+func (s *BigQuery) RewriteTracks(ctx context.Context, rewrites []TrackRewrite) error {
+	if len(rewrites) == 0 {
+		return nil
+	}
+
+	var values []bigQueryTrackRewrite
+	var plays []Play
+	for _, r := range rewrites {
+		values = append(values, bigQueryTrackRewrite{
+			FromArtist: r.From.Artist,
+			FromAlbum:  r.From.Album,
+			FromTrack:  r.From.Track,
+			ToArtist:   r.To.Artist,
+			ToAlbum:    r.To.Album,
+			ToTrack:    r.To.Track,
+		})
+		plays = append(plays, Play{Track: r.To.Track, Album: r.To.Album})
+	}
+
+	queryString := fmt.Sprintf(`
+UPDATE %s p
+SET
+  artists = IF(p.artist = r.to_artist, p.artists, ARRAY<STRING>[]),
+  artist = r.to_artist,
+  album = r.to_album,
+  track = r.to_track
+FROM UNNEST(@rewrites) r
+WHERE p.artist = r.from_artist AND p.album = r.from_album AND p.track = r.from_track
+`, s.tableRef())
+
+	_, err := s.runDML(ctx, queryString, []bigquery.QueryParameter{{Name: "rewrites", Value: values}})
+	if err != nil {
+		return fmt.Errorf("failed to rewrite plays: %w", err)
+	}
+
+	return s.Titles.Save(ctx, plays)
+}
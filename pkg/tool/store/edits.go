@@ -0,0 +1,243 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	FieldArtist = "artist"
+	FieldAlbum  = "album"
+	FieldTrack  = "track"
+)
+
+// Rewrite replaces matches of Pattern in one field of plays, Replace can
+// refer to groups in the pattern as $1. When Artist is set only plays with
+// that artist string are changed.
+type Rewrite struct {
+	Field   string
+	Pattern *regexp.Regexp
+	Replace string
+	Artist  string
+}
+
+// NewRewrite returns a rewrite of field, which is artist, album or track
+func NewRewrite(field, pattern, replace, artist string) (Rewrite, error) {
+	switch field {
+	case FieldArtist, FieldAlbum, FieldTrack:
+	default:
+		return Rewrite{}, fmt.Errorf("unknown field %q, expected artist, album or track", field)
+	}
+
+	if pattern == "" {
+		return Rewrite{}, fmt.Errorf("a pattern is required")
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return Rewrite{}, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+
+	return Rewrite{Field: field, Pattern: re, Replace: replace, Artist: artist}, nil
+}
+
+// String describes the rewrite for the audit log
+func (r Rewrite) String() string {
+	s := fmt.Sprintf("%s: %q -> %q", r.Field, r.Pattern.String(), r.Replace)
+	if r.Artist != "" {
+		s += fmt.Sprintf(" for artist %q", r.Artist)
+	}
+	return s
+}
+
+// Tracks returns the changes to make to each track in counts. Tracks which
+// don't change, or where the field would be left empty, are skipped.
+func (r Rewrite) Tracks(counts []TrackCount) ([]TrackRewrite, []AuditChange) {
+	var rewrites []TrackRewrite
+	var changes []AuditChange
+	for _, c := range counts {
+		if r.Artist != "" && c.Artist != r.Artist {
+			continue
+		}
+
+		from := PlayNames{Artist: c.Artist, Album: c.Album, Track: c.Track}
+		to := from
+
+		value := &to.Track
+		switch r.Field {
+		case FieldArtist:
+			value = &to.Artist
+		case FieldAlbum:
+			value = &to.Album
+		}
+		if !r.Pattern.MatchString(*value) {
+			continue
+		}
+		*value = strings.TrimSpace(r.Pattern.ReplaceAllString(*value, r.Replace))
+		if *value == "" || to == from {
+			continue
+		}
+
+		rewrites = append(rewrites, TrackRewrite{From: from, To: to})
+		changes = append(changes, AuditChange{Before: from, After: &to, Plays: c.Count})
+	}
+
+	return rewrites, changes
+}
+
+// PlayEditor changes plays in a store and records each change in the audit
+// log with the name of the user who made it
+type PlayEditor struct {
+	Store   PlayStore
+	Audit   *AuditLog
+	Private *PrivatePlays
+	// Index gets the names plays are changed to when it's set, edited plays
+	// keep their created_at so build_index doesn't see them as new
+	Index *NameIndex
+}
+
+// Edit sets the fields of a play which are set in names
+func (e *PlayEditor) Edit(ctx context.Context, user string, key PlayKey, names PlayNames) (AuditEntry, error) {
+	if names == (PlayNames{}) {
+		return AuditEntry{}, fmt.Errorf("at least one of artist, album or track is required")
+	}
+
+	play, err := e.Store.FindPlay(ctx, key)
+	if err != nil {
+		return AuditEntry{}, err
+	}
+
+	before := play.Names()
+	after := names.Apply(before)
+	err = e.Store.EditPlay(ctx, key, after)
+	if err != nil {
+		return AuditEntry{}, err
+	}
+
+	entry := AuditEntry{
+		User:    user,
+		Action:  AuditActionEdit,
+		Changes: []AuditChange{playChange(key, before, &after)},
+	}
+
+	err = e.Audit.Record(ctx, &entry)
+	if err != nil {
+		return entry, err
+	}
+
+	return entry, e.index(ctx, after)
+}
+
+// Delete removes a play
+func (e *PlayEditor) Delete(ctx context.Context, user string, key PlayKey) (AuditEntry, error) {
+	play, err := e.Store.FindPlay(ctx, key)
+	if err != nil {
+		return AuditEntry{}, err
+	}
+
+	err = e.Store.DeletePlay(ctx, key)
+	if err != nil {
+		return AuditEntry{}, err
+	}
+
+	entry := AuditEntry{
+		User:    user,
+		Action:  AuditActionDelete,
+		Changes: []AuditChange{playChange(key, play.Names(), nil)},
+	}
+
+	return entry, e.Audit.Record(ctx, &entry)
+}
+
+// SetPrivate hides a play from visitors who aren't signed in, or shows it
+// again
+func (e *PlayEditor) SetPrivate(ctx context.Context, user string, key PlayKey, private bool) (AuditEntry, error) {
+	play, err := e.Store.FindPlay(ctx, key)
+	if err != nil {
+		return AuditEntry{}, err
+	}
+
+	err = e.Private.Set(ctx, key, private)
+	if err != nil {
+		return AuditEntry{}, err
+	}
+
+	names := play.Names()
+	entry := AuditEntry{
+		User:    user,
+		Action:  AuditActionPublic,
+		Changes: []AuditChange{playChange(key, names, &names)},
+	}
+	if private {
+		entry.Action = AuditActionPrivate
+	}
+
+	return entry, e.Audit.Record(ctx, &entry)
+}
+
+// Rewrite changes every play matching the rewrite. When dryRun is set the
+// changes are returned without being made or recorded.
+func (e *PlayEditor) Rewrite(ctx context.Context, user string, rewrite Rewrite, dryRun bool) (AuditEntry, error) {
+	counts, err := e.Store.RawTrackCounts(ctx)
+	if err != nil {
+		return AuditEntry{}, err
+	}
+
+	rewrites, changes := rewrite.Tracks(counts)
+	entry := AuditEntry{
+		User:    user,
+		Action:  AuditActionRewrite,
+		Details: rewrite.String(),
+		Changes: changes,
+	}
+	if entry.Changes == nil {
+		entry.Changes = []AuditChange{}
+	}
+	if dryRun || len(rewrites) == 0 {
+		return entry, nil
+	}
+
+	err = e.Store.RewriteTracks(ctx, rewrites)
+	if err != nil {
+		return AuditEntry{}, err
+	}
+
+	err = e.Audit.Record(ctx, &entry)
+	if err != nil {
+		return entry, err
+	}
+
+	names := make([]PlayNames, len(rewrites))
+	for i, r := range rewrites {
+		names[i] = r.To
+	}
+
+	return entry, e.index(ctx, names...)
+}
+
+// index adds the names plays were changed to
+func (e *PlayEditor) index(ctx context.Context, names ...PlayNames) error {
+	if e.Index == nil {
+		return nil
+	}
+
+	plays := make([]Play, len(names))
+	for i, n := range names {
+		plays[i] = Play{Artist: n.Artist, Album: n.Album, Track: n.Track}
+	}
+
+	_, err := e.Index.AddPlays(ctx, plays)
+	return err
+}
+
+func playChange(key PlayKey, before PlayNames, after *PlayNames) AuditChange {
+	timestamp := key.Timestamp.UTC()
+	return AuditChange{
+		Source:    key.Source,
+		Timestamp: &timestamp,
+		Before:    before,
+		After:     after,
+		Plays:     1,
+	}
+}
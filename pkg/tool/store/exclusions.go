@@ -0,0 +1,167 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+// Exclusion is a rule for plays which aren't music, such as white noise or
+// podcasts, which are left out of the counts on the site. Every field which
+// is set must match. Artist, Album and Track are case insensitive LIKE
+// patterns, where % matches any text and _ any character. Durations are in ms
+// and only match plays with a known duration.
+type Exclusion struct {
+	ID int64 `db:"id" goqu:"skipinsert" json:"id"`
+
+	Artist string `db:"artist" json:"artist"`
+	Album  string `db:"album" json:"album"`
+	Track  string `db:"track" json:"track"`
+	Source string `db:"source" json:"source"`
+
+	ShorterThan int64 `db:"shorter_than_ms" json:"shorter_than_ms"`
+	LongerThan  int64 `db:"longer_than_ms" json:"longer_than_ms"`
+
+	// HideRecent also hides matching plays from the recent plays
+	HideRecent bool `db:"hide_recent" json:"hide_recent"`
+}
+
+// Empty is true when the rule has nothing to match and would exclude all
+// plays, empty rules can't be added
+func (e Exclusion) Empty() bool {
+	return e.Artist == "" && e.Album == "" && e.Track == "" && e.Source == "" &&
+		e.ShorterThan == 0 && e.LongerThan == 0
+}
+
+// Matches reports whether the rule excludes a play, it's the same test as the
+// queries in the play stores
+func (e Exclusion) Matches(p Play) bool {
+	if e.Artist != "" && !likeMatch(e.Artist, p.Artist) {
+		return false
+	}
+	if e.Album != "" && !likeMatch(e.Album, p.Album) {
+		return false
+	}
+	if e.Track != "" && !likeMatch(e.Track, p.Track) {
+		return false
+	}
+	if e.Source != "" && e.Source != p.Source {
+		return false
+	}
+	if e.ShorterThan > 0 && (p.Duration <= 0 || p.Duration >= e.ShorterThan) {
+		return false
+	}
+	if e.LongerThan > 0 && p.Duration <= e.LongerThan {
+		return false
+	}
+
+	return true
+}
+
+// likeMatch matches value with a case insensitive LIKE pattern
+func likeMatch(pattern, value string) bool {
+	var expr strings.Builder
+	expr.WriteString("(?is)^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			expr.WriteString(".*")
+		case '_':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+
+	return regexp.MustCompile(expr.String()).MatchString(value)
+}
+
+// exclusionMatch is the condition matching plays in p to a rule in e, used by
+// the SQL and BigQuery stores
+const exclusionMatch = `(e.artist = '' OR LOWER(p.artist) LIKE LOWER(e.artist))
+    AND (e.album = '' OR LOWER(p.album) LIKE LOWER(e.album))
+    AND (e.track = '' OR LOWER(p.track) LIKE LOWER(e.track))
+    AND (e.source = '' OR p.source = e.source)
+    AND (e.shorter_than_ms = 0 OR (p.duration > 0 AND p.duration < e.shorter_than_ms))
+    AND (e.longer_than_ms = 0 OR p.duration > e.longer_than_ms)`
+
+// Exclusions saves exclusion rules in music.play_exclusions, like aliases
+// they're always in the tool database
+type Exclusions struct {
+	goquDB *goqu.Database
+	// changes counts the writes made with this value, the BigQuery store
+	// loads the rules again when it changes
+	changes atomic.Uint64
+}
+
+// NewExclusions returns the rules in the database with the music schema
+func NewExclusions(db *sql.DB) *Exclusions {
+	return &Exclusions{goquDB: goqu.New("postgres", db)}
+}
+
+// List returns every rule, oldest first
+func (x *Exclusions) List(ctx context.Context) ([]Exclusion, error) {
+	exclusions := []Exclusion{}
+	err := x.goquDB.From("music.play_exclusions").
+		Select(&Exclusion{}).
+		Order(goqu.C("id").Asc()).
+		ScanStructsContext(ctx, &exclusions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select play exclusions: %v", err)
+	}
+
+	return exclusions, nil
+}
+
+// Add saves a rule and returns it with its id
+func (x *Exclusions) Add(ctx context.Context, e Exclusion) (Exclusion, error) {
+	e.Artist = strings.TrimSpace(e.Artist)
+	e.Album = strings.TrimSpace(e.Album)
+	e.Track = strings.TrimSpace(e.Track)
+	e.Source = strings.TrimSpace(e.Source)
+	if e.ShorterThan < 0 || e.LongerThan < 0 {
+		return Exclusion{}, fmt.Errorf("durations can't be negative")
+	}
+	if e.Empty() {
+		return Exclusion{}, fmt.Errorf("an exclusion needs an artist, album, track, source or duration")
+	}
+
+	defer x.changes.Add(1)
+
+	_, err := x.goquDB.Insert("music.play_exclusions").
+		Rows(e).
+		Returning("id").
+		Executor().
+		ScanValContext(ctx, &e.ID)
+	if err != nil {
+		return Exclusion{}, fmt.Errorf("failed to insert play exclusion: %v", err)
+	}
+
+	return e, nil
+}
+
+// Remove deletes a rule, false is returned when there's no rule with the id
+func (x *Exclusions) Remove(ctx context.Context, id int64) (bool, error) {
+	defer x.changes.Add(1)
+
+	res, err := x.goquDB.Delete("music.play_exclusions").
+		Where(goqu.C("id").Eq(id)).
+		Executor().
+		ExecContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete play exclusion: %v", err)
+	}
+
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get removed count: %v", err)
+	}
+
+	return removed > 0, nil
+}
@@ -0,0 +1,276 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/gosimple/slug"
+)
+
+const (
+	// fallbackIDMin is the smallest fallback id, above every crc32 so that
+	// fallback ids never take the id of another name
+	fallbackIDMin = 1 << 32
+	// fallbackIDMax keeps fallback ids exact in javascript and as floats
+	fallbackIDMax = 1 << 53
+	// nameIndexBatchSize is how many names are looked up and inserted at once
+	nameIndexBatchSize = 500
+)
+
+// IndexedName is an artist, album or track name with the id used in page urls
+type IndexedName struct {
+	ID   int64  `db:"id"`
+	Name string `db:"name"`
+	// Hash is the crc32 of the name, it's the id unless another name had the
+	// same crc32 when the name was indexed
+	Hash       int64  `db:"hash"`
+	ArtistMBID string `db:"artist_mbid"`
+}
+
+// Slug is the name's id and slugified name, as used in page urls
+func (n IndexedName) Slug() string {
+	return FormatNameID(n.ID) + "-" + slug.Make(n.Name)
+}
+
+// FormatNameID formats an id as it is in page urls
+func FormatNameID(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+// NameHash is the crc32 of a name, it's the id of most names and the id in
+// links made from the name alone
+func NameHash(name string) int64 {
+	return int64(crc32.ChecksumIEEE([]byte(name)))
+}
+
+// fallbackNameID is the id of a name whose crc32 is already the id of another
+// name. It only depends on the name so it's the same when the index is
+// rebuilt.
+func fallbackNameID(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return fallbackIDMin + int64(h.Sum64()%(fallbackIDMax-fallbackIDMin))
+}
+
+// NameIndex saves the ids of names in music.name_index
+type NameIndex struct {
+	goquDB *goqu.Database
+}
+
+// NewNameIndex returns the index in the database with the music schema
+func NewNameIndex(db *sql.DB) *NameIndex {
+	return &NameIndex{goquDB: goqu.New("postgres", db)}
+}
+
+// Add indexes names which aren't in the index yet and returns how many were
+// added. Names get their crc32 as their id, or a fallback id when another name
+// has it. Names are looked up and inserted in batches.
+func (x *NameIndex) Add(ctx context.Context, names []string) (int64, error) {
+	var unique []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if strings.TrimSpace(name) == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		unique = append(unique, name)
+	}
+
+	var added int64
+	for start := 0; start < len(unique); start += nameIndexBatchSize {
+		end := start + nameIndexBatchSize
+		if end > len(unique) {
+			end = len(unique)
+		}
+
+		n, err := x.addBatch(ctx, unique[start:end])
+		if err != nil {
+			return added, err
+		}
+		added += n
+	}
+
+	return added, nil
+}
+
+// AddPlays indexes the credited artists, artist, album and track of plays
+// like Add. Names are added in a stable order so that which of two names with
+// the same crc32 keeps it doesn't depend on the order of the plays.
+func (x *NameIndex) AddPlays(ctx context.Context, plays []Play) (int64, error) {
+	var names []string
+	for _, p := range plays {
+		names = append(names, p.CreditedArtists()...)
+		names = append(names, p.Artist, p.Album, p.Track)
+	}
+	sort.Strings(names)
+
+	return x.Add(ctx, names)
+}
+
+func (x *NameIndex) addBatch(ctx context.Context, names []string) (int64, error) {
+	hashes := make([]int64, len(names))
+	for i, name := range names {
+		hashes[i] = NameHash(name)
+	}
+
+	var indexed []IndexedName
+	err := x.goquDB.From("music.name_index").
+		Select("id", "name").
+		Where(goqu.Or(goqu.C("name").In(names), goqu.C("id").In(hashes))).
+		ScanStructsContext(ctx, &indexed)
+	if err != nil {
+		return 0, fmt.Errorf("failed to select indexed names: %v", err)
+	}
+
+	ids := make(map[int64]bool)
+	existing := make(map[string]bool)
+	for _, n := range indexed {
+		ids[n.ID] = true
+		existing[n.Name] = true
+	}
+
+	var rows []IndexedName
+	var fallbacks []int
+	for i, name := range names {
+		if existing[name] {
+			continue
+		}
+
+		row := IndexedName{ID: hashes[i], Name: name, Hash: hashes[i]}
+		if ids[row.ID] {
+			row.ID = fallbackNameID(name)
+			fallbacks = append(fallbacks, len(rows))
+		} else {
+			ids[row.ID] = true
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+
+	// fallback ids are checked against the index until each is free
+	for len(fallbacks) > 0 {
+		candidates := make([]int64, len(fallbacks))
+		for i, r := range fallbacks {
+			candidates[i] = rows[r].ID
+		}
+
+		var taken []int64
+		err = x.goquDB.From("music.name_index").
+			Select("id").
+			Where(goqu.C("id").In(candidates)).
+			ScanValsContext(ctx, &taken)
+		if err != nil {
+			return 0, fmt.Errorf("failed to select fallback ids: %v", err)
+		}
+		for _, id := range taken {
+			ids[id] = true
+		}
+
+		var next []int
+		for _, r := range fallbacks {
+			if ids[rows[r].ID] {
+				rows[r].ID++
+				next = append(next, r)
+				continue
+			}
+			ids[rows[r].ID] = true
+		}
+		fallbacks = next
+	}
+
+	records := make([]goqu.Record, len(rows))
+	for i, r := range rows {
+		records[i] = goqu.Record{"id": r.ID, "name": r.Name, "hash": r.Hash}
+	}
+
+	res, err := x.goquDB.Insert("music.name_index").
+		Rows(records).
+		OnConflict(goqu.DoNothing()).
+		Executor().
+		ExecContext(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert names: %v", err)
+	}
+
+	added, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get row count: %v", err)
+	}
+
+	return added, nil
+}
+
+// Find returns the indexed name, false is returned when it isn't indexed
+func (x *NameIndex) Find(ctx context.Context, name string) (IndexedName, bool, error) {
+	var n IndexedName
+	found, err := x.goquDB.From("music.name_index").
+		Select("id", "name", "hash", "artist_mbid").
+		Where(goqu.C("name").Eq(name)).
+		ScanStructContext(ctx, &n)
+	if err != nil {
+		return IndexedName{}, false, fmt.Errorf("failed to select indexed name: %v", err)
+	}
+
+	return n, found, nil
+}
+
+// ArtistsWithMBID returns the names saved with a MusicBrainz id in order
+func (x *NameIndex) ArtistsWithMBID(ctx context.Context, mbid string) ([]string, error) {
+	var names []string
+	err := x.goquDB.From("music.name_index").
+		Select("name").
+		Where(goqu.C("artist_mbid").Eq(mbid)).
+		Order(goqu.C("name").Asc()).
+		ScanValsContext(ctx, &names)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select names with mbid: %v", err)
+	}
+
+	return names, nil
+}
+
+// Resolve finds the name for a page url slug, only the id at the start of the
+// slug is required. Slugs made from a name alone use its crc32, so names with
+// a fallback id are also found by their hash when the rest of the slug matches
+// the name. false is returned when there's no name or the slug is malformed.
+func (x *NameIndex) Resolve(ctx context.Context, nameSlug string) (IndexedName, bool, error) {
+	idPart, text, _ := strings.Cut(nameSlug, "-")
+	id, err := strconv.ParseInt(idPart, 10, 64)
+	if err != nil || id < 0 {
+		return IndexedName{}, false, nil
+	}
+
+	var candidates []IndexedName
+	err = x.goquDB.From("music.name_index").
+		Select("id", "name", "hash", "artist_mbid").
+		Where(goqu.Or(goqu.C("id").Eq(id), goqu.C("hash").Eq(id))).
+		Order(goqu.C("id").Asc()).
+		ScanStructsContext(ctx, &candidates)
+	if err != nil {
+		return IndexedName{}, false, fmt.Errorf("failed to select indexed name: %v", err)
+	}
+
+	var byID *IndexedName
+	for i, c := range candidates {
+		if slug.Make(c.Name) == text {
+			return c, true, nil
+		}
+		if c.ID == id {
+			byID = &candidates[i]
+		}
+	}
+	if byID != nil {
+		return *byID, true, nil
+	}
+
+	return IndexedName{}, false, nil
+}
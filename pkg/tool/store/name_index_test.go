@@ -0,0 +1,100 @@
+package store_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+// plumless and buckeroo have the same crc32
+var collidingNames = []string{"buckeroo", "plumless"}
+
+func indexedNames(t *testing.T, index *store.NameIndex) map[string]store.IndexedName {
+	t.Helper()
+
+	result := make(map[string]store.IndexedName)
+	for _, name := range collidingNames {
+		n, found, err := index.Resolve(context.Background(), store.FormatNameID(store.NameHash(name))+"-"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found {
+			t.Fatalf("expected %q to be found by its crc32 and name", name)
+		}
+		result[name] = n
+	}
+
+	return result
+}
+
+func TestNameIndexCollidingNames(t *testing.T) {
+	ctx := context.Background()
+
+	if store.NameHash(collidingNames[0]) != store.NameHash(collidingNames[1]) {
+		t.Fatal("expected the names to have the same crc32")
+	}
+
+	index := store.NewNameIndex(newSQLiteStore(t).DB)
+	added, err := index.Add(ctx, collidingNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 2 {
+		t.Fatalf("expected 2 names to be added, got %d", added)
+	}
+
+	names := indexedNames(t, index)
+	buckeroo, plumless := names["buckeroo"], names["plumless"]
+	if buckeroo.Name != "buckeroo" || plumless.Name != "plumless" {
+		t.Fatalf("expected each name to be found by its own slug, got %q and %q", buckeroo.Name, plumless.Name)
+	}
+	if buckeroo.ID != store.NameHash("buckeroo") {
+		t.Fatalf("expected the first name to have its crc32 as its id, got %d", buckeroo.ID)
+	}
+	if plumless.ID == buckeroo.ID || plumless.ID <= 1<<32 {
+		t.Fatalf("expected the second name to have a fallback id, got %d", plumless.ID)
+	}
+
+	// both are found by their canonical slugs
+	for _, n := range names {
+		resolved, found, err := index.Resolve(ctx, n.Slug())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || resolved != n {
+			t.Fatalf("expected %s to resolve to %+v, got %+v", n.Slug(), n, resolved)
+		}
+	}
+
+	// a bare crc32 is the name which has it as its id
+	resolved, found, err := index.Resolve(ctx, store.FormatNameID(store.NameHash("plumless")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || resolved.Name != "buckeroo" {
+		t.Fatalf("expected the bare crc32 to resolve to buckeroo, got %+v", resolved)
+	}
+
+	// adding the names again changes nothing
+	added, err = index.Add(ctx, []string{"plumless", "buckeroo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 0 {
+		t.Fatalf("expected no names to be added, got %d", added)
+	}
+	if again := indexedNames(t, index); again["buckeroo"] != buckeroo || again["plumless"] != plumless {
+		t.Fatalf("expected the ids not to change, got %+v", again)
+	}
+
+	// the ids are the same when the index is rebuilt
+	rebuilt := store.NewNameIndex(newSQLiteStore(t).DB)
+	_, err = rebuilt.Add(ctx, collidingNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again := indexedNames(t, rebuilt); again["buckeroo"].ID != buckeroo.ID || again["plumless"].ID != plumless.ID {
+		t.Fatalf("expected a rebuilt index to have the same ids, got %+v", again)
+	}
+}
@@ -0,0 +1,233 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+// Privacy limits the plays shown to visitors who aren't signed in. Queries
+// apply it when it's set on the request context with WithPrivacy.
+type Privacy struct {
+	// Delay hides plays until they are this old
+	Delay time.Duration
+	// Location is the time zone of the daily windows
+	Location *time.Location
+	// Daily are the times of day when plays are hidden
+	Daily []DailyWindow
+	// Ranges are periods when plays are hidden
+	Ranges []TimeRange
+}
+
+// DailyWindow is a time of day, in minutes after midnight, from From until
+// To. Windows where To is before From run over midnight.
+type DailyWindow struct {
+	From int
+	To   int
+}
+
+// TimeRange is the period from Start until End
+type TimeRange struct {
+	Start time.Time
+	End   time.Time
+}
+
+// ParseDailyWindow parses a window from times formatted as 15:04
+func ParseDailyWindow(from, to string) (DailyWindow, error) {
+	f, err := time.Parse("15:04", from)
+	if err != nil {
+		return DailyWindow{}, fmt.Errorf("invalid time %q: %v", from, err)
+	}
+	t, err := time.Parse("15:04", to)
+	if err != nil {
+		return DailyWindow{}, fmt.Errorf("invalid time %q: %v", to, err)
+	}
+
+	w := DailyWindow{From: f.Hour()*60 + f.Minute(), To: t.Hour()*60 + t.Minute()}
+	if w.From == w.To {
+		return DailyWindow{}, fmt.Errorf("window from %s to %s is empty", from, to)
+	}
+
+	return w, nil
+}
+
+// contains reports whether a minute of the day is in the window
+func (w DailyWindow) contains(minute int) bool {
+	if w.From < w.To {
+		return minute >= w.From && minute < w.To
+	}
+	return minute >= w.From || minute < w.To
+}
+
+// Visible reports whether a play at t can be shown at now, plays marked as
+// private are checked separately
+func (p *Privacy) Visible(t, now time.Time) bool {
+	if p == nil {
+		return true
+	}
+
+	if t.After(now.Add(-p.Delay)) {
+		return false
+	}
+
+	for _, r := range p.Ranges {
+		if !t.Before(r.Start) && t.Before(r.End) {
+			return false
+		}
+	}
+
+	local := t.In(p.location())
+	minute := local.Hour()*60 + local.Minute()
+	for _, w := range p.Daily {
+		if w.contains(minute) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p *Privacy) location() *time.Location {
+	if p.Location == nil {
+		return time.UTC
+	}
+	return p.Location
+}
+
+type privacyKey struct{}
+
+// WithPrivacy returns a context where queries only return plays which are
+// visible with p
+func WithPrivacy(ctx context.Context, p *Privacy) context.Context {
+	return context.WithValue(ctx, privacyKey{}, p)
+}
+
+// PrivacyFrom returns the privacy set on the context, nil when all plays can
+// be shown
+func PrivacyFrom(ctx context.Context) *Privacy {
+	p, _ := ctx.Value(privacyKey{}).(*Privacy)
+	return p
+}
+
+// privacySQL holds the parts of privacy conditions which differ between
+// databases, the play is aliased as p
+type privacySQL struct {
+	// timeLiteral formats a time to compare with the timestamp column
+	timeLiteral func(t time.Time) string
+	// minuteOfDay is the minute of the day of the play's timestamp in a time
+	// zone
+	minuteOfDay func(tz string) string
+	// private matches plays which are marked as private
+	private string
+}
+
+// conditions returns the conditions joined with AND for plays visible at now,
+// it's empty when p is nil
+func (p *Privacy) conditions(now time.Time, d privacySQL) string {
+	if p == nil {
+		return ""
+	}
+
+	conditions := []string{
+		fmt.Sprintf("p.timestamp <= %s", d.timeLiteral(now.Add(-p.Delay))),
+		fmt.Sprintf("NOT %s", d.private),
+	}
+
+	for _, r := range p.Ranges {
+		conditions = append(conditions, fmt.Sprintf(
+			"NOT (p.timestamp >= %s AND p.timestamp < %s)",
+			d.timeLiteral(r.Start),
+			d.timeLiteral(r.End),
+		))
+	}
+
+	if len(p.Daily) > 0 {
+		minute := d.minuteOfDay(strings.ReplaceAll(p.location().String(), "'", "''"))
+		for _, w := range p.Daily {
+			op := "AND"
+			if w.From > w.To {
+				op = "OR"
+			}
+			conditions = append(conditions, fmt.Sprintf(
+				"NOT (%[1]s >= %[2]d %[3]s %[1]s < %[4]d)",
+				minute, w.From, op, w.To,
+			))
+		}
+	}
+
+	return strings.Join(conditions, "\n    AND ")
+}
+
+// PrivatePlays saves the plays marked as private in music.private_plays, like
+// aliases they're always in the tool database
+type PrivatePlays struct {
+	goquDB *goqu.Database
+	// timeValue converts a timestamp to the value stored by the play store
+	timeValue func(t time.Time) interface{}
+	// changes counts the writes made with this value, the BigQuery store
+	// loads the private plays again when it changes
+	changes atomic.Uint64
+}
+
+// NewPrivatePlays returns the private plays in a postgres database with the
+// music schema
+func NewPrivatePlays(db *sql.DB) *PrivatePlays {
+	return &PrivatePlays{goquDB: goqu.New("postgres", db), timeValue: postgresDialect.timeValue}
+}
+
+// NewSQLitePrivatePlays returns the private plays in a sqlite database with
+// music attached
+func NewSQLitePrivatePlays(db *sql.DB) *PrivatePlays {
+	return &PrivatePlays{goquDB: goqu.New("postgres", db), timeValue: sqliteDialect.timeValue}
+}
+
+// List returns the key of each private play
+func (x *PrivatePlays) List(ctx context.Context) ([]PlayKey, error) {
+	var rows []struct {
+		Source    string    `db:"source"`
+		Timestamp time.Time `db:"timestamp"`
+	}
+	err := x.goquDB.From("music.private_plays").
+		Select("source", "timestamp").
+		Order(goqu.C("timestamp").Asc()).
+		ScanStructsContext(ctx, &rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select private plays: %v", err)
+	}
+
+	keys := []PlayKey{}
+	for _, r := range rows {
+		keys = append(keys, PlayKey{Source: r.Source, Timestamp: r.Timestamp.UTC()})
+	}
+
+	return keys, nil
+}
+
+// Set marks a play as private, or public again
+func (x *PrivatePlays) Set(ctx context.Context, key PlayKey, private bool) error {
+	defer x.changes.Add(1)
+
+	var err error
+	if private {
+		_, err = x.goquDB.Insert("music.private_plays").
+			Rows(goqu.Record{"source": key.Source, "timestamp": x.timeValue(key.Timestamp)}).
+			OnConflict(goqu.DoNothing()).
+			Executor().
+			ExecContext(ctx)
+	} else {
+		_, err = x.goquDB.Delete("music.private_plays").
+			Where(goqu.C("source").Eq(key.Source), goqu.C("timestamp").Eq(x.timeValue(key.Timestamp))).
+			Executor().
+			ExecContext(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update private plays: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,1096 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+// SQL is a PlayStore backed by the music.plays table in postgres or sqlite,
+// reads for the site use the canonical_plays view which omits duplicates
+type SQL struct {
+	DB *sql.DB
+
+	goquDB  *goqu.Database
+	dialect sqlDialect
+	aliases *Aliases
+
+	// Titles saves the normalized titles of inserted plays when set
+	Titles *Titles
+}
+
+// sqlDialect holds the parts of queries which differ between databases
+type sqlDialect struct {
+	// strpos is the function returning the 1-based index of a substring
+	strpos string
+	// month is an expression formatting the timestamp column as 2006-01
+	month string
+	// timeValue converts a time to a value stored in, or compared with,
+	// timestamp columns
+	timeValue func(t time.Time) interface{}
+	// timeLiteral formats a time as a literal compared with timestamp columns
+	timeLiteral func(t time.Time) string
+	// minuteOfDay is an expression for the minute of the day of p.timestamp
+	// in a time zone
+	minuteOfDay func(tz string) string
+}
+
+var postgresDialect = sqlDialect{
+	strpos: "STRPOS",
+	month:  "TO_CHAR(timestamp AT TIME ZONE 'UTC', 'YYYY-MM')",
+	timeValue: func(t time.Time) interface{} {
+		return t.UTC()
+	},
+	timeLiteral: func(t time.Time) string {
+		return fmt.Sprintf("'%s'::TIMESTAMPTZ", t.UTC().Format(time.RFC3339Nano))
+	},
+	minuteOfDay: func(tz string) string {
+		return fmt.Sprintf(
+			"(EXTRACT(HOUR FROM p.timestamp AT TIME ZONE '%[1]s') * 60 + EXTRACT(MINUTE FROM p.timestamp AT TIME ZONE '%[1]s'))",
+			tz,
+		)
+	},
+}
+
+var sqliteDialect = sqlDialect{
+	strpos: "INSTR",
+	month:  "STRFTIME('%Y-%m', timestamp)",
+	// times are stored as fixed width UTC text so that they sort
+	// correctly when compared as strings
+	timeValue: func(t time.Time) interface{} {
+		return t.UTC().Format(sqliteTimeFormat)
+	},
+	timeLiteral: func(t time.Time) string {
+		return fmt.Sprintf("'%s'", t.UTC().Format(sqliteTimeFormat))
+	},
+	// sqlite has no time zones, the function is registered on each
+	// connection when the database is opened
+	minuteOfDay: func(tz string) string {
+		return fmt.Sprintf("music_minute_of_day(p.timestamp, '%s')", tz)
+	},
+}
+
+// NewPostgres returns a store using the tool database connection
+func NewPostgres(db *sql.DB) *SQL {
+	return &SQL{
+		DB:      db,
+		goquDB:  goqu.New("postgres", db),
+		aliases: NewAliases(db),
+		dialect: postgresDialect,
+	}
+}
+
+// NewSQLite returns a store using a sqlite database with music attached and
+// the music_minute_of_day function registered, see SQLiteMinuteOfDay
+func NewSQLite(db *sql.DB) *SQL {
+	return &SQL{
+		DB:      db,
+		goquDB:  goqu.New("postgres", db),
+		aliases: NewAliases(db),
+		dialect: sqliteDialect,
+	}
+}
+
+// sqliteLocations caches the time zones loaded by SQLiteMinuteOfDay, which is
+// called for every row
+var sqliteLocations sync.Map
+
+// SQLiteMinuteOfDay is the music_minute_of_day function used by the sqlite
+// store, it returns the minute of the day of a stored timestamp in a time zone
+func SQLiteMinuteOfDay(timestamp, tz string) (int, error) {
+	t, err := time.Parse(sqliteTimeFormat, timestamp)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q: %v", timestamp, err)
+	}
+
+	location, ok := sqliteLocations.Load(tz)
+	if !ok {
+		l, err := time.LoadLocation(tz)
+		if err != nil {
+			return 0, fmt.Errorf("invalid time zone %q: %v", tz, err)
+		}
+		location, _ = sqliteLocations.LoadOrStore(tz, l)
+	}
+
+	local := t.In(location.(*time.Location))
+
+	return local.Hour()*60 + local.Minute(), nil
+}
+
+const sqliteTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// resolvedPlays is music.canonical_plays without excluded plays, and plays
+// hidden by the privacy on the context, with canonical_artist,
+// canonical_track and canonical_album columns set to the artist name and
+// normalized titles each play is counted under
+func (s *SQL) resolvedPlays(ctx context.Context) string {
+	return fmt.Sprintf(`(
+  SELECT
+    p.*,
+    COALESCE(a.artist, p.artist) AS canonical_artist,
+    COALESCE(nt.title, p.track) AS canonical_track,
+    COALESCE(na.title, p.album) AS canonical_album
+  FROM music.canonical_plays p
+  LEFT JOIN music.artist_aliases a ON a.alias = p.artist
+  LEFT JOIN music.normalized_titles nt ON nt.field = 'track' AND nt.raw = p.track
+  LEFT JOIN music.normalized_titles na ON na.field = 'album' AND na.raw = p.album
+  WHERE NOT EXISTS (
+    SELECT 1 FROM music.play_exclusions e
+    WHERE %s )%s ) AS plays`, exclusionMatch, s.privacy(ctx))
+}
+
+// privacy returns conditions on plays aliased as p, starting with AND, which
+// hide plays when the context has a privacy set
+func (s *SQL) privacy(ctx context.Context) string {
+	conditions := PrivacyFrom(ctx).conditions(time.Now(), privacySQL{
+		timeLiteral: s.dialect.timeLiteral,
+		minuteOfDay: s.dialect.minuteOfDay,
+		private: `EXISTS (
+      SELECT 1 FROM music.private_plays pp
+      WHERE pp.source = p.source AND pp.timestamp = p.timestamp )`,
+	})
+	if conditions == "" {
+		return ""
+	}
+
+	return "\n    AND " + conditions
+}
+
+// titleMatch matches plays counted under the normalized title of the raw
+// title in param, field is track or album
+func (s *SQL) titleMatch(field, param string) string {
+	return fmt.Sprintf(`canonical_%[1]s = COALESCE(
+    (SELECT t.title FROM music.normalized_titles t WHERE t.field = '%[1]s' AND t.raw = %[2]s), %[2]s)`, field, param)
+}
+
+// artistMatch matches artist strings which credit an artist, or one of its
+// aliases, where canonical is the column with the canonical artist string.
+// Strings without a credit only match the whole string.
+func (s *SQL) artistMatch(canonical string) string {
+	return fmt.Sprintf(`(%s = $1 OR artist IN (
+    SELECT c.artist FROM music.artist_credits c
+    LEFT JOIN music.artist_aliases a ON a.alias = c.name
+    WHERE COALESCE(a.artist, c.name) = $1 ))`, canonical)
+}
+
+// artistCreditsBatchSize limits the number of artist strings in one query
+const artistCreditsBatchSize = 500
+
+// artistCredits returns the credited artists of each artist string which has
+// a credit, all credits are returned when artists is nil
+func (s *SQL) artistCredits(ctx context.Context, artists []string) (map[string][]string, error) {
+	credits := make(map[string][]string)
+
+	batches := [][]string{nil}
+	if artists != nil {
+		batches = nil
+		for len(artists) > 0 {
+			n := artistCreditsBatchSize
+			if len(artists) < n {
+				n = len(artists)
+			}
+			batches = append(batches, artists[:n])
+			artists = artists[n:]
+		}
+	}
+
+	for _, batch := range batches {
+		query := s.goquDB.From("music.artist_credits").
+			Select("artist", "name").
+			Order(goqu.C("artist").Asc(), goqu.C("position").Asc())
+		if batch != nil {
+			query = query.Where(goqu.C("artist").In(batch))
+		}
+
+		var rows []struct {
+			Artist string `db:"artist"`
+			Name   string `db:"name"`
+		}
+		err := query.ScanStructsContext(ctx, &rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to select artist credits: %v", err)
+		}
+
+		for _, r := range rows {
+			credits[r.Artist] = append(credits[r.Artist], r.Name)
+		}
+	}
+
+	return credits, nil
+}
+
+// attachArtists sets the artists of plays from their artist string's credit
+func (s *SQL) attachArtists(ctx context.Context, plays []Play) error {
+	var artists []string
+	for _, p := range plays {
+		artists = append(artists, p.Artist)
+	}
+
+	credits, err := s.artistCredits(ctx, distinct(artists))
+	if err != nil {
+		return err
+	}
+
+	for i := range plays {
+		plays[i].Artists = credits[plays[i].Artist]
+	}
+
+	return nil
+}
+
+// attachCountArtists sets the artists of track counts, see attachArtists.
+// Counts are of canonical artists, so credited names are also resolved.
+func (s *SQL) attachCountArtists(ctx context.Context, counts []TrackCount) error {
+	var artists []string
+	for _, c := range counts {
+		artists = append(artists, c.Artist)
+	}
+
+	credits, err := s.artistCredits(ctx, distinct(artists))
+	if err != nil {
+		return err
+	}
+
+	aliases, err := s.aliases.Map(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i := range counts {
+		counts[i].Artists = resolveArtists(aliases, credits[counts[i].Artist])
+	}
+
+	return nil
+}
+
+// saveArtistCredits saves credits for artist strings which don't have one, the
+// first credit seen for a string is kept
+func (s *SQL) saveArtistCredits(ctx context.Context, credits []ArtistCredit) error {
+	var artists []string
+	for _, c := range credits {
+		artists = append(artists, c.Artist)
+	}
+
+	existing, err := s.artistCredits(ctx, distinct(artists))
+	if err != nil {
+		return err
+	}
+
+	var rows []goqu.Record
+	for _, c := range credits {
+		if len(c.Artists) == 0 {
+			continue
+		}
+		if _, ok := existing[c.Artist]; ok {
+			continue
+		}
+		existing[c.Artist] = c.Artists
+
+		for i, name := range c.Artists {
+			rows = append(rows, goqu.Record{
+				"artist":   c.Artist,
+				"position": i,
+				"name":     name,
+			})
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	_, err = s.goquDB.Insert("music.artist_credits").
+		Rows(rows).
+		OnConflict(goqu.DoNothing()).
+		Executor().
+		ExecContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to insert artist credits: %v", err)
+	}
+
+	return nil
+}
+
+func distinct(values []string) []string {
+	seen := make(map[string]bool)
+	result := []string{}
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
+
+const sqlPlayColumns = `track, artist, album, timestamp, duration, spotify_id, album_cover, created_at, source,
+  youtube_id, youtube_category_id, soundcloud_id, soundcloud_permalink, shazam_id, shazam_permalink,
+  track_mbid, artist_mbid, album_mbid`
+
+type sqlPlayRow struct {
+	Track     string        `db:"track"`
+	Artist    string        `db:"artist"`
+	Album     string        `db:"album"`
+	Timestamp time.Time     `db:"timestamp"`
+	Duration  sql.NullInt64 `db:"duration"`
+
+	SpotifyID  string    `db:"spotify_id"`
+	AlbumCover string    `db:"album_cover"`
+	CreatedAt  time.Time `db:"created_at"`
+	Source     string    `db:"source"`
+
+	YoutubeID           string `db:"youtube_id"`
+	YoutubeCategoryID   string `db:"youtube_category_id"`
+	SoundcloudID        string `db:"soundcloud_id"`
+	SoundcloudPermalink string `db:"soundcloud_permalink"`
+	ShazamID            string `db:"shazam_id"`
+	ShazamPermalink     string `db:"shazam_permalink"`
+
+	TrackMBID  string `db:"track_mbid"`
+	ArtistMBID string `db:"artist_mbid"`
+	AlbumMBID  string `db:"album_mbid"`
+}
+
+func (r sqlPlayRow) play() Play {
+	return Play{
+		Track:               r.Track,
+		Artist:              r.Artist,
+		Album:               r.Album,
+		Timestamp:           r.Timestamp.UTC(),
+		Duration:            r.Duration.Int64,
+		SpotifyID:           r.SpotifyID,
+		AlbumCover:          r.AlbumCover,
+		CreatedAt:           r.CreatedAt.UTC(),
+		Source:              r.Source,
+		YoutubeID:           r.YoutubeID,
+		YoutubeCategoryID:   r.YoutubeCategoryID,
+		SoundcloudID:        r.SoundcloudID,
+		SoundcloudPermalink: r.SoundcloudPermalink,
+		ShazamID:            r.ShazamID,
+		ShazamPermalink:     r.ShazamPermalink,
+		TrackMBID:           r.TrackMBID,
+		ArtistMBID:          r.ArtistMBID,
+		AlbumMBID:           r.AlbumMBID,
+	}
+}
+
+// playRecord converts a play to a row for the plays table
+func (s *SQL) playRecord(p Play) goqu.Record {
+	createdAt := p.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+
+	return goqu.Record{
+		"track":                p.Track,
+		"artist":               p.Artist,
+		"album":                p.Album,
+		"timestamp":            s.dialect.timeValue(p.Timestamp),
+		"duration":             sql.NullInt64{Int64: p.Duration, Valid: p.Duration != 0},
+		"spotify_id":           p.SpotifyID,
+		"album_cover":          p.AlbumCover,
+		"created_at":           s.dialect.timeValue(createdAt),
+		"source":               p.Source,
+		"youtube_id":           p.YoutubeID,
+		"youtube_category_id":  p.YoutubeCategoryID,
+		"soundcloud_id":        p.SoundcloudID,
+		"soundcloud_permalink": p.SoundcloudPermalink,
+		"shazam_id":            p.ShazamID,
+		"shazam_permalink":     p.ShazamPermalink,
+		"track_mbid":           p.TrackMBID,
+		"artist_mbid":          p.ArtistMBID,
+		"album_mbid":           p.AlbumMBID,
+	}
+}
+
+func (s *SQL) readPlays(ctx context.Context, query string, args ...interface{}) ([]Play, error) {
+	var rows []sqlPlayRow
+	err := s.goquDB.ScanStructsContext(ctx, &rows, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select plays: %v", err)
+	}
+
+	var plays []Play
+	for _, r := range rows {
+		plays = append(plays, r.play())
+	}
+
+	err = s.attachArtists(ctx, plays)
+	if err != nil {
+		return nil, err
+	}
+
+	return plays, nil
+}
+
+func (s *SQL) readTrackCounts(ctx context.Context, query string, args ...interface{}) ([]TrackCount, error) {
+	var rows []struct {
+		Artist string `db:"artist"`
+		Album  string `db:"album"`
+		Track  string `db:"track"`
+		Count  int64  `db:"count"`
+	}
+	err := s.goquDB.ScanStructsContext(ctx, &rows, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select track counts: %v", err)
+	}
+
+	var counts []TrackCount
+	for _, r := range rows {
+		counts = append(counts, TrackCount{Artist: r.Artist, Album: r.Album, Track: r.Track, Count: r.Count})
+	}
+
+	err = s.attachCountArtists(ctx, counts)
+	if err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+func (s *SQL) readStrings(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	var values []string
+	err := s.goquDB.ScanValsContext(ctx, &values, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select values: %v", err)
+	}
+
+	return values, nil
+}
+
+func (s *SQL) InsertPlays(ctx context.Context, plays []Play) error {
+	if len(plays) == 0 {
+		return nil
+	}
+
+	var rows []goqu.Record
+	for _, p := range plays {
+		rows = append(rows, s.playRecord(p))
+	}
+
+	query := s.goquDB.Insert("music.plays").Rows(rows).OnConflict(goqu.DoNothing())
+	_, err := query.Executor().ExecContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to insert plays: %v", err)
+	}
+
+	err = s.Titles.Save(ctx, plays)
+	if err != nil {
+		return err
+	}
+
+	// plays without a list of artists are left for the artist credits job
+	var credits []ArtistCredit
+	for _, p := range plays {
+		credits = append(credits, ArtistCredit{Artist: p.Artist, Artists: p.Artists})
+	}
+
+	return s.saveArtistCredits(ctx, credits)
+}
+
+func (s *SQL) MostRecentTimestamps(ctx context.Context, source string, count int) ([]time.Time, error) {
+	var t []time.Time
+	err := s.goquDB.From("music.plays").
+		Select("timestamp").
+		Where(goqu.C("source").Eq(source)).
+		Order(goqu.C("timestamp").Desc()).
+		Limit(uint(count)).
+		ScanValsContext(ctx, &t)
+	if err != nil {
+		return t, fmt.Errorf("failed query for recent timestamps: %v", err)
+	}
+
+	for i := range t {
+		t[i] = t[i].UTC()
+	}
+
+	return t, nil
+}
+
+func (s *SQL) SourceTimestamps(ctx context.Context, source string, from, to time.Time) ([]time.Time, error) {
+	var t []time.Time
+	err := s.goquDB.ScanValsContext(ctx, &t, `
+SELECT timestamp FROM music.plays
+WHERE source = $1 AND timestamp >= $2 AND timestamp <= $3
+ORDER BY timestamp DESC
+`, source, s.dialect.timeValue(from), s.dialect.timeValue(to))
+	if err != nil {
+		return t, fmt.Errorf("failed query for source timestamps: %v", err)
+	}
+
+	for i := range t {
+		t[i] = t[i].UTC()
+	}
+
+	return t, nil
+}
+
+func (s *SQL) SourcePlays(ctx context.Context, source string, from, to time.Time) ([]Play, error) {
+	return s.readPlays(ctx, fmt.Sprintf(`
+SELECT %s FROM music.plays
+WHERE source = $1 AND timestamp >= $2 AND timestamp <= $3
+ORDER BY timestamp ASC
+`, sqlPlayColumns), source, s.dialect.timeValue(from), s.dialect.timeValue(to))
+}
+
+func (s *SQL) EachPlay(ctx context.Context, fn func(Play) error) error {
+	credits, err := s.artistCredits(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	scanner, err := s.goquDB.From("music.plays").
+		Select(&sqlPlayRow{}).
+		Order(goqu.C("timestamp").Asc()).
+		Executor().
+		ScannerContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to select plays: %v", err)
+	}
+	defer scanner.Close()
+
+	for scanner.Next() {
+		var r sqlPlayRow
+		err = scanner.ScanStruct(&r)
+		if err != nil {
+			return fmt.Errorf("failed to scan play: %v", err)
+		}
+
+		p := r.play()
+		p.Artists = credits[p.Artist]
+
+		err = fn(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (s *SQL) CanonicalPlays(ctx context.Context, from, to time.Time) ([]Play, error) {
+	return s.readPlays(ctx, fmt.Sprintf(`
+SELECT %s FROM music.canonical_plays
+WHERE timestamp >= $1 AND timestamp <= $2
+ORDER BY timestamp ASC
+`, sqlPlayColumns), s.dialect.timeValue(from), s.dialect.timeValue(to))
+}
+
+func (s *SQL) PlaysCreatedAfter(ctx context.Context, cursor CreatedCursor, limit int) ([]Play, error) {
+	return s.readPlays(ctx, fmt.Sprintf(`
+SELECT %s FROM music.canonical_plays
+WHERE created_at > $1
+  OR (created_at = $1 AND (source > $2 OR (source = $2 AND timestamp > $3)))
+ORDER BY created_at ASC, source ASC, timestamp ASC
+LIMIT $4
+`, sqlPlayColumns),
+		s.dialect.timeValue(cursor.CreatedAt),
+		cursor.Source,
+		s.dialect.timeValue(cursor.Timestamp),
+		limit,
+	)
+}
+
+func (s *SQL) MarkDuplicates(ctx context.Context, duplicates []Duplicate) error {
+	if len(duplicates) == 0 {
+		return nil
+	}
+
+	var rows []goqu.Record
+	for _, d := range duplicates {
+		rows = append(rows, goqu.Record{
+			"source":              d.Source,
+			"timestamp":           s.dialect.timeValue(d.Timestamp),
+			"canonical_source":    d.CanonicalSource,
+			"canonical_timestamp": s.dialect.timeValue(d.CanonicalTimestamp),
+		})
+	}
+
+	query := s.goquDB.Insert("music.play_duplicates").Rows(rows).OnConflict(goqu.DoNothing())
+	_, err := query.Executor().ExecContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to insert duplicates: %v", err)
+	}
+
+	return nil
+}
+
+// RecentPlays leaves out plays matching exclusions which hide recent plays
+func (s *SQL) RecentPlays(ctx context.Context, limit int) ([]Play, error) {
+	return s.readPlays(ctx, fmt.Sprintf(`
+SELECT %s FROM music.canonical_plays p
+WHERE NOT EXISTS (
+  SELECT 1 FROM music.play_exclusions e
+  WHERE e.hide_recent AND %s )%s
+ORDER BY timestamp DESC
+LIMIT $1
+`, sqlPlayColumns, exclusionMatch, s.privacy(ctx)), limit)
+}
+
+func (s *SQL) TopTracks(ctx context.Context, since time.Time, limit int) ([]TrackCount, error) {
+	return s.readTrackCounts(ctx, fmt.Sprintf(`
+SELECT
+  canonical_artist AS artist,
+  MAX(canonical_album) AS album,
+  canonical_track AS track,
+  COUNT(track) AS count
+FROM
+  %s
+WHERE
+  timestamp > $1
+GROUP BY
+  canonical_artist,
+  canonical_track
+ORDER BY
+  count DESC
+LIMIT
+  $2
+`, s.resolvedPlays(ctx)), s.dialect.timeValue(since), limit)
+}
+
+func (s *SQL) MonthsTopTracks(ctx context.Context, limit int) ([]MonthTopTracks, error) {
+	var rows []struct {
+		Month  string `db:"month"`
+		Artist string `db:"artist"`
+		Album  string `db:"album"`
+		Track  string `db:"track"`
+		Count  int64  `db:"count"`
+	}
+	err := s.goquDB.ScanStructsContext(ctx, &rows, fmt.Sprintf(`
+WITH
+  counts AS (
+  SELECT
+    %s AS month,
+    canonical_artist AS artist,
+    MAX(canonical_album) AS album,
+    canonical_track AS track,
+    COUNT(track) AS count
+  FROM
+    %s
+  GROUP BY
+    month,
+    canonical_artist,
+    canonical_track ),
+  ranked AS (
+  SELECT
+    *,
+    ROW_NUMBER() OVER (PARTITION BY month ORDER BY count DESC) AS position
+  FROM
+    counts )
+SELECT
+  month,
+  artist,
+  album,
+  track,
+  count
+FROM
+  ranked
+WHERE
+  position <= $1
+ORDER BY
+  month DESC,
+  count DESC
+`, s.dialect.month, s.resolvedPlays(ctx)), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select months: %v", err)
+	}
+
+	var months []MonthTopTracks
+	for _, r := range rows {
+		if len(months) == 0 || months[len(months)-1].Month != r.Month {
+			months = append(months, MonthTopTracks{Month: r.Month})
+		}
+		m := &months[len(months)-1]
+		m.Tracks = append(m.Tracks, TrackCount{Artist: r.Artist, Album: r.Album, Track: r.Track, Count: r.Count})
+	}
+
+	for i := range months {
+		err = s.attachCountArtists(ctx, months[i].Tracks)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return months, nil
+}
+
+func (s *SQL) SearchArtists(ctx context.Context, query string) ([]string, error) {
+	return s.readStrings(ctx, fmt.Sprintf(`
+SELECT
+  artist
+FROM
+  music.plays p
+WHERE
+  %s(LOWER(artist), LOWER($1)) > 0
+  AND NOT EXISTS (
+    SELECT 1 FROM music.play_exclusions e
+    WHERE %s )%s
+GROUP BY
+  artist
+ORDER BY
+  LENGTH(artist) ASC
+`, s.dialect.strpos, exclusionMatch, s.privacy(ctx)), query)
+}
+
+func (s *SQL) ArtistTracks(ctx context.Context, artist string) ([]TrackCount, error) {
+	return s.readTrackCounts(ctx, fmt.Sprintf(`
+SELECT
+  canonical_artist AS artist,
+  canonical_album AS album,
+  canonical_track AS track,
+  COUNT(track) AS count
+FROM %s
+WHERE %s
+GROUP BY canonical_artist, canonical_album, canonical_track
+ORDER BY count DESC
+`, s.resolvedPlays(ctx), s.artistMatch("canonical_artist")), artist)
+}
+
+func (s *SQL) ArtistRanks(ctx context.Context, artist string) ([]ArtistRank, error) {
+	var rows []struct {
+		Artist string `db:"artist"`
+		Rank   int64  `db:"rank"`
+	}
+	err := s.goquDB.ScanStructsContext(ctx, &rows, fmt.Sprintf(`
+WITH
+  artists AS (
+  SELECT
+    canonical_artist AS artist,
+    COUNT(track) AS count
+  FROM
+    %s
+  GROUP BY
+    canonical_artist ),
+  ranks AS (
+  SELECT
+    ROW_NUMBER() OVER (ORDER BY count DESC) AS rank,
+    artist
+  FROM
+    artists )
+SELECT
+  artist,
+  rank
+FROM
+  ranks
+WHERE
+  %s
+`, s.resolvedPlays(ctx), s.artistMatch("artist")), artist)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select artist ranks: %v", err)
+	}
+
+	var ranks []ArtistRank
+	for _, r := range rows {
+		ranks = append(ranks, ArtistRank{Artist: r.Artist, Rank: r.Rank})
+	}
+
+	return ranks, nil
+}
+
+func (s *SQL) ArtistAlbumTracks(ctx context.Context, artist, album string) ([]TrackCount, error) {
+	return s.readTrackCounts(ctx, fmt.Sprintf(`
+SELECT
+  canonical_artist AS artist,
+  canonical_album AS album,
+  canonical_track AS track,
+  COUNT(track) AS count
+FROM
+  %s
+WHERE
+  %s
+  AND ( %s )
+GROUP BY
+  canonical_artist,
+  canonical_album,
+  canonical_track
+ORDER BY
+  count DESC
+`, s.resolvedPlays(ctx), s.artistMatch("canonical_artist"), s.titleMatch("album", "$2")), artist, album)
+}
+
+func (s *SQL) ArtistTrackPlays(ctx context.Context, artist, track string) ([]Play, error) {
+	return s.readPlays(ctx, fmt.Sprintf(`
+SELECT %s FROM %s
+WHERE
+  %s
+  AND ( %s )
+ORDER BY
+  timestamp DESC
+`, sqlPlayColumns, s.resolvedPlays(ctx), s.artistMatch("canonical_artist"), s.titleMatch("track", "$2")), artist, track)
+}
+
+func (s *SQL) ArtistAlbumTrackPlays(ctx context.Context, artist, album, track string) ([]Play, error) {
+	return s.readPlays(ctx, fmt.Sprintf(`
+SELECT %s FROM %s
+WHERE
+  %s
+  AND ( %s )
+  AND ( %s )
+ORDER BY
+  timestamp DESC
+`,
+		sqlPlayColumns,
+		s.resolvedPlays(ctx),
+		s.artistMatch("canonical_artist"),
+		s.titleMatch("album", "$2"),
+		s.titleMatch("track", "$3"),
+	), artist, album, track)
+}
+
+func (s *SQL) AlbumCovers(ctx context.Context) ([]AlbumCover, error) {
+	var rows []struct {
+		Artist string `db:"artist"`
+		Album  string `db:"album"`
+		URL    string `db:"album_cover"`
+	}
+	err := s.goquDB.ScanStructsContext(ctx, &rows, `
+SELECT
+  artist,
+  album,
+  album_cover
+FROM (
+  SELECT
+    artist,
+    album,
+    album_cover,
+    ROW_NUMBER() OVER (PARTITION BY artist, album ORDER BY timestamp DESC) AS position
+  FROM
+    music.plays ) AS latest
+WHERE
+  position = 1
+ORDER BY
+  artist,
+  album
+`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select album covers: %v", err)
+	}
+
+	var covers []AlbumCover
+	for _, r := range rows {
+		covers = append(covers, AlbumCover{Artist: r.Artist, Album: r.Album, URL: r.URL})
+	}
+
+	return covers, nil
+}
+
+func (s *SQL) Artists(ctx context.Context) ([]string, error) {
+	return s.readStrings(ctx, "SELECT DISTINCT artist FROM music.plays ORDER BY artist ASC")
+}
+
+func (s *SQL) ArtistNames(ctx context.Context) ([]string, error) {
+	return s.readStrings(ctx, "SELECT DISTINCT name FROM music.artist_credits ORDER BY name ASC")
+}
+
+func (s *SQL) UncreditedArtists(ctx context.Context) ([]UncreditedArtist, error) {
+	var rows []struct {
+		Artist    string `db:"artist"`
+		SpotifyID string `db:"spotify_id"`
+		Joined    int64  `db:"joined"`
+	}
+	err := s.goquDB.ScanStructsContext(ctx, &rows, `
+SELECT
+  p.artist,
+  COALESCE(MAX(CASE WHEN p.source = 'spotify' THEN p.spotify_id END), '') AS spotify_id,
+  MAX(CASE WHEN p.source = 'spotify' THEN 1 ELSE 0 END) AS joined
+FROM
+  music.plays p
+WHERE
+  NOT EXISTS (
+    SELECT 1 FROM music.artist_credits c WHERE c.artist = p.artist
+  )
+GROUP BY
+  p.artist
+ORDER BY
+  p.artist
+`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select uncredited artists: %v", err)
+	}
+
+	var artists []UncreditedArtist
+	for _, r := range rows {
+		artists = append(artists, UncreditedArtist{
+			Artist:    r.Artist,
+			SpotifyID: r.SpotifyID,
+			Joined:    r.Joined == 1,
+		})
+	}
+
+	return artists, nil
+}
+
+func (s *SQL) SetArtistCredits(ctx context.Context, credits []ArtistCredit) error {
+	return s.saveArtistCredits(ctx, credits)
+}
+
+func (s *SQL) ArtistMBIDs(ctx context.Context) ([]ArtistMBID, error) {
+	var rows []struct {
+		Artist string `db:"artist"`
+		MBID   string `db:"artist_mbid"`
+	}
+	err := s.goquDB.ScanStructsContext(ctx, &rows, `
+SELECT
+  artist,
+  artist_mbid
+FROM (
+  SELECT
+    artist,
+    artist_mbid,
+    ROW_NUMBER() OVER (PARTITION BY artist ORDER BY COUNT(*) DESC, artist_mbid ASC) AS position
+  FROM
+    music.plays
+  WHERE
+    artist_mbid <> ''
+  GROUP BY
+    artist,
+    artist_mbid ) AS counts
+WHERE
+  position = 1
+ORDER BY
+  artist
+`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select artist mbids: %v", err)
+	}
+
+	var mbids []ArtistMBID
+	for _, r := range rows {
+		mbids = append(mbids, ArtistMBID{Artist: r.Artist, MBID: r.MBID})
+	}
+
+	return mbids, nil
+}
+
+func (s *SQL) Albums(ctx context.Context) ([]string, error) {
+	return s.readStrings(ctx, "SELECT DISTINCT album FROM music.plays ORDER BY album ASC")
+}
+
+func (s *SQL) Tracks(ctx context.Context) ([]string, error) {
+	return s.readStrings(ctx, "SELECT DISTINCT track FROM music.plays ORDER BY track ASC")
+}
+
+func (s *SQL) FindPlay(ctx context.Context, key PlayKey) (Play, error) {
+	plays, err := s.readPlays(ctx, fmt.Sprintf(`
+SELECT %s FROM music.plays
+WHERE source = $1 AND timestamp = $2
+`, sqlPlayColumns), key.Source, s.dialect.timeValue(key.Timestamp))
+	if err != nil {
+		return Play{}, err
+	}
+	if len(plays) == 0 {
+		return Play{}, ErrPlayNotFound
+	}
+
+	return plays[0], nil
+}
+
+// playKeyMatch matches the play with a key in the plays table
+func (s *SQL) playKeyMatch(key PlayKey) goqu.Expression {
+	return goqu.And(
+		goqu.C("source").Eq(key.Source),
+		goqu.C("timestamp").Eq(s.dialect.timeValue(key.Timestamp)),
+	)
+}
+
+func (s *SQL) EditPlay(ctx context.Context, key PlayKey, names PlayNames) error {
+	res, err := s.goquDB.Update("music.plays").
+		Set(goqu.Record{"artist": names.Artist, "album": names.Album, "track": names.Track}).
+		Where(s.playKeyMatch(key)).
+		Executor().
+		ExecContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to update play: %v", err)
+	}
+
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get updated count: %v", err)
+	}
+	if updated == 0 {
+		return ErrPlayNotFound
+	}
+
+	// a new artist string is left for the artist credits job
+	return s.Titles.Save(ctx, []Play{{Track: names.Track, Album: names.Album}})
+}
+
+// DeletePlay also removes the play's own duplicate mark. Plays marked as a
+// duplicate of it stay hidden as they're the same listen.
+func (s *SQL) DeletePlay(ctx context.Context, key PlayKey) error {
+	return s.goquDB.WithTx(func(tx *goqu.TxDatabase) error {
+		res, err := tx.Delete("music.plays").
+			Where(s.playKeyMatch(key)).
+			Executor().
+			ExecContext(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to delete play: %v", err)
+		}
+
+		deleted, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to get deleted count: %v", err)
+		}
+		if deleted == 0 {
+			return ErrPlayNotFound
+		}
+
+		_, err = tx.Delete("music.play_duplicates").
+			Where(s.playKeyMatch(key)).
+			Executor().
+			ExecContext(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to delete play duplicate: %v", err)
+		}
+
+		return nil
+	})
+}
+
+func (s *SQL) RawTrackCounts(ctx context.Context) ([]TrackCount, error) {
+	return s.readTrackCounts(ctx, `
+SELECT artist, album, track, COUNT(*) AS count
+FROM music.plays
+GROUP BY artist, album, track
+ORDER BY artist ASC, album ASC, track ASC
+`)
+}
+
+func (s *SQL) RewriteTracks(ctx context.Context, rewrites []TrackRewrite) error {
+	if len(rewrites) == 0 {
+		return nil
+	}
+
+	err := s.goquDB.WithTx(func(tx *goqu.TxDatabase) error {
+		for _, r := range rewrites {
+			_, err := tx.Update("music.plays").
+				Set(goqu.Record{"artist": r.To.Artist, "album": r.To.Album, "track": r.To.Track}).
+				Where(
+					goqu.C("artist").Eq(r.From.Artist),
+					goqu.C("album").Eq(r.From.Album),
+					goqu.C("track").Eq(r.From.Track),
+				).
+				Executor().
+				ExecContext(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to rewrite plays of %q: %v", r.From.Track, err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var plays []Play
+	for _, r := range rewrites {
+		plays = append(plays, Play{Track: r.To.Track, Album: r.To.Album})
+	}
+
+	return s.Titles.Save(ctx, plays)
+}
@@ -0,0 +1,445 @@
+package store_test
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/charlieegan3/music/pkg/tool"
+	"github.com/charlieegan3/music/pkg/tool/store"
+)
+
+// newSQLiteStore returns a sqlite store in a new file which is removed when
+// the test ends
+func newSQLiteStore(t *testing.T) *store.SQL {
+	t.Helper()
+
+	db, err := tool.OpenSQLite(filepath.Join(t.TempDir(), "music.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return store.NewSQLite(db)
+}
+
+func play(source, artist, album, track string, timestamp time.Time) store.Play {
+	return store.Play{
+		Source:    source,
+		Artist:    artist,
+		Album:     album,
+		Track:     track,
+		Timestamp: timestamp,
+		CreatedAt: timestamp,
+	}
+}
+
+func countTracks(counts []store.TrackCount) map[string]int64 {
+	result := make(map[string]int64)
+	for _, c := range counts {
+		result[c.Artist+" - "+c.Track] = c.Count
+	}
+	return result
+}
+
+func TestSQLiteInsertPlays(t *testing.T) {
+	ctx := context.Background()
+	s := newSQLiteStore(t)
+
+	start := time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)
+	plays := []store.Play{
+		play("lastfm", "Artist", "Album", "One", start),
+		play("lastfm", "Artist", "Album", "Two", start.Add(5*time.Minute)),
+		// the same second from another source is a separate play
+		play("spotify", "Artist", "Album", "Two", start.Add(5*time.Minute)),
+	}
+
+	err := s.InsertPlays(ctx, plays)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// plays which are already saved are skipped
+	err = s.InsertPlays(ctx, append(plays, play("lastfm", "Artist", "Album", "Three", start.Add(10*time.Minute))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var saved []store.Play
+	err = s.EachPlay(ctx, func(p store.Play) error {
+		saved = append(saved, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 4 {
+		t.Fatalf("expected 4 plays, got %d", len(saved))
+	}
+
+	timestamps, err := s.MostRecentTimestamps(ctx, "lastfm", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []time.Time{start.Add(10 * time.Minute), start.Add(5 * time.Minute)}
+	if !reflect.DeepEqual(timestamps, expected) {
+		t.Fatalf("expected timestamps %v, got %v", expected, timestamps)
+	}
+
+	timestamps, err = s.SourceTimestamps(ctx, "spotify", start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []time.Time{start.Add(5 * time.Minute)}
+	if !reflect.DeepEqual(timestamps, expected) {
+		t.Fatalf("expected spotify timestamps %v, got %v", expected, timestamps)
+	}
+
+	// plays marked as duplicates are kept but not counted
+	err = s.MarkDuplicates(ctx, []store.Duplicate{{
+		Source:             "spotify",
+		Timestamp:          start.Add(5 * time.Minute),
+		CanonicalSource:    "lastfm",
+		CanonicalTimestamp: start.Add(5 * time.Minute),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recent, err := s.RecentPlays(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recent) != 3 {
+		t.Fatalf("expected 3 recent plays, got %d", len(recent))
+	}
+	for _, p := range recent {
+		if p.Source != "lastfm" {
+			t.Fatalf("expected duplicate to be left out, got %+v", p)
+		}
+	}
+
+	found, err := s.FindPlay(ctx, store.PlayKey{Source: "spotify", Timestamp: start.Add(5 * time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Track != "Two" {
+		t.Fatalf("expected to find the duplicate, got %+v", found)
+	}
+}
+
+func TestSQLiteTopTracksAndArtists(t *testing.T) {
+	ctx := context.Background()
+	s := newSQLiteStore(t)
+
+	start := time.Date(2023, 1, 2, 15, 0, 0, 0, time.UTC)
+	var plays []store.Play
+	for i, p := range []struct{ artist, track string }{
+		{"Alpha", "Often"},
+		{"Alpha", "Often"},
+		{"Alpha", "Often"},
+		{"Alpha", "Sometimes"},
+		{"Beta", "Twice"},
+		{"Beta", "Twice"},
+		{"Gamma", "Once"},
+	} {
+		plays = append(plays, play("lastfm", p.artist, "Album", p.track, start.Add(time.Duration(i)*time.Minute)))
+	}
+	err := s.InsertPlays(ctx, plays)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	top, err := s.TopTracks(ctx, time.Time{}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []store.TrackCount{
+		{Artist: "Alpha", Album: "Album", Track: "Often", Count: 3},
+		{Artist: "Beta", Album: "Album", Track: "Twice", Count: 2},
+	}
+	if !reflect.DeepEqual(top, expected) {
+		t.Fatalf("expected top tracks %+v, got %+v", expected, top)
+	}
+
+	// only plays after since are counted
+	top, err = s.TopTracks(ctx, start.Add(3*time.Minute), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedCounts := map[string]int64{"Beta - Twice": 2, "Gamma - Once": 1}
+	if counts := countTracks(top); !reflect.DeepEqual(counts, expectedCounts) {
+		t.Fatalf("expected top tracks since %v, got %v", expectedCounts, counts)
+	}
+
+	for artist, rank := range map[string]int64{"Alpha": 1, "Beta": 2, "Gamma": 3} {
+		ranks, err := s.ArtistRanks(ctx, artist)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []store.ArtistRank{{Artist: artist, Rank: rank}}
+		if !reflect.DeepEqual(ranks, expected) {
+			t.Fatalf("expected ranks %+v, got %+v", expected, ranks)
+		}
+	}
+
+	artists, err := s.Artists(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(artists) != 3 {
+		t.Fatalf("expected 3 artists, got %v", artists)
+	}
+
+	results, err := s.SearchArtists(ctx, "Amm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(results, []string{"Gamma"}) {
+		t.Fatalf("expected search to find Gamma, got %v", results)
+	}
+}
+
+func TestSQLiteMonthsTopTracks(t *testing.T) {
+	ctx := context.Background()
+	s := newSQLiteStore(t)
+
+	january := time.Date(2023, 1, 31, 23, 0, 0, 0, time.UTC)
+	february := time.Date(2023, 2, 1, 1, 0, 0, 0, time.UTC)
+	err := s.InsertPlays(ctx, []store.Play{
+		play("lastfm", "Alpha", "Album", "Cold", january),
+		play("lastfm", "Alpha", "Album", "Cold", january.Add(time.Minute)),
+		play("lastfm", "Beta", "Album", "Frost", january.Add(2*time.Minute)),
+		play("lastfm", "Beta", "Album", "Frost", february),
+		play("lastfm", "Beta", "Album", "Frost", february.Add(time.Minute)),
+		play("lastfm", "Alpha", "Album", "Cold", february.Add(2*time.Minute)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	months, err := s.MonthsTopTracks(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []store.MonthTopTracks{
+		{Month: "2023-02", Tracks: []store.TrackCount{{Artist: "Beta", Album: "Album", Track: "Frost", Count: 2}}},
+		{Month: "2023-01", Tracks: []store.TrackCount{{Artist: "Alpha", Album: "Album", Track: "Cold", Count: 2}}},
+	}
+	if !reflect.DeepEqual(months, expected) {
+		t.Fatalf("expected months %+v, got %+v", expected, months)
+	}
+}
+
+func TestSQLiteArtistMatching(t *testing.T) {
+	ctx := context.Background()
+	s := newSQLiteStore(t)
+
+	start := time.Date(2023, 1, 2, 15, 0, 0, 0, time.UTC)
+	collab := play("lastfm", "Alpha & Beta", "Together", "Duet", start)
+	collab.Artists = []string{"Alpha", "Beta"}
+	err := s.InsertPlays(ctx, []store.Play{
+		play("lastfm", "Alpha", "Solo", "First", start.Add(time.Minute)),
+		collab,
+		play("lastfm", "ALPHA", "Solo", "Second", start.Add(2*time.Minute)),
+		play("lastfm", "Beta", "Solo", "Third", start.Add(3*time.Minute)),
+		// not credited, so only matches the whole artist string
+		play("lastfm", "Alpha and Gamma", "Together", "Trio", start.Add(4*time.Minute)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.NewAliases(s.DB).Merge(ctx, "Alpha", []string{"ALPHA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		artist string
+		tracks map[string]int64
+	}{
+		{
+			artist: "Alpha",
+			tracks: map[string]int64{
+				"Alpha - First":       1,
+				"Alpha - Second":      1,
+				"Alpha & Beta - Duet": 1,
+			},
+		},
+		{
+			artist: "Beta",
+			tracks: map[string]int64{
+				"Alpha & Beta - Duet": 1,
+				"Beta - Third":        1,
+			},
+		},
+		{
+			artist: "Alpha and Gamma",
+			tracks: map[string]int64{
+				"Alpha and Gamma - Trio": 1,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.artist, func(t *testing.T) {
+			tracks, err := s.ArtistTracks(ctx, tc.artist)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if counts := countTracks(tracks); !reflect.DeepEqual(counts, tc.tracks) {
+				t.Fatalf("expected tracks %v, got %v", tc.tracks, counts)
+			}
+		})
+	}
+
+	names, err := s.ArtistNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"Alpha", "Beta"}) {
+		t.Fatalf("expected credited names, got %v", names)
+	}
+}
+
+func TestSQLiteMinuteOfDay(t *testing.T) {
+	ctx := context.Background()
+	s := newSQLiteStore(t)
+
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 03:30 UTC is 22:30 the day before in New York
+	minute, err := store.SQLiteMinuteOfDay("2023-01-02T03:30:00.000000000Z", "America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if minute != 22*60+30 {
+		t.Fatalf("expected minute %d, got %d", 22*60+30, minute)
+	}
+
+	_, err = store.SQLiteMinuteOfDay("2023-01-02T03:30:00.000000000Z", "Nowhere/Else")
+	if err == nil {
+		t.Fatal("expected an error for an unknown time zone")
+	}
+
+	err = s.InsertPlays(ctx, []store.Play{
+		play("lastfm", "Artist", "Album", "Evening", time.Date(2023, 1, 2, 1, 0, 0, 0, time.UTC)),
+		play("lastfm", "Artist", "Album", "Night", time.Date(2023, 1, 2, 5, 0, 0, 0, time.UTC)),
+		play("lastfm", "Artist", "Album", "Morning", time.Date(2023, 1, 2, 13, 0, 0, 0, time.UTC)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// hide plays from 23:00 to 07:00 in New York, which is 04:00 to 12:00 UTC
+	window, err := store.ParseDailyWindow("23:00", "07:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	privacy := &store.Privacy{Location: newYork, Daily: []store.DailyWindow{window}}
+
+	recent, err := s.RecentPlays(store.WithPrivacy(ctx, privacy), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tracks []string
+	for _, p := range recent {
+		tracks = append(tracks, p.Track)
+		if !privacy.Visible(p.Timestamp, time.Now()) {
+			t.Fatalf("expected %q to be hidden", p.Track)
+		}
+	}
+	if !reflect.DeepEqual(tracks, []string{"Morning", "Evening"}) {
+		t.Fatalf("expected Morning and Evening, got %v", tracks)
+	}
+}
+
+func TestSQLiteArtistCredits(t *testing.T) {
+	ctx := context.Background()
+	s := newSQLiteStore(t)
+
+	start := time.Date(2023, 1, 2, 15, 0, 0, 0, time.UTC)
+	err := s.InsertPlays(ctx, []store.Play{
+		play("spotify", "Alpha, Beta", "Together", "Duet", start),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uncredited, err := s.UncreditedArtists(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uncredited) != 1 || uncredited[0].Artist != "Alpha, Beta" || !uncredited[0].Joined {
+		t.Fatalf("expected the joined artist string to be uncredited, got %+v", uncredited)
+	}
+
+	err = s.SetArtistCredits(ctx, []store.ArtistCredit{{Artist: "Alpha, Beta", Artists: []string{"Alpha", "Beta"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the list is kept per artist string, so plays saved later without a list
+	// are credited too
+	err = s.InsertPlays(ctx, []store.Play{
+		play("spotify", "Alpha, Beta", "Together", "Duet", start.Add(time.Hour)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncredited, err = s.UncreditedArtists(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uncredited) != 0 {
+		t.Fatalf("expected no uncredited artist strings, got %+v", uncredited)
+	}
+
+	// a string with a list keeps it
+	err = s.SetArtistCredits(ctx, []store.ArtistCredit{{Artist: "Alpha, Beta", Artists: []string{"Alpha, Beta"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracks, err := s.ArtistTracks(ctx, "Beta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int64{"Alpha, Beta - Duet": 2}
+	if counts := countTracks(tracks); !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("expected tracks %v, got %v", expected, counts)
+	}
+}
+
+func TestSQLiteSearchArtistsExclusions(t *testing.T) {
+	ctx := context.Background()
+	s := newSQLiteStore(t)
+
+	start := time.Date(2023, 1, 2, 15, 0, 0, 0, time.UTC)
+	err := s.InsertPlays(ctx, []store.Play{
+		play("lastfm", "White Noise Sleep", "Album", "Rain", start),
+		play("lastfm", "White Lies", "Album", "Death", start.Add(time.Minute)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.NewExclusions(s.DB).Add(ctx, store.Exclusion{Artist: "%noise%"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := s.SearchArtists(ctx, "white")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(results, []string{"White Lies"}) {
+		t.Fatalf("expected search to leave out excluded artists, got %v", results)
+	}
+}
@@ -0,0 +1,297 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrPlayNotFound is returned when there is no play with a PlayKey
+var ErrPlayNotFound = errors.New("play not found")
+
+// ErrPlayTooRecent is returned when plays can't be changed yet, BigQuery
+// can't change plays in the streaming buffer until they are flushed
+var ErrPlayTooRecent = errors.New("play is too recent to edit, retry in ~90 minutes")
+
+// Play is a single listen of a track, it mirrors the columns in bq/schema.json
+type Play struct {
+	Track     string
+	Artist    string
+	Album     string
+	Timestamp time.Time
+
+	// Duration is the length of the track in ms, 0 when unknown
+	Duration   int64
+	SpotifyID  string
+	AlbumCover string
+	CreatedAt  time.Time
+	Source     string
+
+	YoutubeID           string
+	YoutubeCategoryID   string
+	SoundcloudID        string
+	SoundcloudPermalink string
+	ShazamID            string
+	ShazamPermalink     string
+
+	// MusicBrainz ids, empty when the source doesn't supply them
+	TrackMBID  string
+	ArtistMBID string
+	AlbumMBID  string
+
+	// Artists lists the artists credited in Artist, primary artist first. It
+	// is empty for plays saved before credits were kept which haven't been
+	// backfilled.
+	Artists []string
+}
+
+// CreditedArtists returns the artists of the play, the artist string is the
+// only artist when the play has no list
+func (p Play) CreditedArtists() []string {
+	return creditedArtists(p.Artist, p.Artists)
+}
+
+// InsertID is the id used to deduplicate inserts of a play, it is the same as
+// the BigQuery insert id used since plays were first saved
+func InsertID(p Play) string {
+	return fmt.Sprintf("%d", p.Timestamp.Unix())
+}
+
+// PlayKey identifies a play, a source only saves one play at each timestamp
+type PlayKey struct {
+	Source    string
+	Timestamp time.Time
+}
+
+// Key returns the key of the play
+func (p Play) Key() PlayKey {
+	return PlayKey{Source: p.Source, Timestamp: p.Timestamp}
+}
+
+// PlayNames are the artist, album and track of a play
+type PlayNames struct {
+	Artist string `json:"artist"`
+	Album  string `json:"album"`
+	Track  string `json:"track"`
+}
+
+// Names returns the artist, album and track of the play
+func (p Play) Names() PlayNames {
+	return PlayNames{Artist: p.Artist, Album: p.Album, Track: p.Track}
+}
+
+// Apply returns names with the fields set in n replaced, empty fields are
+// left unchanged
+func (n PlayNames) Apply(names PlayNames) PlayNames {
+	if n.Artist != "" {
+		names.Artist = n.Artist
+	}
+	if n.Album != "" {
+		names.Album = n.Album
+	}
+	if n.Track != "" {
+		names.Track = n.Track
+	}
+	return names
+}
+
+// TrackRewrite changes the names of every play of a track
+type TrackRewrite struct {
+	From PlayNames
+	To   PlayNames
+}
+
+// TrackCount is the number of plays for an artist, album and track
+type TrackCount struct {
+	Artist string
+	Album  string
+	Track  string
+	Count  int64
+
+	// Artists lists the artists credited in Artist, see Play
+	Artists []string
+}
+
+// CreditedArtists returns the artists of the track, see Play.CreditedArtists
+func (c TrackCount) CreditedArtists() []string {
+	return creditedArtists(c.Artist, c.Artists)
+}
+
+func creditedArtists(artist string, artists []string) []string {
+	if len(artists) > 0 {
+		return artists
+	}
+	return []string{artist}
+}
+
+// ArtistCredit is the list of artists credited by an artist string
+type ArtistCredit struct {
+	Artist  string
+	Artists []string
+}
+
+// UncreditedArtist is an artist string used by plays without a list of
+// artists, it's used to backfill the list
+type UncreditedArtist struct {
+	Artist string
+	// SpotifyID is a track played with the artist string, empty when unknown
+	SpotifyID string
+	// Joined is set when the string was saved by a source which joined the
+	// names of the artists with ", "
+	Joined bool
+}
+
+// MonthTopTracks is the list of top tracks for a calendar month
+type MonthTopTracks struct {
+	// Month is formatted as 2006-01
+	Month  string
+	Tracks []TrackCount
+}
+
+// ArtistRank is the position of an artist string in the all time list of
+// artists by play count
+type ArtistRank struct {
+	Artist string
+	Rank   int64
+}
+
+// ArtistMBID is the MusicBrainz id saved with an artist string
+type ArtistMBID struct {
+	Artist string
+	MBID   string
+}
+
+// AlbumCover is the most recent cover image url seen for an artist and album
+type AlbumCover struct {
+	Artist string
+	Album  string
+	URL    string
+}
+
+// Duplicate records that the play from Source at Timestamp is the same listen
+// as the canonical play recorded by another source
+type Duplicate struct {
+	Source    string
+	Timestamp time.Time
+
+	CanonicalSource    string
+	CanonicalTimestamp time.Time
+}
+
+// CreatedCursor is a position in the plays ordered by the time they were
+// saved, source and timestamp break ties between plays saved together
+type CreatedCursor struct {
+	CreatedAt time.Time
+	Source    string
+	Timestamp time.Time
+}
+
+// Cursor returns the position of a play
+func (p Play) Cursor() CreatedCursor {
+	return CreatedCursor{CreatedAt: p.CreatedAt, Source: p.Source, Timestamp: p.Timestamp}
+}
+
+// PlayStore is the interface used by handlers and jobs to read and write plays
+type PlayStore interface {
+	// InsertPlays saves new plays to the store
+	InsertPlays(ctx context.Context, plays []Play) error
+	// MostRecentTimestamps returns the N most recent timestamps for a given source
+	MostRecentTimestamps(ctx context.Context, source string, count int) ([]time.Time, error)
+	// SourceTimestamps returns the timestamps of plays from a source between
+	// from and to inclusive, it is used to skip plays which are already saved
+	SourceTimestamps(ctx context.Context, source string, from, to time.Time) ([]time.Time, error)
+	// SourcePlays returns the plays from a source between from and to
+	// inclusive, including duplicates, oldest first. It is used to skip plays
+	// which are already saved when their timestamps aren't exact.
+	SourcePlays(ctx context.Context, source string, from, to time.Time) ([]Play, error)
+
+	// EachPlay calls fn with every play in the store, including duplicates,
+	// oldest first. Plays are streamed so that the whole table is not held
+	// in memory.
+	EachPlay(ctx context.Context, fn func(Play) error) error
+	// CanonicalPlays returns plays from all sources between from and to
+	// inclusive which are not marked as duplicates, oldest first
+	CanonicalPlays(ctx context.Context, from, to time.Time) ([]Play, error)
+	// MarkDuplicates excludes plays from all read queries other than those
+	// used to sync sources, plays already marked are ignored
+	MarkDuplicates(ctx context.Context, duplicates []Duplicate) error
+	// PlaysCreatedAfter returns up to limit plays saved after the cursor which
+	// are not marked as duplicates, in the order they were saved. Plays
+	// without a created at time are not returned.
+	PlaysCreatedAfter(ctx context.Context, cursor CreatedCursor, limit int) ([]Play, error)
+
+	// RecentPlays returns the most recent plays, newest first
+	RecentPlays(ctx context.Context, limit int) ([]Play, error)
+	// TopTracks returns the most played tracks since a given time, a zero time
+	// returns the top tracks of all time
+	TopTracks(ctx context.Context, since time.Time, limit int) ([]TrackCount, error)
+	// MonthsTopTracks returns the top tracks for each month, newest month first
+	MonthsTopTracks(ctx context.Context, limit int) ([]MonthTopTracks, error)
+
+	// SearchArtists returns artist strings containing the lower case query
+	SearchArtists(ctx context.Context, query string) ([]string, error)
+	// ArtistTracks returns the play counts of tracks crediting an artist
+	ArtistTracks(ctx context.Context, artist string) ([]TrackCount, error)
+	// ArtistRanks returns the ranks of all artist strings crediting an artist
+	ArtistRanks(ctx context.Context, artist string) ([]ArtistRank, error)
+	// ArtistAlbumTracks returns the play counts of tracks on an album by an artist
+	ArtistAlbumTracks(ctx context.Context, artist, album string) ([]TrackCount, error)
+	// ArtistTrackPlays returns each play of a track by an artist, newest first
+	ArtistTrackPlays(ctx context.Context, artist, track string) ([]Play, error)
+	// ArtistAlbumTrackPlays returns each play of a track on an album, newest first
+	ArtistAlbumTrackPlays(ctx context.Context, artist, album, track string) ([]Play, error)
+
+	// AlbumCovers returns the latest known cover for each artist and album
+	AlbumCovers(ctx context.Context) ([]AlbumCover, error)
+	// Artists returns each distinct artist string
+	Artists(ctx context.Context) ([]string, error)
+	// ArtistNames returns each distinct credited artist name
+	ArtistNames(ctx context.Context) ([]string, error)
+	// UncreditedArtists returns the artist strings of plays without a list of
+	// artists. The stores keep the lists differently: SQL keeps one list per
+	// artist string in music.artist_credits, which every play with the string
+	// is counted with, so a string is returned until it has a list. BigQuery
+	// keeps the list on each play, so a string is returned while any of its
+	// plays has an empty list, including plays saved after it was credited.
+	UncreditedArtists(ctx context.Context) ([]UncreditedArtist, error)
+	// SetArtistCredits saves the list of artists for each artist string. SQL
+	// only saves it for strings without a list, BigQuery sets it on the plays
+	// with the string which have an empty list and leaves other plays as they
+	// are.
+	SetArtistCredits(ctx context.Context, credits []ArtistCredit) error
+	// ArtistMBIDs returns the MusicBrainz id saved most often with each
+	// artist string, artists without an id are not returned
+	ArtistMBIDs(ctx context.Context) ([]ArtistMBID, error)
+	// Albums returns each distinct album name
+	Albums(ctx context.Context) ([]string, error)
+	// Tracks returns each distinct track name
+	Tracks(ctx context.Context) ([]string, error)
+
+	// FindPlay returns the play with a key, including duplicates, or
+	// ErrPlayNotFound
+	FindPlay(ctx context.Context, key PlayKey) (Play, error)
+	// EditPlay sets the artist, album and track of a play
+	EditPlay(ctx context.Context, key PlayKey, names PlayNames) error
+	// DeletePlay removes a play from the store
+	DeletePlay(ctx context.Context, key PlayKey) error
+	// RawTrackCounts returns the play counts of each artist, album and track
+	// as saved, including duplicates and without aliases or normalized titles
+	RawTrackCounts(ctx context.Context) ([]TrackCount, error)
+	// RewriteTracks sets the names of all plays of each track in rewrites
+	RewriteTracks(ctx context.Context, rewrites []TrackRewrite) error
+}
+
+// Migrator is implemented by stores whose tables are not managed by the
+// database migrations
+type Migrator interface {
+	// Migrate creates or updates the store's tables
+	Migrate(ctx context.Context) error
+}
+
+// Extractor is implemented by stores which can export the full table to a GCS
+// bucket without reading the data themselves
+type Extractor interface {
+	// Extract writes the whole table as newline delimited json to the GCS uri
+	Extract(ctx context.Context, uri string) error
+}
@@ -0,0 +1,169 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/doug-martin/goqu/v9"
+
+	"github.com/charlieegan3/music/pkg/tool/titles"
+)
+
+// NormalizedTitle is the title which a raw track or album title is counted as
+type NormalizedTitle struct {
+	// Field is track or album
+	Field string `db:"field"`
+	Raw   string `db:"raw"`
+	Title string `db:"title"`
+}
+
+// Titles saves the normalized titles of tracks and albums in
+// music.normalized_titles. Only titles which are changed by normalization are
+// saved, plays keep their raw titles. The table is always in the tool
+// database, including when plays are in BigQuery.
+type Titles struct {
+	goquDB     *goqu.Database
+	normalizer *titles.Normalizer
+	// changes counts the writes made with this value, the BigQuery store
+	// loads the titles again when it changes
+	changes atomic.Uint64
+}
+
+// NewTitles returns the normalized titles in the database with the music
+// schema, normalizer is used for the titles of new plays
+func NewTitles(db *sql.DB, normalizer *titles.Normalizer) *Titles {
+	return &Titles{goquDB: goqu.New("postgres", db), normalizer: normalizer}
+}
+
+// List returns every normalized title
+func (t *Titles) List(ctx context.Context) ([]NormalizedTitle, error) {
+	var normalized []NormalizedTitle
+	err := t.goquDB.From("music.normalized_titles").
+		Select("field", "raw", "title").
+		Order(goqu.C("field").Asc(), goqu.C("raw").Asc()).
+		ScanStructsContext(ctx, &normalized)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select normalized titles: %v", err)
+	}
+
+	return normalized, nil
+}
+
+// Normalize returns the titles changed by normalization
+func (t *Titles) Normalize(tracks, albums []string) []NormalizedTitle {
+	var normalized []NormalizedTitle
+	seen := make(map[NormalizedTitle]bool)
+	add := func(field, raw, title string) {
+		n := NormalizedTitle{Field: field, Raw: raw, Title: title}
+		if raw == title || seen[n] {
+			return
+		}
+		seen[n] = true
+		normalized = append(normalized, n)
+	}
+
+	for _, track := range tracks {
+		add(titles.FieldTrack, track, t.normalizer.Track(track))
+	}
+	for _, album := range albums {
+		add(titles.FieldAlbum, album, t.normalizer.Album(album))
+	}
+
+	return normalized
+}
+
+// Save saves the normalized titles of plays as they are inserted, it does
+// nothing for a nil Titles
+func (t *Titles) Save(ctx context.Context, plays []Play) error {
+	if t == nil {
+		return nil
+	}
+
+	var tracks, albums []string
+	for _, p := range plays {
+		tracks = append(tracks, p.Track)
+		albums = append(albums, p.Album)
+	}
+
+	return t.save(ctx, t.Normalize(tracks, albums))
+}
+
+// Rebuild normalizes every title again, it's used when the rules change.
+// The number of titles saved and removed is returned.
+func (t *Titles) Rebuild(ctx context.Context, tracks, albums []string) (int, int, error) {
+	defer t.changes.Add(1)
+
+	existing, err := t.List(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	normalized := t.Normalize(tracks, albums)
+	current := make(map[NormalizedTitle]bool)
+	for _, n := range normalized {
+		current[n] = true
+	}
+
+	removed := 0
+	for _, e := range existing {
+		if current[e] {
+			continue
+		}
+		// the raw title is either no longer changed or has a new title,
+		// which is saved below
+		_, err = t.goquDB.Delete("music.normalized_titles").
+			Where(goqu.C("field").Eq(e.Field), goqu.C("raw").Eq(e.Raw)).
+			Executor().
+			ExecContext(ctx)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to delete normalized title: %v", err)
+		}
+		removed++
+	}
+
+	err = t.save(ctx, normalized)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return len(normalized), removed, nil
+}
+
+// normalizedTitlesBatchSize limits the rows in one insert
+const normalizedTitlesBatchSize = 500
+
+func (t *Titles) save(ctx context.Context, normalized []NormalizedTitle) error {
+	if len(normalized) > 0 {
+		defer t.changes.Add(1)
+	}
+
+	for len(normalized) > 0 {
+		n := normalizedTitlesBatchSize
+		if len(normalized) < n {
+			n = len(normalized)
+		}
+
+		var rows []goqu.Record
+		for _, title := range normalized[:n] {
+			rows = append(rows, goqu.Record{
+				"field": title.Field,
+				"raw":   title.Raw,
+				"title": title.Title,
+			})
+		}
+		normalized = normalized[n:]
+
+		_, err := t.goquDB.Insert("music.normalized_titles").
+			Rows(rows).
+			OnConflict(goqu.DoUpdate("field, raw", goqu.C("title").Set(goqu.L("EXCLUDED.title")))).
+			Executor().
+			ExecContext(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to insert normalized titles: %v", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package titles
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	FieldTrack = "track"
+	FieldAlbum = "album"
+)
+
+// Rule replaces matches of Pattern in track or album titles
+type Rule struct {
+	Name    string
+	Pattern *regexp.Regexp
+	Replace string
+
+	Track bool
+	Album bool
+}
+
+// builtinRules are the rules which can be enabled by name, they remove
+// suffixes added to the titles of the same song or record
+var builtinRules = []Rule{
+	{
+		// Song - 2011 Remaster, Album (Remastered 2009), Song [Digital Remaster]
+		Name:    "remaster",
+		Pattern: regexp.MustCompile(`(?i)\s*(?:-\s*|[(\[])(?:\d{4}\s+)?(?:digital(?:ly)?\s+)?remaster(?:ed)?(?:\s+(?:version|edition|\d{4}))*\s*[)\]]?\s*$`),
+		Track:   true,
+		Album:   true,
+	},
+	{
+		// Album (Deluxe Edition), Album - Deluxe, Album [Super Deluxe Version]
+		Name:    "deluxe",
+		Pattern: regexp.MustCompile(`(?i)\s*(?:-\s*|[(\[])(?:super\s+)?deluxe(?:\s+(?:edition|version))*\s*[)\]]?\s*$`),
+		Album:   true,
+	},
+	{
+		// Song - Live, Song (Live at Wembley)
+		Name:    "live",
+		Pattern: regexp.MustCompile(`(?i)\s*(?:-\s*|[(\[])live(?:\s+(?:at|from|in|on)\s[^)\]]*)?\s*[)\]]?\s*$`),
+		Track:   true,
+	},
+	{
+		// Song (feat. Artist), Song [ft. Artist], Song - featuring Artist
+		Name:    "feat",
+		Pattern: regexp.MustCompile(`(?i)\s*(?:[(\[](?:feat\.?|ft\.?|featuring)\s[^)\]]*[)\]]|(?:-\s*|\s)(?:feat\.|ft\.|featuring)\s.*$)`),
+		Track:   true,
+	},
+}
+
+// BuiltinNames returns the names of the built in rules
+func BuiltinNames() []string {
+	var names []string
+	for _, r := range builtinRules {
+		names = append(names, r.Name)
+	}
+	return names
+}
+
+// Builtin returns the built in rules with the names given
+func Builtin(names ...string) ([]Rule, error) {
+	var rules []Rule
+	for _, name := range names {
+		found := false
+		for _, r := range builtinRules {
+			if r.Name == name {
+				rules = append(rules, r)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown built in title rule %q", name)
+		}
+	}
+
+	return rules, nil
+}
+
+// NewRule returns a rule for a regular expression, fields are track and album
+// and both are used when none are given
+func NewRule(pattern, replace string, fields ...string) (Rule, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return Rule{}, fmt.Errorf("invalid title rule pattern %q: %v", pattern, err)
+	}
+
+	rule := Rule{Name: pattern, Pattern: re, Replace: replace}
+	if len(fields) == 0 {
+		rule.Track = true
+		rule.Album = true
+	}
+	for _, f := range fields {
+		switch f {
+		case FieldTrack:
+			rule.Track = true
+		case FieldAlbum:
+			rule.Album = true
+		default:
+			return Rule{}, fmt.Errorf("unknown title rule field %q", f)
+		}
+	}
+
+	return rule, nil
+}
+
+// maxPasses limits how many times the rules are applied to a title, titles
+// can have more than one suffix such as Song - Live - 2011 Remaster
+const maxPasses = 5
+
+// Normalizer maps the titles of variants of a track or album to one title. A
+// nil Normalizer returns titles unchanged.
+type Normalizer struct {
+	rules []Rule
+}
+
+// New returns a normalizer applying rules in order
+func New(rules []Rule) *Normalizer {
+	return &Normalizer{rules: rules}
+}
+
+// Track returns the normalized title of a track
+func (n *Normalizer) Track(title string) string {
+	return n.normalize(title, func(r Rule) bool { return r.Track })
+}
+
+// Album returns the normalized title of an album
+func (n *Normalizer) Album(title string) string {
+	return n.normalize(title, func(r Rule) bool { return r.Album })
+}
+
+func (n *Normalizer) normalize(title string, applies func(Rule) bool) string {
+	if n == nil {
+		return title
+	}
+
+	normalized := title
+	for i := 0; i < maxPasses; i++ {
+		previous := normalized
+		for _, r := range n.rules {
+			if applies(r) {
+				normalized = strings.TrimSpace(r.Pattern.ReplaceAllString(normalized, r.Replace))
+			}
+		}
+		if normalized == previous {
+			break
+		}
+	}
+
+	// a rule which removes the whole title leaves it as it was
+	if normalized == "" {
+		return title
+	}
+
+	return normalized
+}
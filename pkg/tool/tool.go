@@ -1,26 +1,75 @@
 package tool
 
 import (
+	"context"
 	"database/sql"
 	"embed"
 	"fmt"
+	"net/http"
+	"time"
 
 	"github.com/Jeffail/gabs/v2"
 	"github.com/gorilla/mux"
 
+	"github.com/charlieegan3/music/pkg/tool/backup"
 	"github.com/charlieegan3/music/pkg/tool/cache"
+	"github.com/charlieegan3/music/pkg/tool/events"
+	"github.com/charlieegan3/music/pkg/tool/forward"
 	"github.com/charlieegan3/music/pkg/tool/handlers"
 	"github.com/charlieegan3/music/pkg/tool/jobs"
+	"github.com/charlieegan3/music/pkg/tool/nowplaying"
+	"github.com/charlieegan3/music/pkg/tool/store"
+	"github.com/charlieegan3/music/pkg/tool/titles"
 	"github.com/charlieegan3/toolbelt/pkg/apis"
 )
 
 //go:embed migrations
 var migrations embed.FS
 
+const (
+	playStoreBigQuery = "bigquery"
+	playStorePostgres = "postgres"
+	playStoreSQLite   = "sqlite"
+)
+
+const (
+	backupDestinationGCS   = "gcs"
+	backupDestinationLocal = "local"
+	backupDestinationS3    = "s3"
+)
+
+const (
+	forwardTargetListenBrainz = "listenbrainz"
+	forwardTargetWebhook      = "webhook"
+)
+
 // Music is a tool that syncs last.fm plays to bigquery
 type Music struct {
-	db     *sql.DB
-	config *gabs.Container
+	db        *sql.DB
+	config    *gabs.Container
+	playStore store.PlayStore
+
+	nowPlaying *nowplaying.Store
+	// aliases are artist names merged into another name
+	aliases *store.Aliases
+	// titles are the normalized track and album titles
+	titles          *store.Titles
+	titleNormalizer *titles.Normalizer
+	// editor changes plays and records changes in the audit log
+	editor *store.PlayEditor
+	// exclusions are rules for plays left out of counts
+	exclusions *store.Exclusions
+	// privacy limits the plays shown to visitors who aren't signed in, it's
+	// nil when not configured
+	privacy *store.Privacy
+	// private are plays only shown to signed in users
+	private *store.PrivatePlays
+	// nameIndex has the ids of artist, album and track names in page urls
+	nameIndex *store.NameIndex
+	// events passes plays saved by jobs and receivers to /recent/stream
+	events *events.Bus
+
+	playStoreType string
 
 	lastFMschedule  string
 	spotifySchedule string
@@ -28,8 +77,20 @@ type Music struct {
 	artistsSchedule string
 	backupSchedule  string
 
-	lastFMAPIKey   string
-	lastFMUsername string
+	lastFMBackfillSchedule  string
+	dedupeSchedule          string
+	forwardSchedule         string
+	artistCreditsSchedule   string
+	normalizeTitlesSchedule string
+
+	dedupeWindow         time.Duration
+	dedupeLookback       time.Duration
+	dedupeSourcePriority []string
+
+	lastFMAPIKey       string
+	lastFMUsername     string
+	lastFMEndpoint     string
+	lastFMBackfillFrom time.Time
 
 	spotifyAccessToken  string
 	spotifyRefreshToken string
@@ -42,6 +103,20 @@ type Music struct {
 	googleJSON       string
 	coversBucketName string
 	backupBucketName string
+
+	backupDestination backup.Destination
+	backupRetention   backup.Retention
+	backupSkipVerify  bool
+
+	scrobbleUsername string
+	scrobblePassword string
+	scrobbleClients  []handlers.ScrobbleClient
+
+	listenBrainzClients []handlers.ListenBrainzClient
+
+	adminUsers []handlers.AdminUser
+
+	forwardTargets []forward.Target
 }
 
 func (m *Music) Name() string {
@@ -54,7 +129,9 @@ func (m *Music) FeatureSet() apis.FeatureSet {
 		HTTPHost: true,
 		Config:   true,
 		Jobs:     true,
-		Database: true,
+		// in sqlite mode the tool opens its own database rather than
+		// using the belt's postgres connection
+		Database: m.playStoreType != playStoreSQLite,
 	}
 }
 
@@ -64,10 +141,68 @@ func (m *Music) DatabaseMigrations() (*embed.FS, string, error) {
 
 func (m *Music) DatabaseSet(db *sql.DB) {
 	m.db = db
+	m.nowPlaying = nowplaying.New(db)
+	m.aliases = store.NewAliases(db)
+	m.titles = store.NewTitles(db, m.titleNormalizer)
+	m.exclusions = store.NewExclusions(db)
+	m.private = store.NewPrivatePlays(db)
+	m.nameIndex = store.NewNameIndex(db)
+
+	switch m.playStoreType {
+	case playStorePostgres:
+		playStore := store.NewPostgres(db)
+		playStore.Titles = m.titles
+		m.playStore = playStore
+	case playStoreBigQuery:
+		// aliases, titles, exclusions and private plays are kept in the tool
+		// database and passed to queries
+		m.playStore.(*store.BigQuery).Aliases = m.aliases
+		m.playStore.(*store.BigQuery).Titles = m.titles
+		m.playStore.(*store.BigQuery).Exclusions = m.exclusions
+		m.playStore.(*store.BigQuery).Private = m.private
+	}
+	m.editor = &store.PlayEditor{Store: m.playStore, Audit: store.NewAuditLog(db), Private: m.private, Index: m.nameIndex}
+}
+
+// PlayStore returns the configured play store, it is set once the tool has
+// been added to a belt
+func (m *Music) PlayStore() store.PlayStore {
+	return m.playStore
+}
+
+// Aliases returns the artist aliases, they are set once the tool has been
+// added to a belt
+func (m *Music) Aliases() *store.Aliases {
+	return m.aliases
+}
+
+// Exclusions returns the play exclusion rules, they are set once the tool
+// has been added to a belt
+func (m *Music) Exclusions() *store.Exclusions {
+	return m.exclusions
+}
+
+// Editor returns the play editor, it is set once the tool has been added to
+// a belt
+func (m *Music) Editor() *store.PlayEditor {
+	return m.editor
+}
+
+// Restore loads the plays from a backup at a gs:// uri or local path into the
+// play store, when dryRun is set the backup is only checked
+func (m *Music) Restore(ctx context.Context, uri string, dryRun bool) (backup.RestoreResult, error) {
+	r, err := backup.Open(ctx, uri, m.googleJSON)
+	if err != nil {
+		return backup.RestoreResult{}, err
+	}
+	defer r.Close()
+
+	return backup.Restore(ctx, m.playStore, m.nameIndex, r, dryRun)
 }
 
 func (m *Music) SetConfig(config map[string]any) error {
 	m.config = gabs.Wrap(config)
+	m.events = events.New()
 
 	var path string
 	var ok bool
@@ -109,6 +244,51 @@ func (m *Music) SetConfig(config map[string]any) error {
 	if !ok {
 		return fmt.Errorf("missing required config path: %s", path)
 	}
+	// endpoint is optional, it can be set to use a fake api in development
+	m.lastFMEndpoint, _ = m.config.Path("lastfm.endpoint").Data().(string)
+
+	// backfill schedule and start date are optional, by default the full
+	// history is loaded
+	m.lastFMBackfillSchedule, _ = m.config.Path("jobs.lastfm_backfill.schedule").Data().(string)
+	path = "lastfm.backfill_from"
+	if from, ok := m.config.Path(path).Data().(string); ok {
+		var err error
+		m.lastFMBackfillFrom, err = time.Parse("2006-01-02", from)
+		if err != nil {
+			return fmt.Errorf("invalid date at config path %s: %w", path, err)
+		}
+	}
+
+	m.artistCreditsSchedule, _ = m.config.Path("jobs.artist_credits.schedule").Data().(string)
+
+	err := m.setTitleNormalizer()
+	if err != nil {
+		return err
+	}
+
+	// dedupe config is optional, the job has defaults for each value
+	m.dedupeSchedule, _ = m.config.Path("jobs.dedupe.schedule").Data().(string)
+	path = "dedupe.window"
+	if window, ok := m.config.Path(path).Data().(string); ok {
+		var err error
+		m.dedupeWindow, err = time.ParseDuration(window)
+		if err != nil {
+			return fmt.Errorf("invalid duration at config path %s: %w", path, err)
+		}
+	}
+	path = "dedupe.lookback"
+	if lookback, ok := m.config.Path(path).Data().(string); ok {
+		var err error
+		m.dedupeLookback, err = time.ParseDuration(lookback)
+		if err != nil {
+			return fmt.Errorf("invalid duration at config path %s: %w", path, err)
+		}
+	}
+	for _, source := range m.config.Path("dedupe.sources").Children() {
+		if value, ok := source.Data().(string); ok {
+			m.dedupeSourcePriority = append(m.dedupeSourcePriority, value)
+		}
+	}
 
 	path = "spotify.access_token"
 	m.spotifyAccessToken, ok = m.config.Path(path).Data().(string)
@@ -132,105 +312,583 @@ func (m *Music) SetConfig(config map[string]any) error {
 		return fmt.Errorf("missing required config path: %s", path)
 	}
 
-	// load google config (bq & storage)
-	path = "bigquery.project_id"
-	m.projectID, ok = m.config.Path(path).Data().(string)
+	// load the play store config, bigquery is used unless another is set
+	path = "plays.store"
+	m.playStoreType, ok = m.config.Path(path).Data().(string)
 	if !ok {
-		return fmt.Errorf("missing required config path: %s", path)
+		m.playStoreType = playStoreBigQuery
 	}
-	path = "bigquery.dataset"
-	m.dataset, ok = m.config.Path(path).Data().(string)
-	if !ok {
-		return fmt.Errorf("missing required config path: %s", path)
+	switch m.playStoreType {
+	case playStoreBigQuery, playStorePostgres, playStoreSQLite:
+	default:
+		return fmt.Errorf("unknown play store %q at config path: %s", m.playStoreType, path)
 	}
-	path = "bigquery.table"
-	m.table, ok = m.config.Path(path).Data().(string)
-	if !ok {
-		return fmt.Errorf("missing required config path: %s", path)
+
+	// load google config (bq & storage)
+	if m.playStoreType == playStoreBigQuery {
+		path = "bigquery.project_id"
+		m.projectID, ok = m.config.Path(path).Data().(string)
+		if !ok {
+			return fmt.Errorf("missing required config path: %s", path)
+		}
+		path = "bigquery.dataset"
+		m.dataset, ok = m.config.Path(path).Data().(string)
+		if !ok {
+			return fmt.Errorf("missing required config path: %s", path)
+		}
+		path = "bigquery.table"
+		m.table, ok = m.config.Path(path).Data().(string)
+		if !ok {
+			return fmt.Errorf("missing required config path: %s", path)
+		}
+		path = "google.json"
+		m.googleJSON, ok = m.config.Path(path).Data().(string)
+		if !ok {
+			return fmt.Errorf("missing required config path: %s", path)
+		}
+		path = "google.covers_bucket"
+		m.coversBucketName, ok = m.config.Path(path).Data().(string)
+		if !ok {
+			return fmt.Errorf("missing required config path: %s", path)
+		}
+		path = "google.backup_bucket"
+		m.backupBucketName, ok = m.config.Path(path).Data().(string)
+		if !ok {
+			return fmt.Errorf("missing required config path: %s", path)
+		}
+
+		m.playStore = store.NewBigQuery(m.projectID, m.dataset, m.table, m.googleJSON)
+	} else {
+		// google config is optional when plays are not in bigquery
+		m.googleJSON, _ = m.config.Path("google.json").Data().(string)
+		m.coversBucketName, _ = m.config.Path("google.covers_bucket").Data().(string)
+		m.backupBucketName, _ = m.config.Path("google.backup_bucket").Data().(string)
 	}
-	path = "google.json"
-	m.googleJSON, ok = m.config.Path(path).Data().(string)
-	if !ok {
-		return fmt.Errorf("missing required config path: %s", path)
+
+	err = m.setBackupDestination()
+	if err != nil {
+		return err
 	}
-	path = "google.covers_bucket"
-	m.coversBucketName, ok = m.config.Path(path).Data().(string)
-	if !ok {
-		return fmt.Errorf("missing required config path: %s", path)
+
+	m.backupSkipVerify, _ = m.config.Path("backup.skip_verify").Data().(bool)
+
+	// retention is optional, by default all backups are kept
+	for path, count := range map[string]*int{
+		"backup.retention.daily":   &m.backupRetention.Daily,
+		"backup.retention.weekly":  &m.backupRetention.Weekly,
+		"backup.retention.monthly": &m.backupRetention.Monthly,
+	} {
+		switch value := m.config.Path(path).Data().(type) {
+		case nil:
+		case int:
+			*count = value
+		case float64:
+			*count = int(value)
+		default:
+			return fmt.Errorf("expected a number at config path: %s", path)
+		}
+	}
+
+	err = m.setScrobbleClients()
+	if err != nil {
+		return err
+	}
+
+	// listenbrainz clients are optional, the api is only served when set
+	for i, c := range m.config.Path("listenbrainz.clients").Children() {
+		client := handlers.ListenBrainzClient{}
+		path = fmt.Sprintf("listenbrainz.clients.%d.name", i)
+		client.Name, ok = c.Path("name").Data().(string)
+		if !ok {
+			return fmt.Errorf("missing required config path: %s", path)
+		}
+		path = fmt.Sprintf("listenbrainz.clients.%d.token", i)
+		client.Token, ok = c.Path("token").Data().(string)
+		if !ok || client.Token == "" {
+			return fmt.Errorf("missing required config path: %s", path)
+		}
+		m.listenBrainzClients = append(m.listenBrainzClients, client)
+	}
+
+	err = m.setForwardTargets()
+	if err != nil {
+		return err
+	}
+
+	// admin users are optional, the admin api is only served when set
+	for i, c := range m.config.Path("admin.users").Children() {
+		user := handlers.AdminUser{}
+		path = fmt.Sprintf("admin.users.%d.name", i)
+		user.Name, ok = c.Path("name").Data().(string)
+		if !ok {
+			return fmt.Errorf("missing required config path: %s", path)
+		}
+		path = fmt.Sprintf("admin.users.%d.token", i)
+		user.Token, ok = c.Path("token").Data().(string)
+		if !ok || user.Token == "" {
+			return fmt.Errorf("missing required config path: %s", path)
+		}
+		m.adminUsers = append(m.adminUsers, user)
+	}
+
+	err = m.setPrivacy()
+	if err != nil {
+		return err
 	}
-	path = "google.backup_bucket"
-	m.backupBucketName, ok = m.config.Path(path).Data().(string)
+
+	if m.playStoreType == playStoreSQLite {
+		sqlitePath, ok := m.config.Path("sqlite.path").Data().(string)
+		if !ok {
+			sqlitePath = "music.db"
+		}
+
+		db, err := OpenSQLite(sqlitePath)
+		if err != nil {
+			return fmt.Errorf("failed to open sqlite database: %v", err)
+		}
+
+		m.db = db
+		m.nowPlaying = nowplaying.New(db)
+		m.aliases = store.NewAliases(db)
+		m.titles = store.NewTitles(db, m.titleNormalizer)
+		m.exclusions = store.NewExclusions(db)
+		m.private = store.NewSQLitePrivatePlays(db)
+		m.nameIndex = store.NewNameIndex(db)
+
+		playStore := store.NewSQLite(db)
+		playStore.Titles = m.titles
+		m.playStore = playStore
+		m.editor = &store.PlayEditor{Store: m.playStore, Audit: store.NewAuditLog(db), Private: m.private, Index: m.nameIndex}
+	}
+
+	// tables outside the tool database, i.e. in bigquery, are updated when
+	// the tool is added to a belt, before any jobs or pages use them
+	if migrator, ok := m.playStore.(store.Migrator); ok {
+		err = migrator.Migrate(context.Background())
+		if err != nil {
+			return fmt.Errorf("failed to migrate play store: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// setBackupDestination loads the optional backup.destination config, when
+// unset backups are extracted by the play store
+func (m *Music) setBackupDestination() error {
+	var path string
+	var ok bool
+
+	destination, _ := m.config.Path("backup.destination").Data().(string)
+	switch destination {
+	case "":
+	case backupDestinationGCS:
+		if m.backupBucketName == "" {
+			return fmt.Errorf("missing required config path: %s", "google.backup_bucket")
+		}
+		m.backupDestination = &backup.GCS{
+			BucketName:            m.backupBucketName,
+			GoogleCredentialsJSON: m.googleJSON,
+		}
+	case backupDestinationLocal:
+		path = "backup.local.path"
+		dir, ok := m.config.Path(path).Data().(string)
+		if !ok {
+			return fmt.Errorf("missing required config path: %s", path)
+		}
+		m.backupDestination = &backup.Local{Dir: dir}
+	case backupDestinationS3:
+		s3 := &backup.S3{}
+		path = "backup.s3.endpoint"
+		s3.Endpoint, ok = m.config.Path(path).Data().(string)
+		if !ok {
+			return fmt.Errorf("missing required config path: %s", path)
+		}
+		path = "backup.s3.bucket"
+		s3.BucketName, ok = m.config.Path(path).Data().(string)
+		if !ok {
+			return fmt.Errorf("missing required config path: %s", path)
+		}
+		path = "backup.s3.access_key_id"
+		s3.AccessKeyID, ok = m.config.Path(path).Data().(string)
+		if !ok {
+			return fmt.Errorf("missing required config path: %s", path)
+		}
+		path = "backup.s3.secret_access_key"
+		s3.SecretAccessKey, ok = m.config.Path(path).Data().(string)
+		if !ok {
+			return fmt.Errorf("missing required config path: %s", path)
+		}
+		s3.Region, _ = m.config.Path("backup.s3.region").Data().(string)
+		s3.Insecure, _ = m.config.Path("backup.s3.insecure").Data().(bool)
+		m.backupDestination = s3
+	default:
+		return fmt.Errorf("unknown backup destination %q at config path: %s", destination, "backup.destination")
+	}
+
+	return nil
+}
+
+// setTitleNormalizer loads the optional titles config, all built in rules are
+// used when none are listed
+func (m *Music) setTitleNormalizer() error {
+	var path string
+
+	m.normalizeTitlesSchedule, _ = m.config.Path("jobs.normalize_titles.schedule").Data().(string)
+
+	builtin := titles.BuiltinNames()
+	if m.config.Exists("titles", "builtin") {
+		builtin = []string{}
+		for i, c := range m.config.Path("titles.builtin").Children() {
+			name, ok := c.Data().(string)
+			if !ok {
+				return fmt.Errorf("invalid value at config path: %s", fmt.Sprintf("titles.builtin.%d", i))
+			}
+			builtin = append(builtin, name)
+		}
+	}
+	rules, err := titles.Builtin(builtin...)
+	if err != nil {
+		return fmt.Errorf("invalid config path titles.builtin: %v", err)
+	}
+
+	for i, c := range m.config.Path("titles.rules").Children() {
+		path = fmt.Sprintf("titles.rules.%d.pattern", i)
+		pattern, ok := c.Path("pattern").Data().(string)
+		if !ok || pattern == "" {
+			return fmt.Errorf("missing required config path: %s", path)
+		}
+		replace, _ := c.Path("replace").Data().(string)
+
+		var fields []string
+		for _, f := range c.Path("fields").Children() {
+			if value, ok := f.Data().(string); ok {
+				fields = append(fields, value)
+			}
+		}
+
+		rule, err := titles.NewRule(pattern, replace, fields...)
+		if err != nil {
+			return fmt.Errorf("invalid config path %s: %v", path, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	m.titleNormalizer = titles.New(rules)
+
+	return nil
+}
+
+// setPrivacy loads the optional privacy config, when it's unset visitors
+// are shown every play except those marked as private
+func (m *Music) setPrivacy() error {
+	var path string
+
+	privacy := &store.Privacy{Location: time.UTC}
+	if !m.config.Exists("privacy") {
+		m.privacy = privacy
+		return nil
+	}
+
+	if delay, ok := m.config.Path("privacy.delay").Data().(string); ok {
+		d, err := time.ParseDuration(delay)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid duration at config path: %s", "privacy.delay")
+		}
+		privacy.Delay = d
+	}
+
+	if timezone, ok := m.config.Path("privacy.timezone").Data().(string); ok {
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			return fmt.Errorf("invalid config path privacy.timezone: %v", err)
+		}
+		privacy.Location = location
+	}
+
+	for i, c := range m.config.Path("privacy.hidden").Children() {
+		from, _ := c.Path("from").Data().(string)
+		to, _ := c.Path("to").Data().(string)
+		start, _ := c.Path("start").Data().(string)
+		end, _ := c.Path("end").Data().(string)
+
+		switch {
+		case from != "" || to != "":
+			path = fmt.Sprintf("privacy.hidden.%d", i)
+			window, err := store.ParseDailyWindow(from, to)
+			if err != nil {
+				return fmt.Errorf("invalid config path %s: %v", path, err)
+			}
+			privacy.Daily = append(privacy.Daily, window)
+		case start != "" || end != "":
+			path = fmt.Sprintf("privacy.hidden.%d.start", i)
+			startTime, err := time.Parse(time.RFC3339, start)
+			if err != nil {
+				return fmt.Errorf("invalid time at config path: %s", path)
+			}
+			path = fmt.Sprintf("privacy.hidden.%d.end", i)
+			endTime, err := time.Parse(time.RFC3339, end)
+			if err != nil || !endTime.After(startTime) {
+				return fmt.Errorf("invalid time at config path: %s", path)
+			}
+			privacy.Ranges = append(privacy.Ranges, store.TimeRange{Start: startTime, End: endTime})
+		default:
+			return fmt.Errorf("missing required config path: %s", fmt.Sprintf("privacy.hidden.%d.from", i))
+		}
+	}
+
+	m.privacy = privacy
+
+	return nil
+}
+
+// setScrobbleClients loads the optional scrobble config, the scrobble api is
+// only served when a password is set
+func (m *Music) setScrobbleClients() error {
+	var path string
+	var ok bool
+
+	m.scrobblePassword, _ = m.config.Path("scrobble.password").Data().(string)
+	if m.scrobblePassword == "" {
+		return nil
+	}
+
+	path = "scrobble.username"
+	m.scrobbleUsername, ok = m.config.Path(path).Data().(string)
 	if !ok {
 		return fmt.Errorf("missing required config path: %s", path)
 	}
 
+	for i, c := range m.config.Path("scrobble.clients").Children() {
+		client := handlers.ScrobbleClient{}
+		path = fmt.Sprintf("scrobble.clients.%d.name", i)
+		client.Name, ok = c.Path("name").Data().(string)
+		if !ok {
+			return fmt.Errorf("missing required config path: %s", path)
+		}
+		path = fmt.Sprintf("scrobble.clients.%d.api_key", i)
+		client.APIKey, ok = c.Path("api_key").Data().(string)
+		if !ok {
+			return fmt.Errorf("missing required config path: %s", path)
+		}
+		path = fmt.Sprintf("scrobble.clients.%d.shared_secret", i)
+		client.SharedSecret, ok = c.Path("shared_secret").Data().(string)
+		if !ok {
+			return fmt.Errorf("missing required config path: %s", path)
+		}
+		m.scrobbleClients = append(m.scrobbleClients, client)
+	}
+	if len(m.scrobbleClients) == 0 {
+		return fmt.Errorf("missing required config path: %s", "scrobble.clients")
+	}
+
+	return nil
+}
+
+// setForwardTargets loads the optional forward config, plays are only
+// forwarded when targets are listed
+func (m *Music) setForwardTargets() error {
+	var path string
+	var ok bool
+
+	m.forwardSchedule, _ = m.config.Path("jobs.forward.schedule").Data().(string)
+
+	for i, c := range m.config.Path("forward.targets").Children() {
+		target := forward.Target{}
+		path = fmt.Sprintf("forward.targets.%d.name", i)
+		target.Name, ok = c.Path("name").Data().(string)
+		if !ok {
+			return fmt.Errorf("missing required config path: %s", path)
+		}
+		for _, source := range c.Path("sources").Children() {
+			if value, ok := source.Data().(string); ok {
+				target.Sources = append(target.Sources, value)
+			}
+		}
+
+		path = fmt.Sprintf("forward.targets.%d.type", i)
+		targetType, _ := c.Path("type").Data().(string)
+		switch targetType {
+		case forwardTargetListenBrainz:
+			lb := &forward.ListenBrainz{}
+			path = fmt.Sprintf("forward.targets.%d.token", i)
+			lb.Token, ok = c.Path("token").Data().(string)
+			if !ok {
+				return fmt.Errorf("missing required config path: %s", path)
+			}
+			lb.Endpoint, _ = c.Path("endpoint").Data().(string)
+			target.Sender = lb
+		case forwardTargetWebhook:
+			wh := &forward.Webhook{}
+			path = fmt.Sprintf("forward.targets.%d.url", i)
+			wh.URL, ok = c.Path("url").Data().(string)
+			if !ok {
+				return fmt.Errorf("missing required config path: %s", path)
+			}
+			wh.Secret, _ = c.Path("secret").Data().(string)
+			target.Sender = wh
+		default:
+			return fmt.Errorf("unknown forward target type %q at config path: %s", targetType, path)
+		}
+
+		m.forwardTargets = append(m.forwardTargets, target)
+	}
+
 	return nil
 }
 
 func (m *Music) Jobs() ([]apis.Job, error) {
-	return []apis.Job{
-		&jobs.LastFMSync{
-			ScheduleOverride:      m.lastFMschedule,
-			APIKey:                m.lastFMAPIKey,
-			Username:              m.lastFMUsername,
-			GoogleCredentialsJSON: m.googleJSON,
-			ProjectID:             m.projectID,
-			DatasetName:           m.dataset,
-			TableName:             m.table,
-		},
-
-		&jobs.SpotifySync{
-			SpotifyAccessToken:  m.spotifyAccessToken,
-			SpotifyRefreshToken: m.spotifyRefreshToken,
-			SpotifyClientID:     m.spotifyClientID,
-			SpotifyClientSecret: m.spotifyClientSecret,
-
-			ScheduleOverride:      m.spotifySchedule,
-			GoogleCredentialsJSON: m.googleJSON,
-			ProjectID:             m.projectID,
-			DatasetName:           m.dataset,
-			TableName:             m.table,
-		},
-
-		&jobs.CoversSync{
-			DB:                    m.db,
-			ScheduleOverride:      m.coversSchedule,
-			GoogleCredentialsJSON: m.googleJSON,
-			ProjectID:             m.projectID,
-			DatasetName:           m.dataset,
-			TableName:             m.table,
-		},
+	jobList := []apis.Job{
+		m.LastFMSync(),
+		m.SpotifySync(),
+		m.CoversSync(),
+		m.CoversStore(),
+		m.BuildIndex(),
+		m.Backup(),
+		m.Dedupe(),
+		m.Forward(),
+		m.ArtistCredits(),
+		m.NormalizeTitles(),
+	}
 
-		&jobs.CoversStore{
-			DB:               m.db,
-			ScheduleOverride: m.coversSchedule,
-			LastFMAPIKey:     m.lastFMAPIKey,
+	// the backfill crawls the whole history, so it's only scheduled when
+	// configured and otherwise run with the lastfm_backfill command
+	if m.lastFMBackfillSchedule != "" {
+		jobList = append(jobList, m.LastFMBackfill())
+	}
 
-			GoogleCredentialsJSON: m.googleJSON,
-			GoogleBucketName:      m.coversBucketName,
-		},
+	return jobList, nil
+}
 
-		&jobs.BuildIndex{
-			DB:               m.db,
-			ScheduleOverride: m.artistsSchedule,
+// LastFMSync returns the job which saves recent Last.fm scrobbles
+func (m *Music) LastFMSync() *jobs.LastFMSync {
+	return &jobs.LastFMSync{
+		ScheduleOverride: m.lastFMschedule,
+		Endpoint:         m.lastFMEndpoint,
+		APIKey:           m.lastFMAPIKey,
+		Username:         m.lastFMUsername,
+		Store:            m.playStore,
+		NowPlaying:       m.nowPlaying,
+		Events:           m.events,
+	}
+}
 
-			GoogleCredentialsJSON: m.googleJSON,
-			ProjectID:             m.projectID,
-			DatasetName:           m.dataset,
-			TableName:             m.table,
-		},
+// SpotifySync returns the job which saves recent Spotify plays
+func (m *Music) SpotifySync() *jobs.SpotifySync {
+	return &jobs.SpotifySync{
+		SpotifyAccessToken:  m.spotifyAccessToken,
+		SpotifyRefreshToken: m.spotifyRefreshToken,
+		SpotifyClientID:     m.spotifyClientID,
+		SpotifyClientSecret: m.spotifyClientSecret,
 
-		&jobs.Backup{
-			DB:               m.db,
-			ScheduleOverride: m.backupSchedule,
+		ScheduleOverride: m.spotifySchedule,
+		Store:            m.playStore,
+		NowPlaying:       m.nowPlaying,
+		Events:           m.events,
+	}
+}
 
-			GoogleCredentialsJSON: m.googleJSON,
-			ProjectID:             m.projectID,
-			DatasetName:           m.dataset,
-			TableName:             m.table,
-			BackupBucketName:      m.backupBucketName,
-		},
-	}, nil
+// CoversSync returns the job which keeps the artist and album list in the
+// database
+func (m *Music) CoversSync() *jobs.CoversSync {
+	return &jobs.CoversSync{
+		DB:               m.db,
+		Store:            m.playStore,
+		ScheduleOverride: m.coversSchedule,
+	}
+}
+
+// CoversStore returns the job which copies album covers to the covers bucket
+func (m *Music) CoversStore() *jobs.CoversStore {
+	return &jobs.CoversStore{
+		DB:               m.db,
+		ScheduleOverride: m.coversSchedule,
+		LastFMAPIKey:     m.lastFMAPIKey,
+
+		GoogleCredentialsJSON: m.googleJSON,
+		GoogleBucketName:      m.coversBucketName,
+	}
+}
+
+// BuildIndex returns the job which saves the ids of names in page urls
+func (m *Music) BuildIndex() *jobs.BuildIndex {
+	return &jobs.BuildIndex{
+		DB:               m.db,
+		Store:            m.playStore,
+		ScheduleOverride: m.artistsSchedule,
+	}
+}
+
+// Backup returns the job which writes every play to the backup destination
+func (m *Music) Backup() *jobs.Backup {
+	return &jobs.Backup{
+		DB:               m.db,
+		Store:            m.playStore,
+		ScheduleOverride: m.backupSchedule,
+
+		BackupBucketName:      m.backupBucketName,
+		GoogleCredentialsJSON: m.googleJSON,
+		Destination:           m.backupDestination,
+		Retention:             m.backupRetention,
+		SkipVerify:            m.backupSkipVerify,
+	}
+}
+
+// Dedupe returns the job which marks plays saved by more than one source
+func (m *Music) Dedupe() *jobs.Dedupe {
+	return &jobs.Dedupe{
+		Store:            m.playStore,
+		ScheduleOverride: m.dedupeSchedule,
+		Window:           m.dedupeWindow,
+		Lookback:         m.dedupeLookback,
+		SourcePriority:   m.dedupeSourcePriority,
+	}
+}
+
+// Forward returns the job which sends new plays to the forward targets
+func (m *Music) Forward() *jobs.Forward {
+	return &jobs.Forward{
+		DB:               m.db,
+		Store:            m.playStore,
+		ScheduleOverride: m.forwardSchedule,
+		Targets:          m.forwardTargets,
+	}
+}
+
+// ArtistCredits returns the job which saves the artists credited on plays
+func (m *Music) ArtistCredits() *jobs.ArtistCredits {
+	return &jobs.ArtistCredits{
+		Store:            m.playStore,
+		ScheduleOverride: m.artistCreditsSchedule,
+
+		SpotifyAccessToken:  m.spotifyAccessToken,
+		SpotifyRefreshToken: m.spotifyRefreshToken,
+		SpotifyClientID:     m.spotifyClientID,
+		SpotifyClientSecret: m.spotifyClientSecret,
+	}
+}
+
+// NormalizeTitles returns the job which saves the normalized track and album
+// titles
+func (m *Music) NormalizeTitles() *jobs.NormalizeTitles {
+	return &jobs.NormalizeTitles{
+		Store:            m.playStore,
+		Titles:           m.titles,
+		ScheduleOverride: m.normalizeTitlesSchedule,
+	}
+}
+
+// LastFMBackfill returns the job which loads a user's whole Last.fm history
+func (m *Music) LastFMBackfill() *jobs.LastFMBackfill {
+	return &jobs.LastFMBackfill{
+		DB:               m.db,
+		Store:            m.playStore,
+		ScheduleOverride: m.lastFMBackfillSchedule,
+		Endpoint:         m.lastFMEndpoint,
+		APIKey:           m.lastFMAPIKey,
+		Username:         m.lastFMUsername,
+		From:             m.lastFMBackfillFrom,
+	}
 }
 
 func (m *Music) HTTPAttach(router *mux.Router) error {
@@ -244,73 +902,84 @@ func (m *Music) HTTPAttach(router *mux.Router) error {
 
 	router.Handle(
 		"/",
-		cache.Middleware(
+		m.page(
 			"24h",
 			store,
-			handlers.BuildTopHandler(m.projectID, m.dataset, m.table, m.googleJSON),
+			handlers.BuildTopHandler(m.playStore),
 		),
 	).Methods("GET")
 
+	// registered before /recent{format} which would also match it
+	router.Handle(
+		"/recent/stream",
+		m.uncachedPage(handlers.BuildRecentStreamHandler(m.events, m.exclusions, m.private)),
+	).Methods("GET")
+
 	router.Handle(
 		"/recent{format:.*}",
-		cache.Middleware(
+		m.page(
 			"15m",
 			store,
-			handlers.BuildRecentHandler(m.projectID, m.dataset, m.table, m.googleJSON),
+			handlers.BuildRecentHandler(m.playStore),
 		),
 	).Methods("GET")
 
+	router.Handle(
+		"/now{format:(?:\\.json)?}",
+		m.uncachedPage(handlers.BuildNowHandler(m.nowPlaying)),
+	).Methods("GET")
+
 	router.Handle(
 		"/months",
-		cache.Middleware(
+		m.page(
 			"168h",
 			store,
-			handlers.BuildMonthsHandler(m.projectID, m.dataset, m.table, m.googleJSON),
+			handlers.BuildMonthsHandler(m.playStore),
 		),
 	).Methods("GET")
 
 	router.Handle(
 		"/artists",
-		cache.Middleware(
+		m.page(
 			"24h",
 			store,
-			handlers.BuildArtistSearchHandler(m.projectID, m.dataset, m.table, m.googleJSON),
+			handlers.BuildArtistSearchHandler(m.playStore),
 		),
 	).Methods("GET")
 
 	router.Handle(
 		"/artists/{artistSlug}",
-		cache.Middleware(
+		m.page(
 			"24h",
 			store,
-			handlers.BuildArtistHandler(m.db, m.projectID, m.dataset, m.table, m.googleJSON),
+			handlers.BuildArtistHandler(m.db, m.playStore),
 		),
 	).Methods("GET")
 
 	router.Handle(
 		"/artists/{artistSlug}/albums/{albumSlug}",
-		cache.Middleware(
+		m.page(
 			"24h",
 			store,
-			handlers.BuildArtistAlbumHandler(m.db, m.projectID, m.dataset, m.table, m.googleJSON),
+			handlers.BuildArtistAlbumHandler(m.db, m.playStore),
 		),
 	).Methods("GET")
 
 	router.Handle(
 		"/artists/{artistSlug}/tracks/{trackSlug}",
-		cache.Middleware(
+		m.page(
 			"24h",
 			store,
-			handlers.BuildArtistTrackHandler(m.db, m.projectID, m.dataset, m.table, m.googleJSON),
+			handlers.BuildArtistTrackHandler(m.db, m.playStore),
 		),
 	).Methods("GET")
 
 	router.Handle(
 		"/artists/{artistSlug}/albums/{albumSlug}/tracks/{trackSlug}",
-		cache.Middleware(
+		m.page(
 			"24h",
 			store,
-			handlers.BuildArtistAlbumTrackHandler(m.db, m.projectID, m.dataset, m.table, m.googleJSON),
+			handlers.BuildArtistAlbumTrackHandler(m.db, m.playStore),
 		),
 	).Methods("GET")
 
@@ -319,6 +988,99 @@ func (m *Music) HTTPAttach(router *mux.Router) error {
 		handlers.BuildArtworkHandler(m.coversBucketName),
 	).Methods("GET")
 
+	if m.scrobblePassword != "" {
+		router.HandleFunc(
+			"/2.0{slash:/?}",
+			handlers.BuildAudioscrobblerHandler(
+				m.playStore,
+				m.nowPlaying,
+				m.events,
+				m.scrobbleUsername,
+				m.scrobblePassword,
+				m.scrobbleClients,
+			),
+		).Methods("GET", "POST")
+	}
+
+	if len(m.listenBrainzClients) > 0 {
+		router.HandleFunc(
+			"/1/submit-listens",
+			handlers.BuildListenBrainzSubmitHandler(m.playStore, m.nowPlaying, m.events, m.listenBrainzClients),
+		).Methods("POST")
+
+		router.HandleFunc(
+			"/1/validate-token",
+			handlers.BuildListenBrainzValidateTokenHandler(m.listenBrainzClients),
+		).Methods("GET")
+	}
+
+	if len(m.adminUsers) > 0 {
+		router.HandleFunc(
+			"/login",
+			handlers.BuildLoginHandler(m.adminUsers),
+		).Methods("GET", "POST")
+
+		router.HandleFunc(
+			"/logout",
+			handlers.BuildLogoutHandler(),
+		).Methods("POST")
+
+		router.HandleFunc(
+			"/admin/artists/aliases",
+			handlers.BuildArtistAliasesHandler(m.aliases, m.adminUsers),
+		).Methods("GET")
+
+		router.HandleFunc(
+			"/admin/artists/merge",
+			handlers.BuildArtistMergeHandler(m.aliases, store, m.adminUsers),
+		).Methods("POST")
+
+		router.HandleFunc(
+			"/admin/artists/unmerge",
+			handlers.BuildArtistUnmergeHandler(m.aliases, store, m.adminUsers),
+		).Methods("POST")
+
+		router.HandleFunc(
+			"/admin/exclusions",
+			handlers.BuildExclusionsHandler(m.exclusions, m.adminUsers),
+		).Methods("GET")
+
+		router.HandleFunc(
+			"/admin/exclusions/add",
+			handlers.BuildExclusionAddHandler(m.exclusions, store, m.adminUsers),
+		).Methods("POST")
+
+		router.HandleFunc(
+			"/admin/exclusions/remove",
+			handlers.BuildExclusionRemoveHandler(m.exclusions, store, m.adminUsers),
+		).Methods("POST")
+
+		router.HandleFunc(
+			"/admin/plays/edit",
+			handlers.BuildPlayEditHandler(m.editor, store, m.adminUsers),
+		).Methods("POST")
+
+		router.HandleFunc(
+			"/admin/plays/delete",
+			handlers.BuildPlayDeleteHandler(m.editor, store, m.adminUsers),
+		).Methods("POST")
+
+		router.HandleFunc(
+			"/admin/plays/private",
+			handlers.BuildPlayPrivateHandler(m.editor, store, m.adminUsers),
+		).Methods("POST")
+
+		router.HandleFunc(
+			"/admin/plays/rewrite",
+			handlers.BuildPlayRewriteHandler(m.editor, store, m.adminUsers),
+		).Methods("POST")
+
+		router.HandleFunc(
+			"/admin/audit",
+			handlers.BuildAuditLogHandler(m.editor.Audit, m.adminUsers),
+		).Methods("GET")
+	}
+
 	router.HandleFunc(
 		"/{.*}",
 		handlers.BuildStaticHandler(),
@@ -326,6 +1088,19 @@ func (m *Music) HTTPAttach(router *mux.Router) error {
 
 	return nil
 }
+
+// page caches a page for duration, signed in users see every play and skip
+// the cache
+func (m *Music) page(duration string, pageCache *cache.Storage, handler func(http.ResponseWriter, *http.Request)) http.Handler {
+	return handlers.PrivacyMiddleware(m.privacy, m.adminUsers, cache.Middleware(duration, pageCache, handler), handler)
+}
+
+// uncachedPage is a page which is never cached, but still only shows visible
+// plays to visitors who aren't signed in
+func (m *Music) uncachedPage(handler func(http.ResponseWriter, *http.Request)) http.Handler {
+	return handlers.PrivacyMiddleware(m.privacy, m.adminUsers, http.HandlerFunc(handler), handler)
+}
+
 func (m *Music) HTTPHost() string {
 	path := "web.host"
 	host, ok := m.config.Path(path).Data().(string)